@@ -1,13 +1,26 @@
 package bootstrap
 
 import (
+	"bufio"
+	"context"
+	"fmt"
 	. "github.com/xeha-gmbh/homelab/shared"
 	"github.com/spf13/cobra"
+	"os"
+	"strings"
 )
 
 const (
 	flagConfig = "config"
+	flagState  = "state"
 	noDefault  = ""
+
+	flagParallelism    = "parallelism"
+	defaultParallelism = 4
+
+	flagOnly        = "only"
+	flagPurgeImages = "purge-images"
+	flagYes         = "yes"
 )
 
 var (
@@ -15,38 +28,267 @@ var (
 	extraArgs *ExtraArgs
 )
 
+// Returns the 'bootstrap' command. Run by itself, it is the same as 'bootstrap apply'.
 func NewBootstrapCommand() *cobra.Command {
+	cmd := newApplyCommand("bootstrap", "bootstrap home lab with a single config")
+	cmd.AddCommand(newPlanCommand())
+	cmd.AddCommand(newApplyCommand("apply", "create and update VMs as planned"))
+	cmd.AddCommand(newDestroyCommand())
+	return cmd
+}
+
+func newPlanCommand() *cobra.Command {
 	payload := new(Payload)
 
 	cmd := &cobra.Command{
-		Use:   "bootstrap",
-		Short: "bootstrap home lab with a single config",
-		PreRunE: func(cmd *cobra.Command, args []string) error {
-			if err := cmd.ParseFlags(args); err != nil {
-				return err
-			}
-			extraArgs = &payload.ExtraArgs
-			output = WithConfig(cmd, extraArgs)
-			return nil
+		Use:     "plan",
+		Short:   "show what bootstrap would create and update",
+		PreRunE: payload.preRun,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, _, _, err := payload.plan()
+			return err
 		},
+	}
+
+	payload.bindFlags(cmd)
+	return cmd
+}
+
+func newApplyCommand(use, short string) *cobra.Command {
+	payload := new(Payload)
+
+	cmd := &cobra.Command{
+		Use:     use,
+		Short:   short,
+		PreRunE: payload.preRun,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			config, err := ParseConfig(payload.YamlPath)
+			config, state, actions, err := payload.plan()
 			if err != nil {
 				return err
 			}
-			return config.Bootstrap()
+			return config.Apply(WithPrinter(context.Background(), output), actions, state, payload.Parallelism)
 		},
 	}
 
-	cmd.Flags().StringVar(&payload.YamlPath, flagConfig, noDefault, "Path to the YAML configuration file.")
-	cmd.MarkFlagFilename(flagConfig, "yaml", "yml")
-	cmd.MarkFlagRequired(flagConfig)
-	payload.ExtraArgs.InjectExtraArgs(cmd)
+	payload.bindFlags(cmd)
+	cmd.Flags().IntVar(&payload.Parallelism, flagParallelism, defaultParallelism,
+		"Maximum number of VMs to create and update at the same time. 1 applies one VM after the other.")
+	return cmd
+}
+
+func newDestroyCommand() *cobra.Command {
+	payload := new(DestroyPayload)
 
+	cmd := &cobra.Command{
+		Use:     "destroy",
+		Short:   "stop and delete the VMs of a config",
+		PreRunE: payload.preRun,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return payload.destroy()
+		},
+	}
+
+	payload.bindFlags(cmd)
+	cmd.Flags().StringArrayVar(&payload.Only, flagOnly, []string{},
+		"Name of a VM to destroy, instead of all VMs of the config. Repeat to destroy several.")
+	cmd.Flags().BoolVar(&payload.PurgeImages, flagPurgeImages, false,
+		"Also delete the auto-install images remastered for the VMs, from storage and "+tempDir+".")
+	cmd.Flags().BoolVarP(&payload.Yes, flagYes, "y", false, "Destroy without asking for confirmation. Refused for VMs matched by name only.")
 	return cmd
 }
 
 type Payload struct {
 	ExtraArgs
 	YamlPath string
+	// State file, defaults to the config file with extension .state.json.
+	StatePath string
+	// Maximum number of VMs applied concurrently.
+	Parallelism int
+}
+
+func (p *Payload) bindFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&p.YamlPath, flagConfig, noDefault, "Path to the YAML configuration file.")
+	cmd.MarkFlagFilename(flagConfig, "yaml", "yml")
+	cmd.MarkFlagRequired(flagConfig)
+	cmd.Flags().StringVar(&p.StatePath, flagState, noDefault,
+		"Path to the state file. Defaults to the configuration file with extension "+stateSuffix+".")
+	p.ExtraArgs.InjectExtraArgs(cmd)
+}
+
+func (p *Payload) preRun(cmd *cobra.Command, args []string) error {
+	cmd.SetOutput(os.Stdout)
+	if err := cmd.ParseFlags(args); err != nil {
+		return err
+	}
+	extraArgs = &p.ExtraArgs
+	output = WithConfig(cmd, extraArgs)
+	if len(p.StatePath) == 0 {
+		p.StatePath = DefaultStatePath(p.YamlPath)
+	}
+	return nil
+}
+
+// Parses the config and plans the actions against the state, reporting them.
+func (p *Payload) plan() (Config, *State, []*PlannedAction, error) {
+	config, err := ParseConfig(p.YamlPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	state, err := p.readState()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	actions, err := config.Plan(WithPrinter(context.Background(), output), state)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	reportPlan(actions, false)
+	return config, state, actions, nil
+}
+
+func (p *Payload) readState() (*State, error) {
+	state, err := ReadState(p.StatePath)
+	if err != nil {
+		output.Fatal(ErrParse.ExitCode,
+			"Unable to read state file {{index .file}}. Cause: {{index .cause}}",
+			map[string]interface{}{
+				"event": "parse_error",
+				"file":  p.StatePath,
+				"cause": err.Error(),
+			})
+		return nil, ErrParse
+	}
+	return state, nil
+}
+
+// Reports the planned actions, and a summary of either a plan to bootstrap, or one to destroy.
+func reportPlan(actions []*PlannedAction, destroy bool) {
+	symbols := map[string]string{actionCreate: "+", actionUpdate: "~", actionNoop: "=", actionDestroy: "-"}
+	for _, action := range actions {
+		output.Info("{{index .symbol}} {{index .name}} {{index .action}}: {{index .reason}}",
+			map[string]interface{}{
+				"event":  "plan_action",
+				"symbol": symbols[action.Action],
+				"name":   action.VM.Name,
+				"action": action.Action,
+				"reason": action.Reason,
+				"id":     action.VmId,
+				"node":   action.Node,
+			})
+		for _, change := range action.Changes {
+			output.Info("    {{index .key}}: {{index .from}} -> {{index .to}}",
+				map[string]interface{}{
+					"event": "plan_change",
+					"name":  action.VM.Name,
+					"key":   change.Key,
+					"from":  change.From,
+					"to":    change.To,
+				})
+		}
+	}
+
+	counts := summarize(actions)
+	if destroy {
+		output.Info("Plan: {{index .destroy}} to destroy, {{index .noop}} not existing.",
+			map[string]interface{}{
+				"event":   "plan",
+				"destroy": counts[actionDestroy],
+				"noop":    counts[actionNoop],
+			})
+		return
+	}
+	output.Info("Plan: {{index .create}} to create, {{index .update}} to update, {{index .noop}} unchanged.",
+		map[string]interface{}{
+			"event":  "plan",
+			"create": counts[actionCreate],
+			"update": counts[actionUpdate],
+			"noop":   counts[actionNoop],
+		})
+}
+
+type DestroyPayload struct {
+	Payload
+	// Names of the VMs to destroy. All VMs of the config if empty.
+	Only        []string
+	PurgeImages bool
+	// Skips the confirmation prompt.
+	Yes bool
+}
+
+func (p *DestroyPayload) destroy() error {
+	config, err := ParseConfig(p.YamlPath)
+	if err != nil {
+		return err
+	}
+	state, err := p.readState()
+	if err != nil {
+		return err
+	}
+
+	ctx := WithPrinter(context.Background(), output)
+	actions, err := config.PlanDestroy(ctx, state, p.Only)
+	if err != nil {
+		return err
+	}
+	reportPlan(actions, true)
+
+	// without VMs to destroy, there may still be images to purge or VMs to remove from the state.
+	counts := summarize(actions)
+	if counts[actionDestroy] == 0 && !p.PurgeImages && !recorded(actions) {
+		return nil
+	}
+	// a vm matched by name only may be an unrelated one, so it is only destroyed when confirmed.
+	if names := matchedByNameOnly(actions); p.Yes && len(names) > 0 {
+		output.Fatal(ErrOp.ExitCode,
+			"Refusing to destroy vms matched by name only with --{{index .flag}}: {{index .names}}. Set their ids in the config, or confirm interactively.",
+			map[string]interface{}{
+				"event": "destroy_refused",
+				"flag":  flagYes,
+				"names": strings.Join(names, ", "),
+			})
+		return ErrOp
+	}
+	if !p.Yes && !confirm(fmt.Sprintf("Destroy %d VMs? Only 'yes' is accepted: ", counts[actionDestroy])) {
+		output.Fatal(ErrOp.ExitCode,
+			"Destruction cancelled. Use --{{index .flag}} to destroy without confirmation.",
+			map[string]interface{}{
+				"event": "destroy_cancelled",
+				"flag":  flagYes,
+			})
+		return ErrOp
+	}
+	return config.Destroy(ctx, actions, state, p.PurgeImages)
+}
+
+// Asks the question on an interactive terminal and returns true if it is answered with yes.
+// Without terminal, nothing is confirmed.
+func confirm(question string) bool {
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	fmt.Fprint(os.Stderr, question)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(line) == "yes"
+}
+
+// Returns the names of the VMs to destroy that were matched by name only.
+func matchedByNameOnly(actions []*PlannedAction) []string {
+	names := make([]string, 0)
+	for _, a := range actions {
+		if a.Action == actionDestroy && a.NameOnly {
+			names = append(names, a.VM.Name)
+		}
+	}
+	return names
+}
+
+func recorded(actions []*PlannedAction) bool {
+	for _, action := range actions {
+		if action.State != nil {
+			return true
+		}
+	}
+	return false
 }
@@ -1,6 +1,9 @@
 package bootstrap
 
 import (
+	"context"
+	"fmt"
+	"github.com/mitchellh/mapstructure"
 	"github.com/xeha-gmbh/homelab/shared"
 	"gopkg.in/yaml.v2"
 	"os"
@@ -32,20 +35,46 @@ func ParseConfig(path string) (Config, error) {
 		return nil, shared.ErrParse
 	}
 
-	switch raw["version"].(string) {
+	// an unquoted version is decoded as number.
+	version := fmt.Sprint(raw["version"])
+	switch version {
 	case "1":
-		return parseV1Config(raw)
+		return parseV1Config(raw, false)
+	case "2":
+		return parseV2Config(raw)
 	default:
 		output.Fatal(shared.ErrApi.ExitCode,
 			"Unsupported API version {{index .version}}",
 			map[string]interface{}{
 				"event":   "api_error",
-				"version": raw["version"].(string),
+				"version": version,
 			})
 		return nil, shared.ErrApi
 	}
 }
 
 type Config interface {
-	Bootstrap() error
+	// Plans the action of each VM, given the state of previous runs.
+	Plan(ctx context.Context, state *State) ([]*PlannedAction, error)
+	// Executes the planned actions, at most parallelism at a time, and records their outcome in the state.
+	Apply(ctx context.Context, actions []*PlannedAction, state *State, parallelism int) error
+	// Plans the destruction of the VMs, or only of those named if any names are given.
+	PlanDestroy(ctx context.Context, state *State, only []string) ([]*PlannedAction, error)
+	// Destroys the VMs as planned and removes them from the state. With purgeImages, the images
+	// remastered for the VMs are deleted as well.
+	Destroy(ctx context.Context, actions []*PlannedAction, state *State, purgeImages bool) error
+}
+
+// Decodes the raw config into the output. Weakly typed input, which version 2 configs decode with, lets
+// values rendered from templates, which are strings, decode into numbers and booleans, and numbers into
+// strings, e.g. an unquoted id. Version 1 configs are decoded strictly.
+func decode(input interface{}, output interface{}, weak bool) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		WeaklyTypedInput: weak,
+		Result:           output,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(input)
 }
@@ -0,0 +1,170 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Checks that the VMs only depend on declared VMs, and that the dependencies have no cycle.
+func checkDependencies(vms []*VM) error {
+	declared := make(map[string]bool, len(vms))
+	for _, vm := range vms {
+		declared[vm.Name] = true
+	}
+	for _, vm := range vms {
+		for _, dep := range vm.DependsOn {
+			switch {
+			case dep == vm.Name:
+				return fmt.Errorf("vm %s depends on itself", vm.Name)
+			case !declared[dep]:
+				return fmt.Errorf("vm %s depends on %s, which is not declared", vm.Name, dep)
+			}
+		}
+	}
+
+	if sorted := sortByDependencies(vms); len(sorted) < len(vms) {
+		placed := make(map[*VM]bool, len(sorted))
+		for _, vm := range sorted {
+			placed[vm] = true
+		}
+		cyclic := make([]string, 0, len(vms)-len(sorted))
+		for _, vm := range vms {
+			if !placed[vm] {
+				cyclic = append(cyclic, vm.Name)
+			}
+		}
+		return fmt.Errorf("dependencies of vms %s form a cycle", strings.Join(cyclic, ", "))
+	}
+	return nil
+}
+
+// Returns the VMs ordered so that each VM comes after those it depends on, and otherwise in order of
+// declaration. VMs on a dependency cycle are left out. Dependencies on VMs not in the list are ignored.
+func sortByDependencies(vms []*VM) []*VM {
+	listed := make(map[string]bool, len(vms))
+	for _, vm := range vms {
+		listed[vm.Name] = true
+	}
+
+	placed := make(map[string]bool, len(vms))
+	sorted := make([]*VM, 0, len(vms))
+	for len(sorted) < len(vms) {
+		progress := false
+		for _, vm := range vms {
+			if placed[vm.Name] || !dependenciesMet(vm, listed, placed) {
+				continue
+			}
+			placed[vm.Name], progress = true, true
+			sorted = append(sorted, vm)
+		}
+		if !progress {
+			break
+		}
+	}
+	return sorted
+}
+
+func dependenciesMet(vm *VM, listed, done map[string]bool) bool {
+	for _, dep := range vm.DependsOn {
+		if listed[dep] && !done[dep] {
+			return false
+		}
+	}
+	return true
+}
+
+// Outcome of running the actions of a graph.
+type graphResult struct {
+	// Errors of the actions that failed, by VM name.
+	Failed map[string]error
+	// VMs whose actions were running when the graph was cancelled.
+	Cancelled []string
+	// VMs whose actions never started because the graph was cancelled.
+	Skipped []string
+}
+
+func (r *graphResult) ok() bool {
+	return len(r.Failed) == 0 && len(r.Cancelled) == 0 && len(r.Skipped) == 0
+}
+
+// Returns the errors of the failed actions as a single message, in the order of the actions.
+func (r *graphResult) cause(actions []*PlannedAction) string {
+	causes := make([]string, 0, len(r.Failed))
+	for _, action := range actions {
+		if err, failed := r.Failed[action.VM.Name]; failed {
+			causes = append(causes, fmt.Sprintf("%s: %s", action.VM.Name, err.Error()))
+		}
+	}
+	return strings.Join(causes, "; ")
+}
+
+// Runs the actions concurrently, at most parallelism at a time, starting each action once the actions
+// of the VMs it depends on have succeeded. The first failure cancels the context of the running actions
+// and no more actions are started. A parallelism below one runs all actions at once.
+func runGraph(ctx context.Context, actions []*PlannedAction, parallelism int, run func(ctx context.Context, action *PlannedAction) error) *graphResult {
+	if parallelism < 1 {
+		parallelism = len(actions)
+	}
+
+	listed := make(map[string]bool, len(actions))
+	for _, action := range actions {
+		listed[action.VM.Name] = true
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type done struct {
+		action *PlannedAction
+		err    error
+	}
+	var (
+		result    = &graphResult{Failed: make(map[string]error)}
+		started   = make(map[string]bool, len(actions))
+		succeeded = make(map[string]bool, len(actions))
+		finished  = make(chan done)
+		running   = 0
+		cancelled = false
+	)
+
+	for {
+		// actions are started in order, as soon as their dependencies succeeded.
+		for _, action := range actions {
+			if cancelled || running >= parallelism {
+				break
+			}
+			if started[action.VM.Name] || !dependenciesMet(action.VM, listed, succeeded) {
+				continue
+			}
+			started[action.VM.Name] = true
+			running++
+			go func(action *PlannedAction) {
+				finished <- done{action: action, err: run(ctx, action)}
+			}(action)
+		}
+		if running == 0 {
+			break
+		}
+
+		d := <-finished
+		running--
+		switch {
+		case d.err == nil:
+			succeeded[d.action.VM.Name] = true
+		case cancelled:
+			result.Cancelled = append(result.Cancelled, d.action.VM.Name)
+		default:
+			result.Failed[d.action.VM.Name] = d.err
+			cancelled = true
+			cancel()
+		}
+	}
+
+	for _, action := range actions {
+		if !started[action.VM.Name] {
+			result.Skipped = append(result.Skipped, action.VM.Name)
+		}
+	}
+	return result
+}
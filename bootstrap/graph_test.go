@@ -0,0 +1,217 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func vmsOf(deps ...[]string) []*VM {
+	names := []string{"a", "b", "c", "d"}
+	vms := make([]*VM, 0, len(deps))
+	for i, dependsOn := range deps {
+		vms = append(vms, &VM{Name: names[i], DependsOn: dependsOn})
+	}
+	return vms
+}
+
+func namesOf(vms []*VM) []string {
+	names := make([]string, 0, len(vms))
+	for _, vm := range vms {
+		names = append(names, vm.Name)
+	}
+	return names
+}
+
+func TestCheckDependencies(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		vms   []*VM
+		error string
+	}{
+		{
+			name: "independent",
+			vms:  vmsOf(nil, nil),
+		},
+		{
+			name: "chain",
+			vms:  vmsOf([]string{"b"}, []string{"c"}, nil),
+		},
+		{
+			name:  "self dependency",
+			vms:   vmsOf(nil, []string{"b"}),
+			error: "vm b depends on itself",
+		},
+		{
+			name:  "undeclared",
+			vms:   vmsOf([]string{"x"}),
+			error: "vm a depends on x, which is not declared",
+		},
+		{
+			name:  "cycle",
+			vms:   vmsOf([]string{"c"}, nil, []string{"d"}, []string{"a"}),
+			error: "dependencies of vms a, c, d form a cycle",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkDependencies(tc.vms)
+			switch {
+			case len(tc.error) == 0 && err != nil:
+				t.Fatalf("unexpected error: %s", err.Error())
+			case len(tc.error) > 0 && (err == nil || err.Error() != tc.error):
+				t.Fatalf("expected error %q, got %v", tc.error, err)
+			}
+		})
+	}
+}
+
+func TestSortByDependencies(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		vms    []*VM
+		sorted []string
+	}{
+		{
+			name:   "declaration order",
+			vms:    vmsOf(nil, nil, nil),
+			sorted: []string{"a", "b", "c"},
+		},
+		{
+			name:   "dependencies first",
+			vms:    vmsOf([]string{"c"}, nil, []string{"b"}),
+			sorted: []string{"b", "c", "a"},
+		},
+		{
+			name:   "unlisted dependency",
+			vms:    vmsOf([]string{"x"}, nil),
+			sorted: []string{"a", "b"},
+		},
+		{
+			name:   "cycle left out",
+			vms:    vmsOf([]string{"b"}, []string{"a"}, nil),
+			sorted: []string{"c"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if sorted := namesOf(sortByDependencies(tc.vms)); !reflect.DeepEqual(sorted, tc.sorted) {
+				t.Fatalf("expected %v, got %v", tc.sorted, sorted)
+			}
+		})
+	}
+}
+
+func TestRunGraph(t *testing.T) {
+	const (
+		succeed = "succeed"
+		fail    = "fail"
+		// blocks until the graph is cancelled.
+		block = "block"
+	)
+
+	for _, tc := range []struct {
+		name        string
+		vms         []*VM
+		runs        map[string]string
+		parallelism int
+		order       []string
+		failed      []string
+		cancelled   []string
+		skipped     []string
+	}{
+		{
+			name:        "dependencies first with parallelism 1",
+			vms:         vmsOf([]string{"b"}, nil, []string{"a"}, nil),
+			runs:        map[string]string{"a": succeed, "b": succeed, "c": succeed, "d": succeed},
+			parallelism: 1,
+			order:       []string{"b", "a", "c", "d"},
+		},
+		{
+			name:        "failed dependency skips dependent",
+			vms:         vmsOf(nil, []string{"a"}),
+			runs:        map[string]string{"a": fail, "b": succeed},
+			parallelism: 2,
+			order:       []string{"a"},
+			failed:      []string{"a"},
+			skipped:     []string{"b"},
+		},
+		{
+			name:        "first failure cancels running and skips pending",
+			vms:         vmsOf(nil, nil, nil),
+			runs:        map[string]string{"a": fail, "b": block, "c": succeed},
+			parallelism: 2,
+			order:       []string{"a", "b"},
+			failed:      []string{"a"},
+			cancelled:   []string{"b"},
+			skipped:     []string{"c"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actions := make([]*PlannedAction, 0, len(tc.vms))
+			for _, vm := range tc.vms {
+				actions = append(actions, &PlannedAction{VM: vm})
+			}
+
+			// failing actions wait for the blocking ones to start, so that they are cancelled rather than skipped.
+			blocking := new(sync.WaitGroup)
+			for _, run := range tc.runs {
+				if run == block {
+					blocking.Add(1)
+				}
+			}
+
+			var (
+				mu    sync.Mutex
+				order = make([]string, 0, len(actions))
+			)
+			result := runGraph(context.Background(), actions, tc.parallelism, func(ctx context.Context, action *PlannedAction) error {
+				mu.Lock()
+				order = append(order, action.VM.Name)
+				mu.Unlock()
+
+				switch tc.runs[action.VM.Name] {
+				case fail:
+					blocking.Wait()
+					return errors.New("failed")
+				case block:
+					blocking.Done()
+					<-ctx.Done()
+					return ctx.Err()
+				default:
+					return nil
+				}
+			})
+
+			if tc.parallelism == 1 && !reflect.DeepEqual(order, tc.order) {
+				t.Errorf("expected order %v, got %v", tc.order, order)
+			} else if len(order) != len(tc.order) {
+				t.Errorf("expected %v to run, got %v", tc.order, order)
+			}
+			failed := make([]string, 0, len(result.Failed))
+			for _, action := range actions {
+				if _, ok := result.Failed[action.VM.Name]; ok {
+					failed = append(failed, action.VM.Name)
+				}
+			}
+			for _, c := range []struct {
+				what             string
+				expected, actual []string
+			}{
+				{"failed", tc.failed, failed},
+				{"cancelled", tc.cancelled, result.Cancelled},
+				{"skipped", tc.skipped, result.Skipped},
+			} {
+				if len(c.expected) != len(c.actual) || (len(c.expected) > 0 && !reflect.DeepEqual(c.expected, c.actual)) {
+					t.Errorf("expected %s %v, got %v", c.what, c.expected, c.actual)
+				}
+			}
+			if ok := len(tc.failed) == 0 && len(tc.cancelled) == 0 && len(tc.skipped) == 0; result.ok() != ok {
+				t.Errorf("expected ok %v, got %v", ok, result.ok())
+			}
+		})
+	}
+}
@@ -3,10 +3,9 @@ package bootstrap
 import (
 	"fmt"
 	"github.com/xeha-gmbh/homelab/shared"
-	"github.com/mitchellh/mapstructure"
 )
 
-func ParseImages(data map[string]interface{}) ([]*Image, error) {
+func ParseImages(data map[string]interface{}, weak bool) ([]*Image, error) {
 	rawImages, isList := data[keyImages].([]interface{})
 	if !isList {
 		output.Fatal(shared.ErrParse.ExitCode,
@@ -22,7 +21,7 @@ func ParseImages(data map[string]interface{}) ([]*Image, error) {
 	images := make([]*Image, 0, len(rawImages))
 	for _, oneRawImage := range rawImages {
 		image := &Image{}
-		if err := mapstructure.Decode(oneRawImage, image); err != nil {
+		if err := decode(oneRawImage, image, weak); err != nil {
 			output.Fatal(shared.ErrParse.ExitCode,
 				"Malformed config: failed to parse image. Cause: {{index .cause}}",
 				map[string]interface{}{
@@ -30,8 +29,19 @@ func ParseImages(data map[string]interface{}) ([]*Image, error) {
 					"cause": err.Error(),
 				})
 			return nil, shared.ErrParse
-		} else {
+		}
+
+		switch image.Download {
+		case "", downloadLocal, downloadNode:
 			images = append(images, image)
+		default:
+			output.Fatal(shared.ErrParse.ExitCode,
+				"Malformed config: {{index .error}}",
+				map[string]interface{}{
+					"event": "parse_error",
+					"error": fmt.Sprintf("image %s: download must be either %s or %s.", image.Name, downloadLocal, downloadNode),
+				})
+			return nil, shared.ErrParse
 		}
 	}
 
@@ -45,8 +55,22 @@ type Image struct {
 	UsbBoot bool   `yaml:"usb-boot"`
 	Reuse   bool   `yaml:"reuse"`
 	Format  string `yaml:"format"`
+	// Expected checksum of the downloaded image as 'algorithm:digest'. Only verified when the image
+	// is uploaded as is, i.e. not remastered for auto install.
+	Checksum string `yaml:"checksum"`
+	// Where the image is downloaded: 'local' (default) downloads to the workstation and uploads from there,
+	// 'node' lets the Proxmox node download the image itself. Only applies to images not remastered.
+	Download string `yaml:"download"`
+}
+
+// Returns true if the Proxmox node downloads the image itself, saving the round trip via the workstation.
+func (i *Image) DownloadedByNode() bool {
+	return !i.Auto && i.Download == downloadNode
 }
 
 const (
 	keyImages = "images"
+
+	downloadLocal = "local"
+	downloadNode  = "node"
 )
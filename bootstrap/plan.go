@@ -0,0 +1,42 @@
+package bootstrap
+
+import (
+	proxmoxvm "github.com/xeha-gmbh/homelab/proxmox/vm"
+)
+
+const (
+	actionCreate  = "create"
+	actionUpdate  = "update"
+	actionNoop    = "no-op"
+	actionDestroy = "destroy"
+)
+
+// The action bootstrap takes to bring a VM to its configuration.
+type PlannedAction struct {
+	VM *VM
+	// One of create, update and no-op, or destroy and no-op when tearing down.
+	Action string
+	// Why the action was chosen.
+	Reason string
+	// Node and id of the existing VM. Empty if the VM is to be created, or does not exist.
+	Node string
+	VmId string
+	// Configuration changes of an update.
+	Changes []proxmoxvm.Change
+	// Set if the VM exists, but is not recorded in the state yet. Apply records it.
+	Unrecorded bool
+	// Set on destroy if the VM was found by its name alone, being neither recorded in the state nor
+	// configured with an id. Such a VM may be an unrelated one of the same name.
+	NameOnly bool
+	// What to record about the existing VM.
+	State *VMState
+}
+
+// Counts the actions by type.
+func summarize(actions []*PlannedAction) map[string]int {
+	counts := map[string]int{actionCreate: 0, actionUpdate: 0, actionNoop: 0, actionDestroy: 0}
+	for _, a := range actions {
+		counts[a.Action]++
+	}
+	return counts
+}
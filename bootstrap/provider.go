@@ -1,15 +1,15 @@
 package bootstrap
 
 import (
+	"context"
 	"fmt"
 	"github.com/xeha-gmbh/homelab/shared"
-	"github.com/mitchellh/mapstructure"
 	"reflect"
 )
 
 // Entry point to parse a list of providers.
 // Input data expects a top level key whose name is the value of 'keyInfra'
-func ParseProviders(data map[string]interface{}) ([]Provider, error) {
+func ParseProviders(data map[string]interface{}, weak bool) ([]Provider, error) {
 	rawProviders, isList := data[keyInfra].([]interface{})
 	if !isList {
 		output.Fatal(shared.ErrParse.ExitCode,
@@ -49,7 +49,7 @@ func ParseProviders(data map[string]interface{}) ([]Provider, error) {
 		switch providerName {
 		case proxmox:
 			oneProvider = &proxmoxProvider{}
-			if err := mapstructure.Decode(rawData, oneProvider); err != nil {
+			if err := decode(rawData, oneProvider, weak); err != nil {
 				output.Fatal(shared.ErrParse.ExitCode,
 					"Malformed config, unable to decode provider. Cause: {{index .cause}}",
 					map[string]interface{}{
@@ -87,5 +87,19 @@ func ParseProviders(data map[string]interface{}) ([]Provider, error) {
 // Interface for all providers
 type Provider interface {
 	Name() string
-	CreateVM(vm *VM, images []*Image) error
+	// Plans the action bringing the VM to its configuration, given what the state recorded about it,
+	// which is nil if nothing is recorded.
+	PlanVM(ctx context.Context, vm *VM, recorded *VMState) (*PlannedAction, error)
+	// Creates the VM and returns what is to be recorded about it.
+	CreateVM(ctx context.Context, vm *VM, images []*Image) (*VMState, error)
+	// Applies the changes of a planned update.
+	UpdateVM(ctx context.Context, action *PlannedAction) error
+	// Plans the destruction of the VM, given what the state recorded about it. The action is a no-op
+	// if the VM does not exist.
+	PlanDestroy(ctx context.Context, vm *VM, recorded *VMState) (*PlannedAction, error)
+	// Stops and deletes the VM of a planned destruction.
+	DestroyVM(ctx context.Context, action *PlannedAction) error
+	// Deletes the installation media remastered for the VM from storage, and their local copies. Media shared
+	// with other VMs are kept while inUse reports them in use.
+	PurgeImage(ctx context.Context, action *PlannedAction, images []*Image, inUse func(volid string) bool) error
 }
@@ -1,96 +1,176 @@
 package bootstrap
 
 import (
-	"errors"
+	"context"
 	"fmt"
-	"github.com/xeha-gmbh/homelab/shared"
+	"github.com/xeha-gmbh/homelab/iso/auto"
+	"github.com/xeha-gmbh/homelab/iso/get"
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/ct"
+	"github.com/xeha-gmbh/homelab/proxmox/login"
+	"github.com/xeha-gmbh/homelab/proxmox/storage"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
+	"github.com/xeha-gmbh/homelab/proxmox/upload"
+	proxmoxvm "github.com/xeha-gmbh/homelab/proxmox/vm"
+	. "github.com/xeha-gmbh/homelab/shared"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 // The proxmox provider
 type proxmoxProvider struct {
 	Api      string `yaml:"api"`
+	Context  string `yaml:"context"`
 	Identity struct {
 		Realm    string `yaml:"realm"`
 		Username string `yaml:"username"`
 		Password string `yaml:"password"`
+		Token    struct {
+			Id     string `yaml:"id"`
+			Secret string `yaml:"secret"`
+		} `yaml:"token"`
 	} `yaml:"identity"`
 	DataStores []struct {
 		Name string   `yaml:"name"`
 		Tags []string `yaml:"tags"`
 	} `yaml:"datastores"`
+	// Range of ids, e.g. 100-199, that VMs without id get their id from. Defaults to the range of the context.
+	IdRange string `yaml:"idrange"`
+
+	// VMs are created concurrently. mu guards logins, the ids reserved for the VMs being created and
+	// the images downloaded or uploaded for them. Remastering shares the workspace, so images are remastered one at a time.
+	mu         sync.Mutex
+	reserved   []string
+	downloads  map[string]*downloadedImage
+	remasterMu sync.Mutex
+}
+
+// An image downloaded or uploaded once, for all VMs using it.
+type downloadedImage struct {
+	once sync.Once
+	path string
+	err  error
 }
 
 func (p *proxmoxProvider) Name() string {
 	return proxmox
 }
 
-func (p *proxmoxProvider) CreateVM(vm *VM, images []*Image) error {
+func (p *proxmoxProvider) CreateVM(ctx context.Context, vm *VM, images []*Image) (*VMState, error) {
 	var (
-		err           error
-		dlImagePath   string
-		autoImagePath string
-		image         *Image
+		err       error
+		imagePath string
+		seedPath  string
+		image     *Image
 	)
 
+	ctx = p.withContext(ctx)
+
+	// the id is resolved before any work, as collisions should surface early and it names the seed medium.
+	if err = p.ensureLoggedIn(ctx, vm); err != nil {
+		return nil, err
+	}
+	if vm.Id, err = p.reserveVmId(ctx, vm); err != nil {
+		return nil, err
+	}
+
+	state := &VMState{
+		Name:       vm.Name,
+		Provider:   proxmox,
+		Context:    p.Context,
+		Kind:       vm.Kind,
+		VmId:       vm.Id,
+		RecordedAt: time.Now(),
+	}
+
+	// containers are created from an OS template, not an image.
+	if vm.Kind == kindLxc {
+		state.Node, err = p.createContainer(ctx, vm)
+		return p.created(state, err)
+	}
+
+	// cloned and cloud-init VMs need no installation image.
+	if vm.Archetype == cloneArchetype || vm.Archetype == cloudInitArchetype {
+		state.Node, err = p.createVMFromImage(ctx, vm, "", "")
+		return p.created(state, err)
+	}
+
 	if image, err = p.getImage(vm.Image.Name, images); err != nil {
-		return err
+		return nil, err
 	}
 
-	output.Info("Ensuring image {{index .imageName}} exists. Necessary downloads may take a while.",
-		map[string]interface{}{
-			"event":     "pre_ensure_image",
-			"imageName": image.Name,
-		})
-	if dlImagePath, err = p.ensureImage(vm, image); err != nil {
-		return err
+	if image.DownloadedByNode() {
+		var isoPath string
+		if isoPath, err = p.downloadImageByNode(ctx, vm, image); err != nil {
+			return nil, err
+		}
+		state.ImageVolid = fmt.Sprintf("%s:iso/%s", vm.Image.Store, isoPath)
+		state.ImageHash = image.Checksum
+		state.Node, err = p.createVMFromImage(ctx, vm, isoPath, "")
+		return p.created(state, err)
 	}
-	output.Info("Image {{index .imageName}} now exists at {{index .path}}",
-		map[string]interface{}{
-			"event":     "post_ensure_image",
-			"imageName": image.Name,
-			"path":      dlImagePath,
-		})
 
-	output.Info("Processing image {{index .path}}.",
-		map[string]interface{}{
-			"event": "pre_process_image",
-			"path":  dlImagePath,
-		})
-	if autoImagePath, err = p.createAutoInstallImage(vm, image, dlImagePath); err != nil {
-		return err
+	// the image is the same for all VMs using it, so it is prepared and uploaded once. Auto-install images
+	// leave the settings of the VM to a seed medium of each VM.
+	if imagePath, err = p.prepareImage(ctx, vm, image); err != nil {
+		return nil, err
 	}
-	output.Info("Processed image. New image at {{index .path}}",
-		map[string]interface{}{
-			"event": "post_process_image",
-			"path":  autoImagePath,
-		})
+	if state.ImageVolid, err = p.uploadImage(ctx, vm, image, imagePath); err != nil {
+		return nil, err
+	}
+	state.ImageHash = p.imageHash(imagePath)
 
-	output.Info("Uploading image {{index .path}}.",
-		map[string]interface{}{
-			"event": "pre_upload_image",
-			"path":  autoImagePath,
-		})
-	if err = p.uploadAutoInstallImage(vm, image, autoImagePath); err != nil {
-		return err
+	if image.Auto {
+		if seedPath, state.SeedVolid, err = p.createSeedMedium(ctx, vm, image); err != nil {
+			return nil, err
+		}
 	}
-	output.Info("Image {{index .path}} uploaded.",
-		map[string]interface{}{
-			"event": "post_upload_image",
-			"path":  autoImagePath,
-		})
 
+	state.Node, err = p.createVMFromImage(ctx, vm, imagePath, seedPath)
+	return p.created(state, err)
+}
+
+// Resolves the id of the VM, never to an id already reserved for another VM of this run.
+func (p *proxmoxProvider) reserveVmId(ctx context.Context, vm *VM) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	vmId, err := proxmoxvm.ResolveVmId(ctx, vm.Id, p.IdRange, p.reserved...)
+	if err != nil {
+		return "", err
+	}
+	p.reserved = append(p.reserved, vmId)
+	return vmId, nil
+}
+
+func (p *proxmoxProvider) created(state *VMState, err error) (*VMState, error) {
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Returns a copy of ctx selecting the context of the provider, and able to log in again.
+func (p *proxmoxProvider) withContext(ctx context.Context) context.Context {
+	ctx = common.WithSelectedContext(ctx, p.Context)
+	return common.WithLoginFunc(ctx, p.loginFunc())
+}
+
+// Returns the node the VM is created on. The seed medium, if any, is attached as second CD drive.
+func (p *proxmoxProvider) createVMFromImage(ctx context.Context, vm *VM, imagePath, seedPath string) (string, error) {
 	output.Info("Creating VM {{index .id}}.",
 		map[string]interface{}{
 			"event": "pre_create_vm",
 			"id":    vm.Id,
 		})
-	if err = p.createAndStartVM(vm, autoImagePath); err != nil {
-		return err
+	node, err := p.createAndStartVM(ctx, vm, imagePath, seedPath)
+	if err != nil {
+		return "", err
 	}
 	output.Info("VM {{index .id}} created.",
 		map[string]interface{}{
@@ -98,245 +178,815 @@ func (p *proxmoxProvider) CreateVM(vm *VM, images []*Image) error {
 			"id":    vm.Id,
 		})
 
-	return nil
+	return node, nil
 }
 
-func (p *proxmoxProvider) createAndStartVM(vm *VM, filePath string) error {
-	var err error
+// Creates the container, downloading its template if necessary, and waits for the creation task to
+// finish. A container is started by the creation task if requested. Returns the node of the container.
+func (p *proxmoxProvider) createContainer(ctx context.Context, vm *VM) (string, error) {
+	if err := p.ensureLoggedIn(ctx, vm); err != nil {
+		return "", err
+	}
 
-	if err = p.ensureLoggedIn(vm); err != nil {
-		return err
+	output.Info("Creating container {{index .id}}.",
+		map[string]interface{}{
+			"event": "pre_create_ct",
+			"id":    vm.Id,
+		})
+
+	params := vm.Params.(*proxmoxLxcParams)
+	hostname := params.System.Hostname
+	if len(hostname) == 0 {
+		hostname = vm.Name
+	}
+	upid, err := ct.CreateContainer(ctx, &ct.Container{
+		Node:            p.node(vm),
+		VmId:            vm.Id,
+		Hostname:        hostname,
+		Template:        vm.Template,
+		TemplateStorage: vm.Image.Store,
+		Storage:         params.Drive.Store,
+		DiskSize:        params.DriveGB(),
+		Cores:           params.Cpu,
+		Memory:          params.MemoryMB(),
+		Swap:            params.SwapMB(),
+		NetworkIFace:    params.Network.Interface,
+		Ip:              params.IpCIDR(),
+		Gateway:         params.Network.Gateway,
+		Dns:             params.Network.Dns,
+		SearchDomain:    params.System.Domain,
+		Password:        params.System.Password,
+		SshKeys:         strings.Join(params.SshKeys, "\n"),
+		Privileged:      params.Privileged,
+		Nesting:         params.Nesting,
+		Start:           vm.Start,
+	})
+	if err != nil {
+		return "", err
+	}
+	if _, err = task.Wait(ctx, upid, &task.WaitOptions{}); err != nil {
+		return "", err
+	}
+
+	output.Info("Container {{index .id}} created.",
+		map[string]interface{}{
+			"event": "post_create_ct",
+			"id":    vm.Id,
+		})
+	return p.node(vm), nil
+}
+
+// Lets the Proxmox node download the image into the image store, and returns the file name of the image.
+func (p *proxmoxProvider) downloadImageByNode(ctx context.Context, vm *VM, image *Image) (string, error) {
+	if err := p.ensureLoggedIn(ctx, vm); err != nil {
+		return "", err
+	}
+
+	imageUrl := get.FlavorUrl(image.Flavor)
+	if len(imageUrl) == 0 {
+		return "", get.ErrUnsupportedFlavor
+	}
+
+	// VMs on the same node and store share the download.
+	return p.downloadOnce(p.storedImageKey(vm, image), func() (string, error) {
+		output.Info("Node is downloading image {{index .imageName}} from {{index .url}}. This may take a while.",
+			map[string]interface{}{
+				"event":     "pre_download_image",
+				"imageName": image.Name,
+				"url":       imageUrl,
+			})
+		result, err := storage.DownloadURL(ctx, &storage.DownloadURLRequest{
+			ExtraArgs:          ExtraArgs{Debug: extraArgs.Debug},
+			Node:               p.node(vm),
+			Storage:            vm.Image.Store,
+			Url:                imageUrl,
+			Format:             image.Format,
+			Checksum:           image.Checksum,
+			VerifyCertificates: true,
+		})
+		if err != nil {
+			return "", err
+		}
+		output.Info("Image {{index .imageName}} now exists at {{index .volid}}",
+			map[string]interface{}{
+				"event":     "post_download_image",
+				"imageName": image.Name,
+				"volid":     result.Volid,
+			})
+
+		return result.Filename, nil
+	})
+}
+
+// Creates the VM and starts it if requested, waiting for each task to finish so that failures surface
+// before bootstrap moves on. Returns the node of the VM.
+func (p *proxmoxProvider) createAndStartVM(ctx context.Context, vm *VM, filePath, seedPath string) (string, error) {
+	var (
+		err  error
+		upid string
+	)
+
+	if err = p.ensureLoggedIn(ctx, vm); err != nil {
+		return "", err
 	} else {
 		output.Info("User logged in.", map[string]interface{}{})
 	}
 
-	proxmoxVmCreateArgs := []string{
-		"proxmox",
-		"vm",
-		"create",
-		vm.Archetype,
-		"--output-format", shared.OutputFormatJson,
-		"--start",
-	}
+	node := p.node(vm)
 	switch vm.Archetype {
 	case basicArchetype:
 		params := vm.Params.(*proxmoxBasicArchetypeParams)
-		proxmoxVmCreateArgs = append(proxmoxVmCreateArgs, []string{
-			"--id", vm.Id,
-			"--name", vm.Name,
-			"--node", vm.Provider.Args["node"].(string),
-			"--core", fmt.Sprintf("%d", params.Cpu),
-			"--memory", fmt.Sprintf("%d", params.MemoryMB()),
-			"--drive-size", fmt.Sprintf("%d", params.DriveGB()),
-			"--drive-storage", params.Drive.Store,
-			"--iso-image", filepath.Base(filePath),
-			"--iso-storage", vm.Image.Store,
-			"--iface", params.Network.Interface,
-		}...)
+		basicVM := &proxmoxvm.BasicVM{
+			Node:           node,
+			VmId:           vm.Id,
+			Name:           vm.Name,
+			IsoStorage:     vm.Image.Store,
+			IsoImage:       filepath.Base(filePath),
+			Disks:          params.DiskDevices(),
+			Nics:           params.NicDevices(),
+			Sockets:        params.Machine.Sockets,
+			Cores:          params.Cpu,
+			Memory:         params.MemoryMB(),
+			CpuType:        params.Machine.CpuType,
+			Machine:        params.Machine.Type,
+			Bios:           params.Machine.Bios,
+			EfiDiskStorage: params.Machine.EfiDisk,
+		}
+		if len(basicVM.Disks) == 0 {
+			basicVM.DriveStorage, basicVM.DriveSize = params.Drive.Store, params.DriveGB()
+		}
+		if len(basicVM.Nics) == 0 {
+			basicVM.NetworkIFace = params.Network.Interface
+		}
+		if len(seedPath) > 0 {
+			basicVM.SeedImage = filepath.Base(seedPath)
+		}
+		upid, err = proxmoxvm.CreateBasicVM(ctx, basicVM)
+		if err == nil {
+			_, err = task.Wait(ctx, upid, &task.WaitOptions{})
+		}
+	case cloudInitArchetype:
+		params := vm.Params.(*proxmoxBasicArchetypeParams)
+		node, err = proxmoxvm.CreateCloudInitVM(ctx, &proxmoxvm.CloudInitVM{
+			Node:         node,
+			VmId:         vm.Id,
+			Name:         vm.Name,
+			CloudImage:   params.CloudInit.Image,
+			Template:     vm.Template,
+			Full:         params.CloudInit.Full,
+			DriveStorage: params.Drive.Store,
+			DriveSize:    params.DriveGB(),
+			Cores:        params.Cpu,
+			Memory:       params.MemoryMB(),
+			NetworkIFace: params.Network.Interface,
+			CloudInit:    params.CloudInitSettings(),
+		})
+	case cloneArchetype:
+		params := vm.Params.(*proxmoxCloneArchetypeParams)
+		node, err = proxmoxvm.CreateCloneVM(ctx, &proxmoxvm.CloneVM{
+			Node:         node,
+			Template:     vm.Template,
+			VmId:         vm.Id,
+			Name:         vm.Name,
+			Full:         params.Full,
+			Storage:      params.Storage,
+			Cores:        params.Cpu,
+			Memory:       params.MemoryMB(),
+			DriveSize:    params.DriveGB(),
+			NetworkIFace: params.Network.Interface,
+		})
 	default:
-		return fmt.Errorf("unknown archetype %s", vm.Archetype)
+		return "", fmt.Errorf("unknown archetype %s", vm.Archetype)
+	}
+	if err != nil {
+		return "", err
 	}
-	proxmoxVmCreate := exec.Command("homelab", proxmoxVmCreateArgs...)
 
-	_, err = shared.HandleOutput(output)(proxmoxVmCreate.CombinedOutput())(func(data map[string]interface{}) (interface{}, error) {
-		if len(data) > 0 {
-			if strings.ToUpper(data["level"].(string)) == "ERROR" {
-				return nil, errors.New(data["message"].(string))
-			}
+	if vm.Start {
+		if upid, err = proxmoxvm.StartVM(ctx, node, vm.Id); err != nil {
+			return "", err
+		}
+		if _, err = task.Wait(ctx, upid, &task.WaitOptions{}); err != nil {
+			return "", err
+		}
+	}
+	return node, nil
+}
+
+// Uploads the image into the image store once for all VMs using it, and returns its volume id. Auto-install
+// images are remastered anew by each run, so a file of the same name is replaced.
+func (p *proxmoxProvider) uploadImage(ctx context.Context, vm *VM, image *Image, filePath string) (string, error) {
+	return p.downloadOnce(p.storedImageKey(vm, image), func() (string, error) {
+		if err := p.ensureLoggedIn(ctx, vm); err != nil {
+			return "", err
+		} else {
+			output.Info("User logged in.", map[string]interface{}{})
+		}
+
+		output.Info("Uploading image {{index .path}}.",
+			map[string]interface{}{
+				"event": "pre_upload_image",
+				"path":  filePath,
+			})
+		req := &upload.ProxmoxUploadRequest{
+			ExtraArgs: ExtraArgs{Debug: extraArgs.Debug},
+			Node:      p.node(vm),
+			Storage:   vm.Image.Store,
+			File:      filePath,
+			Format:    image.Format,
+			Replace:   image.Auto,
+			WaitArgs:  task.WaitArgs{Wait: true},
+		}
+		if !image.Auto {
+			req.Checksum = image.Checksum
+		}
+		result, err := upload.Upload(ctx, req)
+		if err != nil {
+			return "", err
 		}
-		return nil, nil
+		output.Info("Image {{index .path}} uploaded.",
+			map[string]interface{}{
+				"event": "post_upload_image",
+				"path":  filePath,
+			})
+		return result.Volid, nil
 	})
+}
+
+func (p *proxmoxProvider) ensureLoggedIn(ctx context.Context, vm *VM) error {
+	forceLogin, _ := vm.Provider.Args["force-login"].(bool)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
+	_, err := login.Login(ctx, p.loginRequest(forceLogin))
 	return err
 }
 
-func (p *proxmoxProvider) uploadAutoInstallImage(vm *VM, image *Image, filePath string) error {
-	var err error
-
-	if err = p.ensureLoggedIn(vm); err != nil {
-		return err
-	} else {
-		output.Info("User logged in.", map[string]interface{}{})
+// Returns a login function using the provider identity. Installed into the context, it allows
+// operations to log in again when the ticket expires during long running steps.
+func (p *proxmoxProvider) loginFunc() common.LoginFunc {
+	return func(ctx context.Context) (*common.ProxmoxSubject, error) {
+		return login.Login(ctx, p.loginRequest(true))
 	}
+}
 
-	proxmoxUploadArgs := []string{
-		"proxmox",
-		"upload",
-		"--node", vm.Provider.Args["node"].(string),
-		"--file", filePath,
-		"--format", image.Format,
-		"--node", vm.Provider.Args["node"].(string),
-		"--storage", vm.Image.Store,
-		"--output-format", shared.OutputFormatJson,
-	}
-	if extraArgs.Debug {
-		proxmoxUploadArgs = append(proxmoxUploadArgs, "--debug")
+func (p *proxmoxProvider) loginRequest(force bool) *login.ProxmoxLoginRequest {
+	return &login.ProxmoxLoginRequest{
+		ExtraArgs:   ExtraArgs{Debug: extraArgs.Debug},
+		Username:    p.Identity.Username,
+		Password:    p.Identity.Password,
+		Realm:       p.Identity.Realm,
+		ApiServer:   p.Api,
+		Force:       force,
+		TokenId:     p.Identity.Token.Id,
+		TokenSecret: p.Identity.Token.Secret,
+		Context:     p.Context,
 	}
-	proxmoxUpload := exec.Command("homelab", proxmoxUploadArgs...)
+}
 
-	_, err = shared.HandleOutput(output)(proxmoxUpload.CombinedOutput())(func(data map[string]interface{}) (interface{}, error) {
-		if len(data) > 0 {
-			if strings.ToUpper(data["level"].(string)) == "ERROR" {
-				return nil, errors.New(data["message"].(string))
-			}
+// Downloads the image and remasters auto-install images, once for all VMs using the image. Returns the
+// path of the image.
+func (p *proxmoxProvider) prepareImage(ctx context.Context, vm *VM, image *Image) (string, error) {
+	return p.downloadOnce(image.Name, func() (string, error) {
+		output.Info("Ensuring image {{index .imageName}} exists. Necessary downloads may take a while.",
+			map[string]interface{}{
+				"event":     "pre_ensure_image",
+				"imageName": image.Name,
+			})
+		dlImagePath, err := p.ensureImage(ctx, vm, image)
+		if err != nil {
+			return "", err
+		}
+		output.Info("Image {{index .imageName}} now exists at {{index .path}}",
+			map[string]interface{}{
+				"event":     "post_ensure_image",
+				"imageName": image.Name,
+				"path":      dlImagePath,
+			})
+		if !image.Auto {
+			return dlImagePath, nil
+		}
+
+		output.Info("Processing image {{index .path}}.",
+			map[string]interface{}{
+				"event": "pre_process_image",
+				"path":  dlImagePath,
+			})
+		autoImagePath, err := p.createAutoInstallImage(ctx, image, dlImagePath)
+		if err != nil {
+			return "", err
 		}
-		return nil, nil
+		output.Info("Processed image. New image at {{index .path}}",
+			map[string]interface{}{
+				"event": "post_process_image",
+				"path":  autoImagePath,
+			})
+		return autoImagePath, nil
 	})
+}
 
-	return err
+// Remasters the image for the auto installation of any VM. The settings of each VM are read from its seed
+// medium, see createSeedMedium.
+func (p *proxmoxProvider) createAutoInstallImage(ctx context.Context, image *Image, downloadedImagePath string) (string, error) {
+	payload := &auto.Payload{
+		ExtraArgs:  ExtraArgs{Debug: extraArgs.Debug},
+		Flavor:     image.Flavor,
+		InputIso:   downloadedImagePath,
+		OutputIso:  p.autoImagePath(image),
+		Workspace:  tempDir,
+		UsbBoot:    image.UsbBoot,
+		Reuse:      image.Reuse,
+		SeedMedium: true,
+	}
+
+	p.remasterMu.Lock()
+	defer p.remasterMu.Unlock()
+	return auto.Remaster(ctx, payload)
 }
 
-func (p *proxmoxProvider) ensureLoggedIn(vm *VM) error {
-	var err error
+// Makes the seed medium with the settings of the VM and uploads it into the image store. Returns the local
+// path and the volume id of the seed medium.
+func (p *proxmoxProvider) createSeedMedium(ctx context.Context, vm *VM, image *Image) (string, string, error) {
+	payload := &auto.Payload{
+		ExtraArgs: ExtraArgs{Debug: extraArgs.Debug},
+		Flavor:    image.Flavor,
+		Workspace: tempDir,
+	}
+	switch vm.Archetype {
+	case basicArchetype:
+		params := vm.Params.(*proxmoxBasicArchetypeParams)
+		payload.Timezone = params.System.Timezone
+		payload.Username = params.System.Username
+		payload.Password = params.System.Password
+		payload.Hostname = params.System.Hostname
+		payload.Domain = params.System.Domain
+		payload.IpAddress = params.Network.Ip
+		payload.NetMask = params.Network.Mask
+		payload.Gateway = params.Network.Gateway
+		payload.NameServers = strings.Join(params.Network.Dns, " ")
+	default:
+		return "", "", fmt.Errorf("unknown archetype %s", vm.Archetype)
+	}
 
-	proxmoxLoginArgs := []string{
-		"proxmox",
-		"login",
-		"--username", p.Identity.Username,
-		"--password", p.Identity.Password,
-		"--realm", p.Identity.Realm,
-		"--api-server", p.Api,
-		"--force",
-		"--output-format", shared.OutputFormatJson,
+	seedPath, err := auto.MakeSeedMedium(ctx, payload, p.seedMediumPath(image, vm.Id))
+	if err != nil {
+		return "", "", err
 	}
-	if vm.Provider.Args["force-login"].(bool) {
-		proxmoxLoginArgs = append(proxmoxLoginArgs, "--force")
+	output.Info("Seed medium of VM {{index .id}} created at {{index .path}}.",
+		map[string]interface{}{
+			"event": "seed_created",
+			"id":    vm.Id,
+			"path":  seedPath,
+		})
+
+	if err = p.ensureLoggedIn(ctx, vm); err != nil {
+		return "", "", err
 	}
-	if extraArgs.Debug {
-		proxmoxLoginArgs = append(proxmoxLoginArgs, "--debug")
+	result, err := upload.Upload(ctx, &upload.ProxmoxUploadRequest{
+		ExtraArgs: ExtraArgs{Debug: extraArgs.Debug},
+		Node:      p.node(vm),
+		Storage:   vm.Image.Store,
+		File:      seedPath,
+		Format:    image.Format,
+		Replace:   true,
+		WaitArgs:  task.WaitArgs{Wait: true},
+	})
+	if err != nil {
+		return "", "", err
 	}
-	proxmoxLogin := exec.Command("homelab", proxmoxLoginArgs...)
+	return seedPath, result.Volid, nil
+}
 
-	_, err = shared.HandleOutput(output)(proxmoxLogin.CombinedOutput())(func(data map[string]interface{}) (interface{}, error) {
-		if len(data) > 0 {
-			if strings.ToUpper(data["level"].(string)) == "ERROR" {
-				return nil, errors.New(data["message"].(string))
-			}
+// Returns the local path of the auto-install image remastered from the image.
+func (p *proxmoxProvider) autoImagePath(image *Image) string {
+	return filepath.Join(
+		tempDir,
+		fmt.Sprintf("%s-%s.iso",
+			strings.Replace(image.Flavor, string(filepath.Separator), "-", -1),
+			image.Name))
+}
+
+// Returns the local path of the seed medium of the VM of the id.
+func (p *proxmoxProvider) seedMediumPath(image *Image, vmId string) string {
+	return filepath.Join(tempDir, fmt.Sprintf("%s-seed-%s.iso", image.Name, vmId))
+}
+
+// Returns the checksum of the image, computed once for all VMs using it, or empty if it cannot be computed.
+func (p *proxmoxProvider) imageHash(path string) string {
+	hash, _ := p.downloadOnce(path+"#"+imageHashAlgorithm, func() (string, error) {
+		checksum, err := upload.ComputeChecksum(path, imageHashAlgorithm)
+		if err != nil {
+			return "", err
 		}
-		return nil, nil
+		return checksum.String(), nil
 	})
-
-	return err
+	return hash
 }
 
-func (p *proxmoxProvider) createAutoInstallImage(vm *VM, image *Image, downloadedImagePath string) (string, error) {
+func (p *proxmoxProvider) copy(source, dest string) error {
 	var (
-		err        error
-		outputPath = filepath.Join(
-			tempDir,
-			fmt.Sprintf("%s-%s.iso",
-				strings.Replace(image.Flavor, string(filepath.Separator), "-", -1),
-				vm.Id))
+		in, out *os.File
+		err     error
 	)
 
-	if !image.Auto {
-		return downloadedImagePath, nil
+	if in, err = os.Open(source); err != nil {
+		return err
+	}
+
+	if out, err = os.Create(dest); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+func (p *proxmoxProvider) ensureImage(ctx context.Context, vm *VM, image *Image) (string, error) {
+	return get.Get(ctx, &get.IsoGetPayload{
+		ExtraArgs: ExtraArgs{Debug: extraArgs.Debug},
+		Flavor:    image.Flavor,
+		TargetDir: tempDir,
+		Reuse:     true,
+	})
+}
+
+// Identifies the image in the image store of the VM.
+func (p *proxmoxProvider) storedImageKey(vm *VM, image *Image) string {
+	return fmt.Sprintf("%s@%s/%s", image.Name, p.node(vm), vm.Image.Store)
+}
+
+// Calls download only for the first of the VMs downloading or uploading the image of the key, and
+// returns its result to all of them.
+func (p *proxmoxProvider) downloadOnce(key string, download func() (string, error)) (string, error) {
+	p.mu.Lock()
+	if p.downloads == nil {
+		p.downloads = make(map[string]*downloadedImage)
+	}
+	downloaded, ok := p.downloads[key]
+	if !ok {
+		downloaded = new(downloadedImage)
+		p.downloads[key] = downloaded
+	}
+	p.mu.Unlock()
+
+	downloaded.once.Do(func() {
+		downloaded.path, downloaded.err = download()
+	})
+	return downloaded.path, downloaded.err
+}
+
+// Finds the existing VM, by the id recorded in the state, or else by its configured id or name, and
+// plans its creation if there is none, or else the changes of the settings that can be changed after
+// creation: cores, memory, drive size and network interface.
+func (p *proxmoxProvider) PlanVM(ctx context.Context, vm *VM, recorded *VMState) (*PlannedAction, error) {
+	ctx = p.withContext(ctx)
+	if err := p.ensureLoggedIn(ctx, vm); err != nil {
+		return nil, err
 	}
 
-	isoAutoArgs := []string{
-		"iso",
-		"auto",
-		"--flavor", image.Flavor,
-		"--input-iso", downloadedImagePath,
-		"--output-iso", outputPath,
-		"--workspace", tempDir,
-		"--output-format", shared.OutputFormatJson,
+	action := &PlannedAction{VM: vm}
+	guest, reason, err := p.lookupGuest(ctx, vm, recorded)
+	if err != nil {
+		return nil, err
+	} else if guest == nil {
+		action.Action, action.Reason = actionCreate, reason
+		return action, nil
 	}
-	if image.UsbBoot {
-		isoAutoArgs = append(isoAutoArgs, "--usb-boot")
+
+	action.Node, action.VmId, action.Unrecorded = guest.Node, guest.VmId.String(), recorded == nil
+	action.State = &VMState{
+		Name:       vm.Name,
+		Provider:   proxmox,
+		Context:    p.Context,
+		Kind:       vm.Kind,
+		Node:       action.Node,
+		VmId:       action.VmId,
+		RecordedAt: time.Now(),
 	}
-	if image.Reuse {
-		isoAutoArgs = append(isoAutoArgs, "--reuse")
+	if recorded != nil {
+		action.State.ImageVolid = recorded.ImageVolid
+		action.State.ImageHash = recorded.ImageHash
+		action.State.SeedVolid = recorded.SeedVolid
+		action.State.RecordedAt = recorded.RecordedAt
+		action.State.UpdatedAt = recorded.UpdatedAt
 	}
-	if extraArgs.Debug {
-		isoAutoArgs = append(isoAutoArgs, "--debug")
+
+	if action.Changes, _, err = p.set(ctx, vm, action, true); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(action.Changes) > 0:
+		action.Action, action.Reason = actionUpdate, fmt.Sprintf("%d settings differ", len(action.Changes))
+	case action.Unrecorded:
+		action.Action, action.Reason = actionNoop, "exists, but is not recorded in the state yet"
+	default:
+		action.Action, action.Reason = actionNoop, "up to date"
+	}
+	return action, nil
+}
+
+// Applies the changes of a planned update. Changes that only take effect after a restart are reported.
+func (p *proxmoxProvider) UpdateVM(ctx context.Context, action *PlannedAction) error {
+	ctx = p.withContext(ctx)
+	if err := p.ensureLoggedIn(ctx, action.VM); err != nil {
+		return err
+	}
+
+	_, pending, err := p.set(ctx, action.VM, action, false)
+	if err != nil {
+		return err
+	}
+	for _, option := range pending {
+		output.Info("{{index .key}} of {{index .id}} changes to {{index .to}} on restart.",
+			map[string]interface{}{
+				"event": "update_pending",
+				"id":    action.VmId,
+				"key":   option.Key,
+				"to":    option.Pending,
+			})
+	}
+	return nil
+}
+
+// Sets the configured cores, memory, drive size and network interface on the existing VM, or only
+// computes the changes if dryRun is set. Returns the changes and those pending a restart.
+func (p *proxmoxProvider) set(ctx context.Context, vm *VM, action *PlannedAction, dryRun bool) ([]proxmoxvm.Change, []client.PendingOption, error) {
+	if vm.Kind == kindLxc {
+		params := vm.Params.(*proxmoxLxcParams)
+		result, err := ct.Set(ctx, &ct.SetRequest{
+			Node:         action.Node,
+			CT:           action.VmId,
+			Cores:        params.Cpu,
+			Memory:       params.MemoryMB(),
+			Swap:         params.SwapMB(),
+			DiskSize:     params.DriveGB(),
+			NetworkIFace: params.Network.Interface,
+			DryRun:       dryRun,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return result.Changes, result.Pending, nil
+	}
+
+	request := &proxmoxvm.SetRequest{
+		Node:   action.Node,
+		VM:     action.VmId,
+		Drive:  "scsi0",
+		Net:    "net0",
+		DryRun: dryRun,
 	}
 	switch vm.Archetype {
-	case basicArchetype:
+	case basicArchetype, cloudInitArchetype:
 		params := vm.Params.(*proxmoxBasicArchetypeParams)
-		isoAutoArgs = append(isoAutoArgs, []string{
-			"--timezone", params.System.Timezone,
-			"--username", params.System.Username,
-			"--password", params.System.Password,
-			"--hostname", params.System.Hostname,
-			"--domain", params.System.Domain,
-			"--ip-address", params.Network.Ip,
-			"--net-mask", params.Network.Mask,
-			"--gateway", params.Network.Gateway,
-			"--name-servers", strings.Join(params.Network.Dns, " "),
-		}...)
+		request.Cores, request.Memory = params.Cpu, params.MemoryMB()
+		request.NetworkIFace = params.Network.Interface
+		// the first disk replaces the drive, whose size is optional then.
+		if disks := params.DiskDevices(); len(disks) > 0 {
+			request.DriveSize = disks[0].Size
+		} else if len(params.Drive.Size) > 0 {
+			request.DriveSize = params.DriveGB()
+		}
+		if nics := params.NicDevices(); len(nics) > 0 {
+			request.NetworkIFace = nics[0].Bridge
+		}
+		request.Sockets = params.Machine.Sockets
+	case cloneArchetype:
+		params := vm.Params.(*proxmoxCloneArchetypeParams)
+		request.Cores, request.Memory = params.Cpu, params.MemoryMB()
+		request.DriveSize, request.NetworkIFace = params.DriveGB(), params.Network.Interface
 	default:
-		return "", fmt.Errorf("unknown archetype %s", vm.Archetype)
+		return nil, nil, fmt.Errorf("unknown archetype %s", vm.Archetype)
 	}
-	isoAuto := exec.Command("homelab", isoAutoArgs...)
-
-	result, err := shared.HandleOutput(output)(isoAuto.CombinedOutput())(func(data map[string]interface{}) (interface{}, error) {
-		if len(data) > 0 {
-			switch strings.ToLower(data["event"].(string)) {
-			case "remaster-success":
-				return data["outputPath"], nil
-			default:
-				if strings.ToUpper(data["level"].(string)) == "ERROR" {
-					return nil, errors.New(data["message"].(string))
-				} else {
-					return nil, unknownReturnStatus
-				}
-			}
-		}
-		return "", unknownReturnStatus
+
+	result, err := proxmoxvm.Set(ctx, request)
+	if err != nil {
+		return nil, nil, err
+	}
+	return result.Changes, result.Pending, nil
+}
+
+// Finds the existing VM like PlanVM, and plans its destruction. If it does not exist, the action is a
+// no-op, which still lets the image be purged and the VM be removed from the state. A VM found by its
+// name alone is marked as such, as it may not be the one bootstrap created.
+func (p *proxmoxProvider) PlanDestroy(ctx context.Context, vm *VM, recorded *VMState) (*PlannedAction, error) {
+	ctx = p.withContext(ctx)
+	if err := p.ensureLoggedIn(ctx, vm); err != nil {
+		return nil, err
+	}
+
+	action := &PlannedAction{VM: vm, State: recorded}
+	guest, reason, err := p.lookupGuest(ctx, vm, recorded)
+	if err != nil {
+		return nil, err
+	} else if guest == nil {
+		action.Action, action.Reason = actionNoop, reason
+		return action, nil
+	}
+
+	action.Action, action.Node, action.VmId = actionDestroy, guest.Node, guest.VmId.String()
+	action.Reason = fmt.Sprintf("%s %s on node %s is %s", guest.Type, action.VmId, action.Node, guest.Status)
+	if recorded == nil && (len(vm.Id) == 0 || vm.Id == proxmoxvm.AutoVmId) {
+		action.NameOnly = true
+		action.Reason += ", matched by name only"
+	}
+	return action, nil
+}
+
+// Stops the VM if it is running, and deletes it together with its disks.
+func (p *proxmoxProvider) DestroyVM(ctx context.Context, action *PlannedAction) error {
+	ctx = p.withContext(ctx)
+	if err := p.ensureLoggedIn(ctx, action.VM); err != nil {
+		return err
+	}
+
+	wait := task.WaitArgs{Wait: true}
+	if action.VM.Kind == kindLxc {
+		_, err := ct.Delete(ctx, &ct.DeleteRequest{
+			WaitArgs: wait,
+			Node:     action.Node,
+			CT:       action.VmId,
+			Purge:    true,
+			Force:    true,
+		})
+		return err
+	}
+	_, err := proxmoxvm.Delete(ctx, &proxmoxvm.DeleteRequest{
+		WaitArgs: wait,
+		Node:     action.Node,
+		VM:       action.VmId,
+		Purge:    true,
+		Force:    true,
 	})
+	return err
+}
 
+// Deletes the seed medium of the VM, and the auto-install image unless inUse reports other VMs installed from
+// it, from the image store and the temp directory. Images that are not remastered may be shared by other VMs
+// and are kept.
+func (p *proxmoxProvider) PurgeImage(ctx context.Context, action *PlannedAction, images []*Image, inUse func(volid string) bool) error {
+	vm := action.VM
+	if vm.Kind == kindLxc || vm.Archetype != basicArchetype {
+		return nil
+	}
+	image, err := p.getImage(vm.Image.Name, images)
 	if err != nil {
-		return "", err
+		return err
+	}
+	if !image.Auto || image.DownloadedByNode() {
+		return nil
+	}
+
+	vmId, node, imageVolid, seedVolid := action.VmId, action.Node, "", ""
+	if action.State != nil {
+		vmId, node = action.State.VmId, action.State.Node
+		imageVolid, seedVolid = action.State.ImageVolid, action.State.SeedVolid
 	}
-	return result.(string), nil
+	if len(vmId) == 0 && vm.Id != proxmoxvm.AutoVmId {
+		vmId = vm.Id
+	}
+	if len(node) == 0 {
+		node = p.node(vm)
+	}
+	if len(imageVolid) == 0 {
+		imageVolid = p.volid(vm, p.autoImagePath(image))
+	}
+
+	ctx = p.withContext(ctx)
+	if err = p.ensureLoggedIn(ctx, vm); err != nil {
+		return err
+	}
+
+	// the seed medium is named after the id, so it is known for VMs that were recorded or have an explicit id.
+	if len(seedVolid) == 0 && len(vmId) > 0 {
+		seedVolid = p.volid(vm, p.seedMediumPath(image, vmId))
+	}
+	if len(seedVolid) > 0 {
+		if err = p.removeImage(ctx, node, seedVolid); err != nil {
+			return err
+		}
+	}
+	if inUse(imageVolid) {
+		return nil
+	}
+	return p.removeImage(ctx, node, imageVolid)
 }
 
-func (p *proxmoxProvider) copy(source, dest string) error {
-	var (
-		in, out *os.File
-		err     error
-	)
+// Returns the volume id of the file in the image store of the VM.
+func (p *proxmoxProvider) volid(vm *VM, path string) string {
+	return fmt.Sprintf("%s:iso/%s", vm.Image.Store, filepath.Base(path))
+}
 
-	if in, err = os.Open(source); err != nil {
+// Deletes the volume from the image store, and the file of the same name from the temp directory.
+func (p *proxmoxProvider) removeImage(ctx context.Context, node, volid string) error {
+	if err := p.deleteVolume(ctx, node, volid); err != nil {
 		return err
 	}
 
-	if out, err = os.Create(dest); err != nil {
+	localPath := filepath.Join(tempDir, filepath.Base(volid))
+	if err := os.Remove(localPath); err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err == nil {
+		output.Info("Removed image {{index .path}}.",
+			map[string]interface{}{
+				"event": "image_removed",
+				"path":  localPath,
+			})
+	}
+	return nil
+}
+
+// Deletes the volume from its storage on the node and waits for the deletion. A missing volume
+// is not an error.
+func (p *proxmoxProvider) deleteVolume(ctx context.Context, node, volid string) error {
+	pve, err := common.NewClientFromCache(ctx, output)
+	if err != nil {
+		return fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	storage := volid[:strings.Index(volid, ":")]
+	content, err := upload.FindContent(ctx, pve, node, storage, "iso", volid[strings.LastIndex(volid, "/")+1:])
+	if err != nil || content == nil {
 		return err
 	}
 
-	_, err = io.Copy(out, in)
-	return err
+	if err = upload.DeleteVolume(ctx, pve, node, storage, content.Volid); err != nil {
+		return err
+	}
+	output.Info("Deleted image {{index .volid}}.",
+		map[string]interface{}{
+			"event": "image_deleted",
+			"volid": volid,
+		})
+	return nil
 }
 
-func (p *proxmoxProvider) ensureImage(vm *VM, image *Image) (file string, err error) {
-	isoGetArgs := []string{
-		"iso",
-		"get",
-		"--flavor", image.Flavor,
-		"--target-dir", tempDir,
-		"--output-format", shared.OutputFormatJson,
-		"--reuse",
-	}
-	isoGet := exec.Command("homelab", isoGetArgs...)
-
-	result, err := shared.HandleOutput(output)(isoGet.CombinedOutput())(func(data map[string]interface{}) (interface{}, error) {
-		if len(data) > 0 {
-			switch strings.ToUpper(data["level"].(string)) {
-			case "INFO", "DEBUG":
-				return data["file"], nil
-			case "ERROR":
-				return nil, errors.New(data["message"].(string))
+// Finds the existing guest of the VM, by the id recorded in the state, or else by its configured id or
+// name. If there is none, the reason is returned instead.
+func (p *proxmoxProvider) lookupGuest(ctx context.Context, vm *VM, recorded *VMState) (*client.ClusterResource, string, error) {
+	pve, err := common.NewClientFromCache(ctx, output)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+	resources, err := pve.ClusterResources(ctx, client.ResourceTypeVM)
+	if err != nil {
+		return nil, "", err
+	}
+
+	guestType := client.GuestTypeQemu
+	if vm.Kind == kindLxc {
+		guestType = client.GuestTypeLxc
+	}
+
+	var guest *client.ClusterResource
+	switch {
+	case recorded != nil:
+		if guest = p.findGuest(resources, func(r *client.ClusterResource) bool {
+			return r.VmId.String() == recorded.VmId
+		}); guest == nil {
+			return nil, fmt.Sprintf("recorded id %s no longer exists", recorded.VmId), nil
+		} else if guest.Type != guestType {
+			return nil, "", fmt.Errorf("recorded id %s is a %s, not a %s", recorded.VmId, guest.Type, guestType)
+		}
+	case len(vm.Id) > 0 && vm.Id != proxmoxvm.AutoVmId:
+		guest = p.findGuest(resources, func(r *client.ClusterResource) bool {
+			return r.VmId.String() == vm.Id
+		})
+		if guest != nil && (guest.Type != guestType || guest.Name != vm.Name) {
+			return nil, "", fmt.Errorf("id %s is in use by %s %s", vm.Id, guest.Type, guest.Name)
+		}
+	default:
+		var matches int
+		for i := range resources {
+			if resources[i].Type == guestType && resources[i].Name == vm.Name {
+				guest, matches = &resources[i], matches+1
 			}
 		}
-		return nil, unknownReturnStatus
-	})
+		if matches > 1 {
+			return nil, "", fmt.Errorf("%d guests are named %s, set the id to pick one", matches, vm.Name)
+		}
+	}
 
-	if result != nil {
-		file = result.(string)
+	if guest == nil {
+		return nil, "does not exist", nil
 	}
-	return
+	return guest, "", nil
+}
+
+func (p *proxmoxProvider) findGuest(resources []client.ClusterResource, match func(r *client.ClusterResource) bool) *client.ClusterResource {
+	for i := range resources {
+		if match(&resources[i]) {
+			return &resources[i]
+		}
+	}
+	return nil
+}
+
+// Returns the Proxmox node the VM is placed on, as specified by the provider args.
+func (p *proxmoxProvider) node(vm *VM) string {
+	node, _ := vm.Provider.Args["node"].(string)
+	return node
 }
 
 func (p *proxmoxProvider) getImage(name string, images []*Image) (*Image, error) {
@@ -355,8 +1005,6 @@ const (
 	keyName  = "name"
 	proxmox  = "proxmox"
 	tempDir  = "/tmp"
-)
 
-var (
-	unknownReturnStatus = errors.New("unknown_return_status")
+	imageHashAlgorithm = "sha256"
 )
@@ -0,0 +1,126 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	stateVersion = 1
+	stateSuffix  = ".state.json"
+)
+
+// What bootstrap recorded about the VMs it created, keyed by VM name. It lets later runs tell VMs
+// that already exist from those still to be created.
+type State struct {
+	Version int                 `json:"version"`
+	VMs     map[string]*VMState `json:"vms"`
+	// File the state is read from and written to.
+	path string
+	// Guards the VMs, which are recorded concurrently when VMs are applied in parallel.
+	mu sync.Mutex
+}
+
+// What bootstrap recorded about one VM.
+type VMState struct {
+	Name     string `json:"name"`
+	Provider string `json:"provider"`
+	// Provider specific context, e.g. the context of the Proxmox ticket cache.
+	Context string `json:"context,omitempty"`
+	Kind    string `json:"kind,omitempty"`
+	Node    string `json:"node"`
+	VmId    string `json:"vmid"`
+	// Volume id of the installation image, and its checksum as 'algorithm:digest' if known.
+	ImageVolid string `json:"image_volid,omitempty"`
+	ImageHash  string `json:"image_hash,omitempty"`
+	// Volume id of the seed medium with the settings of the VM, for auto-install images.
+	SeedVolid string `json:"seed_volid,omitempty"`
+	// When the VM was first recorded, i.e. created by bootstrap or found existing, and last updated.
+	RecordedAt time.Time  `json:"recorded_at"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+}
+
+// Returns the state file next to the config file, e.g. k8s.state.json for k8s.yaml.
+func DefaultStatePath(configPath string) string {
+	return strings.TrimSuffix(configPath, filepath.Ext(configPath)) + stateSuffix
+}
+
+// Reads the state from the file. A missing file is an empty state.
+func ReadState(path string) (*State, error) {
+	state := &State{Version: stateVersion, VMs: make(map[string]*VMState), path: path}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(b, state); err != nil {
+		return nil, err
+	}
+	if state.VMs == nil {
+		state.VMs = make(map[string]*VMState)
+	}
+	return state, nil
+}
+
+// Returns the recorded state of the VM, or nil if none is recorded.
+func (s *State) VM(name string) *VMState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.VMs[name]
+}
+
+// Returns true if a VM other than the named one is recorded as installed from the image of the volume id.
+func (s *State) ImageInUse(volid, except string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, vm := range s.VMs {
+		if name != except && vm.ImageVolid == volid {
+			return true
+		}
+	}
+	return false
+}
+
+// Records the VM and writes the state, so that progress survives failures of later steps.
+func (s *State) Record(vm *VMState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.VMs[vm.Name] = vm
+	return s.write()
+}
+
+// Removes the VM from the state and writes the state.
+func (s *State) Forget(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.VMs, name)
+	return s.write()
+}
+
+// Writes the state in (pretty) JSON format. The file is replaced atomically.
+func (s *State) Write() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write()
+}
+
+func (s *State) write() error {
+	b, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -1,26 +1,38 @@
 package bootstrap
 
 import (
+	"context"
 	"fmt"
 	. "github.com/xeha-gmbh/homelab/shared"
 	"strings"
+	"time"
 )
 
-func parseV1Config(data map[string]interface{}) (Config, error) {
-	providers, err := ParseProviders(data)
+// Parses the config, decoding weakly typed input if weak is set, see decode.
+func parseV1Config(data map[string]interface{}, weak bool) (Config, error) {
+	providers, err := ParseProviders(data, weak)
 	if err != nil {
 		return nil, err
 	}
 
-	images, err := ParseImages(data)
+	images, err := ParseImages(data, weak)
 	if err != nil {
 		return nil, err
 	}
 
-	vms, err := ParseVMs(data)
+	vms, err := ParseVMs(data, weak)
 	if err != nil {
 		return nil, err
 	}
+	if err = checkDependencies(vms); err != nil {
+		output.Fatal(ErrParse.ExitCode,
+			"Malformed config: {{index .error}}",
+			map[string]interface{}{
+				"event": "parse_error",
+				"error": err.Error(),
+			})
+		return nil, ErrParse
+	}
 
 	return &v1Config{Providers: providers, Images: images, VMs: vms}, nil
 }
@@ -32,33 +44,227 @@ type v1Config struct {
 	out       MessagePrinter `yaml:"-"`
 }
 
-func (c *v1Config) Bootstrap() error {
-	//yaml.NewEncoder(os.Stdout).Encode(c)
-	//yaml.NewEncoder(os.Stdout).Encode(c.VMs[0].Params)
+// Plans the action of each VM against the live state of its provider and what the state recorded.
+func (c *v1Config) Plan(ctx context.Context, state *State) ([]*PlannedAction, error) {
+	names := make(map[string]bool, len(c.VMs))
+	actions := make([]*PlannedAction, 0, len(c.VMs))
+	for _, vm := range c.VMs {
+		// the state is keyed by name.
+		if names[vm.Name] {
+			output.Fatal(ErrParse.ExitCode,
+				"Malformed config: vm names must be unique, {{index .name}} is not.",
+				map[string]interface{}{
+					"event": "parse_error",
+					"name":  vm.Name,
+				})
+			return nil, ErrParse
+		}
+		names[vm.Name] = true
+
+		provider, err := c.GetProvider(vm.Provider.Name)
+		if err == nil {
+			var action *PlannedAction
+			if action, err = provider.PlanVM(ctx, vm, state.VM(vm.Name)); err == nil {
+				actions = append(actions, action)
+				continue
+			}
+		}
+		output.Fatal(ErrOp.ExitCode,
+			"Failed to plan vm [name={{index .name}}]. Cause: {{index .cause}}.",
+			map[string]interface{}{
+				"event": "plan_failed",
+				"name":  vm.Name,
+				"cause": err.Error(),
+			})
+		return nil, ErrOp
+	}
+	return actions, nil
+}
+
+// Executes the planned actions, at most parallelism at a time and each after those of the VMs it
+// depends on, recording each VM in the state as soon as it is created or updated. The first failure
+// cancels the actions still running, and all failures are reported together.
+func (c *v1Config) Apply(ctx context.Context, actions []*PlannedAction, state *State, parallelism int) error {
+	result := runGraph(ctx, actions, parallelism, func(ctx context.Context, action *PlannedAction) error {
+		return c.apply(ctx, action, state)
+	})
+	if result.ok() {
+		return nil
+	}
+
+	for _, action := range actions {
+		if err, failed := result.Failed[action.VM.Name]; failed {
+			output.Info("Failed to {{index .action}} vm {{index .name}}. Cause: {{index .cause}}.",
+				map[string]interface{}{
+					"event":  "vm_failed",
+					"action": action.Action,
+					"name":   action.VM.Name,
+					"cause":  err.Error(),
+				})
+		}
+	}
+	for _, name := range result.Cancelled {
+		output.Info("Cancelled vm {{index .name}}.",
+			map[string]interface{}{
+				"event": "vm_cancelled",
+				"name":  name,
+			})
+	}
+	for _, name := range result.Skipped {
+		output.Info("Skipped vm {{index .name}}.",
+			map[string]interface{}{
+				"event": "vm_skipped",
+				"name":  name,
+			})
+	}
+	output.Fatal(ErrOp.ExitCode,
+		"Failed to apply {{index .failed}} of {{index .total}} vms, {{index .cancelled}} cancelled and "+
+			"{{index .skipped}} skipped. Cause: {{index .cause}}.",
+		map[string]interface{}{
+			"event":     "apply_failed",
+			"total":     len(actions),
+			"failed":    len(result.Failed),
+			"cancelled": len(result.Cancelled),
+			"skipped":   len(result.Skipped),
+			"cause":     result.cause(actions),
+		})
+	return ErrOp
+}
+
+// Executes the planned action of one VM and records the VM.
+func (c *v1Config) apply(ctx context.Context, action *PlannedAction, state *State) error {
+	vm := action.VM
 
+	provider, err := c.GetProvider(vm.Provider.Name)
+	if err != nil {
+		return err
+	}
+	switch action.Action {
+	case actionCreate:
+		var created *VMState
+		if created, err = provider.CreateVM(ctx, vm, c.Images); err == nil {
+			err = state.Record(created)
+		}
+	case actionUpdate:
+		if err = provider.UpdateVM(ctx, action); err == nil {
+			now := time.Now()
+			action.State.UpdatedAt = &now
+			err = state.Record(action.State)
+		}
+	case actionNoop:
+		if action.Unrecorded {
+			err = state.Record(action.State)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if action.Action == actionNoop && !action.Unrecorded {
+		return nil
+	}
+	id := action.VmId
+	if len(id) == 0 {
+		id = vm.Id
+	}
+	output.Info("Applied {{index .action}} of vm {{index .name}} ({{index .id}}).",
+		map[string]interface{}{
+			"event":  "applied",
+			"action": action.Action,
+			"name":   vm.Name,
+			"id":     id,
+		})
+	return nil
+}
+
+// Plans the destruction of the VMs, or only of those named, in reverse order of their dependencies and
+// declaration.
+func (c *v1Config) PlanDestroy(ctx context.Context, state *State, only []string) ([]*PlannedAction, error) {
+	selected := make(map[string]bool, len(only))
+	for _, name := range only {
+		selected[name] = false
+	}
 	for _, vm := range c.VMs {
+		if _, ok := selected[vm.Name]; ok {
+			selected[vm.Name] = true
+		}
+	}
+	for _, name := range only {
+		if !selected[name] {
+			output.Fatal(ErrParse.ExitCode,
+				"No vm by name {{index .name}} in config.",
+				map[string]interface{}{
+					"event": "parse_error",
+					"name":  name,
+				})
+			return nil, ErrParse
+		}
+	}
+
+	// VMs are destroyed in reverse, so that dependent VMs and those declared later, e.g. workers, go first.
+	vms := sortByDependencies(c.VMs)
+	actions := make([]*PlannedAction, 0, len(vms))
+	for i := len(vms) - 1; i >= 0; i-- {
+		vm := vms[i]
+		if len(only) > 0 && !selected[vm.Name] {
+			continue
+		}
+
+		provider, err := c.GetProvider(vm.Provider.Name)
+		if err == nil {
+			var action *PlannedAction
+			if action, err = provider.PlanDestroy(ctx, vm, state.VM(vm.Name)); err == nil {
+				actions = append(actions, action)
+				continue
+			}
+		}
+		output.Fatal(ErrOp.ExitCode,
+			"Failed to plan destruction of vm [name={{index .name}}]. Cause: {{index .cause}}.",
+			map[string]interface{}{
+				"event": "plan_failed",
+				"name":  vm.Name,
+				"cause": err.Error(),
+			})
+		return nil, ErrOp
+	}
+	return actions, nil
+}
+
+// Destroys the VMs as planned, removing each VM from the state as soon as it is gone.
+func (c *v1Config) Destroy(ctx context.Context, actions []*PlannedAction, state *State, purgeImages bool) error {
+	for _, action := range actions {
+		vm := action.VM
+
 		provider, err := c.GetProvider(vm.Provider.Name)
+		if err == nil && action.Action == actionDestroy {
+			err = provider.DestroyVM(ctx, action)
+		}
+		if err == nil && purgeImages {
+			err = provider.PurgeImage(ctx, action, c.Images, func(volid string) bool {
+				return state.ImageInUse(volid, vm.Name)
+			})
+		}
+		if err == nil && state.VM(vm.Name) != nil {
+			err = state.Forget(vm.Name)
+		}
 		if err != nil {
 			output.Fatal(ErrOp.ExitCode,
-				"Failed to creating vm [name={{index .name}}]. Cause: {{index .cause}}.",
+				"Failed to destroy vm [name={{index .name}}]. Cause: {{index .cause}}.",
 				map[string]interface{}{
-					"event": "",
+					"event": "destroy_failed",
 					"name":  vm.Name,
 					"cause": err.Error(),
 				})
 			return ErrOp
 		}
 
-		err = provider.CreateVM(vm, c.Images)
-		if err != nil {
-			output.Fatal(ErrOp.ExitCode,
-				"Failed to creating vm [name={{index .name}}]. Cause: {{index .cause}}.",
+		if action.Action == actionDestroy {
+			output.Info("Destroyed vm {{index .name}} ({{index .id}}).",
 				map[string]interface{}{
-					"event": "",
+					"event": "destroyed",
 					"name":  vm.Name,
-					"cause": err.Error(),
+					"id":    action.VmId,
 				})
-			return ErrOp
 		}
 	}
 
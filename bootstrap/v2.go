@@ -0,0 +1,332 @@
+package bootstrap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	. "github.com/xeha-gmbh/homelab/shared"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	keyVars     = "vars"
+	keyDefaults = "defaults"
+	keyCount    = "count"
+	keyForEach  = "for_each"
+
+	// Names of the template values of the VMs stamped out by count or for_each.
+	varIndex = "index"
+	varKey   = "key"
+	varValue = "value"
+)
+
+var (
+	// ${name} anywhere in a value.
+	varRef = regexp.MustCompile(`\$\{(\w+)\}`)
+	// ${name} as the whole value, which keeps the type of the var, e.g. a list.
+	wholeVarRef = regexp.MustCompile(`^\$\{(\w+)\}$`)
+)
+
+// Config version 2 is version 1 with top-level vars, a defaults block merged into every VM, interpolation of
+// vars with ${name} or Go templates in values, and count or for_each on VMs to stamp out several similar VMs.
+// The config is expanded into a version 1 config, which is then parsed as such.
+func parseV2Config(data map[string]interface{}) (Config, error) {
+	expanded, err := expandV2Config(data)
+	if err != nil {
+		output.Fatal(ErrParse.ExitCode,
+			"Malformed config: {{index .error}}",
+			map[string]interface{}{
+				"event": "parse_error",
+				"error": err.Error(),
+			})
+		return nil, ErrParse
+	}
+	return parseV1Config(expanded, true)
+}
+
+func expandV2Config(data map[string]interface{}) (map[string]interface{}, error) {
+	vars := make(map[string]interface{})
+	if raw, ok := data[keyVars]; ok && raw != nil {
+		rawVars, isMap := raw.(map[interface{}]interface{})
+		if !isMap {
+			return nil, fmt.Errorf("expect key '%s' to be a map", keyVars)
+		}
+		for k, v := range rawVars {
+			name := fmt.Sprint(k)
+			switch name {
+			case varIndex, varKey, varValue:
+				return nil, fmt.Errorf("var name '%s' is reserved for count and for_each", name)
+			}
+			vars[name] = v
+		}
+	}
+
+	defaults := make(map[interface{}]interface{})
+	if raw, ok := data[keyDefaults]; ok && raw != nil {
+		rawDefaults, isMap := raw.(map[interface{}]interface{})
+		if !isMap {
+			return nil, fmt.Errorf("expect key '%s' to be a map", keyDefaults)
+		}
+		defaults = rawDefaults
+	}
+
+	expanded := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		switch k {
+		case keyVars, keyDefaults:
+			continue
+		case keyVMs:
+			vms, err := expandVMs(v, defaults, vars)
+			if err != nil {
+				return nil, err
+			}
+			expanded[k] = vms
+		default:
+			rendered, err := render(v, vars)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", k, err.Error())
+			}
+			expanded[k] = rendered
+		}
+	}
+	return expanded, nil
+}
+
+// Merges the defaults into each VM, stamps out the VMs with count or for_each, and renders their values.
+func expandVMs(raw interface{}, defaults map[interface{}]interface{}, vars map[string]interface{}) ([]interface{}, error) {
+	rawVMs, isList := raw.([]interface{})
+	if !isList {
+		return nil, fmt.Errorf("expect key '%s' to be a list", keyVMs)
+	}
+
+	vms := make([]interface{}, 0, len(rawVMs))
+	for i, oneRawVM := range rawVMs {
+		rawVM, isMap := oneRawVM.(map[interface{}]interface{})
+		if !isMap {
+			return nil, fmt.Errorf("expect each '%s' to be a map", keyVMs)
+		}
+		vm := merge(defaults, rawVM)
+
+		instances, err := instancesOf(vm, vars)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d]: %s", keyVMs, i, err.Error())
+		}
+		delete(vm, keyCount)
+		delete(vm, keyForEach)
+
+		for _, instance := range instances {
+			rendered, err := render(vm, instance)
+			if err != nil {
+				return nil, fmt.Errorf("%s[%d]: %s", keyVMs, i, err.Error())
+			}
+			vms = append(vms, rendered)
+		}
+	}
+	return vms, nil
+}
+
+// Returns the template values of each VM stamped out of the VM entry: one per count, one per element of a
+// for_each list, or one per key of a for_each map in order of the keys. Without either, the entry is one VM.
+func instancesOf(vm map[interface{}]interface{}, vars map[string]interface{}) ([]map[string]interface{}, error) {
+	count, hasCount := vm[keyCount]
+	forEach, hasForEach := vm[keyForEach]
+
+	switch {
+	case hasCount && hasForEach:
+		return nil, fmt.Errorf("either %s or %s, not both", keyCount, keyForEach)
+	case hasCount:
+		rendered, err := render(count, vars)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", keyCount, err.Error())
+		}
+		n, err := toInt(rendered)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s must be a number of vms, got %v", keyCount, rendered)
+		}
+		instances := make([]map[string]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			instances = append(instances, withVars(vars, i, i, i))
+		}
+		return instances, nil
+	case hasForEach:
+		rendered, err := render(forEach, vars)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", keyForEach, err.Error())
+		}
+		switch each := rendered.(type) {
+		case []interface{}:
+			instances := make([]map[string]interface{}, 0, len(each))
+			for i, v := range each {
+				instances = append(instances, withVars(vars, i, i, v))
+			}
+			return instances, nil
+		case map[interface{}]interface{}:
+			keys := make([]string, 0, len(each))
+			values := make(map[string]interface{}, len(each))
+			for k, v := range each {
+				keys = append(keys, fmt.Sprint(k))
+				values[fmt.Sprint(k)] = v
+			}
+			sort.Strings(keys)
+			instances := make([]map[string]interface{}, 0, len(keys))
+			for i, k := range keys {
+				instances = append(instances, withVars(vars, i, k, values[k]))
+			}
+			return instances, nil
+		default:
+			return nil, fmt.Errorf("%s must be a list or a map", keyForEach)
+		}
+	default:
+		return []map[string]interface{}{vars}, nil
+	}
+}
+
+func withVars(vars map[string]interface{}, index int, key, value interface{}) map[string]interface{} {
+	instance := make(map[string]interface{}, len(vars)+3)
+	for k, v := range vars {
+		instance[k] = v
+	}
+	instance[varIndex] = index
+	instance[varKey] = key
+	instance[varValue] = value
+	return instance
+}
+
+// Returns a copy of the defaults with the values of the VM. Maps are merged recursively, other values
+// of the VM, lists included, replace those of the defaults.
+func merge(defaults, vm map[interface{}]interface{}) map[interface{}]interface{} {
+	merged := make(map[interface{}]interface{}, len(defaults)+len(vm))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range vm {
+		defaultMap, isDefaultMap := merged[k].(map[interface{}]interface{})
+		vmMap, isVMMap := v.(map[interface{}]interface{})
+		if isDefaultMap && isVMMap {
+			merged[k] = merge(defaultMap, vmMap)
+		} else {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// Returns a copy of the raw value with ${name} references and Go templates in its strings rendered.
+func render(raw interface{}, vars map[string]interface{}) (interface{}, error) {
+	switch v := raw.(type) {
+	case string:
+		return interpolate(v, vars)
+	case map[interface{}]interface{}:
+		rendered := make(map[interface{}]interface{}, len(v))
+		for k, value := range v {
+			r, err := render(value, vars)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %s", k, err.Error())
+			}
+			rendered[k] = r
+		}
+		return rendered, nil
+	case []interface{}:
+		rendered := make([]interface{}, 0, len(v))
+		for _, value := range v {
+			r, err := render(value, vars)
+			if err != nil {
+				return nil, err
+			}
+			rendered = append(rendered, r)
+		}
+		return rendered, nil
+	default:
+		return raw, nil
+	}
+}
+
+// Replaces the ${name} references in the value, then executes the value as Go template if it is one.
+// A value consisting of a single reference takes the var as is, e.g. a list of dns servers.
+func interpolate(value string, vars map[string]interface{}) (interface{}, error) {
+	if m := wholeVarRef.FindStringSubmatch(value); m != nil {
+		v, ok := vars[m[1]]
+		if !ok {
+			return nil, fmt.Errorf("undefined var %s", m[1])
+		}
+		return v, nil
+	}
+
+	var err error
+	value = varRef.ReplaceAllStringFunc(value, func(ref string) string {
+		name := varRef.FindStringSubmatch(ref)[1]
+		v, ok := vars[name]
+		if !ok {
+			err = fmt.Errorf("undefined var %s", name)
+			return ref
+		}
+		return fmt.Sprint(v)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+	t, err := template.New("value").Funcs(templateFuncs).Option("missingkey=error").Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err = t.Execute(buf, vars); err != nil {
+		return nil, err
+	}
+	return buf.String(), nil
+}
+
+var templateFuncs = template.FuncMap{
+	// Adds numbers, e.g. {{add 110 .index}} for the VM ids.
+	"add": func(a, b interface{}) (int, error) {
+		x, err := toInt(a)
+		if err != nil {
+			return 0, err
+		}
+		y, err := toInt(b)
+		if err != nil {
+			return 0, err
+		}
+		return x + y, nil
+	},
+	// Increments an IPv4 address, e.g. {{ipadd "192.168.100.31" .index}}.
+	"ipadd": func(ip string, n interface{}) (string, error) {
+		addr := net.ParseIP(ip).To4()
+		if addr == nil {
+			return "", fmt.Errorf("malformed ip address %s", ip)
+		}
+		offset, err := toInt(n)
+		if err != nil {
+			return "", err
+		}
+		sum := int64(binary.BigEndian.Uint32(addr)) + int64(offset)
+		if sum < 0 || sum > 0xffffffff {
+			return "", fmt.Errorf("ip address %s plus %d is out of range", ip, offset)
+		}
+		next := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(next, uint32(sum))
+		return next.String(), nil
+	},
+}
+
+func toInt(v interface{}) (int, error) {
+	switch n := v.(type) {
+	case int:
+		return n, nil
+	case int64:
+		return int(n), nil
+	case string:
+		return strconv.Atoi(strings.TrimSpace(n))
+	default:
+		return 0, fmt.Errorf("expect a number, got %v", v)
+	}
+}
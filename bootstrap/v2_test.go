@@ -0,0 +1,268 @@
+package bootstrap
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestExpandV2Config(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config string
+		// the expanded vms, or the error.
+		vms   string
+		error string
+	}{
+		{
+			name: "count",
+			config: `
+vars:
+  workers: 2
+vms:
+  - count: ${workers}
+    id: "{{add 111 .index}}"
+    name: "worker-{{add .index 1}}"
+`,
+			vms: `
+- id: "111"
+  name: worker-1
+- id: "112"
+  name: worker-2
+`,
+		},
+		{
+			name: "zero count",
+			config: `
+vms:
+  - count: 0
+    name: worker
+`,
+			vms: `[]`,
+		},
+		{
+			name: "for_each list",
+			config: `
+vms:
+  - for_each: [alpha, beta]
+    name: "{{.value}}-{{.index}}"
+`,
+			vms: `
+- name: alpha-0
+- name: beta-1
+`,
+		},
+		{
+			name: "for_each map in order of keys",
+			config: `
+vms:
+  - for_each:
+      gluster-2: 192.168.100.41
+      gluster-1: 192.168.100.40
+      gluster-3: 192.168.100.42
+    name: "{{.key}}"
+    ip: "{{.value}}"
+    id: "{{add 115 .index}}"
+`,
+			vms: `
+- name: gluster-1
+  ip: 192.168.100.40
+  id: "115"
+- name: gluster-2
+  ip: 192.168.100.41
+  id: "116"
+- name: gluster-3
+  ip: 192.168.100.42
+  id: "117"
+`,
+		},
+		{
+			name: "deep merge of defaults",
+			config: `
+defaults:
+  archetype: basic
+  params:
+    cpu: 2
+    network:
+      mask: 255.255.255.0
+      dns: [1.1.1.1, 8.8.8.8]
+vms:
+  - name: master
+    params:
+      cpu: 4
+      network:
+        ip: 192.168.100.30
+        dns: [192.168.100.4]
+  - name: plain
+`,
+			vms: `
+- name: master
+  archetype: basic
+  params:
+    cpu: 4
+    network:
+      mask: 255.255.255.0
+      ip: 192.168.100.30
+      dns: [192.168.100.4]
+- name: plain
+  archetype: basic
+  params:
+    cpu: 2
+    network:
+      mask: 255.255.255.0
+      dns: [1.1.1.1, 8.8.8.8]
+`,
+		},
+		{
+			name: "whole var keeps its type",
+			config: `
+vars:
+  dns: [1.1.1.1, 8.8.8.8]
+  cpu: 4
+  domain: imulab.io
+vms:
+  - name: master
+    dns: ${dns}
+    cpu: ${cpu}
+    fqdn: master.${domain}
+    label: "cpu-${cpu}"
+`,
+			vms: `
+- name: master
+  dns: [1.1.1.1, 8.8.8.8]
+  cpu: 4
+  fqdn: master.imulab.io
+  label: cpu-4
+`,
+		},
+		{
+			name: "undefined var as whole value",
+			config: `
+vms:
+  - name: ${missing}
+`,
+			error: "vms[0]: name: undefined var missing",
+		},
+		{
+			name: "undefined var in a string",
+			config: `
+vms:
+  - name: master.${missing}
+`,
+			error: "vms[0]: name: undefined var missing",
+		},
+		{
+			name: "undefined var in a template",
+			config: `
+vms:
+  - name: "{{.missing}}"
+`,
+			error: "map has no entry for key",
+		},
+		{
+			name: "count and for_each",
+			config: `
+vms:
+  - count: 1
+    for_each: [a]
+`,
+			error: "vms[0]: either count or for_each, not both",
+		},
+		{
+			name: "negative count",
+			config: `
+vms:
+  - count: -1
+`,
+			error: "vms[0]: count must be a number of vms, got -1",
+		},
+		{
+			name: "reserved var",
+			config: `
+vars:
+  index: 1
+vms: []
+`,
+			error: "var name 'index' is reserved for count and for_each",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			data := make(map[string]interface{})
+			if err := yaml.Unmarshal([]byte(tc.config), &data); err != nil {
+				t.Fatal(err)
+			}
+
+			expanded, err := expandV2Config(data)
+			if len(tc.error) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.error) {
+					t.Fatalf("expected error %q, got %v", tc.error, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			vms := make([]interface{}, 0)
+			if err := yaml.Unmarshal([]byte(tc.vms), &vms); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(expanded[keyVMs], vms) {
+				t.Fatalf("expected vms %v, got %v", vms, expanded[keyVMs])
+			}
+			for _, key := range []string{keyVars, keyDefaults} {
+				if _, ok := expanded[key]; ok {
+					t.Errorf("expected %s to be removed", key)
+				}
+			}
+		})
+	}
+}
+
+func TestIpAdd(t *testing.T) {
+	ipadd := templateFuncs["ipadd"].(func(string, interface{}) (string, error))
+	for _, tc := range []struct {
+		ip     string
+		n      interface{}
+		result string
+		error  string
+	}{
+		{ip: "192.168.100.31", n: 0, result: "192.168.100.31"},
+		{ip: "192.168.100.31", n: 1, result: "192.168.100.32"},
+		{ip: "192.168.100.31", n: "2", result: "192.168.100.33"},
+		{ip: "192.168.100.255", n: 1, result: "192.168.101.0"},
+		{ip: "192.168.100.1", n: -1, result: "192.168.100.0"},
+		{ip: "255.255.255.254", n: 1, result: "255.255.255.255"},
+		{ip: "255.255.255.255", n: 1, error: "ip address 255.255.255.255 plus 1 is out of range"},
+		{ip: "0.0.0.0", n: -1, error: "ip address 0.0.0.0 plus -1 is out of range"},
+		{ip: "fe80::1", n: 1, error: "malformed ip address fe80::1"},
+		{ip: "192.168.100.31", n: "one", error: "invalid syntax"},
+	} {
+		result, err := ipadd(tc.ip, tc.n)
+		switch {
+		case len(tc.error) > 0 && (err == nil || !strings.Contains(err.Error(), tc.error)):
+			t.Errorf("ipadd %s %v: expected error %q, got %v", tc.ip, tc.n, tc.error, err)
+		case len(tc.error) == 0 && err != nil:
+			t.Errorf("ipadd %s %v: unexpected error: %s", tc.ip, tc.n, err.Error())
+		case result != tc.result:
+			t.Errorf("ipadd %s %v: expected %s, got %s", tc.ip, tc.n, tc.result, result)
+		}
+	}
+}
+
+func TestDecodeWeakOnlyForV2(t *testing.T) {
+	data := map[interface{}]interface{}{"cpu": "4", "memory": "4096M"}
+
+	weak, err := ParseProxmoxCloneArchetypeParams(data, true)
+	if err != nil {
+		t.Fatalf("unexpected error of weak decoding: %s", err.Error())
+	} else if weak.Cpu != 4 {
+		t.Errorf("expected cpu 4, got %d", weak.Cpu)
+	}
+
+	if _, err := ParseProxmoxCloneArchetypeParams(data, false); err == nil {
+		t.Errorf("expected strict decoding to reject cpu %q", data["cpu"])
+	}
+}
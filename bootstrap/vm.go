@@ -3,7 +3,8 @@ package bootstrap
 import (
 	"errors"
 	"fmt"
-	"github.com/mitchellh/mapstructure"
+	proxmoxvm "github.com/xeha-gmbh/homelab/proxmox/vm"
+	"net"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -11,7 +12,7 @@ import (
 )
 
 // main entry point to create VM structures from YAML file
-func ParseVMs(data map[string]interface{}) ([]*VM, error) {
+func ParseVMs(data map[string]interface{}, weak bool) ([]*VM, error) {
 	rawVMs, isList := data[keyVMs].([]interface{})
 	if !isList {
 		output.Fatal(1,
@@ -40,7 +41,7 @@ func ParseVMs(data map[string]interface{}) ([]*VM, error) {
 		}
 
 		vm := &VM{}
-		if err := mapstructure.Decode(rawData, vm); err != nil {
+		if err := decode(rawData, vm, weak); err != nil {
 			output.Fatal(1,
 				"Malformed config: unable to decode vm. Cause: {{index .cause}}",
 				map[string]interface{}{
@@ -53,8 +54,37 @@ func ParseVMs(data map[string]interface{}) ([]*VM, error) {
 
 		switch vm.Provider.Name {
 		case proxmox:
-			if vm.Archetype == basicArchetype {
-				params, err := ParseProxmoxBasicArchetypeParams(rawData["params"])
+			if vm.Kind == kindLxc {
+				params, err := ParseProxmoxLxcParams(rawData["params"], weak)
+				if err == nil && len(vm.Template) == 0 {
+					err = errors.New("lxc kind requires a template")
+				}
+				if err != nil {
+					output.Fatal(1,
+						"Malformed config: unable to parse proxmox lxc params. Cause: {{index .cause}}",
+						map[string]interface{}{
+							"event":    "parse_error",
+							"exitCode": 1,
+							"cause":    err.Error(),
+						})
+					return nil, errors.New("parse_error")
+				}
+				vm.Params = params
+				break
+			} else if len(vm.Kind) > 0 && vm.Kind != kindQemu {
+				output.Fatal(1,
+					"Unsupported proxmox kind {{index .kind}}.",
+					map[string]interface{}{
+						"event":    "api_error",
+						"exitCode": 1,
+						"kind":     vm.Kind,
+					})
+				return nil, errors.New("api_error")
+			}
+
+			switch vm.Archetype {
+			case basicArchetype:
+				params, err := ParseProxmoxBasicArchetypeParams(rawData["params"], weak)
 				if err != nil {
 					output.Fatal(1,
 						"Malformed config: unable to parse proxmox basic params. Cause: {{index .cause}}",
@@ -66,7 +96,39 @@ func ParseVMs(data map[string]interface{}) ([]*VM, error) {
 					return nil, errors.New("parse_error")
 				}
 				vm.Params = params
-			} else {
+			case cloudInitArchetype:
+				params, err := ParseProxmoxBasicArchetypeParams(rawData["params"], weak)
+				if err == nil && len(vm.Template) == 0 && len(params.CloudInit.Image) == 0 {
+					err = errors.New("cloudinit archetype requires either a template or params.cloudinit.image")
+				}
+				if err != nil {
+					output.Fatal(1,
+						"Malformed config: unable to parse proxmox cloudinit params. Cause: {{index .cause}}",
+						map[string]interface{}{
+							"event":    "parse_error",
+							"exitCode": 1,
+							"cause":    err.Error(),
+						})
+					return nil, errors.New("parse_error")
+				}
+				vm.Params = params
+			case cloneArchetype:
+				params, err := ParseProxmoxCloneArchetypeParams(rawData["params"], weak)
+				if err == nil && len(vm.Template) == 0 {
+					err = errors.New("clone archetype requires a template")
+				}
+				if err != nil {
+					output.Fatal(1,
+						"Malformed config: unable to parse proxmox clone params. Cause: {{index .cause}}",
+						map[string]interface{}{
+							"event":    "parse_error",
+							"exitCode": 1,
+							"cause":    err.Error(),
+						})
+					return nil, errors.New("parse_error")
+				}
+				vm.Params = params
+			default:
 				output.Fatal(1,
 					"Unsupported proxmox archetype {{index .archetype}}.",
 					map[string]interface{}{
@@ -94,6 +156,7 @@ func ParseVMs(data map[string]interface{}) ([]*VM, error) {
 }
 
 type VM struct {
+	// Omitted or auto allocates a free id, see the idrange of the provider.
 	Id       string `yaml:"id"`
 	Name     string `yaml:"name"`
 	Provider struct {
@@ -104,16 +167,24 @@ type VM struct {
 		Name  string `yaml:"name"`
 		Store string `yaml:"store"`
 	} `yaml:"image"`
+	// Either qemu (default) for virtual machines, or lxc for containers.
+	Kind string `yaml:"kind"`
+	// Id or name of the template to clone, instead of installing from an image. Requires the clone archetype.
+	// For containers, the volume id of the OS template, or the name of a template of the appliance index
+	// to download into the image store.
+	Template  string      `yaml:"template"`
 	Archetype string      `yaml:"archetype"`
 	Params    interface{} `yaml:"-"`
 	Start     bool        `yaml:"start"`
+	// Names of the VMs to be created before this one, e.g. the master before the workers.
+	DependsOn []string `yaml:"depends_on" mapstructure:"depends_on"`
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-func ParseProxmoxBasicArchetypeParams(data interface{}) (*proxmoxBasicArchetypeParams, error) {
+func ParseProxmoxBasicArchetypeParams(data interface{}, weak bool) (*proxmoxBasicArchetypeParams, error) {
 	p := new(proxmoxBasicArchetypeParams)
-	if err := mapstructure.Decode(data, p); err != nil {
+	if err := decode(data, p, weak); err != nil {
 		return nil, fmt.Errorf("failed to parse proxmox basic params: %s", err.Error())
 	}
 
@@ -121,8 +192,29 @@ func ParseProxmoxBasicArchetypeParams(data interface{}) (*proxmoxBasicArchetypeP
 		return nil, fmt.Errorf("malformed memory size %s", p.Memory)
 	}
 
-	if ok, err := regexp.MatchString("^\\d+[MmGg]$", p.Drive.Size); err != nil || !ok {
-		return nil, fmt.Errorf("malformed drive size %s", p.Drive.Size)
+	// with disks, drive.size is optional.
+	if len(p.Disks) == 0 || len(p.Drive.Size) > 0 {
+		if ok, err := regexp.MatchString("^\\d+[MmGg]$", p.Drive.Size); err != nil || !ok {
+			return nil, fmt.Errorf("malformed drive size %s", p.Drive.Size)
+		}
+	}
+	for _, disk := range p.Disks {
+		if len(disk.Store) == 0 {
+			return nil, errors.New("disk without store")
+		}
+		if ok, err := regexp.MatchString("^\\d+[MmGg]$", disk.Size); err != nil || !ok {
+			return nil, fmt.Errorf("malformed disk size %s", disk.Size)
+		}
+	}
+	for _, nic := range p.Nics {
+		if len(nic.Bridge) == 0 {
+			return nil, errors.New("nic without bridge")
+		}
+		if len(nic.MacAddr) > 0 {
+			if _, err := net.ParseMAC(nic.MacAddr); err != nil {
+				return nil, fmt.Errorf("malformed mac address %s", nic.MacAddr)
+			}
+		}
 	}
 
 	ips := []string{p.Network.Ip, p.Network.Mask, p.Network.Gateway}
@@ -143,6 +235,32 @@ type proxmoxBasicArchetypeParams struct {
 		Store string `yaml:"store"`
 		Size  string `yaml:"size"`
 	} `yaml:"drive"`
+	// Only used by the basic archetype. Replaces drive, the first disk is the system drive.
+	Disks []struct {
+		Store    string `yaml:"store"`
+		Size     string `yaml:"size"`
+		SSD      bool   `yaml:"ssd"`
+		Discard  bool   `yaml:"discard"`
+		IOThread bool   `yaml:"iothread"`
+	} `yaml:"disks"`
+	// Only used by the basic archetype. Replaces network.interface, the network settings apply to the first nic.
+	Nics []struct {
+		Bridge   string `yaml:"bridge"`
+		Model    string `yaml:"model"`
+		Tag      int    `yaml:"tag"`
+		MacAddr  string `yaml:"macaddr"`
+		Firewall bool   `yaml:"firewall"`
+	} `yaml:"nics"`
+	// Only used by the basic archetype. Empty values use the defaults of the archetype.
+	Machine struct {
+		Type    string `yaml:"type"`
+		CpuType string `yaml:"cputype"`
+		Sockets int    `yaml:"sockets"`
+		// Either seabios or ovmf.
+		Bios string `yaml:"bios"`
+		// Storage of the EFI disk of ovmf, defaults to the store of the system drive.
+		EfiDisk string `yaml:"efidisk"`
+	} `yaml:"machine"`
 	Network struct {
 		Interface string   `yaml:"interface"`
 		Ip        string   `yaml:"ip"`
@@ -157,45 +275,267 @@ type proxmoxBasicArchetypeParams struct {
 		Hostname string `yaml:"hostname"`
 		Domain   string `yaml:"domain"`
 	} `yaml:"system"`
+	// Only used by the cloudinit archetype.
+	CloudInit struct {
+		// Volume or absolute path on the node of the cloud image to import, unless a template is cloned.
+		Image   string   `yaml:"image"`
+		Full    bool     `yaml:"full"`
+		SshKeys []string `yaml:"sshkeys"`
+	} `yaml:"cloudinit"`
+}
+
+// Maps the system and network blocks onto cloud-init settings. The host name is the VM name, and the
+// timezone is left to the image, as Proxmox does not pass it to cloud-init.
+func (p *proxmoxBasicArchetypeParams) CloudInitSettings() proxmoxvm.CloudInit {
+	prefix, _ := net.IPMask(net.ParseIP(p.Network.Mask).To4()).Size()
+	return proxmoxvm.CloudInit{
+		User:         p.System.Username,
+		Password:     p.System.Password,
+		SshKeys:      strings.Join(p.CloudInit.SshKeys, "\n"),
+		Ip:           fmt.Sprintf("%s/%d", p.Network.Ip, prefix),
+		Gateway:      p.Network.Gateway,
+		Dns:          p.Network.Dns,
+		SearchDomain: p.System.Domain,
+	}
 }
 
 func (p *proxmoxBasicArchetypeParams) MemoryMB() int {
-	amount, unit, err := p.amountAndUnit(p.Memory)
+	v, _ := sizeMB(p.Memory)
+	return v
+}
+
+// Returns the size of the system drive, or zero if not set, which is allowed with disks and keeps the
+// size of the image for the cloudinit archetype.
+func (p *proxmoxBasicArchetypeParams) DriveGB() int {
+	if len(p.Drive.Size) == 0 {
+		return 0
+	}
+	v, _ := sizeGB(p.Drive.Size)
+	return v
+}
+
+func (p *proxmoxBasicArchetypeParams) DiskDevices() []proxmoxvm.Disk {
+	disks := make([]proxmoxvm.Disk, 0, len(p.Disks))
+	for _, d := range p.Disks {
+		size, _ := sizeGB(d.Size)
+		disks = append(disks, proxmoxvm.Disk{
+			Storage:  d.Store,
+			Size:     size,
+			SSD:      d.SSD,
+			Discard:  d.Discard,
+			IOThread: d.IOThread,
+		})
+	}
+	return disks
+}
+
+func (p *proxmoxBasicArchetypeParams) NicDevices() []proxmoxvm.Nic {
+	nics := make([]proxmoxvm.Nic, 0, len(p.Nics))
+	for _, n := range p.Nics {
+		nics = append(nics, proxmoxvm.Nic{
+			Model:    n.Model,
+			Bridge:   n.Bridge,
+			Tag:      n.Tag,
+			MacAddr:  n.MacAddr,
+			Firewall: n.Firewall,
+		})
+	}
+	return nics
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func ParseProxmoxCloneArchetypeParams(data interface{}, weak bool) (*proxmoxCloneArchetypeParams, error) {
+	p := new(proxmoxCloneArchetypeParams)
+	if data == nil {
+		return p, nil
+	}
+	if err := decode(data, p, weak); err != nil {
+		return nil, fmt.Errorf("failed to parse proxmox clone params: %s", err.Error())
+	}
+
+	if ok, err := regexp.MatchString("^(\\d+[MmGg])?$", p.Memory); err != nil || !ok {
+		return nil, fmt.Errorf("malformed memory size %s", p.Memory)
+	}
+
+	if ok, err := regexp.MatchString("^(\\d+[MmGg])?$", p.Drive.Size); err != nil || !ok {
+		return nil, fmt.Errorf("malformed drive size %s", p.Drive.Size)
+	}
+
+	return p, nil
+}
+
+// Overrides of a VM cloned from a template. Empty values keep the value of the template.
+type proxmoxCloneArchetypeParams struct {
+	Full    bool   `yaml:"full"`
+	Storage string `yaml:"storage"`
+	Cpu     int    `yaml:"cpu"`
+	Memory  string `yaml:"memory"`
+	Drive   struct {
+		Size string `yaml:"size"`
+	} `yaml:"drive"`
+	Network struct {
+		Interface string `yaml:"interface"`
+	} `yaml:"network"`
+}
+
+func (p *proxmoxCloneArchetypeParams) MemoryMB() int {
+	if len(p.Memory) == 0 {
+		return 0
+	}
+	v, _ := sizeMB(p.Memory)
+	return v
+}
+
+func (p *proxmoxCloneArchetypeParams) DriveGB() int {
+	if len(p.Drive.Size) == 0 {
+		return 0
+	}
+	v, _ := sizeGB(p.Drive.Size)
+	return v
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func ParseProxmoxLxcParams(data interface{}, weak bool) (*proxmoxLxcParams, error) {
+	p := new(proxmoxLxcParams)
+	if err := decode(data, p, weak); err != nil {
+		return nil, fmt.Errorf("failed to parse proxmox lxc params: %s", err.Error())
+	}
+
+	if ok, err := regexp.MatchString("^\\d+[MmGg]$", p.Memory); err != nil || !ok {
+		return nil, fmt.Errorf("malformed memory size %s", p.Memory)
+	}
+
+	if ok, err := regexp.MatchString("^(\\d+[MmGg])?$", p.Swap); err != nil || !ok {
+		return nil, fmt.Errorf("malformed swap size %s", p.Swap)
+	}
+
+	if ok, err := regexp.MatchString("^\\d+[MmGg]$", p.Drive.Size); err != nil || !ok {
+		return nil, fmt.Errorf("malformed drive size %s", p.Drive.Size)
+	}
+
+	if len(p.Network.Ip) == 0 {
+		p.Network.Ip = lxcDhcp
+	}
+	ips := append([]string{}, p.Network.Dns...)
+	if p.Network.Ip != lxcDhcp {
+		ips = append(ips, p.Network.Ip, p.Network.Mask)
+		if len(p.Network.Gateway) > 0 {
+			ips = append(ips, p.Network.Gateway)
+		}
+	}
+	for _, ip := range ips {
+		if ok, err := regexp.MatchString("^(?:[0-9]{1,3}\\.){3}[0-9]{1,3}$", ip); err != nil || !ok {
+			return nil, fmt.Errorf("malformed ip address %s", ip)
+		}
+	}
+
+	return p, nil
+}
+
+// Parameters of a container. The root file system is placed on the drive store.
+type proxmoxLxcParams struct {
+	Cpu    int    `yaml:"cpu"`
+	Memory string `yaml:"memory"`
+	// Swap size, defaults to no swap.
+	Swap  string `yaml:"swap"`
+	Drive struct {
+		Store string `yaml:"store"`
+		Size  string `yaml:"size"`
+	} `yaml:"drive"`
+	Network struct {
+		Interface string `yaml:"interface"`
+		// Either dhcp (default), or an address together with mask.
+		Ip      string   `yaml:"ip"`
+		Mask    string   `yaml:"mask"`
+		Gateway string   `yaml:"gateway"`
+		Dns     []string `yaml:"dns"`
+	} `yaml:"network"`
+	System struct {
+		Password string `yaml:"password"`
+		Hostname string `yaml:"hostname"`
+		Domain   string `yaml:"domain"`
+	} `yaml:"system"`
+	SshKeys []string `yaml:"sshkeys"`
+	// Containers are unprivileged unless set.
+	Privileged bool `yaml:"privileged"`
+	// Allows nested containers, e.g. docker.
+	Nesting bool `yaml:"nesting"`
+}
+
+// Returns the address of the container in CIDR notation, or dhcp.
+func (p *proxmoxLxcParams) IpCIDR() string {
+	if p.Network.Ip == lxcDhcp {
+		return lxcDhcp
+	}
+	prefix, _ := net.IPMask(net.ParseIP(p.Network.Mask).To4()).Size()
+	return fmt.Sprintf("%s/%d", p.Network.Ip, prefix)
+}
+
+func (p *proxmoxLxcParams) MemoryMB() int {
+	v, _ := sizeMB(p.Memory)
+	return v
+}
+
+func (p *proxmoxLxcParams) SwapMB() int {
+	if len(p.Swap) == 0 {
+		return 0
+	}
+	v, _ := sizeMB(p.Swap)
+	return v
+}
+
+func (p *proxmoxLxcParams) DriveGB() int {
+	v, _ := sizeGB(p.Drive.Size)
+	return v
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Returns the size in MB of a size like 512M or 8G. Sizes of parsed params are validated, so the
+// methods of the params ignore the error.
+func sizeMB(value string) (int, error) {
+	amount, unit, err := amountAndUnit(value)
 	if err != nil {
-		panic("invalid state: memory size not a number")
+		return 0, err
 	}
 
 	switch strings.ToUpper(unit) {
 	case "M":
-		return amount
+		return amount, nil
 	case "G":
-		return amount * 1024
+		return amount * 1024, nil
 	default:
-		panic("invalid state: unsupported memory unit")
+		return 0, fmt.Errorf("unsupported unit of size %s", value)
 	}
 }
 
-func (p *proxmoxBasicArchetypeParams) DriveGB() int {
-	amount, unit, err := p.amountAndUnit(p.Drive.Size)
+// Returns the size in GB of a size like 512M or 8G, see sizeMB.
+func sizeGB(value string) (int, error) {
+	amount, unit, err := amountAndUnit(value)
 	if err != nil {
-		panic("invalid state: drive size not a number")
+		return 0, err
 	}
 
 	switch strings.ToUpper(unit) {
 	case "M":
-		return amount / 1024
+		return amount / 1024, nil
 	case "G":
-		return amount
+		return amount, nil
 	default:
-		panic("invalid state: unsupported drive size unit")
+		return 0, fmt.Errorf("unsupported unit of size %s", value)
 	}
 }
 
-func (p *proxmoxBasicArchetypeParams) amountAndUnit(value string) (int, string, error) {
+func amountAndUnit(value string) (int, string, error) {
+	if len(value) < 2 {
+		return 0, "", fmt.Errorf("malformed size %s", value)
+	}
 	amount, unit := value[:len(value)-1], value[len(value)-1:]
 	i, err := strconv.Atoi(amount)
 	if err != nil {
-		return 0, "", err
+		return 0, "", fmt.Errorf("malformed size %s", value)
 	}
 	return i, unit, nil
 }
@@ -203,6 +543,11 @@ func (p *proxmoxBasicArchetypeParams) amountAndUnit(value string) (int, string,
 // ---------------------------------------------------------------------------------------------------------------------
 
 const (
-	keyVMs         = "vms"
-	basicArchetype = "basic"
+	keyVMs             = "vms"
+	basicArchetype     = "basic"
+	cloneArchetype     = "clone"
+	cloudInitArchetype = "cloudinit"
+	kindQemu           = "qemu"
+	kindLxc            = "lxc"
+	lxcDhcp            = "dhcp"
 )
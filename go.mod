@@ -1,5 +1,7 @@
 module github.com/xeha-gmbh/homelab
 
+go 1.11
+
 require (
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/lithammer/dedent v1.0.0
@@ -1,6 +1,8 @@
 package auto
 
 import (
+	"context"
+	"fmt"
 	"github.com/xeha-gmbh/homelab/iso/auto/api"
 	. "github.com/xeha-gmbh/homelab/shared"
 	"github.com/lithammer/dedent"
@@ -35,6 +37,10 @@ type Payload struct {
 	NetMask     string `json:"net_mask"`
 	Gateway     string `json:"gateway"`
 	NameServers string `json:"name_servers"`
+	// If set, the settings of the system, i.e. timezone, user, hostname, domain and network, are not part of
+	// the remastered media, but read from a seed medium (see MakeSeedMedium) in the second CD drive. One
+	// media then serves any number of systems.
+	SeedMedium bool `json:"seed_medium"`
 }
 
 func NewIsoAutoCommand() *cobra.Command {
@@ -61,52 +67,33 @@ func NewIsoAutoCommand() *cobra.Command {
 			return nil
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			for _, provider := range []Provider{
-				&UbuntuPreseedProvider{},
-			} {
-				if !provider.SupportsFlavor(payload.Flavor) {
-					continue
-				}
-
-				if _, err := provider.CheckDependencies(payload); err != nil {
-					output.Debug("Skipped provider {{index .providerName}} due to unmet dependency: {{index .cause}}",
-						map[string]interface{}{
-							"event":        "provider-skipped",
-							"providerName": provider.Name(),
-							"cause":        err.Error(),
-						})
-					continue
-				}
-
-				outputPath, err := provider.RemasterISO(payload)
-				if err != nil {
-					output.Fatal(ErrOp.ExitCode,
-						"Provider {{index .providerName}} failed to remaster ISO. Cause: {{index .cause}}.",
-						map[string]interface{}{
-							"event":        "remaster-failed",
-							"providerName": provider.Name(),
-							"cause":        err.Error(),
-						})
-					return ErrOp
-				}
-
-				output.Info("Provider {{index .providerName}} successfully remastered ISO to {{index .outputPath}}.",
+			outputPath, err := Remaster(WithPrinter(context.Background(), output), payload)
+			switch err {
+			case nil:
+				output.Info("Successfully remastered ISO to {{index .outputPath}}.",
 					map[string]interface{}{
-						"event":        "remaster-success",
-						"providerName": provider.Name(),
-						"outputPath":   outputPath,
-						"payload":      payload,
+						"event":      "remaster-success",
+						"outputPath": outputPath,
+						"payload":    payload,
 					})
 				return nil
+			case ErrNoProvider:
+				output.Fatal(ErrNoProvider.ExitCode,
+					"No provider can handle flavor {{index .flavor}}",
+					map[string]interface{}{
+						"event":  "no-provider",
+						"flavor": payload.Flavor,
+					})
+				return ErrNoProvider
+			default:
+				output.Fatal(ErrOp.ExitCode,
+					"Failed to remaster ISO. Cause: {{index .cause}}.",
+					map[string]interface{}{
+						"event": "remaster-failed",
+						"cause": err.Error(),
+					})
+				return ErrOp
 			}
-
-			output.Fatal(ErrNoProvider.ExitCode,
-				"No provider can handle flavor {{index .flavor}}",
-				map[string]interface{}{
-					"event":  "no-provider",
-					"flavor": payload.Flavor,
-				})
-			return ErrNoProvider
 		},
 	}
 
@@ -117,6 +104,66 @@ func NewIsoAutoCommand() *cobra.Command {
 	return cmd
 }
 
+// Remasters the ISO with the first provider supporting Payload#Flavor and having all dependencies met.
+// Returns the path to the remastered ISO, or ErrNoProvider if no provider can handle the flavor.
+func Remaster(ctx context.Context, payload *Payload) (string, error) {
+	output := Printer(ctx)
+
+	for _, provider := range []Provider{
+		&UbuntuPreseedProvider{},
+	} {
+		if !provider.SupportsFlavor(payload.Flavor) {
+			continue
+		}
+
+		if _, err := provider.CheckDependencies(payload); err != nil {
+			output.Debug("Skipped provider {{index .providerName}} due to unmet dependency: {{index .cause}}",
+				map[string]interface{}{
+					"event":        "provider-skipped",
+					"providerName": provider.Name(),
+					"cause":        err.Error(),
+				})
+			continue
+		}
+
+		outputPath, err := provider.RemasterISO(ctx, payload)
+		if err != nil {
+			return "", fmt.Errorf("provider %s failed to remaster ISO: %s", provider.Name(), err.Error())
+		}
+
+		output.Debug("Provider {{index .providerName}} remastered ISO to {{index .outputPath}}.",
+			map[string]interface{}{
+				"event":        "provider-remastered",
+				"providerName": provider.Name(),
+				"outputPath":   outputPath,
+			})
+		return outputPath, nil
+	}
+
+	return "", ErrNoProvider
+}
+
+// Makes the seed medium carrying the settings of a system in Payload, for media remastered with
+// Payload#SeedMedium, using the first provider supporting Payload#Flavor. Returns the path to the seed
+// medium, or ErrNoProvider if no provider can handle the flavor.
+func MakeSeedMedium(ctx context.Context, payload *Payload, outputIso string) (string, error) {
+	for _, provider := range []Provider{
+		&UbuntuPreseedProvider{},
+	} {
+		if !provider.SupportsFlavor(payload.Flavor) {
+			continue
+		}
+
+		outputPath, err := provider.MakeSeedMedium(ctx, payload, outputIso)
+		if err != nil {
+			return "", fmt.Errorf("provider %s failed to make seed medium: %s", provider.Name(), err.Error())
+		}
+		return outputPath, nil
+	}
+
+	return "", ErrNoProvider
+}
+
 // Mark required auto command flags
 func markIsoAutoCommandRequiredFlags(cmd *cobra.Command) {
 	for _, f := range []string{
@@ -1,5 +1,7 @@
 package auto
 
+import "context"
+
 // Provider for creating unattended iso.
 type Provider interface {
 	// Name of the provider
@@ -9,5 +11,7 @@ type Provider interface {
 	// Returns true if all the underlying package dependencies have been met.
 	CheckDependencies(payload *Payload) (bool, error)
 	// Process the ISO to create an unattended installation media
-	RemasterISO(payload *Payload) (string, error)
+	RemasterISO(ctx context.Context, payload *Payload) (string, error)
+	// Makes the seed medium of the system described by the payload, for media remastered with Payload#SeedMedium
+	MakeSeedMedium(ctx context.Context, payload *Payload, outputIso string) (string, error)
 }
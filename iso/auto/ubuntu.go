@@ -1,8 +1,10 @@
 package auto
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
@@ -25,6 +27,11 @@ const (
 
 	preseedName = "imulab.seed"
 
+	// the seed medium is attached as another CD drive, and found by its label or its preseed file.
+	seedMediumName  = "homelab.seed"
+	seedMediumLabel = "HOMELAB_SEED"
+	seedMediumMount = "/media/seed"
+
 	flagSeed      = "--seed"
 	flagFlavor    = "--flavor"
 	flagInput     = "--input"
@@ -59,15 +66,16 @@ func (p *UbuntuPreseedProvider) CheckDependencies(payload *Payload) (bool, error
 	return true, nil
 }
 
-func (p *UbuntuPreseedProvider) RemasterISO(payload *Payload) (string, error) {
-	// update flavor to adapt to the script '--flavor|-v' parameter
+func (p *UbuntuPreseedProvider) RemasterISO(ctx context.Context, payload *Payload) (string, error) {
+	// adapt flavor to the script '--flavor|-v' parameter
+	var flavor string
 	switch payload.Flavor {
 	case flavorUbuntuBionic64NonLive:
-		payload.Flavor = flavorBionic64
+		flavor = flavorBionic64
 	case flavorUbuntuXenial64:
-		payload.Flavor = flavorXenial64
+		flavor = flavorXenial64
 	default:
-		payload.Flavor = "-"
+		flavor = "-"
 	}
 
 	// parse template
@@ -79,7 +87,7 @@ func (p *UbuntuPreseedProvider) RemasterISO(payload *Payload) (string, error) {
 	// prepare arguments
 	args := []string{
 		flagSeed, parsedSeed,
-		flagFlavor, payload.Flavor,
+		flagFlavor, flavor,
 		flagWorkspace, payload.Workspace,
 		flagInput, payload.InputIso,
 		flagOutput, payload.OutputIso,
@@ -95,7 +103,7 @@ func (p *UbuntuPreseedProvider) RemasterISO(payload *Payload) (string, error) {
 	}
 
 	// execute command
-	remaster := exec.Command(filepath.Join(payload.Workspace, preseedScript), args...)
+	remaster := exec.CommandContext(ctx, filepath.Join(payload.Workspace, preseedScript), args...)
 	remaster.Stdout = os.Stdout
 	remaster.Stderr = os.Stderr
 	if err := remaster.Start(); err != nil {
@@ -131,9 +139,55 @@ func (p *UbuntuPreseedProvider) parseTemplateAndWriteToFile(payload *Payload) (s
 		return "", err
 	}
 
+	// preseed files included later override the settings of earlier ones.
+	if payload.SeedMedium {
+		if _, err = fmt.Fprintf(targetFile, seedMediumInclude, seedMediumMount, seedMediumLabel, seedMediumName); err != nil {
+			return "", err
+		}
+	}
+
 	return targetPath, nil
 }
 
+// Renders the settings of the system into a preseed file, and packs it into an ISO image with mkisofs,
+// or genisoimage as it is called on recent distributions.
+func (p *UbuntuPreseedProvider) MakeSeedMedium(ctx context.Context, payload *Payload, outputIso string) (string, error) {
+	var mkisofs string
+	for _, name := range []string{"mkisofs", "genisoimage"} {
+		if path, err := exec.LookPath(name); err == nil {
+			mkisofs = path
+			break
+		}
+	}
+	if len(mkisofs) == 0 {
+		return "", fmt.Errorf("making a seed medium requires mkisofs or genisoimage")
+	}
+
+	dir, err := ioutil.TempDir(payload.Workspace, "seed")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	seed, err := os.Create(filepath.Join(dir, seedMediumName))
+	if err != nil {
+		return "", err
+	}
+	err = template.Must(template.New(seedMediumName).Parse(seedMediumTemplate)).Execute(seed, payload)
+	if closeErr := seed.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.CommandContext(ctx, mkisofs, "-quiet", "-J", "-r", "-V", seedMediumLabel, "-o", outputIso, dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(string(out)))
+	}
+	return outputIso, nil
+}
+
 func (p *UbuntuPreseedProvider) downloadDefaultPreseedTemplate(workspace string) error {
 	if err := p.download(workspace, preseedDefaultTemplate, preseedDefaultTemplateUrl); err != nil {
 		return err
@@ -178,3 +232,35 @@ func (p *UbuntuPreseedProvider) download(workspace, filename, url string) error
 
 	return nil
 }
+
+// Mounts the seed medium and includes its preseed file. The medium is looked up by its label, and else by
+// probing the CD drives for the preseed file, as the device name depends on the drives of the machine.
+const seedMediumInclude = `
+# settings of the system, read from the seed medium
+d-i preseed/include_command string mkdir -p %[1]s; for dev in /dev/disk/by-label/%[2]s /dev/sr*; do [ -b $dev ] || continue; mount -t iso9660 -o ro $dev %[1]s 2>/dev/null || continue; [ -f %[1]s/%[3]s ] && break; umount %[1]s; done; [ -f %[1]s/%[3]s ] && echo %[1]s/%[3]s
+`
+
+// Settings of the system on the seed medium, overriding those of the installation media.
+const seedMediumTemplate = `# network settings
+{{if eq .IpAddress ""}}
+d-i netcfg/dhcp_timeout                                     string      5
+{{else}}
+d-i netcfg/disable_autoconfig                               boolean     true
+d-i netcfg/get_ipaddress                                    string      {{.IpAddress}}
+d-i netcfg/get_netmask                                      string      {{.NetMask}}
+d-i netcfg/get_gateway                                      string      {{.Gateway}}
+d-i netcfg/get_nameservers                                  string      {{.NameServers}}
+d-i netcfg/confirm_static                                   boolean     true
+{{end}}
+d-i netcfg/get_hostname                                     string      {{.Hostname}}
+d-i netcfg/get_domain                                       string      {{.Domain}}
+
+# clock and timezone settings
+d-i time/zone                                               string      {{.Timezone}}
+
+# user account setup
+d-i passwd/user-fullname                                    string      {{.Username}}
+d-i passwd/username                                         string      {{.Username}}
+d-i passwd/user-password                                    password    {{.Password}}
+d-i passwd/user-password-again                              password    {{.Password}}
+`
@@ -1,7 +1,8 @@
 package get
 
 import (
-	"errors"
+	"context"
+	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -36,6 +37,11 @@ type IsoGetPayload struct {
 	Reuse     bool
 }
 
+var (
+	ErrUnsupportedFlavor = ErrorFactory(1)("unsupported_flavor")
+	ErrDownload          = ErrorFactory(2)("download_error")
+)
+
 func NewIsoGetCommand() *cobra.Command {
 	payload := new(IsoGetPayload)
 
@@ -47,78 +53,34 @@ func NewIsoGetCommand() *cobra.Command {
 			return cmd.ParseFlags(args)
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			var (
-				filename    string
-				downloadUrl string
-			)
-
-			switch payload.Flavor {
-			case flavorUbuntuBionic64Live:
-				downloadUrl = flavorUbuntuBionic64LiveUrl
-				filename = filepath.Join(payload.TargetDir, flavorUbuntuBionic64LiveUrl[strings.LastIndex(flavorUbuntuBionic64LiveUrl, "/")+1:])
-			case flavorUbuntuBionic64NonLive:
-				downloadUrl = flavorUbuntuBionic64NonLiveUrl
-				filename = filepath.Join(payload.TargetDir, flavorUbuntuBionic64NonLiveUrl[strings.LastIndex(flavorUbuntuBionic64NonLiveUrl, "/")+1:])
-			case flavorUbuntuXenial64:
-				downloadUrl = flavorUbuntuXenial64Url
-				filename = filepath.Join(payload.TargetDir, flavorUbuntuXenial64Url[strings.LastIndex(flavorUbuntuXenial64Url, "/")+1:])
-			default:
-				WithConfig(cmd, &payload.ExtraArgs).Fatal(
-					1,
+			output := WithConfig(cmd, &payload.ExtraArgs)
+
+			_, err := Get(WithPrinter(context.Background(), output), payload)
+			switch err {
+			case nil:
+				return nil
+			case ErrUnsupportedFlavor:
+				output.Fatal(
+					ErrUnsupportedFlavor.ExitCode,
 					"Flavor {{index .flavor}} is not supported.",
 					map[string]interface{}{
 						"event":     "unsupported_flavor",
 						"flavor":    payload.Flavor,
-						"exit-code": 1,
-					})
-				return errors.New("unsupported_flavor")
-			}
-
-			if _, err := os.Stat(filename); !os.IsNotExist(err) && payload.Reuse {
-				WithConfig(cmd, &payload.ExtraArgs).Info(
-					"Reused file at {{index .file}}, no download was executed.",
-					map[string]interface{}{
-						"event": "reused_file",
-						"file":  filename,
-						"reuse": payload.Reuse,
+						"exit-code": ErrUnsupportedFlavor.ExitCode,
 					})
-				return nil
-			}
-
-			wgetArgs := []string{"-O", filename, downloadUrl}
-			if !payload.Debug {
-				wgetArgs = append([]string{"-q"}, wgetArgs...)
-			}
-			wget := exec.Command("wget", wgetArgs...)
-			wget.Stdout = cmd.OutOrStdout()
-			wget.Stderr = cmd.OutOrStderr()
-			WithConfig(cmd, &payload.ExtraArgs).Debug(
-				"Downloading from {{index .url}}, please wait.",
-				map[string]interface{}{
-					"event": "download_in_progress",
-					"url":   downloadUrl,
-				})
-			if err := wget.Run(); err != nil {
-				WithConfig(cmd, &payload.ExtraArgs).Fatal(
-					2,
-					"Download from {{index .url}} failed. Cause: {{index .cause}}",
+				return ErrUnsupportedFlavor
+			default:
+				output.Fatal(
+					ErrDownload.ExitCode,
+					"Download of {{index .flavor}} failed. Cause: {{index .cause}}",
 					map[string]interface{}{
 						"event":     "download_error",
-						"url":       downloadUrl,
+						"flavor":    payload.Flavor,
 						"cause":     err.Error(),
-						"exit-code": 2,
+						"exit-code": ErrDownload.ExitCode,
 					})
-				return errors.New("download_error")
+				return ErrDownload
 			}
-
-			WithConfig(cmd, &payload.ExtraArgs).Info(
-				"Image {{index .flavor}} downloaded to {{index .file}}.",
-				map[string]interface{}{
-					"event":  "download_success",
-					"flavor": payload.Flavor,
-					"file":   filename,
-				})
-			return nil
 		},
 	}
 
@@ -129,6 +91,71 @@ func NewIsoGetCommand() *cobra.Command {
 	return cmd
 }
 
+// Downloads the image of IsoGetPayload#Flavor into IsoGetPayload#TargetDir and returns the path
+// to the downloaded file. If IsoGetPayload#Reuse is set, an existing file is returned without download.
+func Get(ctx context.Context, payload *IsoGetPayload) (string, error) {
+	var (
+		output      = Printer(ctx)
+		downloadUrl = FlavorUrl(payload.Flavor)
+	)
+
+	if len(downloadUrl) == 0 {
+		return "", ErrUnsupportedFlavor
+	}
+	filename := filepath.Join(payload.TargetDir, downloadUrl[strings.LastIndex(downloadUrl, "/")+1:])
+
+	if _, err := os.Stat(filename); !os.IsNotExist(err) && payload.Reuse {
+		output.Info(
+			"Reused file at {{index .file}}, no download was executed.",
+			map[string]interface{}{
+				"event": "reused_file",
+				"file":  filename,
+				"reuse": payload.Reuse,
+			})
+		return filename, nil
+	}
+
+	wgetArgs := []string{"-O", filename, downloadUrl}
+	if !payload.Debug {
+		wgetArgs = append([]string{"-q"}, wgetArgs...)
+	}
+	wget := exec.CommandContext(ctx, "wget", wgetArgs...)
+	wget.Stdout = os.Stdout
+	wget.Stderr = os.Stderr
+	output.Debug(
+		"Downloading from {{index .url}}, please wait.",
+		map[string]interface{}{
+			"event": "download_in_progress",
+			"url":   downloadUrl,
+		})
+	if err := wget.Run(); err != nil {
+		return "", fmt.Errorf("download from %s failed: %s", downloadUrl, err.Error())
+	}
+
+	output.Info(
+		"Image {{index .flavor}} downloaded to {{index .file}}.",
+		map[string]interface{}{
+			"event":  "download_success",
+			"flavor": payload.Flavor,
+			"file":   filename,
+		})
+	return filename, nil
+}
+
+// Returns the download url of the flavor, or an empty string if the flavor is not supported.
+func FlavorUrl(flavor string) string {
+	switch flavor {
+	case flavorUbuntuBionic64Live:
+		return flavorUbuntuBionic64LiveUrl
+	case flavorUbuntuBionic64NonLive:
+		return flavorUbuntuBionic64NonLiveUrl
+	case flavorUbuntuXenial64:
+		return flavorUbuntuXenial64Url
+	default:
+		return ""
+	}
+}
+
 func markIsoGetCommandRequiredFlags(cmd *cobra.Command) {
 	cmd.MarkFlagRequired(flagFlavor)
 }
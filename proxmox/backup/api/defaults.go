@@ -0,0 +1,8 @@
+package api
+
+const (
+	DefaultMode     = "snapshot"
+	DefaultCompress = "zstd"
+	// Content type of backups in storage listings.
+	ContentBackup = "backup"
+)
@@ -0,0 +1,19 @@
+package api
+
+const (
+	FlagNode        = "node"
+	FlagStorage     = "storage"
+	FlagMode        = "mode"
+	FlagCompress    = "compress"
+	FlagNotes       = "notes"
+	FlagVmId        = "vmid"
+	FlagForce       = "force"
+	FlagUnique      = "unique"
+	FlagKeepLast    = "keep-last"
+	FlagKeepHourly  = "keep-hourly"
+	FlagKeepDaily   = "keep-daily"
+	FlagKeepWeekly  = "keep-weekly"
+	FlagKeepMonthly = "keep-monthly"
+	FlagKeepYearly  = "keep-yearly"
+	FlagDryRun      = "dry-run"
+)
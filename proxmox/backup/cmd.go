@@ -0,0 +1,275 @@
+package backup
+
+import (
+	"os"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/xeha-gmbh/homelab/proxmox/backup/api"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+var (
+	output shared.MessagePrinter
+)
+
+// Returns the 'backup' command, backing up and restoring virtual machines with vzdump.
+func NewProxmoxBackupCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "back up and restore Proxmox virtual machines",
+	}
+
+	cmd.AddCommand(newCreateCommand())
+	cmd.AddCommand(newListCommand())
+	cmd.AddCommand(newRestoreCommand())
+	cmd.AddCommand(newPruneCommand())
+
+	return cmd
+}
+
+func newCreateCommand() *cobra.Command {
+	payload := &CreateRequest{}
+
+	cmd := &cobra.Command{
+		Use:     "create <vmid|name>",
+		Short:   "back up a virtual machine with vzdump",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: preRun(&payload.ExtraArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			payload.VM = args[0]
+
+			result, err := Create(common.CommandContext(cmd, output), payload)
+			if err != nil {
+				return reportError("backup_create_failed", "Backup of vm {{index .vm}} failed. Cause: {{index .cause}}",
+					map[string]interface{}{"vm": payload.VM}, err)
+			}
+
+			output.Info("Backup of vm {{index .id}} submitted.",
+				map[string]interface{}{
+					"event": "backup_create_success",
+					"id":    result.VmId,
+					"node":  result.Node,
+					"upid":  result.Upid,
+				})
+			return nil
+		},
+	}
+
+	payload.InjectExtraArgs(cmd)
+	payload.InjectWaitArgs(cmd)
+	cmd.Flags().StringVar(&payload.Node, api.FlagNode, "",
+		"The node of the virtual machine. Discovered from the cluster if not set.")
+	cmd.Flags().StringVar(&payload.Storage, api.FlagStorage, "",
+		"The storage device to write the backup to. Defaults to the storage configured for vzdump on the node.")
+	cmd.Flags().StringVar(&payload.Mode, api.FlagMode, api.DefaultMode,
+		"The backup mode, one of snapshot, suspend and stop.")
+	cmd.Flags().StringVar(&payload.Compress, api.FlagCompress, api.DefaultCompress,
+		"The compression of the backup, one of none, lzo, gzip and zstd.")
+	cmd.Flags().StringVar(&payload.Notes, api.FlagNotes, "",
+		"Notes attached to the backup. Requires Proxmox VE 7.2 or later.")
+
+	return cmd
+}
+
+func newListCommand() *cobra.Command {
+	payload := &ListRequest{}
+
+	cmd := &cobra.Command{
+		Use:     "list",
+		Short:   "list the backups on a node",
+		PreRunE: preRun(&payload.ExtraArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			backups, err := List(common.CommandContext(cmd, output), payload)
+			if err != nil {
+				return reportError("backup_list_failed", "Failed to list backups of node {{index .node}}. Cause: {{index .cause}}",
+					map[string]interface{}{"node": payload.Node}, err)
+			}
+
+			for _, backup := range backups {
+				output.Info("{{index .volid}}\t{{index .id}}\t{{index .size}}\t{{index .time}}",
+					map[string]interface{}{
+						"event":  "backup",
+						"volid":  backup.Volid,
+						"id":     backup.VmId.String(),
+						"format": backup.Format,
+						"size":   int64(backup.Size),
+						"time":   time.Unix(int64(backup.Ctime), 0).Format(time.RFC3339),
+						"notes":  backup.Notes,
+					})
+			}
+			return nil
+		},
+	}
+
+	payload.InjectExtraArgs(cmd)
+	cmd.Flags().StringVar(&payload.Node, api.FlagNode, "",
+		"The node whose backups are listed. Required.")
+	cmd.Flags().StringVar(&payload.Storage, api.FlagStorage, "",
+		"Only list backups on this storage device. Defaults to all storage devices holding backups.")
+	cmd.Flags().StringVar(&payload.VmId, api.FlagVmId, "",
+		"Only list backups of this virtual machine.")
+	cmd.MarkFlagRequired(api.FlagNode)
+
+	return cmd
+}
+
+func newRestoreCommand() *cobra.Command {
+	payload := &RestoreRequest{}
+
+	cmd := &cobra.Command{
+		Use:   "restore <volid>",
+		Short: "restore a virtual machine from a backup",
+		Long: dedent.Dedent(`
+			Restores a backup into a new virtual machine --vmid, or overwrites the stopped virtual machine
+			--vmid if --force is given. All disks are placed on --storage if set, otherwise on the storage
+			devices they were backed up from.
+		`),
+		Args:    cobra.ExactArgs(1),
+		PreRunE: preRun(&payload.ExtraArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			payload.Archive = args[0]
+
+			result, err := Restore(common.CommandContext(cmd, output), payload)
+			if err != nil {
+				return reportError("backup_restore_failed", "Restore of {{index .volid}} failed. Cause: {{index .cause}}",
+					map[string]interface{}{"volid": payload.Archive}, err)
+			}
+
+			output.Info("Restore of {{index .volid}} to vm {{index .id}} submitted.",
+				map[string]interface{}{
+					"event": "backup_restore_success",
+					"volid": payload.Archive,
+					"id":    result.VmId,
+					"node":  result.Node,
+					"upid":  result.Upid,
+				})
+			return nil
+		},
+	}
+
+	payload.InjectExtraArgs(cmd)
+	payload.InjectWaitArgs(cmd)
+	cmd.Flags().StringVar(&payload.Node, api.FlagNode, "",
+		"The node to restore the virtual machine on. Required.")
+	cmd.Flags().StringVar(&payload.VmId, api.FlagVmId, "",
+		"The id of the restored virtual machine. Required.")
+	cmd.Flags().StringVar(&payload.Storage, api.FlagStorage, "",
+		"The storage device to place all restored disks on.")
+	cmd.Flags().BoolVar(&payload.Force, api.FlagForce, false,
+		"Whether to overwrite an existing virtual machine --vmid. It must be stopped.")
+	cmd.Flags().BoolVar(&payload.Unique, api.FlagUnique, false,
+		"Whether to regenerate the MAC addresses of the restored network devices.")
+	for _, f := range []string{api.FlagNode, api.FlagVmId} {
+		cmd.MarkFlagRequired(f)
+	}
+
+	return cmd
+}
+
+func newPruneCommand() *cobra.Command {
+	payload := &PruneRequest{}
+
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "remove backups not retained by keep options",
+		Long: dedent.Dedent(`
+			Applies retention options to the backups on a storage device and removes the backups not
+			retained. Each backup is reported as kept or removed. With --dry-run, nothing is removed.
+		`),
+		PreRunE: preRun(&payload.ExtraArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			result, err := Prune(common.CommandContext(cmd, output), payload)
+			if err != nil {
+				return reportError("backup_prune_failed", "Failed to prune backups on {{index .storage}}. Cause: {{index .cause}}",
+					map[string]interface{}{"storage": payload.Storage}, err)
+			}
+
+			for _, entry := range result.Entries {
+				output.Info("{{index .volid}}\t{{index .mark}}",
+					map[string]interface{}{
+						"event": "backup_prune",
+						"volid": entry.Volid,
+						"id":    entry.VmId.String(),
+						"mark":  entry.Mark,
+						"time":  time.Unix(int64(entry.Ctime), 0).Format(time.RFC3339),
+					})
+			}
+
+			message := "Prune of {{index .storage}} submitted."
+			switch {
+			case payload.DryRun:
+				message = "Prune of {{index .storage}} not applied, dry run."
+			case len(result.Upid) == 0:
+				message = "No backups to prune on {{index .storage}}."
+			}
+			output.Info(message,
+				map[string]interface{}{
+					"event":     "backup_prune_success",
+					"storage":   payload.Storage,
+					"retention": payload.Retention(),
+					"upid":      result.Upid,
+					"dry_run":   payload.DryRun,
+				})
+			return nil
+		},
+	}
+
+	payload.InjectExtraArgs(cmd)
+	payload.InjectWaitArgs(cmd)
+	cmd.Flags().StringVar(&payload.Node, api.FlagNode, "",
+		"The node of the storage device. Required.")
+	cmd.Flags().StringVar(&payload.Storage, api.FlagStorage, "",
+		"The storage device holding the backups. Required.")
+	cmd.Flags().StringVar(&payload.VmId, api.FlagVmId, "",
+		"Only prune backups of this virtual machine.")
+	cmd.Flags().IntVar(&payload.KeepLast, api.FlagKeepLast, 0,
+		"Keep the last n backups.")
+	cmd.Flags().IntVar(&payload.KeepHourly, api.FlagKeepHourly, 0,
+		"Keep the last backup of each of the last n hours.")
+	cmd.Flags().IntVar(&payload.KeepDaily, api.FlagKeepDaily, 0,
+		"Keep the last backup of each of the last n days.")
+	cmd.Flags().IntVar(&payload.KeepWeekly, api.FlagKeepWeekly, 0,
+		"Keep the last backup of each of the last n weeks.")
+	cmd.Flags().IntVar(&payload.KeepMonthly, api.FlagKeepMonthly, 0,
+		"Keep the last backup of each of the last n months.")
+	cmd.Flags().IntVar(&payload.KeepYearly, api.FlagKeepYearly, 0,
+		"Keep the last backup of each of the last n years.")
+	cmd.Flags().BoolVar(&payload.DryRun, api.FlagDryRun, false,
+		"Whether to only report the backups to remove.")
+	for _, f := range []string{api.FlagNode, api.FlagStorage} {
+		cmd.MarkFlagRequired(f)
+	}
+
+	return cmd
+}
+
+func preRun(extraArgs *shared.ExtraArgs) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		cmd.SetOutput(os.Stdout)
+		if err := cmd.ParseFlags(args); err != nil {
+			return err
+		}
+		output = shared.WithConfig(cmd, extraArgs)
+		return nil
+	}
+}
+
+// Reports the error of an operation as the event, and returns the matching LabError. Errors of
+// waiting for a task are reported by task.ReportWaitError.
+func reportError(event, message string, args map[string]interface{}, err error) error {
+	switch e := err.(type) {
+	case *task.TaskError:
+		return task.ReportWaitError(output, e.UPID, err)
+	case *task.TimeoutError:
+		return task.ReportWaitError(output, e.UPID, err)
+	}
+
+	args["event"] = event
+	args["cause"] = err.Error()
+	output.Fatal(shared.ErrOp.ExitCode, message, args)
+	return shared.ErrOp
+}
@@ -0,0 +1,324 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/xeha-gmbh/homelab/proxmox/backup/api"
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
+	"github.com/xeha-gmbh/homelab/proxmox/vm"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+var (
+	// Backup modes of vzdump, from least to most disruptive.
+	modes = []string{"snapshot", "suspend", "stop"}
+	// Compression algorithms of vzdump. none is passed as 0.
+	compressions = []string{"none", "lzo", "gzip", "zstd"}
+)
+
+// Arguments for 'proxmox backup create' command.
+type CreateRequest struct {
+	shared.ExtraArgs
+	task.WaitArgs
+	Node string
+	// Id or name of the VM.
+	VM string
+	// Storage to write the backup to. Defaults to the storage configured for vzdump on the node.
+	Storage  string
+	Mode     string
+	Compress string
+	// Optional notes attached to the backup. Requires Proxmox VE 7.2 or later.
+	Notes string
+}
+
+// Outcome of a backup or restore.
+type Result struct {
+	Node string
+	VmId string
+	Upid string
+}
+
+// Backs up the VM selected by CreateRequest#VM with vzdump. If CreateRequest#Wait is set, it waits
+// for the backup task to finish.
+func Create(ctx context.Context, cr *CreateRequest) (*Result, error) {
+	switch {
+	case !contains(modes, cr.Mode):
+		return nil, fmt.Errorf("invalid mode %s, expected one of %s", cr.Mode, strings.Join(modes, ", "))
+	case !contains(compressions, cr.Compress):
+		return nil, fmt.Errorf("invalid compression %s, expected one of %s", cr.Compress, strings.Join(compressions, ", "))
+	}
+
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, common.GenericError(fmt.Errorf("failed to read ticket cache: %s", err.Error()))
+	}
+
+	guest, err := vm.SelectVM(ctx, pve, cr.VM, cr.Node)
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Set("vmid", guest.VmId.String())
+	params.Set("mode", cr.Mode)
+	if cr.Compress == "none" {
+		params.Set("compress", "0")
+	} else {
+		params.Set("compress", cr.Compress)
+	}
+	if len(cr.Storage) > 0 {
+		params.Set("storage", cr.Storage)
+	}
+	if len(cr.Notes) > 0 {
+		params.Set("notes-template", cr.Notes)
+	}
+
+	result := &Result{Node: guest.Node, VmId: guest.VmId.String()}
+	if result.Upid, err = pve.Vzdump(ctx, guest.Node, params); err != nil {
+		return nil, err
+	}
+	if cr.Wait {
+		if _, err = task.WaitWith(ctx, pve, result.Upid, cr.Options()); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Arguments for 'proxmox backup list' command.
+type ListRequest struct {
+	shared.ExtraArgs
+	Node string
+	// If empty, all storage devices of the node holding backups are listed.
+	Storage string
+	// If not empty, only backups of this VM are listed.
+	VmId string
+}
+
+// Returns the backups on the node ordered by creation time.
+func List(ctx context.Context, lr *ListRequest) ([]client.StorageContent, error) {
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, common.GenericError(fmt.Errorf("failed to read ticket cache: %s", err.Error()))
+	}
+
+	storages := []string{lr.Storage}
+	if len(lr.Storage) == 0 {
+		if storages, err = backupStorages(ctx, pve, lr.Node); err != nil {
+			return nil, err
+		}
+	}
+
+	backups := make([]client.StorageContent, 0)
+	for _, storage := range storages {
+		contents, err := pve.StorageContent(ctx, lr.Node, storage, api.ContentBackup)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list content of storage %s: %s", storage, err.Error())
+		}
+		for _, content := range contents {
+			if len(lr.VmId) == 0 || content.VmId.String() == lr.VmId {
+				backups = append(backups, content)
+			}
+		}
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].Ctime < backups[j].Ctime
+	})
+	return backups, nil
+}
+
+// Arguments for 'proxmox backup restore' command.
+type RestoreRequest struct {
+	shared.ExtraArgs
+	task.WaitArgs
+	Node string
+	// Volume id of the backup, e.g. local:backup/vzdump-qemu-110-2021_03_08-18_30_00.vma.zst
+	Archive string
+	VmId    string
+	// Storage to place all restored disks on. Defaults to the storage the disks were backed up from.
+	Storage string
+	// If set, an existing stopped VM VmId is overwritten.
+	Force bool
+	// If set, MAC addresses of the restored network devices are regenerated.
+	Unique bool
+}
+
+// Restores the backup RestoreRequest#Archive into the VM RestoreRequest#VmId on the node. If
+// RestoreRequest#Wait is set, it waits for the restore task to finish.
+func Restore(ctx context.Context, rr *RestoreRequest) (*Result, error) {
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, common.GenericError(fmt.Errorf("failed to read ticket cache: %s", err.Error()))
+	}
+
+	params := url.Values{}
+	if existing, err := findGuest(ctx, pve, rr.VmId); err != nil {
+		return nil, err
+	} else if existing != nil {
+		switch {
+		case existing.Type != client.GuestTypeQemu:
+			return nil, fmt.Errorf("id %s is taken by a %s guest", rr.VmId, existing.Type)
+		case !rr.Force:
+			return nil, fmt.Errorf("vm %s already exists, restore with --%s to overwrite it", rr.VmId, api.FlagForce)
+		case existing.Node != rr.Node:
+			return nil, fmt.Errorf("vm %s exists on node %s, not on %s", rr.VmId, existing.Node, rr.Node)
+		case existing.Status != "stopped":
+			return nil, fmt.Errorf("vm %s is %s, stop it first", rr.VmId, existing.Status)
+		}
+		params.Set("force", "1")
+	}
+	if len(rr.Storage) > 0 {
+		params.Set("storage", rr.Storage)
+	}
+	if rr.Unique {
+		params.Set("unique", "1")
+	}
+
+	result := &Result{Node: rr.Node, VmId: rr.VmId}
+	if result.Upid, err = pve.RestoreQemu(ctx, rr.Node, rr.VmId, rr.Archive, params); err != nil {
+		return nil, err
+	}
+	if rr.Wait {
+		if _, err = task.WaitWith(ctx, pve, result.Upid, rr.Options()); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Arguments for 'proxmox backup prune' command.
+type PruneRequest struct {
+	shared.ExtraArgs
+	task.WaitArgs
+	Node    string
+	Storage string
+	// If not empty, only backups of this VM are pruned.
+	VmId string
+	// Retention options. Zero values are not applied.
+	KeepLast    int
+	KeepHourly  int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	KeepYearly  int
+	// If set, the backups to remove are only reported.
+	DryRun bool
+}
+
+// Returns the retention in the form of the prune-backups parameter, e.g. keep-last=3,keep-daily=7.
+func (pr *PruneRequest) Retention() string {
+	options := make([]string, 0, 6)
+	for _, option := range []struct {
+		name string
+		keep int
+	}{
+		{api.FlagKeepLast, pr.KeepLast},
+		{api.FlagKeepHourly, pr.KeepHourly},
+		{api.FlagKeepDaily, pr.KeepDaily},
+		{api.FlagKeepWeekly, pr.KeepWeekly},
+		{api.FlagKeepMonthly, pr.KeepMonthly},
+		{api.FlagKeepYearly, pr.KeepYearly},
+	} {
+		if option.keep > 0 {
+			options = append(options, fmt.Sprintf("%s=%d", option.name, option.keep))
+		}
+	}
+	return strings.Join(options, ",")
+}
+
+// Outcome of pruning.
+type PruneResult struct {
+	// Backups considered, marked as kept or removed.
+	Entries []client.PruneEntry
+	// UPID of the prune task. Empty on dry run or if nothing was to be removed.
+	Upid string
+}
+
+// Applies the retention options of the PruneRequest to the backups on the storage, removing those
+// not retained. If PruneRequest#Wait is set, it waits for the prune task to finish.
+func Prune(ctx context.Context, pr *PruneRequest) (*PruneResult, error) {
+	retention := pr.Retention()
+	if len(retention) == 0 {
+		return nil, fmt.Errorf("no retention given, set at least one of --%s, --%s, --%s, --%s, --%s and --%s",
+			api.FlagKeepLast, api.FlagKeepHourly, api.FlagKeepDaily, api.FlagKeepWeekly, api.FlagKeepMonthly, api.FlagKeepYearly)
+	}
+
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, common.GenericError(fmt.Errorf("failed to read ticket cache: %s", err.Error()))
+	}
+
+	result := new(PruneResult)
+	if result.Entries, err = pve.PruneBackups(ctx, pr.Node, pr.Storage, retention, pr.VmId); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(result.Entries, func(i, j int) bool {
+		return result.Entries[i].Ctime < result.Entries[j].Ctime
+	})
+
+	removals := 0
+	for _, entry := range result.Entries {
+		if entry.Mark == client.PruneMarkRemove {
+			removals++
+		}
+	}
+	if pr.DryRun || removals == 0 {
+		return result, nil
+	}
+
+	if result.Upid, err = pve.DeletePrunedBackups(ctx, pr.Node, pr.Storage, retention, pr.VmId); err != nil {
+		return nil, err
+	}
+	if pr.Wait {
+		if _, err = task.WaitWith(ctx, pve, result.Upid, pr.Options()); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Returns the guest (VM or container) of the cluster with the id, or nil if none.
+func findGuest(ctx context.Context, pve *client.Client, vmId string) (*client.ClusterResource, error) {
+	resources, err := pve.ClusterResources(ctx, client.ResourceTypeVM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cluster resources: %s", err.Error())
+	}
+
+	for _, r := range resources {
+		if r.VmId.String() == vmId {
+			return &r, nil
+		}
+	}
+	return nil, nil
+}
+
+// Returns the enabled storage devices of the node accepting backups.
+func backupStorages(ctx context.Context, pve *client.Client, node string) ([]string, error) {
+	storages, err := pve.Storages(ctx, node)
+	if err != nil {
+		return nil, fmt.Errorf("get storage failed: %s", err.Error())
+	}
+
+	names := make([]string, 0, len(storages))
+	for _, storage := range storages {
+		if storage.Active != 0 && storage.Accepts(api.ContentBackup) {
+			names = append(names, storage.Storage)
+		}
+	}
+	return names, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
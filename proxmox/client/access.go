@@ -0,0 +1,146 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	CSRFTokenHeader  = "CSRFPreventionToken"
+	TicketCookieName = "PVEAuthCookie"
+
+	AuthorizationHeader = "Authorization"
+
+	tfaChallengeMarker = "!tfa!"
+)
+
+// Credentials decorate an outgoing request with authentication information.
+type Credentials interface {
+	Authenticate(r *http.Request)
+}
+
+// Ticket is the authentication ticket issued by /access/ticket.
+type Ticket struct {
+	Username  string `json:"username"`
+	Ticket    string `json:"ticket"`
+	CSRFToken string `json:"CSRFPreventionToken"`
+	// Set when the user has two-factor authentication enabled. In this case, the ticket is only
+	// valid to complete the second factor with CompleteTFA.
+	NeedTFA Int `json:"NeedTFA"`
+}
+
+// Returns true if the ticket is a partial ticket awaiting the second factor.
+func (t *Ticket) NeedsTFA() bool {
+	return t.NeedTFA != 0
+}
+
+// Sets the ticket cookie and the CSRF prevention header.
+func (t *Ticket) Authenticate(r *http.Request) {
+	r.Header.Set(CSRFTokenHeader, t.CSRFToken)
+	r.AddCookie(&http.Cookie{
+		Name:  TicketCookieName,
+		Value: t.Ticket,
+	})
+}
+
+// APIToken is a Proxmox API token. Unlike tickets, tokens do not expire unless configured to,
+// and requests authenticated by a token need no CSRF prevention token.
+type APIToken struct {
+	// The user owning the token, including the realm (e.g. root@pam).
+	User string
+	// The token id, without the user part.
+	TokenId string
+	// The token secret (a UUID).
+	Secret string
+}
+
+// Sets the 'PVEAPIToken=user@realm!tokenid=secret' authorization header.
+func (t *APIToken) Authenticate(r *http.Request) {
+	r.Header.Set(AuthorizationHeader, fmt.Sprintf("PVEAPIToken=%s!%s=%s", t.User, t.TokenId, t.Secret))
+}
+
+// Obtains a new ticket for the user using password authentication. The returned ticket is not
+// automatically installed as the credentials of this client.
+func (c *Client) Login(ctx context.Context, username, password, realm string) (*Ticket, error) {
+	form := url.Values{}
+	form.Set("username", username)
+	form.Set("password", password)
+	if len(realm) > 0 {
+		form.Set("realm", realm)
+	}
+
+	ticket := new(Ticket)
+	if err := c.post(ctx, "/access/ticket", form, ticket); err != nil {
+		return nil, err
+	}
+	return ticket, nil
+}
+
+// Completes two-factor authentication of a partial ticket with a TOTP code and returns the full ticket.
+// Servers issuing tfa challenge tickets (Proxmox VE 7 and later) are answered at /access/ticket,
+// older servers are answered at /access/tfa using the partial ticket as credentials.
+func (c *Client) CompleteTFA(ctx context.Context, partial *Ticket, otp string) (*Ticket, error) {
+	if strings.Contains(partial.Ticket, tfaChallengeMarker) {
+		form := url.Values{}
+		form.Set("username", partial.Username)
+		form.Set("tfa-challenge", partial.Ticket)
+		form.Set("password", "totp:"+otp)
+
+		ticket := new(Ticket)
+		if err := c.post(ctx, "/access/ticket", form, ticket); err != nil {
+			return nil, err
+		}
+		return ticket, nil
+	}
+
+	form := url.Values{}
+	form.Set("response", otp)
+
+	result := new(Ticket)
+	partialClient := New(c.apiServer, WithHttpClient(c.httpClient), WithPrinter(c.output), WithCredentials(partial))
+	if err := partialClient.post(ctx, "/access/tfa", form, result); err != nil {
+		return nil, err
+	}
+	return &Ticket{
+		Username:  partial.Username,
+		Ticket:    result.Ticket,
+		CSRFToken: partial.CSRFToken,
+	}, nil
+}
+
+// Renews a valid ticket by posting it as the password. The username must include the realm
+// (e.g. root@pam). Proxmox issues a fresh ticket with a new two hour lifetime.
+func (c *Client) RenewTicket(ctx context.Context, username, ticket string) (*Ticket, error) {
+	return c.Login(ctx, username, ticket, "")
+}
+
+// Version information of the Proxmox API server.
+type Version struct {
+	Version string `json:"version"`
+	Release string `json:"release"`
+	RepoId  string `json:"repoid"`
+}
+
+// Returns the major version number, e.g. 7 for version 7.4-3, or 0 if it cannot be determined.
+func (v *Version) Major() int {
+	major := 0
+	for _, r := range v.Version {
+		if r < '0' || r > '9' {
+			break
+		}
+		major = major*10 + int(r-'0')
+	}
+	return major
+}
+
+// Returns the version of the API server. This is also a cheap way to verify credentials.
+func (c *Client) Version(ctx context.Context) (*Version, error) {
+	v := new(Version)
+	if err := c.get(ctx, "/version", nil, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// Appliance is an entry of the appliance index /nodes/{node}/aplinfo, a container template
+// available for download.
+type Appliance struct {
+	// File name of the template, e.g. debian-12-standard_12.2-1_amd64.tar.zst
+	Template string `json:"template"`
+	// Name of the template without version, e.g. debian-12-standard
+	Package     string `json:"package"`
+	Version     string `json:"version"`
+	Os          string `json:"os"`
+	Section     string `json:"section"`
+	Type        string `json:"type"`
+	Headline    string `json:"headline"`
+	Description string `json:"description"`
+	Location    string `json:"location"`
+	Sha512Sum   string `json:"sha512sum"`
+}
+
+// Returns the appliance index of the node.
+func (c *Client) Appliances(ctx context.Context, node string) ([]Appliance, error) {
+	appliances := make([]Appliance, 0)
+	if err := c.get(ctx, fmt.Sprintf("/nodes/%s/aplinfo", node), nil, &appliances); err != nil {
+		return nil, err
+	}
+	return appliances, nil
+}
+
+// Asks the node to download the template of the appliance index into the storage. Returns the
+// UPID of the download task.
+func (c *Client) DownloadAppliance(ctx context.Context, node, storage, template string) (string, error) {
+	form := url.Values{}
+	form.Set("storage", storage)
+	form.Set("template", template)
+
+	var upid string
+	if err := c.post(ctx, fmt.Sprintf("/nodes/%s/aplinfo", node), form, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// Marks of the entries reported by PruneBackups.
+const (
+	PruneMarkKeep      = "keep"
+	PruneMarkRemove    = "remove"
+	PruneMarkProtected = "protected"
+)
+
+// Backs up guests of the node with the given parameters (vmid, mode, compress, storage...).
+// Returns the UPID of the vzdump task.
+func (c *Client) Vzdump(ctx context.Context, node string, params url.Values) (string, error) {
+	var upid string
+	if err := c.post(ctx, fmt.Sprintf("/nodes/%s/vzdump", node), params, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
+
+// Restores the backup archive (a volume id) into the VM vmId on the node. Additional parameters
+// are storage, to place all disks on that storage, and force, to overwrite an existing VM.
+// Returns the UPID of the restore task.
+func (c *Client) RestoreQemu(ctx context.Context, node, vmId, archive string, params url.Values) (string, error) {
+	form := url.Values{}
+	for key, values := range params {
+		form[key] = values
+	}
+	form.Set("vmid", vmId)
+	form.Set("archive", archive)
+	return c.CreateQemu(ctx, node, form)
+}
+
+// PruneEntry is an entry of /nodes/{node}/storage/{storage}/prunebackups.
+type PruneEntry struct {
+	Volid string `json:"volid"`
+	// One of the PruneMark constants.
+	Mark  string `json:"mark"`
+	Ctime Int    `json:"ctime"`
+	Type  string `json:"type"`
+	VmId  Int    `json:"vmid"`
+}
+
+// Returns the backups of the storage marked as kept or removed by the retention options
+// (e.g. keep-last=3,keep-daily=7), without removing anything. If vmId is not empty, only
+// backups of that guest are considered.
+func (c *Client) PruneBackups(ctx context.Context, node, storage, retention, vmId string) ([]PruneEntry, error) {
+	entries := make([]PruneEntry, 0)
+	if err := c.get(ctx, fmt.Sprintf("/nodes/%s/storage/%s/prunebackups", node, storage), pruneParams(retention, vmId), &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Removes the backups of the storage marked as removed by the retention options. Returns the UPID
+// of the prune task.
+func (c *Client) DeletePrunedBackups(ctx context.Context, node, storage, retention, vmId string) (string, error) {
+	var upid string
+	if err := c.delete(ctx, fmt.Sprintf("/nodes/%s/storage/%s/prunebackups", node, storage), pruneParams(retention, vmId), &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
+
+func pruneParams(retention, vmId string) url.Values {
+	params := url.Values{}
+	params.Set("prune-backups", retention)
+	params.Set("type", "qemu")
+	if len(vmId) > 0 {
+		params.Set("vmid", vmId)
+	}
+	return params
+}
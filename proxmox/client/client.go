@@ -0,0 +1,273 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+const (
+	apiPath = "/api2/json"
+)
+
+// Client is a typed client for the Proxmox VE API. It is safe to share a client between goroutines.
+type Client struct {
+	apiServer      string
+	httpClient     *http.Client
+	output         shared.MessagePrinter
+	reauthenticate Reauthenticator
+	mu             sync.RWMutex
+	credentials    Credentials
+}
+
+// Reauthenticator obtains new credentials after the server rejected the current ones with 401.
+type Reauthenticator func(ctx context.Context) (Credentials, error)
+
+// Option configures a Client during construction.
+type Option func(c *Client)
+
+// Use the supplied credentials to authenticate every request.
+func WithCredentials(credentials Credentials) Option {
+	return func(c *Client) {
+		c.credentials = credentials
+	}
+}
+
+// Use the supplied function to obtain new credentials, should the server reject the current ones.
+// The rejected request is retried once with the new credentials.
+func WithReauthenticator(reauthenticate Reauthenticator) Option {
+	return func(c *Client) {
+		c.reauthenticate = reauthenticate
+	}
+}
+
+// Use the supplied http client instead of the default one.
+func WithHttpClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// Use the supplied printer to emit debug messages about requests and responses.
+func WithPrinter(output shared.MessagePrinter) Option {
+	return func(c *Client) {
+		c.output = output
+	}
+}
+
+// Returns a new client targeting the Proxmox API server at the given address (e.g. https://pve:8006).
+// API paths will be appended to this address. Unless overridden by WithHttpClient, the client skips
+// TLS verification, as most Proxmox installations use self-signed certificates.
+func New(apiServer string, options ...Option) *Client {
+	c := &Client{
+		apiServer: strings.TrimRight(apiServer, "/"),
+	}
+	for _, option := range options {
+		option(c)
+	}
+	if c.httpClient == nil {
+		c.httpClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+				},
+			},
+		}
+	}
+	return c
+}
+
+// Returns the address of the API server this client targets.
+func (c *Client) ApiServer() string {
+	return c.apiServer
+}
+
+// Replaces the credentials used to authenticate subsequent requests.
+func (c *Client) SetCredentials(credentials Credentials) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.credentials = credentials
+}
+
+// Returns the credentials used to authenticate requests.
+func (c *Client) Credentials() Credentials {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.credentials
+}
+
+// Issue a GET request and decode the 'data' field of the response into out, if out is not nil.
+func (c *Client) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	return c.do(ctx, http.MethodGet, path, query, out)
+}
+
+// Issue a POST request with form encoded parameters and decode the 'data' field of the response into out.
+func (c *Client) post(ctx context.Context, path string, form url.Values, out interface{}) error {
+	return c.do(ctx, http.MethodPost, path, form, out)
+}
+
+// Issue a PUT request with form encoded parameters and decode the 'data' field of the response into out.
+func (c *Client) put(ctx context.Context, path string, form url.Values, out interface{}) error {
+	return c.do(ctx, http.MethodPut, path, form, out)
+}
+
+// Issue a DELETE request and decode the 'data' field of the response into out.
+func (c *Client) delete(ctx context.Context, path string, query url.Values, out interface{}) error {
+	return c.do(ctx, http.MethodDelete, path, query, out)
+}
+
+// Issue a request against the API path. For GET and DELETE, params are sent as query string. For
+// other methods, params are sent as an url encoded form.
+func (c *Client) do(ctx context.Context, method, path string, params url.Values, out interface{}) error {
+	var (
+		err  error
+		req  *http.Request
+		body io.Reader
+		u    = c.url(path)
+	)
+
+	switch method {
+	case http.MethodGet, http.MethodDelete:
+		if len(params) > 0 {
+			u = u + "?" + params.Encode()
+		}
+	default:
+		if params == nil {
+			params = url.Values{}
+		}
+		body = strings.NewReader(params.Encode())
+	}
+
+	if req, err = http.NewRequest(method, u, body); err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	return c.send(ctx, req, out)
+}
+
+// Authenticates and sends the request, then decodes the response envelope. If the server rejects
+// the credentials and a reauthenticator is installed, the request is retried once with new credentials.
+func (c *Client) send(ctx context.Context, req *http.Request, out interface{}) error {
+	resp, raw, err := c.roundTrip(ctx, req, false)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized && c.reauthenticate != nil && (req.Body == nil || req.GetBody != nil) {
+		c.debug("Credentials rejected by {{index .path}}, re-authenticating.",
+			map[string]interface{}{
+				"event": "reauthenticate",
+				"path":  req.URL.Path,
+			})
+
+		credentials, err := c.reauthenticate(ctx)
+		if err != nil {
+			return fmt.Errorf("re-authentication failed: %s", err.Error())
+		}
+		c.SetCredentials(credentials)
+
+		if resp, raw, err = c.roundTrip(ctx, req, true); err != nil {
+			return err
+		}
+	}
+
+	return decodeResponse(resp, raw, out)
+}
+
+// Sends an authenticated copy of the request and reads the full response body. When retry is set,
+// the request body is recreated.
+func (c *Client) roundTrip(ctx context.Context, req *http.Request, retry bool) (*http.Response, []byte, error) {
+	var (
+		err  error
+		resp *http.Response
+		raw  []byte
+		r    = req.WithContext(ctx)
+	)
+
+	// the credentials are set on a copy of the header, so that a retry does not send them twice.
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+
+	if retry && req.GetBody != nil {
+		if r.Body, err = req.GetBody(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if credentials := c.Credentials(); credentials != nil {
+		credentials.Authenticate(r)
+	}
+
+	if resp, err = c.httpClient.Do(r); err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if raw, err = ioutil.ReadAll(resp.Body); err != nil {
+		return nil, nil, err
+	}
+
+	c.debug("{{index .method}} {{index .path}} returned status {{index .code}}.",
+		map[string]interface{}{
+			"event":  "http_response",
+			"method": r.Method,
+			"path":   r.URL.Path,
+			"code":   resp.StatusCode,
+			"status": resp.Status,
+		})
+
+	return resp, raw, nil
+}
+
+// Decodes the standard Proxmox response envelope. Non-2xx responses are turned into *Error.
+func decodeResponse(resp *http.Response, raw []byte, out interface{}) error {
+	env := envelope{}
+	if len(raw) > 0 {
+		// error responses may carry no or non-JSON bodies, so decoding failure is only fatal on success.
+		if err := json.Unmarshal(raw, &env); err != nil && resp.StatusCode/100 == 2 {
+			return fmt.Errorf("malformed response body: %s", err.Error())
+		}
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return newError(resp, env)
+	}
+
+	if out == nil || len(env.Data) == 0 || string(env.Data) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(env.Data, out); err != nil {
+		return fmt.Errorf("unexpected response data: %s", err.Error())
+	}
+	return nil
+}
+
+func (c *Client) url(path string) string {
+	return c.apiServer + apiPath + path
+}
+
+func (c *Client) debug(templateText string, args map[string]interface{}) {
+	if c.output != nil {
+		c.output.Debug(templateText, args)
+	}
+}
+
+// Standard envelope of all Proxmox API responses.
+type envelope struct {
+	Data    json.RawMessage   `json:"data"`
+	Errors  map[string]string `json:"errors"`
+	Message string            `json:"message"`
+}
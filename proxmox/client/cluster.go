@@ -0,0 +1,67 @@
+package client
+
+import (
+	"context"
+	"net/url"
+)
+
+const (
+	ResourceTypeVM      = "vm"
+	ResourceTypeStorage = "storage"
+	ResourceTypeNode    = "node"
+
+	// Types of the vm resources.
+	GuestTypeQemu = "qemu"
+	GuestTypeLxc  = "lxc"
+)
+
+// ClusterResource is an entry of /cluster/resources. Which fields are set depends on the type of
+// the resource (qemu, lxc, storage, node...).
+type ClusterResource struct {
+	Id       string  `json:"id"`
+	Type     string  `json:"type"`
+	Node     string  `json:"node"`
+	VmId     Int     `json:"vmid"`
+	Name     string  `json:"name"`
+	Status   string  `json:"status"`
+	Template Int     `json:"template"`
+	Storage  string  `json:"storage"`
+	Pool     string  `json:"pool"`
+	Cpu      float64 `json:"cpu"`
+	MaxCpu   Int     `json:"maxcpu"`
+	Mem      Int     `json:"mem"`
+	MaxMem   Int     `json:"maxmem"`
+	Disk     Int     `json:"disk"`
+	MaxDisk  Int     `json:"maxdisk"`
+	Uptime   Int     `json:"uptime"`
+}
+
+// Returns the resources of the cluster. If resourceType is not empty, only resources of that type
+// (vm, storage, node) are returned. Standalone nodes report themselves as a cluster of one.
+func (c *Client) ClusterResources(ctx context.Context, resourceType string) ([]ClusterResource, error) {
+	query := url.Values{}
+	if len(resourceType) > 0 {
+		query.Set("type", resourceType)
+	}
+
+	resources := make([]ClusterResource, 0)
+	if err := c.get(ctx, "/cluster/resources", query, &resources); err != nil {
+		return nil, err
+	}
+	return resources, nil
+}
+
+// Returns the next free VM id of the cluster. If vmId is not empty, it is returned if it is free, and
+// an error is returned if it is in use.
+func (c *Client) NextId(ctx context.Context, vmId string) (string, error) {
+	query := url.Values{}
+	if len(vmId) > 0 {
+		query.Set("vmid", vmId)
+	}
+
+	var id Int
+	if err := c.get(ctx, "/cluster/nextid", query, &id); err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Error is returned when the Proxmox API responds with a non-2xx status.
+type Error struct {
+	// HTTP status code of the response.
+	StatusCode int
+	// Message reported by Proxmox. Proxmox places its message in the HTTP reason phrase.
+	Message string
+	// Per parameter errors reported in the 'errors' object of the response, if any.
+	Errors map[string]string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("proxmox api error %d: %s", e.StatusCode, e.Message)
+	if len(e.Errors) > 0 {
+		fields := make([]string, 0, len(e.Errors))
+		for k := range e.Errors {
+			fields = append(fields, k)
+		}
+		sort.Strings(fields)
+
+		details := make([]string, 0, len(fields))
+		for _, k := range fields {
+			details = append(details, fmt.Sprintf("%s: %s", k, strings.TrimSpace(e.Errors[k])))
+		}
+		msg += " (" + strings.Join(details, "; ") + ")"
+	}
+	return msg
+}
+
+// Returns true if err is a Proxmox API error with status 401.
+func IsUnauthorized(err error) bool {
+	return hasStatus(err, http.StatusUnauthorized)
+}
+
+// Returns true if err is a Proxmox API error with status 400.
+func IsBadRequest(err error) bool {
+	return hasStatus(err, http.StatusBadRequest)
+}
+
+// Returns true if err is a Proxmox API error with status 404.
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+func hasStatus(err error, code int) bool {
+	if e, ok := err.(*Error); ok {
+		return e.StatusCode == code
+	}
+	return false
+}
+
+func newError(resp *http.Response, env envelope) *Error {
+	message := strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)))
+	if len(env.Message) > 0 {
+		message = strings.TrimSpace(env.Message)
+	}
+	if len(message) == 0 {
+		message = http.StatusText(resp.StatusCode)
+	}
+	return &Error{
+		StatusCode: resp.StatusCode,
+		Message:    message,
+		Errors:     env.Errors,
+	}
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// Actions changing the state of a container, posted to /nodes/{node}/lxc/{vmid}/status/{action}.
+const (
+	LxcActionStart    = "start"
+	LxcActionStop     = "stop"
+	LxcActionShutdown = "shutdown"
+	LxcActionReboot   = "reboot"
+)
+
+// Lxc is an entry of /nodes/{node}/lxc, also used for the current status of a single container.
+type Lxc struct {
+	VmId     Int     `json:"vmid"`
+	Name     string  `json:"name"`
+	Status   string  `json:"status"`
+	Template Int     `json:"template"`
+	Cpus     Int     `json:"cpus"`
+	Cpu      float64 `json:"cpu"`
+	MaxMem   Int     `json:"maxmem"`
+	Mem      Int     `json:"mem"`
+	MaxSwap  Int     `json:"maxswap"`
+	MaxDisk  Int     `json:"maxdisk"`
+	Uptime   Int     `json:"uptime"`
+	Lock     string  `json:"lock"`
+}
+
+// Returns all containers on the node.
+func (c *Client) Lxcs(ctx context.Context, node string) ([]Lxc, error) {
+	cts := make([]Lxc, 0)
+	if err := c.get(ctx, fmt.Sprintf("/nodes/%s/lxc", node), nil, &cts); err != nil {
+		return nil, err
+	}
+	return cts, nil
+}
+
+// Returns the current status of the container.
+func (c *Client) LxcStatus(ctx context.Context, node string, vmId string) (*Lxc, error) {
+	ct := new(Lxc)
+	if err := c.get(ctx, fmt.Sprintf("/nodes/%s/lxc/%s/status/current", node, vmId), nil, ct); err != nil {
+		return nil, err
+	}
+	return ct, nil
+}
+
+// Creates a container on the node with the given parameters (vmid, ostemplate, rootfs, net0...).
+// Returns the UPID of the creation task.
+func (c *Client) CreateLxc(ctx context.Context, node string, params url.Values) (string, error) {
+	var upid string
+	if err := c.post(ctx, fmt.Sprintf("/nodes/%s/lxc", node), params, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
+
+// Changes the state of the container by posting the action (one of the LxcAction constants) with
+// optional parameters, e.g. timeout for shutdown. Returns the UPID of the task.
+func (c *Client) LxcAction(ctx context.Context, node string, vmId string, action string, params url.Values) (string, error) {
+	var upid string
+	if err := c.post(ctx, fmt.Sprintf("/nodes/%s/lxc/%s/status/%s", node, vmId, action), params, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
+
+// Destroys the container and all its volumes. The container must be stopped. Returns the UPID of
+// the destroy task.
+func (c *Client) DeleteLxc(ctx context.Context, node string, vmId string, params url.Values) (string, error) {
+	var upid string
+	if err := c.delete(ctx, fmt.Sprintf("/nodes/%s/lxc/%s", node, vmId), params, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
+
+// Returns the current configuration of the container, with pending changes applied.
+func (c *Client) LxcConfig(ctx context.Context, node string, vmId string) (Config, error) {
+	config := make(Config)
+	if err := c.get(ctx, fmt.Sprintf("/nodes/%s/lxc/%s/config", node, vmId), nil, &config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Updates the configuration of the container synchronously, like UpdateQemuConfig.
+func (c *Client) UpdateLxcConfig(ctx context.Context, node string, vmId string, params url.Values) error {
+	return c.put(ctx, fmt.Sprintf("/nodes/%s/lxc/%s/config", node, vmId), params, nil)
+}
+
+// Grows the volume (e.g. rootfs) of the container to the size, e.g. 16G. Returns the UPID of the
+// resize task.
+func (c *Client) ResizeLxcDisk(ctx context.Context, node string, vmId string, disk string, size string) (string, error) {
+	form := url.Values{}
+	form.Set("disk", disk)
+	form.Set("size", size)
+
+	var upid string
+	if err := c.put(ctx, fmt.Sprintf("/nodes/%s/lxc/%s/resize", node, vmId), form, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
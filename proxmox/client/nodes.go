@@ -0,0 +1,26 @@
+package client
+
+import (
+	"context"
+)
+
+// Node is an entry of /nodes.
+type Node struct {
+	Node   string  `json:"node"`
+	Status string  `json:"status"`
+	Cpu    float64 `json:"cpu"`
+	MaxCpu Int     `json:"maxcpu"`
+	Mem    Int     `json:"mem"`
+	MaxMem Int     `json:"maxmem"`
+	Disk   Int     `json:"disk"`
+	Uptime Int     `json:"uptime"`
+}
+
+// Returns all nodes of the cluster.
+func (c *Client) Nodes(ctx context.Context) ([]Node, error) {
+	nodes := make([]Node, 0)
+	if err := c.get(ctx, "/nodes", nil, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
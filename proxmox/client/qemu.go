@@ -0,0 +1,246 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// Actions changing the state of a VM, posted to /nodes/{node}/qemu/{vmid}/status/{action}.
+const (
+	QemuActionStart    = "start"
+	QemuActionStop     = "stop"
+	QemuActionShutdown = "shutdown"
+	QemuActionReboot   = "reboot"
+	QemuActionReset    = "reset"
+	QemuActionSuspend  = "suspend"
+	QemuActionResume   = "resume"
+)
+
+// Qemu is an entry of /nodes/{node}/qemu, also used for the current status of a single VM.
+type Qemu struct {
+	VmId     Int     `json:"vmid"`
+	Name     string  `json:"name"`
+	Status   string  `json:"status"`
+	Template Int     `json:"template"`
+	Cpus     Int     `json:"cpus"`
+	Cpu      float64 `json:"cpu"`
+	MaxMem   Int     `json:"maxmem"`
+	Mem      Int     `json:"mem"`
+	MaxDisk  Int     `json:"maxdisk"`
+	Uptime   Int     `json:"uptime"`
+	Lock     string  `json:"lock"`
+	// Status as reported by QEMU, e.g. paused for a suspended VM. Only set by QemuStatus.
+	QmpStatus string `json:"qmpstatus"`
+}
+
+// Returns all QEMU VMs on the node.
+func (c *Client) Qemus(ctx context.Context, node string) ([]Qemu, error) {
+	vms := make([]Qemu, 0)
+	if err := c.get(ctx, fmt.Sprintf("/nodes/%s/qemu", node), nil, &vms); err != nil {
+		return nil, err
+	}
+	return vms, nil
+}
+
+// Returns the current status of the VM.
+func (c *Client) QemuStatus(ctx context.Context, node string, vmId string) (*Qemu, error) {
+	vm := new(Qemu)
+	if err := c.get(ctx, fmt.Sprintf("/nodes/%s/qemu/%s/status/current", node, vmId), nil, vm); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+// Creates a VM on the node with the given configuration parameters (vmid, name, scsi0, net0...).
+// Returns the UPID of the creation task.
+func (c *Client) CreateQemu(ctx context.Context, node string, params url.Values) (string, error) {
+	var upid string
+	if err := c.post(ctx, fmt.Sprintf("/nodes/%s/qemu", node), params, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
+
+// Starts the VM. Returns the UPID of the start task.
+func (c *Client) StartQemu(ctx context.Context, node string, vmId string) (string, error) {
+	return c.QemuAction(ctx, node, vmId, QemuActionStart, nil)
+}
+
+// Changes the state of the VM by posting the action (one of the QemuAction constants) with optional
+// parameters, e.g. timeout for shutdown. Returns the UPID of the task.
+func (c *Client) QemuAction(ctx context.Context, node string, vmId string, action string, params url.Values) (string, error) {
+	var upid string
+	if err := c.post(ctx, fmt.Sprintf("/nodes/%s/qemu/%s/status/%s", node, vmId, action), params, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
+
+// Destroys the VM and all its disks. The VM must be stopped. Returns the UPID of the destroy task.
+func (c *Client) DeleteQemu(ctx context.Context, node string, vmId string, params url.Values) (string, error) {
+	var upid string
+	if err := c.delete(ctx, fmt.Sprintf("/nodes/%s/qemu/%s", node, vmId), params, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
+
+// Returns the current configuration of the VM, with pending changes applied.
+func (c *Client) QemuConfig(ctx context.Context, node string, vmId string) (Config, error) {
+	config := make(Config)
+	if err := c.get(ctx, fmt.Sprintf("/nodes/%s/qemu/%s/config", node, vmId), nil, &config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Converts the stopped VM into a template. Returns the UPID of the conversion task, which servers
+// older than Proxmox VE 7 do not report.
+func (c *Client) ConvertQemuToTemplate(ctx context.Context, node string, vmId string) (string, error) {
+	var upid string
+	if err := c.post(ctx, fmt.Sprintf("/nodes/%s/qemu/%s/template", node, vmId), nil, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
+
+// Clones the VM or template with the given parameters (newid, name, target, storage, full...).
+// Returns the UPID of the clone task.
+func (c *Client) CloneQemu(ctx context.Context, node string, vmId string, params url.Values) (string, error) {
+	var upid string
+	if err := c.post(ctx, fmt.Sprintf("/nodes/%s/qemu/%s/clone", node, vmId), params, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
+
+// Updates the configuration of the VM synchronously. Options to remove are listed in the 'delete'
+// parameter. If the 'digest' parameter is set, the update fails if the configuration was modified
+// since it was read. Changes that cannot be applied to a running VM become pending.
+func (c *Client) UpdateQemuConfig(ctx context.Context, node string, vmId string, params url.Values) error {
+	return c.put(ctx, fmt.Sprintf("/nodes/%s/qemu/%s/config", node, vmId), params, nil)
+}
+
+// Grows the disk (e.g. scsi0) of the VM to the size, e.g. 64G, or by the size if prefixed with '+'.
+// Returns the UPID of the resize task, which servers older than Proxmox VE 8 do not report.
+func (c *Client) ResizeQemuDisk(ctx context.Context, node string, vmId string, disk string, size string) (string, error) {
+	form := url.Values{}
+	form.Set("disk", disk)
+	form.Set("size", size)
+
+	var upid string
+	if err := c.put(ctx, fmt.Sprintf("/nodes/%s/qemu/%s/resize", node, vmId), form, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
+
+// PendingOption is an entry of /nodes/{node}/qemu/{vmid}/pending.
+type PendingOption struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// The value taking effect on next start, if different from the current value.
+	Pending string `json:"pending"`
+	// Set if the option will be removed on next start.
+	Delete Int `json:"delete"`
+}
+
+// Returns true if the option has a change not yet applied to the running VM.
+func (p *PendingOption) IsPending() bool {
+	return len(p.Pending) > 0 || p.Delete != 0
+}
+
+// Returns the configuration of the VM including changes pending until next start.
+func (c *Client) QemuPending(ctx context.Context, node string, vmId string) ([]PendingOption, error) {
+	return c.pending(ctx, GuestTypeQemu, node, vmId)
+}
+
+// Returns the configuration of the container including changes pending until next start.
+func (c *Client) LxcPending(ctx context.Context, node string, vmId string) ([]PendingOption, error) {
+	return c.pending(ctx, GuestTypeLxc, node, vmId)
+}
+
+func (c *Client) pending(ctx context.Context, guestType, node, vmId string) ([]PendingOption, error) {
+	var raw []map[string]interface{}
+	if err := c.get(ctx, fmt.Sprintf("/nodes/%s/%s/%s/pending", node, guestType, vmId), nil, &raw); err != nil {
+		return nil, err
+	}
+
+	options := make([]PendingOption, 0, len(raw))
+	for _, entry := range raw {
+		option := PendingOption{
+			Key:     fmt.Sprint(entry["key"]),
+			Value:   stringValue(entry["value"]),
+			Pending: stringValue(entry["pending"]),
+		}
+		if d, ok := entry["delete"].(float64); ok {
+			option.Delete = Int(d)
+		}
+		options = append(options, option)
+	}
+	return options, nil
+}
+
+// Blockers of migrating a VM to a node, an entry of MigratePrecondition#NotAllowedNodes.
+type MigrateNodeBlocker struct {
+	// Storage devices used by the VM that are not available on the node.
+	UnavailableStorages []string `json:"unavailable_storages"`
+	// Mapped resources used by the VM that are not available on the node.
+	UnavailableResources []string `json:"unavailable-resources"`
+}
+
+// A disk of the VM on storage local to its node, an entry of MigratePrecondition#LocalDisks.
+type MigrateLocalDisk struct {
+	Volid     string `json:"volid"`
+	DriveName string `json:"drivename"`
+	Size      Int    `json:"size"`
+	// Set if the disk is not attached to the VM.
+	IsUnused Int `json:"is_unused"`
+	// Set if the disk is a CD-ROM image, which cannot be migrated.
+	Cdrom Int `json:"cdrom"`
+	// Set if the disk is replicated to other nodes.
+	Replicated Int `json:"replicated"`
+}
+
+// Preconditions of migrating a VM, as reported by GET /nodes/{node}/qemu/{vmid}/migrate.
+type MigratePrecondition struct {
+	Running Int `json:"running"`
+	// Nodes the VM can be migrated to. Only reported for stopped VMs.
+	AllowedNodes []string `json:"allowed_nodes"`
+	// Nodes the VM cannot be migrated to, by node name. Only reported for stopped VMs.
+	NotAllowedNodes map[string]MigrateNodeBlocker `json:"not_allowed_nodes"`
+	LocalDisks      []MigrateLocalDisk            `json:"local_disks"`
+	// Configuration keys of devices bound to the node, e.g. hostpci0.
+	LocalResources []string `json:"local_resources"`
+}
+
+// Returns the preconditions of migrating the VM to the target node.
+func (c *Client) QemuMigratePrecondition(ctx context.Context, node string, vmId string, target string) (*MigratePrecondition, error) {
+	query := url.Values{}
+	if len(target) > 0 {
+		query.Set("target", target)
+	}
+
+	precondition := new(MigratePrecondition)
+	if err := c.get(ctx, fmt.Sprintf("/nodes/%s/qemu/%s/migrate", node, vmId), query, precondition); err != nil {
+		return nil, err
+	}
+	return precondition, nil
+}
+
+// Migrates the VM to the target node with the given parameters (online, with-local-disks,
+// targetstorage...). Returns the UPID of the migration task.
+func (c *Client) MigrateQemu(ctx context.Context, node string, vmId string, target string, params url.Values) (string, error) {
+	form := url.Values{}
+	for key, values := range params {
+		form[key] = values
+	}
+	form.Set("target", target)
+
+	var upid string
+	if err := c.post(ctx, fmt.Sprintf("/nodes/%s/qemu/%s/migrate", node, vmId), form, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+const (
+	// Name of the pseudo snapshot representing the current state of a guest in snapshot listings.
+	CurrentSnapshot = "current"
+)
+
+// Snapshot is an entry of /nodes/{node}/{qemu|lxc}/{vmid}/snapshot.
+type Snapshot struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Name of the snapshot this one is based on, empty for the first snapshot.
+	Parent   string `json:"parent"`
+	SnapTime Int    `json:"snaptime"`
+	// Set if the snapshot includes the RAM of the running VM. Containers have no RAM state.
+	VmState Int `json:"vmstate"`
+}
+
+// Returns the snapshots of the VM, including the pseudo snapshot CurrentSnapshot.
+func (c *Client) Snapshots(ctx context.Context, node, vmId string) ([]Snapshot, error) {
+	return c.snapshots(ctx, GuestTypeQemu, node, vmId)
+}
+
+// Takes a snapshot of the VM. If vmState is set, the RAM of the running VM is saved as well.
+// Returns the UPID of the snapshot task.
+func (c *Client) CreateSnapshot(ctx context.Context, node, vmId, name, description string, vmState bool) (string, error) {
+	form := url.Values{}
+	if vmState {
+		form.Set("vmstate", "1")
+	}
+	return c.createSnapshot(ctx, GuestTypeQemu, node, vmId, name, description, form)
+}
+
+// Rolls the VM back to the snapshot. Returns the UPID of the rollback task.
+func (c *Client) RollbackSnapshot(ctx context.Context, node, vmId, name string) (string, error) {
+	return c.rollbackSnapshot(ctx, GuestTypeQemu, node, vmId, name)
+}
+
+// Deletes the snapshot of the VM. If force is set, the snapshot is removed from the configuration
+// even if removing its disk snapshots fails. Returns the UPID of the deletion task.
+func (c *Client) DeleteSnapshot(ctx context.Context, node, vmId, name string, force bool) (string, error) {
+	return c.deleteSnapshot(ctx, GuestTypeQemu, node, vmId, name, force)
+}
+
+// Returns the snapshots of the container, including the pseudo snapshot CurrentSnapshot.
+func (c *Client) LxcSnapshots(ctx context.Context, node, vmId string) ([]Snapshot, error) {
+	return c.snapshots(ctx, GuestTypeLxc, node, vmId)
+}
+
+// Takes a snapshot of the container. Returns the UPID of the snapshot task.
+func (c *Client) CreateLxcSnapshot(ctx context.Context, node, vmId, name, description string) (string, error) {
+	return c.createSnapshot(ctx, GuestTypeLxc, node, vmId, name, description, url.Values{})
+}
+
+// Rolls the container back to the snapshot. Returns the UPID of the rollback task.
+func (c *Client) RollbackLxcSnapshot(ctx context.Context, node, vmId, name string) (string, error) {
+	return c.rollbackSnapshot(ctx, GuestTypeLxc, node, vmId, name)
+}
+
+// Deletes the snapshot of the container. Returns the UPID of the deletion task.
+func (c *Client) DeleteLxcSnapshot(ctx context.Context, node, vmId, name string, force bool) (string, error) {
+	return c.deleteSnapshot(ctx, GuestTypeLxc, node, vmId, name, force)
+}
+
+func (c *Client) snapshots(ctx context.Context, guestType, node, vmId string) ([]Snapshot, error) {
+	snapshots := make([]Snapshot, 0)
+	if err := c.get(ctx, fmt.Sprintf("/nodes/%s/%s/%s/snapshot", node, guestType, vmId), nil, &snapshots); err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+func (c *Client) createSnapshot(ctx context.Context, guestType, node, vmId, name, description string, form url.Values) (string, error) {
+	form.Set("snapname", name)
+	if len(description) > 0 {
+		form.Set("description", description)
+	}
+
+	var upid string
+	if err := c.post(ctx, fmt.Sprintf("/nodes/%s/%s/%s/snapshot", node, guestType, vmId), form, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
+
+func (c *Client) rollbackSnapshot(ctx context.Context, guestType, node, vmId, name string) (string, error) {
+	var upid string
+	if err := c.post(ctx, fmt.Sprintf("/nodes/%s/%s/%s/snapshot/%s/rollback", node, guestType, vmId, name), nil, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
+
+func (c *Client) deleteSnapshot(ctx context.Context, guestType, node, vmId, name string, force bool) (string, error) {
+	params := url.Values{}
+	if force {
+		params.Set("force", "1")
+	}
+
+	var upid string
+	if err := c.delete(ctx, fmt.Sprintf("/nodes/%s/%s/%s/snapshot/%s", node, guestType, vmId, name), params, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Storage is an entry of /nodes/{node}/storage.
+type Storage struct {
+	Storage string `json:"storage"`
+	Type    string `json:"type"`
+	Content string `json:"content"`
+	Active  Int    `json:"active"`
+	Enabled Int    `json:"enabled"`
+	Shared  Int    `json:"shared"`
+	Total   Int    `json:"total"`
+	Used    Int    `json:"used"`
+	Avail   Int    `json:"avail"`
+}
+
+// Returns true if the storage accepts the content type (e.g. iso, images, backup).
+func (s Storage) Accepts(content string) bool {
+	for _, c := range strings.Split(s.Content, ",") {
+		if strings.TrimSpace(c) == content {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns all storage devices available on the node.
+func (c *Client) Storages(ctx context.Context, node string) ([]Storage, error) {
+	storages := make([]Storage, 0)
+	if err := c.get(ctx, fmt.Sprintf("/nodes/%s/storage", node), nil, &storages); err != nil {
+		return nil, err
+	}
+	return storages, nil
+}
+
+// StorageContent is an entry of /nodes/{node}/storage/{storage}/content.
+type StorageContent struct {
+	// Volume id, e.g. local:iso/ubuntu.iso
+	Volid   string `json:"volid"`
+	Content string `json:"content"`
+	Format  string `json:"format"`
+	Size    Int    `json:"size"`
+	Used    Int    `json:"used"`
+	VmId    Int    `json:"vmid"`
+	Ctime   Int    `json:"ctime"`
+	Notes   string `json:"notes"`
+}
+
+// Returns the file name part of the volume id, e.g. ubuntu.iso for local:iso/ubuntu.iso
+func (sc StorageContent) Filename() string {
+	name := sc.Volid[strings.Index(sc.Volid, ":")+1:]
+	return name[strings.LastIndex(name, "/")+1:]
+}
+
+// Returns the content of the storage. If content is not empty, only content of that type
+// (e.g. iso, backup) is returned.
+func (c *Client) StorageContent(ctx context.Context, node, storage, content string) ([]StorageContent, error) {
+	query := url.Values{}
+	if len(content) > 0 {
+		query.Set("content", content)
+	}
+
+	contents := make([]StorageContent, 0)
+	if err := c.get(ctx, fmt.Sprintf("/nodes/%s/storage/%s/content", node, storage), query, &contents); err != nil {
+		return nil, err
+	}
+	return contents, nil
+}
+
+// Deletes the volume from the storage. Returns the UPID of the deletion task, which
+// servers older than Proxmox VE 6.4 do not report.
+func (c *Client) DeleteVolume(ctx context.Context, node, storage, volid string) (string, error) {
+	var upid string
+	if err := c.delete(ctx, fmt.Sprintf("/nodes/%s/storage/%s/content/%s", node, storage, url.PathEscape(volid)), nil, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
+
+// Metadata of a remote file, as seen by the node through /nodes/{node}/query-url-metadata.
+type URLMetadata struct {
+	Filename string `json:"filename"`
+	Size     Int    `json:"size"`
+	MimeType string `json:"mimetype"`
+}
+
+// Queries the name and size of the file at the URL from the node. Size is zero if the remote
+// server does not report it.
+func (c *Client) QueryURLMetadata(ctx context.Context, node, fileUrl string, verifyCertificates bool) (*URLMetadata, error) {
+	query := url.Values{}
+	query.Set("url", fileUrl)
+	query.Set("verify-certificates", boolParam(verifyCertificates))
+
+	metadata := new(URLMetadata)
+	if err := c.get(ctx, fmt.Sprintf("/nodes/%s/query-url-metadata", node), query, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// Parameters of a download to /nodes/{node}/storage/{storage}/download-url.
+type DownloadURLRequest struct {
+	Node    string
+	Storage string
+	// Content type of the file, either iso or vztmpl.
+	Content string
+	// Name of the file on the storage.
+	Filename string
+	URL      string
+	// Optional checksum of the file, verified by the node after download. ChecksumAlgorithm is one
+	// of md5, sha1, sha224, sha256, sha384 and sha512.
+	Checksum          string
+	ChecksumAlgorithm string
+	// If set, the node verifies the TLS certificate of the remote server.
+	VerifyCertificates bool
+}
+
+// Asks the node to download the file at the URL into the storage, and returns the UPID of the
+// download task. Available as of Proxmox VE 7.
+func (c *Client) DownloadURL(ctx context.Context, dr *DownloadURLRequest) (string, error) {
+	form := url.Values{}
+	form.Set("content", dr.Content)
+	form.Set("filename", dr.Filename)
+	form.Set("url", dr.URL)
+	form.Set("verify-certificates", boolParam(dr.VerifyCertificates))
+	if len(dr.Checksum) > 0 {
+		form.Set("checksum", dr.Checksum)
+		form.Set("checksum-algorithm", dr.ChecksumAlgorithm)
+	}
+
+	var upid string
+	if err := c.post(ctx, fmt.Sprintf("/nodes/%s/storage/%s/download-url", dr.Node, dr.Storage), form, &upid); err != nil {
+		return "", err
+	}
+	return upid, nil
+}
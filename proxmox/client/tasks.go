@@ -0,0 +1,181 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TaskStatusRunning = "running"
+	TaskStatusStopped = "stopped"
+
+	TaskExitStatusOK = "OK"
+)
+
+// UPID uniquely identifies a task in the cluster. Its string form is
+// UPID:{node}:{pid}:{pstart}:{starttime}:{type}:{id}:{user}: with pid, pstart and starttime in hex.
+type UPID struct {
+	Node      string
+	Pid       int64
+	PStart    int64
+	StartTime time.Time
+	Type      string
+	Id        string
+	User      string
+	raw       string
+}
+
+// Parses the string form of an UPID.
+func ParseUPID(upid string) (*UPID, error) {
+	parts := strings.Split(strings.TrimSpace(upid), ":")
+	if len(parts) < 8 || parts[0] != "UPID" {
+		return nil, fmt.Errorf("malformed upid %s", upid)
+	}
+
+	var numbers [3]int64
+	for i, part := range parts[2:5] {
+		n, err := strconv.ParseInt(part, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed upid %s", upid)
+		}
+		numbers[i] = n
+	}
+
+	return &UPID{
+		Node:      parts[1],
+		Pid:       numbers[0],
+		PStart:    numbers[1],
+		StartTime: time.Unix(numbers[2], 0),
+		Type:      parts[5],
+		Id:        parts[6],
+		User:      strings.Join(parts[7:len(parts)-1], ":"),
+		raw:       strings.TrimSpace(upid),
+	}, nil
+}
+
+// Returns the string form of the UPID.
+func (u *UPID) String() string {
+	return u.raw
+}
+
+// TaskStatus is the status of a task identified by its UPID.
+type TaskStatus struct {
+	UPID       string `json:"upid"`
+	Node       string `json:"node"`
+	Type       string `json:"type"`
+	Id         string `json:"id"`
+	User       string `json:"user"`
+	Status     string `json:"status"`
+	ExitStatus string `json:"exitstatus"`
+	StartTime  Int    `json:"starttime"`
+	Pid        Int    `json:"pid"`
+}
+
+// Returns true if the task is no longer running.
+func (s *TaskStatus) Finished() bool {
+	return s.Status == TaskStatusStopped
+}
+
+// Returns true if the task finished with exit status OK.
+func (s *TaskStatus) Succeeded() bool {
+	return s.Finished() && s.ExitStatus == TaskExitStatusOK
+}
+
+// Returns the status of the task.
+func (c *Client) TaskStatus(ctx context.Context, node, upid string) (*TaskStatus, error) {
+	status := new(TaskStatus)
+	if err := c.get(ctx, fmt.Sprintf("/nodes/%s/tasks/%s/status", node, url.PathEscape(upid)), nil, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// A line of the task log.
+type TaskLogLine struct {
+	// Line number, starting at 1.
+	N Int    `json:"n"`
+	T string `json:"t"`
+}
+
+// Returns at most limit lines of the task log, starting at line offset start (zero based).
+func (c *Client) TaskLog(ctx context.Context, node, upid string, start, limit int) ([]TaskLogLine, error) {
+	query := url.Values{}
+	query.Set("start", strconv.Itoa(start))
+	query.Set("limit", strconv.Itoa(limit))
+
+	lines := make([]TaskLogLine, 0)
+	if err := c.get(ctx, fmt.Sprintf("/nodes/%s/tasks/%s/log", node, url.PathEscape(upid)), query, &lines); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// Task is an entry of /nodes/{node}/tasks.
+type Task struct {
+	UPID      string `json:"upid"`
+	Node      string `json:"node"`
+	Type      string `json:"type"`
+	Id        string `json:"id"`
+	User      string `json:"user"`
+	StartTime Int    `json:"starttime"`
+	EndTime   Int    `json:"endtime"`
+	// Exit status of a finished task, empty while running.
+	Status string `json:"status"`
+}
+
+// Returns true if the task has not finished yet.
+func (t *Task) Running() bool {
+	return t.EndTime == 0
+}
+
+// Filters of a task listing. Zero values do not filter.
+type TaskFilter struct {
+	Limit int
+	VmId  string
+	Type  string
+	User  string
+	// Only list tasks that failed.
+	Errors bool
+	// One of archive, active or all. Defaults to archive on the server.
+	Source string
+}
+
+// Returns the most recent tasks of the node matching the filter.
+func (c *Client) Tasks(ctx context.Context, node string, filter *TaskFilter) ([]Task, error) {
+	query := url.Values{}
+	if filter != nil {
+		if filter.Limit > 0 {
+			query.Set("limit", strconv.Itoa(filter.Limit))
+		}
+		if len(filter.VmId) > 0 {
+			query.Set("vmid", filter.VmId)
+		}
+		if len(filter.Type) > 0 {
+			query.Set("typefilter", filter.Type)
+		}
+		if len(filter.User) > 0 {
+			query.Set("userfilter", filter.User)
+		}
+		if filter.Errors {
+			query.Set("errors", "1")
+		}
+		if len(filter.Source) > 0 {
+			query.Set("source", filter.Source)
+		}
+	}
+
+	tasks := make([]Task, 0)
+	if err := c.get(ctx, fmt.Sprintf("/nodes/%s/tasks", node), query, &tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// Stops the running task.
+func (c *Client) StopTask(ctx context.Context, node, upid string) error {
+	return c.delete(ctx, fmt.Sprintf("/nodes/%s/tasks/%s", node, url.PathEscape(upid)), nil, nil)
+}
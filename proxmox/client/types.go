@@ -0,0 +1,147 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Int decodes integers that Proxmox reports either as JSON numbers or as strings,
+// depending on the endpoint and the server version. Flags reported as JSON booleans
+// decode to 1 and 0.
+type Int int64
+
+func (i *Int) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	switch s {
+	case "", "null", "false":
+		*i = 0
+		return nil
+	case "true":
+		*i = 1
+		return nil
+	}
+
+	var f float64
+	if err := json.Unmarshal([]byte(s), &f); err != nil {
+		return err
+	}
+	*i = Int(f)
+	return nil
+}
+
+// Returns the decimal representation of the integer.
+func (i Int) String() string {
+	return strconv.FormatInt(int64(i), 10)
+}
+
+// Returns the Proxmox representation of a boolean parameter.
+func boolParam(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// Config is the configuration of a VM or container, keyed by option (cores, memory, scsi0...).
+// Proxmox reports values as strings or numbers; all values are kept as strings.
+type Config map[string]string
+
+func (c *Config) UnmarshalJSON(b []byte) error {
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	*c = make(Config, len(raw))
+	for k, v := range raw {
+		if v != nil {
+			(*c)[k] = stringValue(v)
+		}
+	}
+	return nil
+}
+
+// Returns the string representation of a decoded JSON value. Nil becomes the empty string.
+func stringValue(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return boolParam(value)
+	default:
+		encoded, _ := json.Marshal(value)
+		return string(encoded)
+	}
+}
+
+// Returns the option keys in alphabetical order.
+func (c Config) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Returns the digest of the configuration, used to guard updates against concurrent modification.
+func (c Config) Digest() string {
+	return c["digest"]
+}
+
+// Returns the value of the key in a property string like 'virtio=AA:BB,bridge=vmbr0'.
+func PropertyValue(value, key string) string {
+	for _, part := range strings.Split(value, ",") {
+		if strings.HasPrefix(part, key+"=") {
+			return part[len(key)+1:]
+		}
+	}
+	return ""
+}
+
+// Returns the property string with the value of the key replaced, or appended if absent.
+func WithProperty(value, key, option string) string {
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		if strings.HasPrefix(part, key+"=") {
+			parts[i] = key + "=" + option
+			return strings.Join(parts, ",")
+		}
+	}
+	return value + "," + key + "=" + option
+}
+
+// Parses a disk size like 64G or 512M into bytes. Sizes without unit are bytes.
+func ParseSize(size string) (int64, error) {
+	if len(size) == 0 {
+		return 0, fmt.Errorf("no size")
+	}
+
+	shift := uint(0)
+	switch size[len(size)-1] {
+	case 'K', 'k':
+		shift = 10
+	case 'M', 'm':
+		shift = 20
+	case 'G', 'g':
+		shift = 30
+	case 'T', 't':
+		shift = 40
+	}
+	if shift > 0 {
+		size = size[:len(size)-1]
+	}
+
+	n, err := strconv.ParseFloat(size, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(n * float64(int64(1)<<shift)), nil
+}
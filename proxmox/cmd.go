@@ -1,7 +1,14 @@
 package proxmox
 
 import (
+	"github.com/xeha-gmbh/homelab/proxmox/backup"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/contexts"
+	"github.com/xeha-gmbh/homelab/proxmox/ct"
 	"github.com/xeha-gmbh/homelab/proxmox/login"
+	"github.com/xeha-gmbh/homelab/proxmox/storage"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
+	"github.com/xeha-gmbh/homelab/proxmox/template"
 	"github.com/xeha-gmbh/homelab/proxmox/upload"
 	"github.com/xeha-gmbh/homelab/proxmox/vm"
 	"github.com/spf13/cobra"
@@ -13,9 +20,18 @@ func NewProxmoxCommand() *cobra.Command {
 		Short: "easily interact with the proxmox platform for daily tasks",
 	}
 
+	cmd.PersistentFlags().String(common.FlagContext, "",
+		"The context of the ticket cache to use. Defaults to the current context.")
+
 	cmd.AddCommand(login.NewProxmoxLoginCommand())
+	cmd.AddCommand(contexts.NewProxmoxContextCommand())
 	cmd.AddCommand(upload.NewProxmoxUploadCommand())
+	cmd.AddCommand(storage.NewProxmoxStorageCommand())
 	cmd.AddCommand(vm.NewProxmoxVMCommand())
+	cmd.AddCommand(task.NewProxmoxTaskCommand())
+	cmd.AddCommand(backup.NewProxmoxBackupCommand())
+	cmd.AddCommand(ct.NewProxmoxCTCommand())
+	cmd.AddCommand(template.NewProxmoxTemplateCommand())
 
 	return cmd
 }
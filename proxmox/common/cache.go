@@ -2,65 +2,217 @@ package common
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xeha-gmbh/homelab/proxmox/client"
 )
 
 const (
-	TicketCache = ".proxmox"
+	TicketCache    = ".proxmox"
+	DefaultContext = "default"
+)
+
+var (
+	cacheMu sync.Mutex
 )
 
-// Session information representing an authenticated Proxmox user
+// Session information representing an authenticated Proxmox user. A subject either holds a ticket
+// and CSRF token obtained by password login, or an API token id and secret.
 type ProxmoxSubject struct {
-	Username  string `json:"username"`
-	Ticket    string `json:"ticket"`
-	CSRFToken string `json:"csrf_token"`
-	ApiServer string `json:"api_server"`
+	Username    string     `json:"username"`
+	Ticket      string     `json:"ticket,omitempty"`
+	CSRFToken   string     `json:"csrf_token,omitempty"`
+	TokenId     string     `json:"token_id,omitempty"`
+	TokenSecret string     `json:"token_secret,omitempty"`
+	ApiServer   string     `json:"api_server"`
+	Realm       string     `json:"realm,omitempty"`
+	IssuedAt    *time.Time `json:"issued_at,omitempty"`
+	// Range of VM ids, e.g. 100-199, that automatically allocated ids are taken from.
+	VmIdRange string `json:"vmid_range,omitempty"`
+	// Name of the context this subject is stored under in the ticket cache.
+	Context string `json:"-"`
+}
+
+// Returns true if the subject authenticates with an API token instead of a ticket.
+func (s *ProxmoxSubject) HasToken() bool {
+	return len(s.TokenId) > 0
+}
+
+// Returns the credentials to authenticate API requests on behalf of this subject.
+func (s *ProxmoxSubject) Credentials() client.Credentials {
+	if s.HasToken() {
+		return &client.APIToken{
+			User:    s.Username,
+			TokenId: s.TokenId,
+			Secret:  s.TokenSecret,
+		}
+	}
+	return &client.Ticket{
+		Username:  s.Username,
+		Ticket:    s.Ticket,
+		CSRFToken: s.CSRFToken,
+	}
+}
+
+// The ticket cache file. It holds any number of named contexts, each being the subject of one Proxmox
+// API server, and the name of the context used when none is selected explicitly.
+type ProxmoxCache struct {
+	CurrentContext string                     `json:"current_context"`
+	Contexts       map[string]*ProxmoxSubject `json:"contexts"`
+}
+
+// Returns the names of all contexts in alphabetical order.
+func (c *ProxmoxCache) ContextNames() []string {
+	names := make([]string, 0, len(c.Contexts))
+	for name := range c.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
-// Read session subject from ticket cache
-func ReadSubjectFromCache() (*ProxmoxSubject, error) {
+// Returns the name the context is referred to. An empty name refers to the current context, or the
+// default context if no current context is set.
+func (c *ProxmoxCache) resolve(name string) string {
+	switch {
+	case len(name) > 0:
+		return name
+	case len(c.CurrentContext) > 0:
+		return c.CurrentContext
+	default:
+		return DefaultContext
+	}
+}
+
+// Read the ticket cache. A missing cache is reported as an error satisfying os.IsNotExist.
+// Caches written by older versions, holding a single subject, are read as the default context.
+func ReadCache() (*ProxmoxCache, error) {
 	var (
-		err     error
-		file    *os.File
-		b       []byte
-		subject ProxmoxSubject
+		err    error
+		b      []byte
+		cache  = &ProxmoxCache{}
+		legacy ProxmoxSubject
 	)
 
-	file, err = os.Open(proxmoxTicketCache())
-	if err != nil {
+	if b, err = ioutil.ReadFile(proxmoxTicketCache()); err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	b, err = ioutil.ReadAll(file)
-	if err != nil {
+	if err = json.Unmarshal(b, cache); err != nil {
 		return nil, err
 	}
 
-	err = json.Unmarshal(b, &subject)
-	if err != nil {
-		return nil, err
+	if cache.Contexts == nil {
+		cache.Contexts = make(map[string]*ProxmoxSubject)
+		if err = json.Unmarshal(b, &legacy); err == nil && len(legacy.ApiServer) > 0 {
+			cache.CurrentContext = DefaultContext
+			cache.Contexts[DefaultContext] = &legacy
+		}
 	}
 
-	return &subject, nil
+	for name, subject := range cache.Contexts {
+		subject.Context = name
+	}
+
+	return cache, nil
 }
 
-// Write session information to ticket cache in (pretty) JSON format.
-func WriteSubjectToCache(subject *ProxmoxSubject) error {
-	ticketCachePath := proxmoxTicketCache()
+// Write the ticket cache in (pretty) JSON format. The file is replaced atomically, so that concurrent
+// readers never see a partially written cache.
+func WriteCache(cache *ProxmoxCache) error {
+	path := proxmoxTicketCache()
+	if b, err := json.MarshalIndent(cache, "", "    "); err != nil {
+		return err
+	} else if err := ioutil.WriteFile(path+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Read the ticket cache, apply the modification and write it back. A missing cache is treated as empty.
+func UpdateCache(modify func(cache *ProxmoxCache) error) error {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
 
-	if b, err := json.MarshalIndent(subject, "", "    "); err != nil {
+	cache, err := ReadCache()
+	if os.IsNotExist(err) {
+		cache, err = &ProxmoxCache{Contexts: make(map[string]*ProxmoxSubject)}, nil
+	}
+	if err != nil {
 		return err
-	} else if err := ioutil.WriteFile(ticketCachePath, b, 0600); err != nil {
+	}
+
+	if err := modify(cache); err != nil {
 		return err
 	}
+	return WriteCache(cache)
+}
+
+// Read session subject of the named context from ticket cache. An empty name refers to the current context.
+func ReadSubjectFromCache(name string) (*ProxmoxSubject, error) {
+	cache, err := ReadCache()
+	if err != nil {
+		return nil, err
+	}
+
+	name = cache.resolve(name)
+	if subject, ok := cache.Contexts[name]; ok {
+		return subject, nil
+	}
+	return nil, fmt.Errorf("no context by name %s in ticket cache", name)
+}
 
+// Returns ErrContextMismatch if a session of the API server cannot be saved to the context without
+// naming it, because the current context belongs to another API server. A missing cache is no conflict.
+func CheckContext(name, apiServer string) error {
+	cache, err := ReadCache()
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return cache.check(name, apiServer)
+}
+
+func (c *ProxmoxCache) check(name, apiServer string) error {
+	if len(name) > 0 {
+		return nil
+	}
+	name = c.resolve(name)
+	if existing, ok := c.Contexts[name]; ok && len(existing.ApiServer) > 0 && existing.ApiServer != apiServer {
+		return &ErrContextMismatch{Context: name, ContextServer: existing.ApiServer, ApiServer: apiServer}
+	}
 	return nil
 }
 
+// Write session information to the context ProxmoxSubject#Context of the ticket cache. If the subject
+// has no context name, the current context is used, unless it belongs to another API server, which is
+// reported as ErrContextMismatch. The context becomes the current context if there was none. Settings
+// of the context not related to the session, like the VM id range, are kept.
+func WriteSubjectToCache(subject *ProxmoxSubject) error {
+	return UpdateCache(func(cache *ProxmoxCache) error {
+		if err := cache.check(subject.Context, subject.ApiServer); err != nil {
+			return err
+		}
+		subject.Context = cache.resolve(subject.Context)
+		if existing, ok := cache.Contexts[subject.Context]; ok && len(subject.VmIdRange) == 0 {
+			subject.VmIdRange = existing.VmIdRange
+		}
+		cache.Contexts[subject.Context] = subject
+		if len(cache.CurrentContext) == 0 {
+			cache.CurrentContext = subject.Context
+		}
+		return nil
+	})
+}
+
 // Returns the expected Proxmox ticket cache location for the current user.
 // If current user home directory cannot be acquired, it defaults to current directory.
 func proxmoxTicketCache() string {
@@ -70,3 +222,16 @@ func proxmoxTicketCache() string {
 		return filepath.Join(u.HomeDir, TicketCache)
 	}
 }
+
+// Returned when the session of an API server would replace the current context, which belongs to another
+// API server, because no context was named.
+type ErrContextMismatch struct {
+	Context       string
+	ContextServer string
+	ApiServer     string
+}
+
+func (e *ErrContextMismatch) Error() string {
+	return fmt.Sprintf("current context %s belongs to api server %s, select a context with --%s to log into %s",
+		e.Context, e.ContextServer, FlagContext, e.ApiServer)
+}
@@ -0,0 +1,40 @@
+package common
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+const (
+	// Name of the global flag selecting the context of the ticket cache.
+	FlagContext = "context"
+)
+
+type selectedContextKey struct{}
+
+// Returns a copy of ctx selecting the named context of the ticket cache. Operations reading the
+// ticket cache with this context use the subject of the named context instead of the current one.
+func WithSelectedContext(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, selectedContextKey{}, name)
+}
+
+// Returns the name of the ticket cache context selected by ctx, or an empty string for the current context.
+func SelectedContext(ctx context.Context) string {
+	name, _ := ctx.Value(selectedContextKey{}).(string)
+	return name
+}
+
+// Returns the context to run the command's operations in. It carries the printer (unless nil), and
+// selects the ticket cache context named by the global '--context' flag.
+func CommandContext(cmd *cobra.Command, output shared.MessagePrinter) context.Context {
+	ctx := context.Background()
+	if output != nil {
+		ctx = shared.WithPrinter(ctx, output)
+	}
+	if name, err := cmd.Flags().GetString(FlagContext); err == nil && len(name) > 0 {
+		ctx = WithSelectedContext(ctx, name)
+	}
+	return ctx
+}
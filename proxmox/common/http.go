@@ -1,29 +1,42 @@
 package common
 
 import (
+	"context"
 	"crypto/tls"
 	"net/http"
-)
 
-const (
-	ProxmoxCSRFTokenHeader  = "CSRFPreventionToken"
-	ProxmoxTicketCookieName = "PVEAuthCookie"
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+	"github.com/xeha-gmbh/homelab/shared"
 )
 
-func WithHttpCredentials(r *http.Request) (*http.Request, error) {
-	if subject, err := ReadSubjectFromCache(); err != nil {
-		return r, err
-	} else {
-		r.Header.Set(ProxmoxCSRFTokenHeader, subject.CSRFToken)
+// Returns a Proxmox API client targeting the API server of the subject and authenticated with its credentials.
+func NewClient(subject *ProxmoxSubject, output shared.MessagePrinter, options ...client.Option) *client.Client {
+	return client.New(subject.ApiServer, append([]client.Option{
+		client.WithHttpClient(HttpClient()),
+		client.WithPrinter(output),
+		client.WithCredentials(subject.Credentials()),
+	}, options...)...)
+}
 
-		cookie := &http.Cookie{
-			Name:  ProxmoxTicketCookieName,
-			Value: subject.Ticket,
-		}
-		r.AddCookie(cookie)
+// Returns a Proxmox API client authenticated with the subject read from the ticket cache. Tickets
+// are renewed as necessary. If ctx carries a login function (see WithLoginFunc), the client also
+// logs in again transparently when the server rejects its ticket.
+func NewClientFromCache(ctx context.Context, output shared.MessagePrinter) (*client.Client, error) {
+	subject, err := ReadFreshSubject(ctx, output)
+	if err != nil {
+		return nil, err
+	}
 
-		return r, nil
+	if login := loginFuncFrom(ctx); login != nil {
+		return NewClient(subject, output, client.WithReauthenticator(func(ctx context.Context) (client.Credentials, error) {
+			s, err := login(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return s.Credentials(), nil
+		})), nil
 	}
+	return NewClient(subject, output), nil
 }
 
 // Returns an http client.
@@ -0,0 +1,125 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+const (
+	// Lifetime of a Proxmox ticket.
+	TicketLifetime = 2 * time.Hour
+	// Tickets older than this are renewed before use.
+	TicketRenewalAge = time.Hour
+	// Tickets are considered expired this long before their actual expiry, leaving time for the request.
+	ticketExpiryMargin = time.Minute
+)
+
+var (
+	ErrTicketExpired = errors.New("ticket in cache has expired, please login again")
+)
+
+// Function to perform a fresh login, typically with credentials known to an in-process caller.
+type LoginFunc func(ctx context.Context) (*ProxmoxSubject, error)
+
+type loginFuncKey struct{}
+
+// Returns a copy of ctx carrying the login function. Clients created by NewClientFromCache with this
+// context use the function to log in again when the cached ticket expired or was rejected.
+func WithLoginFunc(ctx context.Context, login LoginFunc) context.Context {
+	return context.WithValue(ctx, loginFuncKey{}, login)
+}
+
+func loginFuncFrom(ctx context.Context) LoginFunc {
+	login, _ := ctx.Value(loginFuncKey{}).(LoginFunc)
+	return login
+}
+
+// Returns true if the subject holds a ticket that is expired or about to expire. Subjects with
+// API tokens and subjects without a known issue time never expire.
+func (s *ProxmoxSubject) Expired() bool {
+	if s.HasToken() || !s.hasIssueTime() {
+		return false
+	}
+	return time.Since(*s.IssuedAt) >= TicketLifetime-ticketExpiryMargin
+}
+
+// Returns true if the subject holds a ticket that should be renewed before use. Tickets without a
+// known issue time (i.e. written by an older version) are always renewed.
+func (s *ProxmoxSubject) NeedsRenewal() bool {
+	if s.HasToken() {
+		return false
+	}
+	return !s.hasIssueTime() || time.Since(*s.IssuedAt) >= TicketRenewalAge
+}
+
+// Older versions wrote the zero time for subjects without issue time.
+func (s *ProxmoxSubject) hasIssueTime() bool {
+	return s.IssuedAt != nil && !s.IssuedAt.IsZero()
+}
+
+// Renews the ticket of the subject in place and saves it to the ticket cache.
+func RenewTicket(ctx context.Context, subject *ProxmoxSubject, output shared.MessagePrinter) error {
+	ticket, err := NewClient(subject, output).RenewTicket(ctx, subject.Username, subject.Ticket)
+	if err != nil {
+		return err
+	}
+
+	subject.Ticket = ticket.Ticket
+	subject.CSRFToken = ticket.CSRFToken
+	issuedAt := time.Now()
+	subject.IssuedAt = &issuedAt
+
+	output.Debug("Ticket of user {{index .user}} renewed.",
+		map[string]interface{}{
+			"event": "ticket_renewed",
+			"user":  subject.Username,
+		})
+
+	return WriteSubjectToCache(subject)
+}
+
+// Reads the subject from the ticket cache and makes sure its ticket is usable: tickets about to
+// expire are renewed, and expired or unrenewable tickets are replaced by a fresh login if ctx carries
+// a login function. Otherwise, ErrTicketExpired is returned for expired tickets.
+func ReadFreshSubject(ctx context.Context, output shared.MessagePrinter) (*ProxmoxSubject, error) {
+	login := loginFuncFrom(ctx)
+
+	subject, err := ReadSubjectFromCache(SelectedContext(ctx))
+	if err != nil {
+		if login != nil {
+			return login(ctx)
+		}
+		return nil, err
+	}
+
+	if subject.Expired() {
+		if login != nil {
+			return login(ctx)
+		}
+		return nil, ErrTicketExpired
+	}
+
+	if subject.NeedsRenewal() {
+		if err := RenewTicket(ctx, subject, output); err != nil {
+			output.Debug("Failed to renew ticket. Cause: {{index .cause}}",
+				map[string]interface{}{
+					"event": "ticket_renewal_failed",
+					"cause": err.Error(),
+				})
+			switch {
+			case login != nil:
+				return login(ctx)
+			case client.IsUnauthorized(err):
+				return nil, ErrTicketExpired
+			default:
+				return nil, err
+			}
+		}
+	}
+
+	return subject, nil
+}
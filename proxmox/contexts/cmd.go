@@ -0,0 +1,242 @@
+package contexts
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/vm"
+	. "github.com/xeha-gmbh/homelab/shared"
+)
+
+var (
+	ErrNoContext = ErrorFactory(10)("no_context_error")
+)
+
+// Returns the 'context' command, managing the named contexts of the ticket cache.
+func NewProxmoxContextCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "context",
+		Short: "manage named contexts in the ticket cache",
+	}
+
+	cmd.AddCommand(newListCommand())
+	cmd.AddCommand(newUseCommand())
+	cmd.AddCommand(newDeleteCommand())
+	cmd.AddCommand(newSetRangeCommand())
+
+	return cmd
+}
+
+func newListCommand() *cobra.Command {
+	extraArgs := new(ExtraArgs)
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "list all contexts in the ticket cache",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SetOutput(os.Stdout)
+			return cmd.ParseFlags(args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output := WithConfig(cmd, extraArgs)
+
+			cache, err := common.ReadCache()
+			if os.IsNotExist(err) {
+				cache, err = &common.ProxmoxCache{}, nil
+			}
+			if err != nil {
+				output.Fatal(ErrOp.ExitCode,
+					"Failed to read ticket cache. Cause: {{index .cause}}",
+					map[string]interface{}{
+						"event": "cache_read_failed",
+						"cause": err.Error(),
+					})
+				return ErrOp
+			}
+
+			for _, name := range cache.ContextNames() {
+				subject := cache.Contexts[name]
+				marker := " "
+				if name == cache.CurrentContext {
+					marker = "*"
+				}
+				auth := "ticket"
+				if subject.HasToken() {
+					auth = "token"
+				}
+				output.Info("{{index .marker}} {{index .name}}\t{{index .api_server}}\t{{index .user}}\t{{index .auth}}",
+					map[string]interface{}{
+						"event":      "context",
+						"marker":     marker,
+						"name":       name,
+						"current":    name == cache.CurrentContext,
+						"api_server": subject.ApiServer,
+						"user":       subject.Username,
+						"realm":      subject.Realm,
+						"auth":       auth,
+						"vmid_range": subject.VmIdRange,
+					})
+			}
+			return nil
+		},
+	}
+
+	extraArgs.InjectExtraArgs(cmd)
+
+	return cmd
+}
+
+func newUseCommand() *cobra.Command {
+	extraArgs := new(ExtraArgs)
+
+	cmd := &cobra.Command{
+		Use:   "use <name>",
+		Short: "make the named context the current context",
+		Args:  cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SetOutput(os.Stdout)
+			return cmd.ParseFlags(args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output := WithConfig(cmd, extraArgs)
+			name := args[0]
+
+			err := common.UpdateCache(func(cache *common.ProxmoxCache) error {
+				if _, ok := cache.Contexts[name]; !ok {
+					return fmt.Errorf("no context by name %s", name)
+				}
+				cache.CurrentContext = name
+				return nil
+			})
+			if err != nil {
+				output.Fatal(ErrNoContext.ExitCode,
+					"Failed to switch to context {{index .name}}. Cause: {{index .cause}}",
+					map[string]interface{}{
+						"event": "context_switch_failed",
+						"name":  name,
+						"cause": err.Error(),
+					})
+				return ErrNoContext
+			}
+
+			output.Info("Switched to context {{index .name}}.",
+				map[string]interface{}{
+					"event": "context_switched",
+					"name":  name,
+				})
+			return nil
+		},
+	}
+
+	extraArgs.InjectExtraArgs(cmd)
+
+	return cmd
+}
+
+func newDeleteCommand() *cobra.Command {
+	extraArgs := new(ExtraArgs)
+
+	cmd := &cobra.Command{
+		Use:   "delete <name>",
+		Short: "delete the named context from the ticket cache",
+		Args:  cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SetOutput(os.Stdout)
+			return cmd.ParseFlags(args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output := WithConfig(cmd, extraArgs)
+			name := args[0]
+
+			err := common.UpdateCache(func(cache *common.ProxmoxCache) error {
+				if _, ok := cache.Contexts[name]; !ok {
+					return fmt.Errorf("no context by name %s", name)
+				}
+				delete(cache.Contexts, name)
+				if cache.CurrentContext == name {
+					cache.CurrentContext = ""
+				}
+				return nil
+			})
+			if err != nil {
+				output.Fatal(ErrNoContext.ExitCode,
+					"Failed to delete context {{index .name}}. Cause: {{index .cause}}",
+					map[string]interface{}{
+						"event": "context_delete_failed",
+						"name":  name,
+						"cause": err.Error(),
+					})
+				return ErrNoContext
+			}
+
+			output.Info("Deleted context {{index .name}}.",
+				map[string]interface{}{
+					"event": "context_deleted",
+					"name":  name,
+				})
+			return nil
+		},
+	}
+
+	extraArgs.InjectExtraArgs(cmd)
+
+	return cmd
+}
+
+func newSetRangeCommand() *cobra.Command {
+	extraArgs := new(ExtraArgs)
+
+	cmd := &cobra.Command{
+		Use:   "set-range <name> [from-to]",
+		Short: "set the range of automatically allocated VM ids of the named context, or clear it",
+		Args:  cobra.RangeArgs(1, 2),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SetOutput(os.Stdout)
+			return cmd.ParseFlags(args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output := WithConfig(cmd, extraArgs)
+			name, idRange := args[0], ""
+
+			err := common.UpdateCache(func(cache *common.ProxmoxCache) error {
+				subject, ok := cache.Contexts[name]
+				if !ok {
+					return fmt.Errorf("no context by name %s", name)
+				}
+				if len(args) > 1 {
+					r, err := vm.ParseIdRange(args[1])
+					if err != nil {
+						return err
+					}
+					idRange = r.String()
+				}
+				subject.VmIdRange = idRange
+				return nil
+			})
+			if err != nil {
+				output.Fatal(ErrNoContext.ExitCode,
+					"Failed to set the vm id range of context {{index .name}}. Cause: {{index .cause}}",
+					map[string]interface{}{
+						"event": "context_set_range_failed",
+						"name":  name,
+						"cause": err.Error(),
+					})
+				return ErrNoContext
+			}
+
+			output.Info("Set the vm id range of context {{index .name}} to '{{index .range}}'.",
+				map[string]interface{}{
+					"event": "context_range_set",
+					"name":  name,
+					"range": idRange,
+				})
+			return nil
+		},
+	}
+
+	extraArgs.InjectExtraArgs(cmd)
+
+	return cmd
+}
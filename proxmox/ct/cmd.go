@@ -0,0 +1,391 @@
+package ct
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
+	"github.com/xeha-gmbh/homelab/proxmox/vm"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+const (
+	flagNode  = "node"
+	flagForce = "force"
+	flagPurge = "purge"
+
+	actionCreate = "create"
+	actionDelete = "delete"
+	actionSet    = "set"
+)
+
+var (
+	output   shared.MessagePrinter
+	commands = &vm.GuestCommands{Kind: "container", Noun: "container", Prefix: "ct", Output: &output}
+)
+
+// Returns the 'ct' command, managing LXC containers.
+func NewProxmoxCTCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ct",
+		Short: "manage proxmox LXC containers",
+	}
+
+	cmd.AddCommand(newCreateCommand())
+	cmd.AddCommand(newListCommand())
+	cmd.AddCommand(newSetCommand())
+	for _, action := range []struct{ name, short string }{
+		{client.LxcActionStart, "start a container"},
+		{client.LxcActionStop, "stop a container immediately"},
+		{client.LxcActionShutdown, "shut down a container through its init system"},
+		{client.LxcActionReboot, "reboot a container"},
+	} {
+		cmd.AddCommand(newStateCommand(action.name, action.short))
+	}
+	cmd.AddCommand(newDeleteCommand())
+	cmd.AddCommand(newSnapshotCommand())
+
+	return cmd
+}
+
+func newCreateCommand() *cobra.Command {
+	var (
+		extraArgs   = new(shared.ExtraArgs)
+		waitArgs    = new(task.WaitArgs)
+		ct          = new(Container)
+		sshKeysFile string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "create",
+		Short: "create a container from a template",
+		Long: dedent.Dedent(`
+			Creates a container from an OS template in vztmpl storage. The template is either a volume id,
+			e.g. local:vztmpl/debian-12-standard_12.2-1_amd64.tar.zst, or the name of a template of the
+			appliance index, which is downloaded into --template-storage unless present. See 'proxmox
+			template list'.
+		`),
+		PreRunE: commands.PreRun(extraArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(sshKeysFile) > 0 {
+				keys, err := ioutil.ReadFile(sshKeysFile)
+				if err != nil {
+					return commands.ReportError(actionCreate, ct.VmId, err)
+				}
+				ct.SshKeys = string(keys)
+			}
+
+			ctx := common.CommandContext(cmd, output)
+			upid, err := CreateContainer(ctx, ct)
+			if err != nil {
+				return commands.ReportError(actionCreate, ct.VmId, err)
+			}
+			if waitArgs.Wait {
+				if _, err = task.Wait(ctx, upid, waitArgs.Options()); err != nil {
+					return task.ReportWaitError(output, upid, err)
+				}
+			}
+
+			output.Info("container {{index .id}}: create submitted.",
+				map[string]interface{}{
+					"event":  "ct_create_success",
+					"action": actionCreate,
+					"id":     ct.VmId,
+					"name":   ct.Hostname,
+					"node":   ct.Node,
+					"upid":   upid,
+				})
+			return nil
+		},
+	}
+
+	extraArgs.InjectExtraArgs(cmd)
+	waitArgs.InjectWaitArgs(cmd)
+	flags := cmd.Flags()
+	flags.StringVar(&ct.Node, createFlagNode, "",
+		"The node which the container will be created on. Required.")
+	flags.StringVar(&ct.VmId, createFlagVmId, "",
+		"The ID number of the new container, or auto to allocate a free one. Must be unique. Required.")
+	flags.StringVar(&ct.IdRange, createFlagIdRange, "",
+		"Range of ids, e.g. 100-199, to allocate an auto id from. Defaults to the range of the context.")
+	flags.StringVar(&ct.Hostname, createFlagHostname, "",
+		"The host name of the new container.")
+	flags.StringVar(&ct.Template, createFlagTemplate, "",
+		"Volume id of the OS template, or name of a template of the appliance index. Required.")
+	flags.StringVar(&ct.TemplateStorage, createFlagTemplateStorage, "",
+		"The storage device to download templates of the appliance index to. Defaults to the first storage accepting vztmpl.")
+	flags.StringVar(&ct.Storage, createFlagStorage, createDefaultStorage,
+		"The storage device of the root file system.")
+	flags.IntVar(&ct.DiskSize, createFlagDiskSize, createDefaultDiskSize,
+		"The size in GB of the root file system.")
+	flags.IntVar(&ct.Cores, createFlagCore, createDefaultCore,
+		"Number of CPU cores.")
+	flags.IntVar(&ct.Memory, createFlagMemory, createDefaultMemory,
+		"Amount of memory in MB.")
+	flags.IntVar(&ct.Swap, createFlagSwap, createDefaultSwap,
+		"Amount of swap in MB.")
+	flags.StringVar(&ct.NetworkIFace, createFlagNetworkIFace, createDefaultNetworkIFace,
+		"Host interface to bridge eth0 to.")
+	flags.StringVar(&ct.Ip, createFlagIp, createDefaultIp,
+		"Address of eth0, either dhcp or in CIDR notation, e.g. 192.168.1.20/24.")
+	flags.StringVar(&ct.Gateway, createFlagGateway, "",
+		"Default gateway of eth0.")
+	flags.StringSliceVar(&ct.Dns, createFlagDns, nil,
+		"Name servers. Defaults to the settings of the host.")
+	flags.StringVar(&ct.SearchDomain, createFlagSearchDomain, "",
+		"DNS search domain. Defaults to the settings of the host.")
+	flags.StringVar(&ct.Password, createFlagPassword, "",
+		"Password of root in the container.")
+	flags.StringVar(&sshKeysFile, createFlagSshKeys, "",
+		"File with public SSH keys authorized to log in as root, one per line.")
+	flags.BoolVar(&ct.Privileged, createFlagPrivileged, false,
+		"Whether to run the container privileged. Containers are unprivileged by default.")
+	flags.BoolVar(&ct.Nesting, createFlagNesting, false,
+		"Whether to allow nested containers, e.g. docker.")
+	flags.BoolVar(&ct.Start, createFlagStart, false,
+		"Starts the container after successful creation.")
+	for _, f := range []string{createFlagNode, createFlagVmId, createFlagTemplate} {
+		cmd.MarkFlagRequired(f)
+	}
+
+	return cmd
+}
+
+func newListCommand() *cobra.Command {
+	var (
+		extraArgs = new(shared.ExtraArgs)
+		node      string
+	)
+
+	cmd := &cobra.Command{
+		Use:     "list",
+		Short:   "list containers of the cluster",
+		PreRunE: commands.PreRun(extraArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cts, err := ListContainers(common.CommandContext(cmd, output), node)
+			if err != nil {
+				output.Fatal(shared.ErrOp.ExitCode,
+					"failed to list containers. Cause: {{index .cause}}",
+					map[string]interface{}{
+						"event": "ct_list_failed",
+						"cause": err.Error(),
+					})
+				return shared.ErrOp
+			}
+
+			for _, ct := range cts {
+				output.Info("{{index .id}}\t{{index .name}}\t{{index .node}}\t{{index .status}}",
+					map[string]interface{}{
+						"event":    "ct",
+						"id":       ct.VmId.String(),
+						"name":     ct.Name,
+						"node":     ct.Node,
+						"status":   ct.Status,
+						"template": ct.Template != 0,
+						"cpus":     int64(ct.MaxCpu),
+						"maxmem":   int64(ct.MaxMem),
+						"maxdisk":  int64(ct.MaxDisk),
+						"uptime":   int64(ct.Uptime),
+					})
+			}
+			return nil
+		},
+	}
+
+	extraArgs.InjectExtraArgs(cmd)
+	cmd.Flags().StringVar(&node, flagNode, "",
+		"Only list containers on this node.")
+
+	return cmd
+}
+
+func newStateCommand(action, short string) *cobra.Command {
+	payload := &StateRequest{Action: action}
+
+	cmd := &cobra.Command{
+		Use:     action + " <vmid|name>",
+		Short:   short,
+		Args:    cobra.ExactArgs(1),
+		PreRunE: commands.PreRun(&payload.ExtraArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			payload.CT = args[0]
+
+			result, err := ChangeState(common.CommandContext(cmd, output), payload)
+			if err != nil {
+				return commands.ReportError(action, payload.CT, err)
+			}
+
+			output.Info("container {{index .id}}: {{index .action}} submitted.",
+				map[string]interface{}{
+					"event":  fmt.Sprintf("ct_%s_success", action),
+					"action": action,
+					"id":     result.VmId,
+					"name":   result.Name,
+					"node":   result.Node,
+					"upid":   result.Upid,
+				})
+			return nil
+		},
+	}
+
+	payload.InjectExtraArgs(cmd)
+	payload.InjectWaitArgs(cmd)
+	commands.AddNodeFlag(cmd.Flags(), &payload.Node)
+
+	return cmd
+}
+
+func newDeleteCommand() *cobra.Command {
+	payload := &DeleteRequest{}
+
+	cmd := &cobra.Command{
+		Use:     "delete <vmid|name>",
+		Short:   "destroy a container and its volumes",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: commands.PreRun(&payload.ExtraArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			payload.CT = args[0]
+
+			result, err := Delete(common.CommandContext(cmd, output), payload)
+			if err != nil {
+				return commands.ReportError(actionDelete, payload.CT, err)
+			}
+
+			output.Info("container {{index .id}}: delete submitted.",
+				map[string]interface{}{
+					"event":  "ct_delete_success",
+					"action": actionDelete,
+					"id":     result.VmId,
+					"name":   result.Name,
+					"node":   result.Node,
+					"upid":   result.Upid,
+				})
+			return nil
+		},
+	}
+
+	payload.InjectExtraArgs(cmd)
+	payload.InjectWaitArgs(cmd)
+	commands.AddNodeFlag(cmd.Flags(), &payload.Node)
+	cmd.Flags().BoolVar(&payload.Purge, flagPurge, false,
+		"Whether to also remove the container from backup jobs, replication jobs and HA.")
+	cmd.Flags().BoolVar(&payload.Force, flagForce, false,
+		"Whether to stop a running container first. Otherwise, deleting a running container fails.")
+
+	return cmd
+}
+
+func newSetCommand() *cobra.Command {
+	payload := &SetRequest{}
+
+	cmd := &cobra.Command{
+		Use:   "set <vmid|name>",
+		Short: "change the configuration of a container",
+		Long: dedent.Dedent(`
+			Changes the configuration of a container to the requested values, like 'proxmox vm set'.
+			Options not requested are left unchanged. The root file system can only grow.
+		`),
+		Args:    cobra.ExactArgs(1),
+		PreRunE: commands.PreRun(&payload.ExtraArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			payload.CT = args[0]
+			payload.Preview = func(result *SetResult) {
+				for _, change := range result.Changes {
+					output.Info("{{index .key}}: {{index .from}} -> {{index .to}}",
+						map[string]interface{}{
+							"event": "ct_config_change",
+							"id":    result.VmId,
+							"key":   change.Key,
+							"from":  change.From,
+							"to":    change.To,
+						})
+				}
+			}
+
+			result, err := Set(common.CommandContext(cmd, output), payload)
+			if err != nil {
+				return commands.ReportError(actionSet, payload.CT, err)
+			}
+
+			for _, option := range result.Pending {
+				output.Info("{{index .key}}: {{index .to}} is pending until the container restarts.",
+					map[string]interface{}{
+						"event":  "ct_config_pending",
+						"id":     result.VmId,
+						"key":    option.Key,
+						"from":   option.Value,
+						"to":     option.Pending,
+						"delete": option.Delete != 0,
+					})
+			}
+
+			message := "container {{index .id}}: {{len .changes}} change(s) applied."
+			switch {
+			case len(result.Changes) == 0:
+				message = "container {{index .id}} is up to date."
+			case payload.DryRun:
+				message = "container {{index .id}}: {{len .changes}} change(s) not applied, dry run."
+			}
+			output.Info(message,
+				map[string]interface{}{
+					"event":   "ct_set_success",
+					"action":  actionSet,
+					"id":      result.VmId,
+					"node":    result.Node,
+					"changes": result.Changes,
+					"pending": len(result.Pending) > 0,
+					"dry_run": payload.DryRun,
+				})
+			return nil
+		},
+	}
+
+	payload.InjectExtraArgs(cmd)
+	commands.AddNodeFlag(cmd.Flags(), &payload.Node)
+	cmd.Flags().StringVar(&payload.Hostname, setFlagHostname, "",
+		"The new host name of the container.")
+	cmd.Flags().IntVar(&payload.Cores, setFlagCore, 0,
+		"Number of CPU cores.")
+	cmd.Flags().IntVar(&payload.Memory, setFlagMemory, 0,
+		"Amount of memory in MB.")
+	cmd.Flags().IntVar(&payload.Swap, setFlagSwap, 0,
+		"Amount of swap in MB.")
+	cmd.Flags().IntVar(&payload.DiskSize, setFlagDiskSize, 0,
+		"The new size in GB of the root file system. Must not be smaller than the current size.")
+	cmd.Flags().StringVar(&payload.NetworkIFace, setFlagIFace, "",
+		"Host interface to bridge net0 to.")
+	cmd.Flags().BoolVar(&payload.DryRun, setFlagDryRun, false,
+		"Whether to only print the changes without applying them.")
+
+	return cmd
+}
+
+func newSnapshotCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "snapshot",
+		Short: "manage snapshots of a container",
+	}
+
+	cmd.AddCommand(commands.NewSnapshotListCommand(ListSnapshots))
+	for _, c := range []struct {
+		use, short, action string
+		op                 func(context.Context, *SnapshotRequest) (*Result, error)
+	}{
+		{"create <vmid|name> <snapshot>", "take a snapshot of a container", vm.SnapshotActionCreate, CreateSnapshot},
+		{"rollback <vmid|name> <snapshot>", "roll a container back to a snapshot", vm.SnapshotActionRollback, RollbackSnapshot},
+		{"delete <vmid|name> <snapshot>", "delete a snapshot of a container", vm.SnapshotActionDelete, DeleteSnapshot},
+	} {
+		payload, op := &SnapshotRequest{}, c.op
+		cmd.AddCommand(commands.NewSnapshotTaskCommand(c.use, c.short, c.action, payload,
+			func(ctx context.Context) (*Result, error) {
+				return op(ctx, payload)
+			}))
+	}
+
+	return cmd
+}
@@ -0,0 +1,163 @@
+package ct
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/template"
+	"github.com/xeha-gmbh/homelab/proxmox/vm"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+const (
+	createFlagNode            = "node"
+	createFlagVmId            = "id"
+	createFlagIdRange         = "id-range"
+	createFlagHostname        = "hostname"
+	createFlagTemplate        = "template"
+	createFlagTemplateStorage = "template-storage"
+	createFlagStorage         = "storage"
+	createFlagDiskSize        = "disk-size"
+	createFlagCore            = "core"
+	createFlagMemory          = "memory"
+	createFlagSwap            = "swap"
+	createFlagNetworkIFace    = "iface"
+	createFlagIp              = "ip"
+	createFlagGateway         = "gateway"
+	createFlagDns             = "dns"
+	createFlagSearchDomain    = "search-domain"
+	createFlagPassword        = "password"
+	createFlagSshKeys         = "ssh-keys"
+	createFlagPrivileged      = "privileged"
+	createFlagNesting         = "nesting"
+	createFlagStart           = "start"
+
+	createDefaultStorage      = "local-lvm"
+	createDefaultDiskSize     = 8
+	createDefaultCore         = 1
+	createDefaultMemory       = 512
+	createDefaultSwap         = 512
+	createDefaultNetworkIFace = "vmbr0"
+	createDefaultIp           = "dhcp"
+)
+
+// Parameters of a container.
+type Container struct {
+	Node string
+	// Id of the container, or vm.AutoVmId to allocate one from IdRange.
+	VmId     string
+	IdRange  string
+	Hostname string
+	// Volume id of the OS template, e.g. local:vztmpl/debian-12-standard_12.2-1_amd64.tar.zst, or the
+	// name of a template of the appliance index, downloaded into TemplateStorage unless present.
+	Template        string
+	TemplateStorage string
+	// Storage device of the root file system, and its size in GB.
+	Storage  string
+	DiskSize int
+	Cores    int
+	// Memory and swap in MB.
+	Memory int
+	Swap   int
+	// Host interface to bridge eth0 to, and its address, either dhcp or in CIDR notation.
+	NetworkIFace string
+	Ip           string
+	Gateway      string
+	Dns          []string
+	SearchDomain string
+	// Password of root, and public SSH keys authorized to log in as root.
+	Password string
+	SshKeys  string
+	// If set, the container runs privileged. Otherwise, container root is mapped to an unprivileged user.
+	Privileged bool
+	// If set, the container may run nested containers, e.g. docker.
+	Nesting bool
+	// If set, the container is started once created, by the creation task.
+	Start bool
+}
+
+// Creates the container on its node. A template given by name is downloaded first. Returns the UPID
+// of the creation task.
+func CreateContainer(ctx context.Context, c *Container) (string, error) {
+	output := shared.Printer(ctx)
+
+	pve, err := common.NewClientFromCache(ctx, output)
+	if err != nil {
+		return "", fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	if c.VmId, err = vm.ResolveVmId(ctx, c.VmId, c.IdRange); err != nil {
+		return "", err
+	}
+
+	osTemplate := c.Template
+	if !strings.Contains(osTemplate, ":") {
+		result, err := template.Download(ctx, &template.DownloadRequest{
+			Node:     c.Node,
+			Storage:  c.TemplateStorage,
+			Template: c.Template,
+		})
+		if err != nil {
+			return "", err
+		}
+		osTemplate = result.Volid
+	}
+
+	upid, err := pve.CreateLxc(ctx, c.Node, c.params(osTemplate))
+	if err != nil {
+		return "", err
+	}
+
+	output.Debug("create container task {{index .upid}} submitted.",
+		map[string]interface{}{
+			"event": "task_submitted",
+			"upid":  upid,
+		})
+
+	return upid, nil
+}
+
+func (c *Container) params(osTemplate string) url.Values {
+	net := "name=eth0,bridge=" + c.NetworkIFace + ",ip=" + c.Ip
+	if len(c.Gateway) > 0 {
+		net += ",gw=" + c.Gateway
+	}
+
+	params := url.Values{}
+	params.Set("vmid", c.VmId)
+	params.Set("ostemplate", osTemplate)
+	params.Set("rootfs", fmt.Sprintf("%s:%d", c.Storage, c.DiskSize))
+	params.Set("cores", strconv.Itoa(c.Cores))
+	params.Set("memory", strconv.Itoa(c.Memory))
+	params.Set("swap", strconv.Itoa(c.Swap))
+	params.Set("net0", net)
+	if !c.Privileged {
+		params.Set("unprivileged", "1")
+	}
+	if len(c.Hostname) > 0 {
+		params.Set("hostname", c.Hostname)
+	}
+	if len(c.Dns) > 0 {
+		params.Set("nameserver", strings.Join(c.Dns, " "))
+	}
+	if len(c.SearchDomain) > 0 {
+		params.Set("searchdomain", c.SearchDomain)
+	}
+	if len(c.Password) > 0 {
+		params.Set("password", c.Password)
+	}
+	if len(c.SshKeys) > 0 {
+		params.Set("ssh-public-keys", c.SshKeys)
+	}
+	if c.Nesting {
+		params.Set("features", "nesting=1")
+	}
+	if c.Start {
+		params.Set("start", "1")
+	}
+	return params
+}
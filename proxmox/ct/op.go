@@ -0,0 +1,151 @@
+package ct
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
+	"github.com/xeha-gmbh/homelab/proxmox/vm"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+const (
+	lxcStatusStopped = "stopped"
+)
+
+// Starts the container on the node using the ticket cache. Returns the UPID of the start task.
+func StartContainer(ctx context.Context, node, vmId string) (string, error) {
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return "", fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+	return pve.LxcAction(ctx, node, vmId, client.LxcActionStart, nil)
+}
+
+// Returns all containers of the cluster ordered by id, or only those on the node if node is not empty.
+func ListContainers(ctx context.Context, node string) ([]client.ClusterResource, error) {
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	resources, err := pve.ClusterResources(ctx, client.ResourceTypeVM)
+	if err != nil {
+		return nil, err
+	}
+
+	cts := make([]client.ClusterResource, 0, len(resources))
+	for _, r := range resources {
+		if r.Type == client.GuestTypeLxc && (len(node) == 0 || r.Node == node) {
+			cts = append(cts, r)
+		}
+	}
+	sort.Slice(cts, func(i, j int) bool {
+		return cts[i].VmId < cts[j].VmId
+	})
+	return cts, nil
+}
+
+// Arguments for the 'proxmox ct start|stop|shutdown|reboot' commands.
+type StateRequest struct {
+	shared.ExtraArgs
+	task.WaitArgs
+	Node string
+	// Id or name of the container.
+	CT string
+	// One of the client.LxcAction constants.
+	Action string
+}
+
+// Outcome of an operation on a container.
+type Result = vm.GuestResult
+
+// Changes the state of the container selected by StateRequest#CT. If StateRequest#Wait is set, it
+// waits for the task to finish.
+func ChangeState(ctx context.Context, sr *StateRequest) (*Result, error) {
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	ct, err := vm.SelectGuest(ctx, pve, sr.CT, sr.Node, client.GuestTypeLxc)
+	if err != nil {
+		return nil, err
+	}
+
+	result := resultOf(ct)
+	if result.Upid, err = pve.LxcAction(ctx, ct.Node, result.VmId, sr.Action, nil); err != nil {
+		return nil, err
+	}
+	if sr.Wait {
+		if _, err = task.WaitWith(ctx, pve, result.Upid, sr.Options()); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Arguments for the 'proxmox ct delete' command.
+type DeleteRequest struct {
+	shared.ExtraArgs
+	task.WaitArgs
+	Node string
+	// Id or name of the container.
+	CT string
+	// If set, the container is also removed from backup jobs, replication jobs and HA.
+	Purge bool
+	// If set, a running container is stopped first. Otherwise, deleting a running container fails.
+	Force bool
+}
+
+// Destroys the container selected by DeleteRequest#CT together with its volumes.
+func Delete(ctx context.Context, dr *DeleteRequest) (*Result, error) {
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	ct, err := vm.SelectGuest(ctx, pve, dr.CT, dr.Node, client.GuestTypeLxc)
+	if err != nil {
+		return nil, err
+	}
+
+	result := resultOf(ct)
+	if ct.Status != lxcStatusStopped {
+		if !dr.Force {
+			return nil, fmt.Errorf("container %s is %s, stop it first", result.VmId, ct.Status)
+		}
+		if result.Upid, err = pve.LxcAction(ctx, ct.Node, result.VmId, client.LxcActionStop, nil); err != nil {
+			return nil, err
+		}
+		if _, err = task.WaitWith(ctx, pve, result.Upid, &task.WaitOptions{Timeout: dr.Timeout}); err != nil {
+			return nil, err
+		}
+	}
+
+	params := url.Values{}
+	if dr.Purge {
+		params.Set("purge", "1")
+	}
+	if result.Upid, err = pve.DeleteLxc(ctx, ct.Node, result.VmId, params); err != nil {
+		return nil, err
+	}
+	if dr.Wait {
+		if _, err = task.WaitWith(ctx, pve, result.Upid, dr.Options()); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func resultOf(ct *client.ClusterResource) *Result {
+	return &Result{
+		Node: ct.Node,
+		VmId: ct.VmId.String(),
+		Name: ct.Name,
+	}
+}
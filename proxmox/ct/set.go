@@ -0,0 +1,176 @@
+package ct
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
+	"github.com/xeha-gmbh/homelab/proxmox/vm"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+const (
+	setFlagHostname = "hostname"
+	setFlagCore     = "core"
+	setFlagMemory   = "memory"
+	setFlagSwap     = "swap"
+	setFlagDiskSize = "disk-size"
+	setFlagIFace    = "iface"
+	setFlagDryRun   = "dry-run"
+
+	rootfs = "rootfs"
+	net0   = "net0"
+)
+
+// Arguments for the 'proxmox ct set' command. Zero values leave the option unchanged.
+type SetRequest struct {
+	shared.ExtraArgs
+	Node string
+	// Id or name of the container.
+	CT       string
+	Hostname string
+	Cores    int
+	// Memory and swap in MB.
+	Memory int
+	Swap   int
+	// The new size in GB of the root file system. It cannot shrink.
+	DiskSize int
+	// The host interface to bridge net0 to.
+	NetworkIFace string
+	// If set, changes are computed and reported, but not applied.
+	DryRun bool
+	// If set, called with the result once the changes are computed, before any is applied, e.g. to print them.
+	Preview func(result *SetResult)
+}
+
+// Outcome of 'proxmox ct set'.
+type SetResult struct {
+	Node    string
+	VmId    string
+	Changes []vm.Change
+	// Options whose changes only take effect after the container is restarted.
+	Pending []client.PendingOption
+}
+
+// Computes the changes between the current configuration of the container selected by SetRequest#CT
+// and the requested values, and applies them unless SetRequest#DryRun is set, like 'proxmox vm set'.
+func Set(ctx context.Context, sr *SetRequest) (*SetResult, error) {
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	ct, err := vm.SelectGuest(ctx, pve, sr.CT, sr.Node, client.GuestTypeLxc)
+	if err != nil {
+		return nil, err
+	}
+	result := &SetResult{Node: ct.Node, VmId: ct.VmId.String()}
+
+	config, err := pve.LxcConfig(ctx, result.Node, result.VmId)
+	if err != nil {
+		return nil, err
+	}
+	if result.Changes, err = sr.diff(config); err != nil {
+		return nil, err
+	}
+	if sr.Preview != nil {
+		sr.Preview(result)
+	}
+	if sr.DryRun || len(result.Changes) == 0 {
+		return result, nil
+	}
+
+	params := url.Values{}
+	for _, change := range result.Changes {
+		if !change.Resize {
+			params.Set(change.Key, change.To)
+		}
+	}
+	if len(params) > 0 {
+		params.Set("digest", config.Digest())
+		if err = pve.UpdateLxcConfig(ctx, result.Node, result.VmId, params); err != nil {
+			return nil, fmt.Errorf("failed to update config: %s", err.Error())
+		}
+	}
+
+	for _, change := range result.Changes {
+		if !change.Resize {
+			continue
+		}
+		upid, err := pve.ResizeLxcDisk(ctx, result.Node, result.VmId, change.Key, change.To)
+		if err == nil && len(upid) > 0 {
+			_, err = task.WaitWith(ctx, pve, upid, nil)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to resize %s: %s", change.Key, err.Error())
+		}
+	}
+
+	pending, err := pve.LxcPending(ctx, result.Node, result.VmId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pending changes: %s", err.Error())
+	}
+	for _, option := range pending {
+		if option.IsPending() {
+			result.Pending = append(result.Pending, option)
+		}
+	}
+
+	return result, nil
+}
+
+// Returns the changes to the configuration necessary to reach the requested values.
+func (sr *SetRequest) diff(config client.Config) ([]vm.Change, error) {
+	changes := make([]vm.Change, 0)
+	add := func(key, to string) {
+		if from := config[key]; from != to {
+			changes = append(changes, vm.Change{Key: key, From: from, To: to})
+		}
+	}
+
+	if len(sr.Hostname) > 0 {
+		add("hostname", sr.Hostname)
+	}
+	if sr.Cores > 0 {
+		add("cores", strconv.Itoa(sr.Cores))
+	}
+	if sr.Memory > 0 {
+		add("memory", strconv.Itoa(sr.Memory))
+	}
+	if sr.Swap > 0 {
+		add("swap", strconv.Itoa(sr.Swap))
+	}
+
+	if len(sr.NetworkIFace) > 0 {
+		net, ok := config[net0]
+		if !ok {
+			return nil, fmt.Errorf("container has no network device %s", net0)
+		}
+		add(net0, client.WithProperty(net, "bridge", sr.NetworkIFace))
+	}
+
+	if sr.DiskSize > 0 {
+		size := client.PropertyValue(config[rootfs], "size")
+		current, err := client.ParseSize(size)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read size of %s: %s", rootfs, err.Error())
+		}
+		switch requested := int64(sr.DiskSize) << 30; {
+		case requested < current:
+			return nil, fmt.Errorf("%s cannot shrink from %s to %dG", rootfs, size, sr.DiskSize)
+		case requested > current:
+			changes = append(changes, vm.Change{
+				Key:    rootfs,
+				From:   size,
+				To:     fmt.Sprintf("%dG", sr.DiskSize),
+				Resize: true,
+			})
+		}
+	}
+
+	return changes, nil
+}
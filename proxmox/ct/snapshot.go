@@ -0,0 +1,84 @@
+package ct
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
+	"github.com/xeha-gmbh/homelab/proxmox/vm"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+// Arguments for the 'proxmox ct snapshot create|rollback|delete' commands. vm.GuestSnapshotRequest#Guest
+// is the id or name of the container.
+type SnapshotRequest = vm.GuestSnapshotRequest
+
+// Takes the snapshot SnapshotRequest#Snapshot of the container selected by SnapshotRequest#Guest and
+// waits for the task to finish.
+func CreateSnapshot(ctx context.Context, sr *SnapshotRequest) (*Result, error) {
+	return snapshotTask(ctx, sr, func(pve *client.Client, ct *client.ClusterResource) (string, error) {
+		return pve.CreateLxcSnapshot(ctx, ct.Node, ct.VmId.String(), sr.Snapshot, sr.Description)
+	})
+}
+
+// Rolls the container selected by SnapshotRequest#Guest back to the snapshot SnapshotRequest#Snapshot
+// and waits for the task to finish.
+func RollbackSnapshot(ctx context.Context, sr *SnapshotRequest) (*Result, error) {
+	return snapshotTask(ctx, sr, func(pve *client.Client, ct *client.ClusterResource) (string, error) {
+		return pve.RollbackLxcSnapshot(ctx, ct.Node, ct.VmId.String(), sr.Snapshot)
+	})
+}
+
+// Deletes the snapshot SnapshotRequest#Snapshot of the container selected by SnapshotRequest#Guest and
+// waits for the task to finish.
+func DeleteSnapshot(ctx context.Context, sr *SnapshotRequest) (*Result, error) {
+	return snapshotTask(ctx, sr, func(pve *client.Client, ct *client.ClusterResource) (string, error) {
+		return pve.DeleteLxcSnapshot(ctx, ct.Node, ct.VmId.String(), sr.Snapshot, sr.Force)
+	})
+}
+
+func snapshotTask(ctx context.Context, sr *SnapshotRequest, submit func(pve *client.Client, ct *client.ClusterResource) (string, error)) (*Result, error) {
+	if sr.Snapshot == client.CurrentSnapshot {
+		return nil, fmt.Errorf("%s is reserved for the current state of the container", client.CurrentSnapshot)
+	}
+
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	ct, err := vm.SelectGuest(ctx, pve, sr.Guest, sr.Node, client.GuestTypeLxc)
+	if err != nil {
+		return nil, err
+	}
+
+	result := resultOf(ct)
+	if result.Upid, err = submit(pve, ct); err != nil {
+		return nil, err
+	}
+	if _, err = task.WaitWith(ctx, pve, result.Upid, &task.WaitOptions{Timeout: sr.Timeout}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Returns the snapshots of the container selected by selector in the order of vm.SnapshotTree.
+func ListSnapshots(ctx context.Context, selector, node string) (*Result, []vm.SnapshotNode, error) {
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	ct, err := vm.SelectGuest(ctx, pve, selector, node, client.GuestTypeLxc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	snapshots, err := pve.LxcSnapshots(ctx, ct.Node, ct.VmId.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	return resultOf(ct), vm.SnapshotTree(snapshots), nil
+}
@@ -1,9 +1,12 @@
 package api
 
 const (
-	FlagUsername  = "username"
-	FlagPassword  = "password"
-	FlagRealm     = "realm"
-	FlagApiServer = "api-server"
-	FlagForce     = "force"
+	FlagUsername    = "username"
+	FlagPassword    = "password"
+	FlagRealm       = "realm"
+	FlagApiServer   = "api-server"
+	FlagForce       = "force"
+	FlagTokenId     = "token-id"
+	FlagTokenSecret = "token-secret"
+	FlagOtp         = "otp"
 )
@@ -20,7 +20,7 @@ func NewProxmoxLoginCommand() *cobra.Command {
 
 	cmd := &cobra.Command{
 		Use:   "login",
-		Short: "login user with username and password",
+		Short: "login user with username and password, or an API token",
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			cmd.SetOutput(os.Stdout)
 			if err := cmd.ParseFlags(args); err != nil {
@@ -30,14 +30,36 @@ func NewProxmoxLoginCommand() *cobra.Command {
 			return nil
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			var (
-				err          error
-				subject      *common.ProxmoxSubject
-				isNewAttempt bool
-			)
+			ctx := common.CommandContext(cmd, output)
+			payload.Context = common.SelectedContext(ctx)
 
-			subject, isNewAttempt, err = payload.Login()
-			if err != nil {
+			_, err := Login(ctx, payload)
+			if err == ErrTFA || err == ErrOtpRequired {
+				// the exit code tells a rejected code apart from a missing one.
+				message := "Failed to login. Cause: {{index .cause}}"
+				if err == ErrOtpRequired {
+					message = "Failed to login. A two-factor authentication code is required, supply it with --{{index .flag}}."
+				}
+				output.Fatal(err.(*LabError).ExitCode, message,
+					map[string]interface{}{
+						"event": "login_failed",
+						"cause": err.Error(),
+						"flag":  api.FlagOtp,
+					})
+				return err
+			}
+			switch err.(type) {
+			case nil:
+				return nil
+			case *CacheSaveError:
+				output.Fatal(ErrOp.ExitCode,
+					"Failed to save cache. Cause: {{index .cause}}",
+					map[string]interface{}{
+						"event": "cache_save_failed",
+						"cause": err.Error(),
+					})
+				return ErrOp
+			default:
 				output.Fatal(ErrOp.ExitCode,
 					"Failed to login. Cause: {{index .cause}}",
 					map[string]interface{}{
@@ -46,21 +68,6 @@ func NewProxmoxLoginCommand() *cobra.Command {
 					})
 				return ErrOp
 			}
-
-			if isNewAttempt {
-				err = common.WriteSubjectToCache(subject)
-				if err != nil {
-					output.Fatal(ErrOp.ExitCode,
-						"Failed to save cache. Cause: {{index .cause}}",
-						map[string]interface{}{
-							"event": "cache_save_failed",
-							"cause": err.Error(),
-						})
-					return ErrOp
-				}
-			}
-
-			return nil
 		},
 	}
 
@@ -74,7 +81,6 @@ func NewProxmoxLoginCommand() *cobra.Command {
 // Mark required login command flags
 func markProxmoxLoginCommandRequiredFlags(cmd *cobra.Command) {
 	for _, f := range []string{
-		api.FlagPassword,
 		api.FlagApiServer,
 	} {
 		cmd.MarkPersistentFlagRequired(f)
@@ -90,7 +96,7 @@ func addProxmoxLoginCommandFlags(flagSet *flag.FlagSet, payload *ProxmoxLoginReq
 	)
 	flagSet.StringVar(
 		&payload.Password, api.FlagPassword, "",
-		"The password for the user. Required.",
+		"The password for the user. Required, unless --token-id and --token-secret are set.",
 	)
 	flagSet.StringVar(
 		&payload.Realm, api.FlagRealm, api.DefaultRealm,
@@ -104,4 +110,17 @@ func addProxmoxLoginCommandFlags(flagSet *flag.FlagSet, payload *ProxmoxLoginReq
 		&payload.Force, api.FlagForce, api.DefaultForce,
 		"If set, command will ignore existing ticket cache and force a re-login.",
 	)
+	flagSet.StringVar(
+		&payload.TokenId, api.FlagTokenId, "",
+		"The id of an API token owned by the user, either 'tokenid' or 'user@realm!tokenid'. "+
+			"If set, API token authentication is used instead of password login.",
+	)
+	flagSet.StringVar(
+		&payload.TokenSecret, api.FlagTokenSecret, "",
+		"The secret of the API token specified by --token-id.",
+	)
+	flagSet.StringVar(
+		&payload.Otp, api.FlagOtp, "",
+		"The TOTP code for users with two-factor authentication. If not set, it is prompted for when required.",
+	)
 }
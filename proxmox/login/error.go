@@ -5,5 +5,17 @@ import (
 )
 
 var (
-	ErrAuth = shared.ErrorFactory(10)("authentication_error")
+	ErrAuth        = shared.ErrorFactory(10)("authentication_error")
+	ErrCredentials = shared.ErrorFactory(11)("either password or both token id and token secret must be supplied")
+	ErrTFA         = shared.ErrorFactory(12)("two_factor_authentication_error")
+	ErrOtpRequired = shared.ErrorFactory(13)("otp_required_error")
 )
+
+// Returned by Login when the new ticket cannot be saved to the ticket cache.
+type CacheSaveError struct {
+	Err error
+}
+
+func (e *CacheSaveError) Error() string {
+	return e.Err.Error()
+}
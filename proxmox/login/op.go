@@ -1,34 +1,99 @@
 package login
 
 import (
-	"encoding/json"
+	"bufio"
+	"context"
 	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/xeha-gmbh/homelab/proxmox/client"
 	"github.com/xeha-gmbh/homelab/proxmox/common"
 	"github.com/xeha-gmbh/homelab/shared"
-	"net/http"
-	"net/url"
 )
 
 // Arguments for the 'proxmox login' command
 type ProxmoxLoginRequest struct {
 	shared.ExtraArgs
-	Username  string
-	Password  string
-	Realm     string
-	ApiServer string
-	Force     bool
+	Username    string
+	Password    string
+	Realm       string
+	ApiServer   string
+	Force       bool
+	TokenId     string
+	TokenSecret string
+	// Name of the ticket cache context to log into. Defaults to the current context, if it belongs to
+	// the same API server.
+	Context string
+	// TOTP code for users with two-factor authentication. Prompted for if required but not set.
+	Otp string
 }
 
-// Performs a login using the parameters supplied. This method only performs a new login attempt
-// when ProxmoxLoginRequest#Force is set to true, or a ticket cache cannot be found or used.
-func (pl *ProxmoxLoginRequest) Login() (*common.ProxmoxSubject, bool, error) {
-	if cachedSubject, err := common.ReadSubjectFromCache(); err != nil || pl.Force {
-		s, e := pl.doLogin()
-		return s, true, e
-	} else {
-		output.Info("Ticket exists in cache.", map[string]interface{}{})
-		return cachedSubject, false, nil
+// Performs a login using the parameters supplied and saves the new ticket to the ticket cache.
+// A new login attempt is only made when ProxmoxLoginRequest#Force is set to true, or a ticket cache
+// cannot be found or used. Failure to save the ticket cache is reported as *CacheSaveError. Without
+// ProxmoxLoginRequest#Context, logging into another API server than that of the current context is
+// refused with *common.ErrContextMismatch, so that the current context is not overwritten.
+func Login(ctx context.Context, pl *ProxmoxLoginRequest) (*common.ProxmoxSubject, error) {
+	// refuse before logging in, rather than failing to save the new ticket.
+	if err := common.CheckContext(pl.Context, pl.ApiServer); err != nil {
+		return nil, err
+	}
+
+	subject, isNewAttempt, err := pl.login(ctx)
+	if err != nil {
+		return nil, err
 	}
+
+	if isNewAttempt {
+		if err := common.WriteSubjectToCache(subject); err != nil {
+			return nil, &CacheSaveError{Err: err}
+		}
+	}
+
+	return subject, nil
+}
+
+// Returns the cached subject, unless ProxmoxLoginRequest#Force is set or the ticket cache cannot be
+// used, in which case a new login attempt is made. A cached ticket cannot be used if it belongs to a
+// different API server or has expired. A cached ticket close to expiry is renewed instead.
+// The boolean return value is true for a new attempt.
+func (pl *ProxmoxLoginRequest) login(ctx context.Context) (*common.ProxmoxSubject, bool, error) {
+	output := shared.Printer(ctx)
+
+	if cachedSubject, err := common.ReadSubjectFromCache(pl.Context); err == nil && !pl.Force && pl.canReuse(cachedSubject) {
+		if !cachedSubject.NeedsRenewal() {
+			output.Info("Ticket exists in cache.", map[string]interface{}{})
+			return cachedSubject, false, nil
+		}
+		if err := common.RenewTicket(ctx, cachedSubject, output); err == nil {
+			output.Info("Ticket in cache renewed.", map[string]interface{}{})
+			return cachedSubject, false, nil
+		}
+	}
+
+	var (
+		s *common.ProxmoxSubject
+		e error
+	)
+	switch {
+	case pl.usesToken():
+		s, e = pl.doTokenLogin(ctx)
+	case len(pl.Password) > 0:
+		s, e = pl.doLogin(ctx)
+	default:
+		e = ErrCredentials
+	}
+	if s != nil {
+		s.Context = pl.Context
+	}
+	return s, true, e
+}
+
+// Returns true if the cached subject targets the same API server and has not expired.
+func (pl *ProxmoxLoginRequest) canReuse(cachedSubject *common.ProxmoxSubject) bool {
+	return cachedSubject.ApiServer == pl.ApiServer && !cachedSubject.Expired()
 }
 
 // Performs a real login attempt. This method returns error when
@@ -37,61 +102,142 @@ func (pl *ProxmoxLoginRequest) Login() (*common.ProxmoxSubject, bool, error) {
 // 3) Proxmox returns other non-200 status
 // 4) Response body cannot be decoded properly
 // Otherwise, it returns a nil error and a ProxmoxSubject
-func (pl *ProxmoxLoginRequest) doLogin() (*common.ProxmoxSubject, error) {
-	var (
-		err    error
-		resp   *http.Response
-		client = common.HttpClient()
-		form   = url.Values{}
-	)
+func (pl *ProxmoxLoginRequest) doLogin(ctx context.Context) (*common.ProxmoxSubject, error) {
+	output := shared.Printer(ctx)
+	pve := client.New(pl.ApiServer,
+		client.WithHttpClient(common.HttpClient()),
+		client.WithPrinter(output))
 
-	form.Add("username", pl.Username)
-	form.Add("password", pl.Password)
-	form.Add("realm", pl.Realm)
-
-	resp, err = client.PostForm(loginUrl(pl.ApiServer), form)
+	ticket, err := pve.Login(ctx, pl.Username, pl.Password, pl.Realm)
 	if err != nil {
+		if e, ok := err.(*client.Error); ok {
+			output.Debug("Login request returned status code {{index .code}}",
+				map[string]interface{}{
+					"event":  "login_response",
+					"code":   e.StatusCode,
+					"status": e.Message,
+				})
+			return nil, ErrAuth
+		}
 		return nil, common.ProxmoxError(err)
 	}
-	defer resp.Body.Close()
 
-	output.Debug("Login request return status code {{index .code}}",
+	if ticket.NeedsTFA() {
+		if ticket, err = pl.completeTFA(ctx, pve, ticket); err != nil {
+			return nil, err
+		}
+	}
+
+	issuedAt := time.Now()
+	subject := &common.ProxmoxSubject{
+		Username:  ticket.Username,
+		CSRFToken: ticket.CSRFToken,
+		Ticket:    ticket.Ticket,
+		ApiServer: pl.ApiServer,
+		Realm:     pl.Realm,
+		IssuedAt:  &issuedAt,
+	}
+
+	output.Info("User {{index .user}} is now logged in.",
 		map[string]interface{}{
-			"event":  "login_response",
-			"code":   resp.StatusCode,
-			"status": resp.Status,
+			"event": "login_success",
+			"user":  subject.Username,
 		})
+	return subject, nil
+}
 
-	if resp.StatusCode == http.StatusUnauthorized {
-		return nil, ErrAuth
-	}
+// Completes the second factor of the partial ticket with ProxmoxLoginRequest#Otp, prompting for the
+// code on an interactive terminal if none was supplied. The partial ticket is never cached.
+func (pl *ProxmoxLoginRequest) completeTFA(ctx context.Context, pve *client.Client, partial *client.Ticket) (*client.Ticket, error) {
+	output := shared.Printer(ctx)
+	output.Debug("User {{index .user}} requires two-factor authentication.",
+		map[string]interface{}{
+			"event": "tfa_required",
+			"user":  partial.Username,
+		})
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, ErrAuth
+	otp := strings.TrimSpace(pl.Otp)
+	if len(otp) == 0 {
+		var err error
+		if otp, err = promptOtp(); err != nil {
+			return nil, err
+		}
 	}
 
-	respData := make(map[string]interface{})
-	err = json.NewDecoder(resp.Body).Decode(&respData)
+	ticket, err := pve.CompleteTFA(ctx, partial, otp)
 	if err != nil {
-		return nil, shared.ErrParse
+		if _, ok := err.(*client.Error); ok {
+			return nil, ErrTFA
+		}
+		return nil, common.ProxmoxError(err)
 	}
+	return ticket, nil
+}
 
+// Reads a TOTP code from standard input, provided it is an interactive terminal.
+func promptOtp() (string, error) {
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return "", ErrOtpRequired
+	}
+
+	fmt.Fprint(os.Stderr, "Two-factor authentication code: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && len(line) == 0 {
+		return "", ErrOtpRequired
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// Verifies the API token by requesting the server version with it. API tokens require no
+// login, so a subject is assembled from the request as long as the server accepts the token.
+func (pl *ProxmoxLoginRequest) doTokenLogin(ctx context.Context) (*common.ProxmoxSubject, error) {
+	if len(pl.TokenSecret) == 0 {
+		return nil, ErrCredentials
+	}
+
+	output := shared.Printer(ctx)
 	subject := &common.ProxmoxSubject{
-		Username:  respData["data"].(map[string]interface{})["username"].(string),
-		CSRFToken: respData["data"].(map[string]interface{})["CSRFPreventionToken"].(string),
-		Ticket:    respData["data"].(map[string]interface{})["ticket"].(string),
-		ApiServer: pl.ApiServer,
+		Username:    pl.userWithRealm(),
+		TokenId:     pl.TokenId,
+		TokenSecret: pl.TokenSecret,
+		ApiServer:   pl.ApiServer,
+		Realm:       pl.Realm,
+	}
+	if i := strings.Index(pl.TokenId, "!"); i >= 0 {
+		subject.Username, subject.TokenId = pl.TokenId[:i], pl.TokenId[i+1:]
 	}
 
-	output.Info("User {{index .user}} is now logged in.",
+	if _, err := common.NewClient(subject, output).Version(ctx); err != nil {
+		if e, ok := err.(*client.Error); ok {
+			output.Debug("Token verification returned status code {{index .code}}",
+				map[string]interface{}{
+					"event":  "login_response",
+					"code":   e.StatusCode,
+					"status": e.Message,
+				})
+			return nil, ErrAuth
+		}
+		return nil, common.ProxmoxError(err)
+	}
+
+	output.Info("User {{index .user}} is now authenticated with token {{index .token}}.",
 		map[string]interface{}{
 			"event": "login_success",
 			"user":  subject.Username,
+			"token": subject.TokenId,
 		})
 	return subject, nil
 }
 
-// Returns the ticket API url for the given Proxmox host.
-func loginUrl(base string) string {
-	return fmt.Sprintf("%s/api2/json/access/ticket", base)
+// Returns true if the request asks for API token authentication.
+func (pl *ProxmoxLoginRequest) usesToken() bool {
+	return len(pl.TokenId) > 0
+}
+
+// Returns the username qualified with the realm (e.g. root@pam), as required by API tokens.
+func (pl *ProxmoxLoginRequest) userWithRealm() string {
+	if strings.Contains(pl.Username, "@") {
+		return pl.Username
+	}
+	return pl.Username + "@" + pl.Realm
 }
@@ -0,0 +1,8 @@
+package api
+
+import "time"
+
+const (
+	DefaultFormat  = "iso"
+	DefaultTimeout = time.Duration(0)
+)
@@ -0,0 +1,13 @@
+package api
+
+const (
+	FlagNode               = "node"
+	FlagStorage            = "storage"
+	FlagUrl                = "url"
+	FlagFilename           = "filename"
+	FlagFormat             = "format"
+	FlagChecksum           = "checksum"
+	FlagReplace            = "replace"
+	FlagVerifyCertificates = "verify-certificates"
+	FlagTimeout            = "timeout"
+)
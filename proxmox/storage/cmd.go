@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	flag "github.com/spf13/pflag"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/storage/api"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+// Returns the 'storage' command, working with the content of Proxmox storage devices.
+func NewProxmoxStorageCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "storage",
+		Short: "manage content of Proxmox storage devices",
+	}
+
+	cmd.AddCommand(newDownloadURLCommand())
+
+	return cmd
+}
+
+func newDownloadURLCommand() *cobra.Command {
+	var (
+		output  shared.MessagePrinter
+		payload = &DownloadURLRequest{}
+	)
+
+	cmd := &cobra.Command{
+		Use:   "download-url",
+		Short: "let the Proxmox node download a file into the storage device",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SetOutput(os.Stdout)
+
+			if err := cmd.ParseFlags(args); err != nil {
+				return err
+			}
+
+			output = shared.WithConfig(cmd, &payload.ExtraArgs)
+
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			result, err := DownloadURL(common.CommandContext(cmd, output), payload)
+			switch e := err.(type) {
+			case nil:
+			case *task.TaskError:
+				return task.ReportWaitError(output, e.UPID, err)
+			case *task.TimeoutError:
+				return task.ReportWaitError(output, e.UPID, err)
+			default:
+				output.Fatal(shared.ErrOp.ExitCode,
+					"Download {{index .url}} failed. Cause: {{index .cause}}",
+					map[string]interface{}{
+						"event": "download_failed",
+						"url":   payload.Url,
+						"cause": err.Error(),
+					})
+				return shared.ErrOp
+			}
+
+			output.Info("Download {{index .url}} is successful.",
+				map[string]interface{}{
+					"event":   "download_success",
+					"url":     payload.Url,
+					"volid":   result.Volid,
+					"upid":    result.Upid,
+					"skipped": result.Skipped,
+				})
+			return nil
+		},
+	}
+
+	payload.InjectExtraArgs(cmd)
+	addDownloadURLCommandFlags(cmd.Flags(), payload)
+	markDownloadURLCommandRequiredFlags(cmd)
+
+	return cmd
+}
+
+// Mark required download-url command flags
+func markDownloadURLCommandRequiredFlags(cmd *cobra.Command) {
+	for _, f := range []string{
+		api.FlagNode,
+		api.FlagUrl,
+	} {
+		cmd.MarkFlagRequired(f)
+	}
+}
+
+// Bind download-url command flags to DownloadURLRequest structure.
+func addDownloadURLCommandFlags(flagSet *flag.FlagSet, payload *DownloadURLRequest) {
+	flagSet.StringVar(
+		&payload.Node, api.FlagNode, "",
+		"The Proxmox cluster node that downloads the file. Required.",
+	)
+	flagSet.StringVar(
+		&payload.Storage, api.FlagStorage, "",
+		"The storage device label to download file to. "+
+			"If not set, command will query the node specified by --node to match the first storage device that accepts the file format --format.",
+	)
+	flagSet.StringVar(
+		&payload.Url, api.FlagUrl, "",
+		"The URL of the file to download. Required.",
+	)
+	flagSet.StringVar(
+		&payload.Filename, api.FlagFilename, "",
+		"The name of the file in the storage. Defaults to the name reported by the remote server.",
+	)
+	flagSet.StringVar(
+		&payload.Format, api.FlagFormat, api.DefaultFormat,
+		"The format of the file, either iso or vztmpl.",
+	)
+	flagSet.StringVar(
+		&payload.Checksum, api.FlagChecksum, "",
+		"Expected checksum of the file as 'algorithm:digest' (e.g. sha256:9a2c...), verified by the node after download. "+
+			"A file of the same name in the storage is replaced, as it can not be verified.",
+	)
+	flagSet.BoolVar(
+		&payload.Replace, api.FlagReplace, false,
+		"If set, a file of the same name in the storage is replaced. "+
+			"Otherwise, the download is skipped if a file of the same name and size exists, unless a checksum is given.",
+	)
+	flagSet.BoolVar(
+		&payload.VerifyCertificates, api.FlagVerifyCertificates, true,
+		"If set, the node verifies the TLS certificate of the remote server.",
+	)
+	flagSet.DurationVar(
+		&payload.Timeout, api.FlagTimeout, api.DefaultTimeout,
+		"Maximum time to wait for the download, e.g. 30m. Zero waits indefinitely.",
+	)
+}
@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/login"
+	"github.com/xeha-gmbh/homelab/proxmox/storage/api"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
+	"github.com/xeha-gmbh/homelab/proxmox/upload"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+// Arguments for 'proxmox storage download-url' command.
+type DownloadURLRequest struct {
+	shared.ExtraArgs
+	Node    string
+	Storage string
+	Url     string
+	// Name of the file on the storage. Defaults to the name reported by the remote server, or the
+	// last segment of the URL path.
+	Filename string
+	Format   string
+	// Optional checksum of the file in the form of 'algorithm:digest'.
+	Checksum string
+	// If set, a file of the same name in the storage is deleted and downloaded again.
+	Replace            bool
+	VerifyCertificates bool
+	// Maximum time to wait for the download. Zero waits indefinitely.
+	Timeout time.Duration
+}
+
+// Outcome of a download.
+type DownloadURLResult struct {
+	Storage  string
+	Filename string
+	// Volume id of the file in the storage, e.g. local:iso/ubuntu.iso
+	Volid string
+	// UPID of the download task. Empty if skipped.
+	Upid string
+	// Set when a file of the same name and size already existed, so no download was performed.
+	Skipped bool
+}
+
+// Asks the node to download the file at DownloadURLRequest#Url into the storage and waits for the
+// download task to finish. If DownloadURLRequest#Storage is not set, the first storage device
+// accepting DownloadURLRequest#Format is used. Requires Proxmox VE 7 or later.
+//
+// Like 'proxmox upload', the download is skipped if the storage already holds a file of the same name
+// and size, unless DownloadURLRequest#Replace or DownloadURLRequest#Checksum is set. A file of the same
+// name is reported as error if the size of the remote file is unknown. If DownloadURLRequest#Checksum is
+// set, the node verifies the downloaded file and the task fails on mismatch, returned as *task.TaskError.
+func DownloadURL(ctx context.Context, dr *DownloadURLRequest) (*DownloadURLResult, error) {
+	var (
+		err      error
+		checksum *upload.Checksum
+		metadata *client.URLMetadata
+		version  *client.Version
+		output   = shared.Printer(ctx)
+	)
+
+	if len(dr.Checksum) > 0 {
+		if checksum, err = upload.ParseChecksum(dr.Checksum); err != nil {
+			return nil, err
+		}
+	}
+
+	pve, err := common.NewClientFromCache(ctx, output)
+	if err != nil {
+		return nil, common.GenericError(fmt.Errorf("failed to read ticket cache: %s", err.Error()))
+	}
+
+	if version, err = pve.Version(ctx); err != nil {
+		if client.IsUnauthorized(err) {
+			return nil, login.ErrAuth
+		}
+		return nil, err
+	} else if version.Major() < 7 {
+		return nil, fmt.Errorf("download-url requires Proxmox VE 7 or later, server runs %s", version.Version)
+	}
+
+	if len(strings.TrimSpace(dr.Storage)) == 0 {
+		if dr.Storage, err = upload.MatchFirstStorageDevice(ctx, pve, dr.Node, dr.Format); err != nil {
+			return nil, err
+		}
+	}
+
+	if metadata, err = pve.QueryURLMetadata(ctx, dr.Node, dr.Url, dr.VerifyCertificates); err != nil {
+		return nil, fmt.Errorf("failed to query %s: %s", dr.Url, err.Error())
+	}
+	if len(dr.Filename) == 0 {
+		if dr.Filename, err = filenameOf(dr.Url, metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &DownloadURLResult{
+		Storage:  dr.Storage,
+		Filename: dr.Filename,
+		Volid:    fmt.Sprintf("%s:%s/%s", dr.Storage, dr.Format, dr.Filename),
+	}
+
+	if existing, err := upload.FindContent(ctx, pve, dr.Node, dr.Storage, dr.Format, dr.Filename); err != nil {
+		return nil, err
+	} else if existing != nil {
+		switch {
+		case dr.Replace || checksum != nil:
+			// the checksum of a file in the storage can not be queried, so it is downloaded again to be verified.
+			output.Info("Replacing {{index .volid}}.",
+				map[string]interface{}{
+					"event": "download_replace",
+					"volid": existing.Volid,
+				})
+			if err = upload.DeleteVolume(ctx, pve, dr.Node, dr.Storage, existing.Volid); err != nil {
+				return nil, err
+			}
+		case metadata.Size == 0:
+			return nil, fmt.Errorf("%s already exists, but the size of the remote file is unknown, use --%s to download it again",
+				existing.Volid, api.FlagReplace)
+		case existing.Size == metadata.Size:
+			output.Info("File {{index .volid}} already exists, download skipped.",
+				map[string]interface{}{
+					"event": "download_skipped",
+					"volid": existing.Volid,
+					"size":  int64(existing.Size),
+				})
+			result.Volid, result.Skipped = existing.Volid, true
+			return result, nil
+		default:
+			return nil, fmt.Errorf("%s already exists with a different size (%d bytes, remote file %d bytes)",
+				existing.Volid, int64(existing.Size), int64(metadata.Size))
+		}
+	}
+
+	req := &client.DownloadURLRequest{
+		Node:               dr.Node,
+		Storage:            dr.Storage,
+		Content:            dr.Format,
+		Filename:           dr.Filename,
+		URL:                dr.Url,
+		VerifyCertificates: dr.VerifyCertificates,
+	}
+	if checksum != nil {
+		req.Checksum, req.ChecksumAlgorithm = checksum.Digest, checksum.Algorithm
+	}
+
+	if result.Upid, err = pve.DownloadURL(ctx, req); err != nil {
+		return nil, err
+	}
+	output.Info("Node {{index .node}} is downloading {{index .url}} to {{index .volid}}.",
+		map[string]interface{}{
+			"event": "download_started",
+			"node":  dr.Node,
+			"url":   dr.Url,
+			"volid": result.Volid,
+			"upid":  result.Upid,
+		})
+
+	if _, err = task.WaitWith(ctx, pve, result.Upid, &task.WaitOptions{Timeout: dr.Timeout}); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Returns the file name reported by the remote server, or else the last segment of the URL path.
+func filenameOf(fileUrl string, metadata *client.URLMetadata) (string, error) {
+	if len(metadata.Filename) > 0 {
+		return metadata.Filename, nil
+	}
+
+	u, err := url.Parse(fileUrl)
+	if err != nil {
+		return "", err
+	}
+	if name := path.Base(u.Path); name != "/" && name != "." {
+		return name, nil
+	}
+	return "", fmt.Errorf("unable to determine file name from %s", fileUrl)
+}
@@ -0,0 +1,13 @@
+package api
+
+import "time"
+
+const (
+	DefaultTimeout      = time.Duration(0)
+	DefaultPollInterval = 2 * time.Second
+	DefaultLimit        = 50
+	// Number of trailing log lines reported when a task fails.
+	DefaultFailureLogLines = 10
+	// Number of log lines fetched per request.
+	LogPageSize = 500
+)
@@ -0,0 +1,13 @@
+package api
+
+const (
+	FlagWait    = "wait"
+	FlagTimeout = "timeout"
+	FlagFollow  = "follow"
+	FlagNode    = "node"
+	FlagLimit   = "limit"
+	FlagVmId    = "vmid"
+	FlagType    = "type"
+	FlagErrors  = "errors"
+	FlagRunning = "running"
+)
@@ -0,0 +1,239 @@
+package task
+
+import (
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/task/api"
+	. "github.com/xeha-gmbh/homelab/shared"
+)
+
+var (
+	ErrTaskFailed = ErrorFactory(10)("task_failed")
+	ErrTimeout    = ErrorFactory(11)("task_timeout")
+)
+
+// Returns the 'task' command, tracking the asynchronous tasks of Proxmox nodes.
+func NewProxmoxTaskCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "task",
+		Short: "track asynchronous tasks of Proxmox nodes",
+	}
+
+	cmd.AddCommand(newWaitCommand())
+	cmd.AddCommand(newLogCommand())
+	cmd.AddCommand(newListCommand())
+
+	return cmd
+}
+
+func newWaitCommand() *cobra.Command {
+	var (
+		output    MessagePrinter
+		extraArgs = new(ExtraArgs)
+		opts      = new(WaitOptions)
+	)
+
+	cmd := &cobra.Command{
+		Use:   "wait <upid>",
+		Short: "wait for a task to finish",
+		Args:  cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SetOutput(os.Stdout)
+			if err := cmd.ParseFlags(args); err != nil {
+				return err
+			}
+			output = WithConfig(cmd, extraArgs)
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			status, err := Wait(common.CommandContext(cmd, output), args[0], opts)
+			if err != nil {
+				return ReportWaitError(output, args[0], err)
+			}
+
+			output.Info("Task {{index .upid}} finished with {{index .status}}.",
+				map[string]interface{}{
+					"event":  "task_finished",
+					"upid":   status.UPID,
+					"status": status.ExitStatus,
+				})
+			return nil
+		},
+	}
+
+	extraArgs.InjectExtraArgs(cmd)
+	cmd.Flags().DurationVar(&opts.Timeout, api.FlagTimeout, api.DefaultTimeout,
+		"Maximum time to wait for the task, e.g. 10m. Zero waits indefinitely.")
+	cmd.Flags().BoolVar(&opts.Follow, api.FlagFollow, false,
+		"Whether to print the task log while waiting.")
+
+	return cmd
+}
+
+func newLogCommand() *cobra.Command {
+	var (
+		output    MessagePrinter
+		extraArgs = new(ExtraArgs)
+		follow    bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "log <upid>",
+		Short: "print the log of a task",
+		Args:  cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SetOutput(os.Stdout)
+			if err := cmd.ParseFlags(args); err != nil {
+				return err
+			}
+			output = WithConfig(cmd, extraArgs)
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := common.CommandContext(cmd, output)
+
+			if follow {
+				_, err := Wait(ctx, args[0], &WaitOptions{Follow: true})
+				if _, failed := err.(*TaskError); err != nil && !failed {
+					return ReportWaitError(output, args[0], err)
+				}
+				return nil
+			}
+
+			lines, err := Log(ctx, args[0])
+			if err != nil {
+				output.Fatal(ErrOp.ExitCode,
+					"Failed to read log of task {{index .upid}}. Cause: {{index .cause}}",
+					map[string]interface{}{
+						"event": "task_log_failed",
+						"upid":  args[0],
+						"cause": err.Error(),
+					})
+				return ErrOp
+			}
+
+			for _, line := range lines {
+				output.Info("{{index .line}}",
+					map[string]interface{}{
+						"event": "task_log",
+						"upid":  args[0],
+						"n":     int64(line.N),
+						"line":  line.T,
+					})
+			}
+			return nil
+		},
+	}
+
+	extraArgs.InjectExtraArgs(cmd)
+	cmd.Flags().BoolVar(&follow, api.FlagFollow, false,
+		"Whether to keep printing the log until the task finishes.")
+
+	return cmd
+}
+
+func newListCommand() *cobra.Command {
+	var (
+		output  MessagePrinter
+		payload = new(ListRequest)
+	)
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "list recent tasks of a node",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SetOutput(os.Stdout)
+			if err := cmd.ParseFlags(args); err != nil {
+				return err
+			}
+			output = WithConfig(cmd, &payload.ExtraArgs)
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tasks, err := List(common.CommandContext(cmd, output), payload)
+			if err != nil {
+				output.Fatal(ErrOp.ExitCode,
+					"Failed to list tasks of node {{index .node}}. Cause: {{index .cause}}",
+					map[string]interface{}{
+						"event": "task_list_failed",
+						"node":  payload.Node,
+						"cause": err.Error(),
+					})
+				return ErrOp
+			}
+
+			for _, task := range tasks {
+				status := task.Status
+				if task.Running() {
+					status = "running"
+				}
+				output.Info("{{index .upid}}\t{{index .type}}\t{{index .id}}\t{{index .user}}\t{{index .status}}",
+					map[string]interface{}{
+						"event":      "task",
+						"upid":       task.UPID,
+						"type":       task.Type,
+						"id":         task.Id,
+						"user":       task.User,
+						"status":     status,
+						"start_time": time.Unix(int64(task.StartTime), 0).Format(time.RFC3339),
+					})
+			}
+			return nil
+		},
+	}
+
+	payload.InjectExtraArgs(cmd)
+	cmd.Flags().StringVar(&payload.Node, api.FlagNode, "",
+		"The node whose tasks are listed. Required.")
+	cmd.Flags().IntVar(&payload.Limit, api.FlagLimit, api.DefaultLimit,
+		"Maximum number of tasks to list.")
+	cmd.Flags().StringVar(&payload.VmId, api.FlagVmId, "",
+		"Only list tasks of this VM or container.")
+	cmd.Flags().StringVar(&payload.Type, api.FlagType, "",
+		"Only list tasks of this type, e.g. qmcreate.")
+	cmd.Flags().BoolVar(&payload.Errors, api.FlagErrors, false,
+		"Only list failed tasks.")
+	cmd.Flags().BoolVar(&payload.Running, api.FlagRunning, false,
+		"Only list running tasks.")
+	cmd.MarkFlagRequired(api.FlagNode)
+
+	return cmd
+}
+
+// Reports the error of waiting for a task and returns the matching LabError. Commands submitting
+// tasks use it to report failures of --wait.
+func ReportWaitError(output MessagePrinter, upid string, err error) error {
+	switch e := err.(type) {
+	case *TaskError:
+		output.Fatal(ErrTaskFailed.ExitCode,
+			"Task {{index .upid}} failed with {{index .status}}.",
+			map[string]interface{}{
+				"event":  "task_failed",
+				"upid":   upid,
+				"status": e.ExitStatus,
+				"log":    e.Log,
+			})
+		return ErrTaskFailed
+	case *TimeoutError:
+		output.Fatal(ErrTimeout.ExitCode,
+			"Task {{index .upid}} did not finish within {{index .timeout}}.",
+			map[string]interface{}{
+				"event":   "task_timeout",
+				"upid":    upid,
+				"timeout": e.Timeout.String(),
+			})
+		return ErrTimeout
+	default:
+		output.Fatal(ErrOp.ExitCode,
+			"Failed to wait for task {{index .upid}}. Cause: {{index .cause}}",
+			map[string]interface{}{
+				"event": "task_wait_failed",
+				"upid":  upid,
+				"cause": err.Error(),
+			})
+		return ErrOp
+	}
+}
@@ -0,0 +1,54 @@
+package task
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+// Arguments for 'proxmox task list' command.
+type ListRequest struct {
+	shared.ExtraArgs
+	Node    string
+	Limit   int
+	VmId    string
+	Type    string
+	Errors  bool
+	Running bool
+}
+
+// Returns the most recent tasks of the node.
+func List(ctx context.Context, lr *ListRequest) ([]client.Task, error) {
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, common.GenericError(fmt.Errorf("failed to read ticket cache: %s", err.Error()))
+	}
+
+	filter := &client.TaskFilter{
+		Limit:  lr.Limit,
+		VmId:   lr.VmId,
+		Type:   lr.Type,
+		Errors: lr.Errors,
+	}
+	if lr.Running {
+		filter.Source = "active"
+	}
+	return pve.Tasks(ctx, lr.Node, filter)
+}
+
+// Returns the complete log of the task.
+func Log(ctx context.Context, upid string) ([]client.TaskLogLine, error) {
+	id, err := client.ParseUPID(upid)
+	if err != nil {
+		return nil, err
+	}
+
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, common.GenericError(fmt.Errorf("failed to read ticket cache: %s", err.Error()))
+	}
+	return readLog(ctx, pve, id, 0)
+}
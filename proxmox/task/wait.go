@@ -0,0 +1,220 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/task/api"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+// Waiting behaviour of commands submitting tasks, bound to the --wait and --timeout flags.
+type WaitArgs struct {
+	Wait    bool
+	Timeout time.Duration
+}
+
+func (wa *WaitArgs) InjectWaitArgs(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&wa.Wait, api.FlagWait, false,
+		"Whether to wait for the submitted task to finish, following its log.")
+	cmd.Flags().DurationVar(&wa.Timeout, api.FlagTimeout, api.DefaultTimeout,
+		"Maximum time to wait for the task, e.g. 10m. Zero waits indefinitely.")
+}
+
+// Returns the options to wait with, following the task log.
+func (wa *WaitArgs) Options() *WaitOptions {
+	return &WaitOptions{Timeout: wa.Timeout, Follow: true}
+}
+
+// Options of waiting for a task.
+type WaitOptions struct {
+	// Maximum duration to wait. Zero waits indefinitely.
+	Timeout time.Duration
+	// Interval between status polls. Defaults to api.DefaultPollInterval.
+	Interval time.Duration
+	// If set, lines of the task log are reported as they are written.
+	Follow bool
+}
+
+// Returned when a task finished with an exit status other than OK.
+type TaskError struct {
+	UPID       string
+	ExitStatus string
+	// Trailing lines of the task log.
+	Log []string
+}
+
+func (e *TaskError) Error() string {
+	if len(e.Log) == 0 {
+		return fmt.Sprintf("task %s failed: %s", e.UPID, e.ExitStatus)
+	}
+	return fmt.Sprintf("task %s failed: %s (log: %s)", e.UPID, e.ExitStatus, strings.Join(e.Log, "; "))
+}
+
+// Returned when a task did not finish in time. The task itself keeps running.
+type TimeoutError struct {
+	UPID    string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("task %s did not finish within %s", e.UPID, e.Timeout)
+}
+
+// Waits for the task to finish, using the ticket cache. The node is taken from the UPID. Returns the
+// final status of the task, *TaskError if it failed and *TimeoutError if it did not finish in time.
+func Wait(ctx context.Context, upid string, opts *WaitOptions) (*client.TaskStatus, error) {
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, common.GenericError(fmt.Errorf("failed to read ticket cache: %s", err.Error()))
+	}
+	return WaitWith(ctx, pve, upid, opts)
+}
+
+// Same as Wait, but uses the supplied client.
+func WaitWith(ctx context.Context, pve *client.Client, upid string, opts *WaitOptions) (*client.TaskStatus, error) {
+	var (
+		output   = shared.Printer(ctx)
+		interval = api.DefaultPollInterval
+		follower *logFollower
+	)
+
+	id, err := client.ParseUPID(upid)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts == nil {
+		opts = &WaitOptions{}
+	}
+	if opts.Interval > 0 {
+		interval = opts.Interval
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	if opts.Follow {
+		follower = &logFollower{pve: pve, upid: id, output: output}
+	}
+
+	output.Debug("Waiting for task {{index .upid}}.",
+		map[string]interface{}{
+			"event": "task_wait",
+			"upid":  upid,
+		})
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		status, err := pve.TaskStatus(ctx, id.Node, upid)
+		if err != nil {
+			return nil, timeoutOr(ctx, err, upid, opts.Timeout)
+		}
+		if follower != nil {
+			if err := follower.follow(ctx); err != nil {
+				return nil, timeoutOr(ctx, err, upid, opts.Timeout)
+			}
+		}
+
+		if status.Finished() {
+			if status.Succeeded() {
+				output.Debug("Task {{index .upid}} finished.",
+					map[string]interface{}{
+						"event":  "task_finished",
+						"upid":   upid,
+						"status": status.ExitStatus,
+					})
+				return status, nil
+			}
+			return status, &TaskError{
+				UPID:       upid,
+				ExitStatus: status.ExitStatus,
+				Log:        tail(ctx, pve, id, api.DefaultFailureLogLines),
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, timeoutOr(ctx, ctx.Err(), upid, opts.Timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Turns the error into *TimeoutError if the wait deadline was exceeded.
+func timeoutOr(ctx context.Context, err error, upid string, timeout time.Duration) error {
+	if timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{UPID: upid, Timeout: timeout}
+	}
+	return err
+}
+
+// Returns the last lines of the task log, or nil if the log cannot be read.
+func tail(ctx context.Context, pve *client.Client, id *client.UPID, lines int) []string {
+	all, err := readLog(ctx, pve, id, 0)
+	if err != nil {
+		return nil
+	}
+	if len(all) > lines {
+		all = all[len(all)-lines:]
+	}
+
+	text := make([]string, 0, len(all))
+	for _, line := range all {
+		text = append(text, line.T)
+	}
+	return text
+}
+
+// Reads the task log starting at line offset start.
+func readLog(ctx context.Context, pve *client.Client, id *client.UPID, start int) ([]client.TaskLogLine, error) {
+	all := make([]client.TaskLogLine, 0)
+	for {
+		lines, err := pve.TaskLog(ctx, id.Node, id.String(), start+len(all), api.LogPageSize)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, lines...)
+		if len(lines) < api.LogPageSize {
+			return all, nil
+		}
+	}
+}
+
+// Reports lines of the task log not reported yet.
+type logFollower struct {
+	pve    *client.Client
+	upid   *client.UPID
+	output shared.MessagePrinter
+	last   client.Int
+}
+
+func (f *logFollower) follow(ctx context.Context) error {
+	lines, err := readLog(ctx, f.pve, f.upid, int(f.last))
+	if err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		if line.N <= f.last {
+			continue
+		}
+		f.last = line.N
+		f.output.Info("{{index .line}}",
+			map[string]interface{}{
+				"event": "task_log",
+				"upid":  f.upid.String(),
+				"n":     int64(line.N),
+				"line":  line.T,
+			})
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+package api
+
+import "time"
+
+const (
+	DefaultTimeout = time.Duration(0)
+	// Content type of container templates in storage listings.
+	ContentVztmpl = "vztmpl"
+)
@@ -0,0 +1,8 @@
+package api
+
+const (
+	FlagNode    = "node"
+	FlagStorage = "storage"
+	FlagSection = "section"
+	FlagTimeout = "timeout"
+)
@@ -0,0 +1,143 @@
+package template
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
+	"github.com/xeha-gmbh/homelab/proxmox/template/api"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+// Returns the 'template' command, working with the container templates of the appliance index.
+func NewProxmoxTemplateCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "template",
+		Short: "manage container templates of the Proxmox appliance index",
+	}
+
+	cmd.AddCommand(newListCommand())
+	cmd.AddCommand(newDownloadCommand())
+
+	return cmd
+}
+
+func newListCommand() *cobra.Command {
+	var (
+		output  shared.MessagePrinter
+		payload = &ListRequest{}
+	)
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "list the templates of the appliance index",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SetOutput(os.Stdout)
+			if err := cmd.ParseFlags(args); err != nil {
+				return err
+			}
+			output = shared.WithConfig(cmd, &payload.ExtraArgs)
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			appliances, err := List(common.CommandContext(cmd, output), payload)
+			if err != nil {
+				output.Fatal(shared.ErrOp.ExitCode,
+					"Failed to list templates of node {{index .node}}. Cause: {{index .cause}}",
+					map[string]interface{}{
+						"event": "template_list_failed",
+						"node":  payload.Node,
+						"cause": err.Error(),
+					})
+				return shared.ErrOp
+			}
+
+			for _, appliance := range appliances {
+				output.Info("{{index .template}}\t{{index .section}}\t{{index .headline}}",
+					map[string]interface{}{
+						"event":    "template",
+						"template": appliance.Template,
+						"package":  appliance.Package,
+						"version":  appliance.Version,
+						"os":       appliance.Os,
+						"section":  appliance.Section,
+						"headline": appliance.Headline,
+					})
+			}
+			return nil
+		},
+	}
+
+	payload.InjectExtraArgs(cmd)
+	cmd.Flags().StringVar(&payload.Node, api.FlagNode, "",
+		"The node whose appliance index is listed. Required.")
+	cmd.Flags().StringVar(&payload.Section, api.FlagSection, "",
+		"Only list templates of this section, e.g. system or turnkeylinux.")
+	cmd.MarkFlagRequired(api.FlagNode)
+
+	return cmd
+}
+
+func newDownloadCommand() *cobra.Command {
+	var (
+		output  shared.MessagePrinter
+		payload = &DownloadRequest{}
+	)
+
+	cmd := &cobra.Command{
+		Use:   "download <template>",
+		Short: "let the Proxmox node download a template of the appliance index",
+		Args:  cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SetOutput(os.Stdout)
+			if err := cmd.ParseFlags(args); err != nil {
+				return err
+			}
+			output = shared.WithConfig(cmd, &payload.ExtraArgs)
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			payload.Template = args[0]
+
+			result, err := Download(common.CommandContext(cmd, output), payload)
+			switch e := err.(type) {
+			case nil:
+			case *task.TaskError:
+				return task.ReportWaitError(output, e.UPID, err)
+			case *task.TimeoutError:
+				return task.ReportWaitError(output, e.UPID, err)
+			default:
+				output.Fatal(shared.ErrOp.ExitCode,
+					"Download of template {{index .template}} failed. Cause: {{index .cause}}",
+					map[string]interface{}{
+						"event":    "template_download_failed",
+						"template": payload.Template,
+						"cause":    err.Error(),
+					})
+				return shared.ErrOp
+			}
+
+			output.Info("Template {{index .volid}} is available.",
+				map[string]interface{}{
+					"event":    "template_download_success",
+					"template": result.Template,
+					"volid":    result.Volid,
+					"upid":     result.Upid,
+					"skipped":  result.Skipped,
+				})
+			return nil
+		},
+	}
+
+	payload.InjectExtraArgs(cmd)
+	cmd.Flags().StringVar(&payload.Node, api.FlagNode, "",
+		"The node that downloads the template. Required.")
+	cmd.Flags().StringVar(&payload.Storage, api.FlagStorage, "",
+		"The storage device to download to. Defaults to the first storage device of the node accepting vztmpl.")
+	cmd.Flags().DurationVar(&payload.Timeout, api.FlagTimeout, api.DefaultTimeout,
+		"Maximum time to wait for the download, e.g. 10m. Zero waits indefinitely.")
+	cmd.MarkFlagRequired(api.FlagNode)
+
+	return cmd
+}
@@ -0,0 +1,177 @@
+package template
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
+	"github.com/xeha-gmbh/homelab/proxmox/template/api"
+	"github.com/xeha-gmbh/homelab/proxmox/upload"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+// Arguments for 'proxmox template list' command.
+type ListRequest struct {
+	shared.ExtraArgs
+	Node string
+	// If not empty, only appliances of this section (e.g. system, turnkeylinux) are listed.
+	Section string
+}
+
+// Returns the appliance index of the node ordered by template name.
+func List(ctx context.Context, lr *ListRequest) ([]client.Appliance, error) {
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, common.GenericError(fmt.Errorf("failed to read ticket cache: %s", err.Error()))
+	}
+
+	appliances, err := pve.Appliances(ctx, lr.Node)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]client.Appliance, 0, len(appliances))
+	for _, appliance := range appliances {
+		if len(lr.Section) == 0 || appliance.Section == lr.Section {
+			filtered = append(filtered, appliance)
+		}
+	}
+	sort.Slice(filtered, func(i, j int) bool {
+		return filtered[i].Template < filtered[j].Template
+	})
+	return filtered, nil
+}
+
+// Arguments for 'proxmox template download' command.
+type DownloadRequest struct {
+	shared.ExtraArgs
+	Node string
+	// Storage to download to. Defaults to the first storage device of the node accepting vztmpl.
+	Storage string
+	// File name (e.g. debian-12-standard_12.2-1_amd64.tar.zst) or package name (e.g.
+	// debian-12-standard) of the template in the appliance index.
+	Template string
+	// Maximum time to wait for the download. Zero waits indefinitely.
+	Timeout time.Duration
+}
+
+// Outcome of a template download.
+type DownloadResult struct {
+	Storage  string
+	Template string
+	// Volume id of the template, e.g. local:vztmpl/debian-12-standard_12.2-1_amd64.tar.zst
+	Volid string
+	// UPID of the download task. Empty if skipped.
+	Upid string
+	// Set when the storage already held the template, so no download was performed.
+	Skipped bool
+}
+
+// Asks the node to download the template DownloadRequest#Template from the appliance index into the
+// storage and waits for the download task to finish. A package name selects the latest template of
+// the package. The download is skipped if the storage already holds the template.
+func Download(ctx context.Context, dr *DownloadRequest) (*DownloadResult, error) {
+	output := shared.Printer(ctx)
+
+	pve, err := common.NewClientFromCache(ctx, output)
+	if err != nil {
+		return nil, common.GenericError(fmt.Errorf("failed to read ticket cache: %s", err.Error()))
+	}
+
+	appliance, err := findAppliance(ctx, pve, dr.Node, dr.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(strings.TrimSpace(dr.Storage)) == 0 {
+		if dr.Storage, err = upload.MatchFirstStorageDevice(ctx, pve, dr.Node, api.ContentVztmpl); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &DownloadResult{
+		Storage:  dr.Storage,
+		Template: appliance.Template,
+		Volid:    fmt.Sprintf("%s:%s/%s", dr.Storage, api.ContentVztmpl, appliance.Template),
+	}
+
+	contents, err := pve.StorageContent(ctx, dr.Node, dr.Storage, api.ContentVztmpl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list content of storage %s: %s", dr.Storage, err.Error())
+	}
+	for _, content := range contents {
+		if content.Filename() == appliance.Template {
+			output.Info("Template {{index .volid}} already exists, download skipped.",
+				map[string]interface{}{
+					"event": "template_download_skipped",
+					"volid": content.Volid,
+				})
+			result.Volid, result.Skipped = content.Volid, true
+			return result, nil
+		}
+	}
+
+	if result.Upid, err = pve.DownloadAppliance(ctx, dr.Node, dr.Storage, appliance.Template); err != nil {
+		return nil, err
+	}
+	output.Info("Node {{index .node}} is downloading template {{index .template}} to {{index .volid}}.",
+		map[string]interface{}{
+			"event":    "template_download_started",
+			"node":     dr.Node,
+			"template": appliance.Template,
+			"volid":    result.Volid,
+			"upid":     result.Upid,
+		})
+
+	if _, err = task.WaitWith(ctx, pve, result.Upid, &task.WaitOptions{Timeout: dr.Timeout}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Returns the appliance whose template is name, or else the latest appliance whose package is name.
+func findAppliance(ctx context.Context, pve *client.Client, node, name string) (*client.Appliance, error) {
+	appliances, err := pve.Appliances(ctx, node)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read appliance index: %s", err.Error())
+	}
+
+	var latest *client.Appliance
+	for i, appliance := range appliances {
+		switch {
+		case appliance.Template == name:
+			return &appliances[i], nil
+		case appliance.Package == name && (latest == nil || compareVersions(appliance.Version, latest.Version) > 0):
+			latest = &appliances[i]
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no template %s in the appliance index of node %s", name, node)
+	}
+	return latest, nil
+}
+
+// Compares versions like 12.10-1 part by part, split at dots and dashes. Numeric parts are compared as
+// numbers, so that 12.10-1 is later than 12.2-1, and other parts as strings. Returns a negative number
+// if a is earlier than b, a positive number if it is later, and zero if they are equal.
+func compareVersions(a, b string) int {
+	split := func(r rune) bool { return r == '.' || r == '-' }
+	as, bs := strings.FieldsFunc(a, split), strings.FieldsFunc(b, split)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, errX := strconv.Atoi(as[i])
+		y, errY := strconv.Atoi(bs[i])
+		switch {
+		case errX == nil && errY == nil && x != y:
+			return x - y
+		case (errX != nil || errY != nil) && as[i] != bs[i]:
+			return strings.Compare(as[i], bs[i])
+		}
+	}
+	return len(as) - len(bs)
+}
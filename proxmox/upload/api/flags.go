@@ -1,8 +1,10 @@
 package api
 
 const (
-	FlagNode    = "node"
-	FlagStorage = "storage"
-	FlagFile    = "file"
-	FlagFormat  = "format"
+	FlagNode     = "node"
+	FlagStorage  = "storage"
+	FlagFile     = "file"
+	FlagFormat   = "format"
+	FlagChecksum = "checksum"
+	FlagReplace  = "replace"
 )
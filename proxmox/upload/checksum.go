@@ -0,0 +1,107 @@
+package upload
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// Checksum in the form of 'algorithm:hex digest', e.g. sha256:9a2c...
+type Checksum struct {
+	Algorithm string
+	Digest    string
+}
+
+func (c *Checksum) String() string {
+	return c.Algorithm + ":" + c.Digest
+}
+
+// Parses a checksum in the form of 'algorithm:hex digest'. Algorithms are those accepted by Proxmox:
+// md5, sha1, sha224, sha256, sha384 and sha512.
+func ParseChecksum(value string) (*Checksum, error) {
+	i := strings.Index(value, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("malformed checksum %s, expect 'algorithm:digest'", value)
+	}
+
+	c := &Checksum{
+		Algorithm: strings.ToLower(strings.TrimSpace(value[:i])),
+		Digest:    strings.ToLower(strings.TrimSpace(value[i+1:])),
+	}
+	if _, err := newHash(c.Algorithm); err != nil {
+		return nil, err
+	}
+	if _, err := hex.DecodeString(c.Digest); err != nil || len(c.Digest) == 0 {
+		return nil, fmt.Errorf("malformed checksum digest %s", c.Digest)
+	}
+	return c, nil
+}
+
+// Verifies the file against the checksum, returning ErrChecksumMismatch on mismatch.
+func (c *Checksum) Verify(path string) error {
+	actual, err := ComputeChecksum(path, c.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	if actual.Digest != c.Digest {
+		return &ErrChecksumMismatch{File: path, Expected: c.String(), Actual: actual.String()}
+	}
+	return nil
+}
+
+// Computes the checksum of the file with the algorithm.
+func ComputeChecksum(path, algorithm string) (*Checksum, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return &Checksum{Algorithm: algorithm, Digest: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha224":
+		return sha256.New224(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha384":
+		return sha512.New384(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %s", algorithm)
+	}
+}
+
+// Returned when a file does not match the expected checksum.
+type ErrChecksumMismatch struct {
+	File     string
+	Expected string
+	Actual   string
+}
+
+func (e *ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s: expected %s, got %s", e.File, e.Expected, e.Actual)
+}
@@ -1,12 +1,13 @@
 package upload
 
 import (
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
 	"github.com/xeha-gmbh/homelab/proxmox/upload/api"
 	"github.com/xeha-gmbh/homelab/shared"
 	"github.com/spf13/cobra"
 	flag "github.com/spf13/pflag"
 	"os"
-	"os/exec"
 )
 
 var (
@@ -28,23 +29,17 @@ func NewProxmoxUploadCommand() *cobra.Command {
 
 			output = shared.WithConfig(cmd, &payload.ExtraArgs)
 
-			if err := checkCurlIsOnPath(); err != nil {
-				output.Fatal(shared.ErrDependency.ExitCode,
-					"Dependency unmet. Cause: {{index .cause}}",
-					map[string]interface{}{
-						"event": "pre_failed",
-						"cause": err.Error(),
-					})
-				return shared.ErrDependency
-			}
-
 			return nil
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			var err error
-
-			err = payload.Upload()
-			if err != nil {
+			result, err := Upload(common.CommandContext(cmd, output), payload)
+			switch e := err.(type) {
+			case nil:
+			case *task.TaskError:
+				return task.ReportWaitError(output, e.UPID, err)
+			case *task.TimeoutError:
+				return task.ReportWaitError(output, e.UPID, err)
+			default:
 				output.Fatal(shared.ErrOp.ExitCode,
 					"Upload file {{index .file}} failed. Cause: {{index .cause}}",
 					map[string]interface{}{
@@ -57,14 +52,18 @@ func NewProxmoxUploadCommand() *cobra.Command {
 
 			output.Info("Upload file {{index .file}} is successful.",
 				map[string]interface{}{
-					"event": "upload_success",
-					"file":  payload.File,
+					"event":   "upload_success",
+					"file":    payload.File,
+					"volid":   result.Volid,
+					"upid":    result.Upid,
+					"skipped": result.Skipped,
 				})
 			return nil
 		},
 	}
 
 	payload.InjectExtraArgs(cmd)
+	payload.InjectWaitArgs(cmd)
 	addProxmoxLoginCommandFlags(cmd.PersistentFlags(), payload)
 	markProxmoxUploadCommandRequiredFlags(cmd)
 
@@ -101,11 +100,15 @@ func addProxmoxLoginCommandFlags(flagSet *flag.FlagSet, payload *ProxmoxUploadRe
 		&payload.Format, api.FlagFormat, api.DefaultFormat,
 		"The format of the file specified.",
 	)
-}
-
-func checkCurlIsOnPath() error {
-	if _, err := exec.LookPath("curl"); err != nil {
-		return err
-	}
-	return nil
+	flagSet.StringVar(
+		&payload.Checksum, api.FlagChecksum, "",
+		"Expected checksum of the file as 'algorithm:digest' (e.g. sha256:9a2c...). "+
+			"The file is verified before upload, and Proxmox VE 7 or later verifies it again after upload. "+
+			"A file of the same name in the storage is replaced, as it can not be verified.",
+	)
+	flagSet.BoolVar(
+		&payload.Replace, api.FlagReplace, false,
+		"If set, a file of the same name in the storage is replaced. "+
+			"Otherwise, the upload is skipped if a file of the same name and size exists, unless a checksum is given.",
+	)
 }
@@ -1,130 +1,252 @@
 package upload
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
+	"github.com/xeha-gmbh/homelab/proxmox/client"
 	"github.com/xeha-gmbh/homelab/proxmox/common"
 	"github.com/xeha-gmbh/homelab/proxmox/login"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
 	"github.com/xeha-gmbh/homelab/shared"
-	"net/http"
-	"os/exec"
+	"os"
+	"path/filepath"
 	"strings"
 )
 
 // Arguments for 'proxmox upload' command.
 type ProxmoxUploadRequest struct {
 	shared.ExtraArgs
+	task.WaitArgs
 	Node    string
 	Storage string
 	File    string
 	Format  string
+	// Optional checksum of the file in the form of 'algorithm:digest'.
+	Checksum string
+	// If set, a file of the same name in the storage is deleted and uploaded again.
+	Replace bool
+}
+
+// Outcome of an upload.
+type ProxmoxUploadResult struct {
+	Storage string
+	// Volume id of the file in the storage, e.g. local:iso/ubuntu.iso
+	Volid string
+	// UPID of the upload task. Empty if skipped, or not reported by older servers.
+	Upid string
+	// Set when a file of the same name and size already existed, so no upload was performed.
+	Skipped bool
 }
 
 // Perform upload. If ProxmoxUploadRequest#Storage is not set, this method will try to
 // query the Proxmox API for the first storage device that accepts ProxmoxUploadRequest#Format
 // and use that device as the storage option.
-func (ur *ProxmoxUploadRequest) Upload() error {
-	var err error
+//
+// If ProxmoxUploadRequest#Checksum is set, the local file is verified against it before upload, and
+// the checksum is passed on to servers able to verify it. The upload is skipped if the storage already
+// holds a file of the same name and size, unless ProxmoxUploadRequest#Replace or the checksum is set, as
+// the file in the storage can not be verified. A file of the same name but a different size is reported
+// as error. If ProxmoxUploadRequest#Wait is set, it waits for the
+// task importing the file on the node.
+func Upload(ctx context.Context, ur *ProxmoxUploadRequest) (*ProxmoxUploadResult, error) {
+	var (
+		err      error
+		info     os.FileInfo
+		checksum *Checksum
+		output   = shared.Printer(ctx)
+		filename = filepath.Base(ur.File)
+	)
+
+	pve, err := common.NewClientFromCache(ctx, output)
+	if err != nil {
+		return nil, common.GenericError(fmt.Errorf("failed to read ticket cache: %s", err.Error()))
+	}
 
 	if len(strings.TrimSpace(ur.Storage)) == 0 {
-		if ur.Storage, err = ur.matchFirstStorageDevice(); err != nil {
-			return err
+		if ur.Storage, err = MatchFirstStorageDevice(ctx, pve, ur.Node, ur.Format); err != nil {
+			return nil, err
 		}
 	}
 
-	return ur.doUpload()
-}
+	if info, err = os.Stat(ur.File); err != nil {
+		return nil, err
+	}
+
+	if len(ur.Checksum) > 0 {
+		if checksum, err = ParseChecksum(ur.Checksum); err != nil {
+			return nil, err
+		}
+		if err = checksum.Verify(ur.File); err != nil {
+			return nil, err
+		}
+		output.Debug("File {{index .file}} matches checksum {{index .checksum}}.",
+			map[string]interface{}{
+				"event":    "checksum_verified",
+				"file":     ur.File,
+				"checksum": checksum.String(),
+			})
+	}
 
-// Actually perform the upload operation
-// For unknown reason, HTTP multipart support in Golang does not play well with Proxmox API.
-// Hence, we defer to using curl to perform the web request here.
-func (ur *ProxmoxUploadRequest) doUpload() error {
-	if subject, err := common.ReadSubjectFromCache(); err != nil {
-		return common.GenericError(fmt.Errorf("failed to read ticket cache: %s", err.Error()))
-	} else {
-		curl := exec.Command("curl", "-k",
-			"-H", fmt.Sprintf("CSRFPreventionToken: %s", subject.CSRFToken),
-			"-H", fmt.Sprintf("Cookie: PVEAuthCookie=%s", subject.Ticket),
-			"-H", "Content-Type: multipart/form-data",
-			"--form", fmt.Sprintf("content=%s", ur.Format),
-			"--form", fmt.Sprintf("filename=@%s", ur.File),
-			uploadUrl(subject.ApiServer, ur.Node, ur.Storage))
-		r, err := curl.CombinedOutput()
-		if len(r) > 0 {
-			output.Debug("\ncurl command output:\n\n {{index .output}}\n",
+	existing, err := FindContent(ctx, pve, ur.Node, ur.Storage, ur.Format, filename)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		switch {
+		case ur.Replace || checksum != nil:
+			// the checksum of a file in the storage can not be queried, so it is uploaded again to be verified.
+			output.Info("Replacing {{index .volid}}.",
+				map[string]interface{}{
+					"event": "upload_replace",
+					"volid": existing.Volid,
+				})
+			if err = DeleteVolume(ctx, pve, ur.Node, ur.Storage, existing.Volid); err != nil {
+				return nil, err
+			}
+		case int64(existing.Size) == info.Size():
+			output.Info("File {{index .volid}} of the same size already exists, upload skipped.",
 				map[string]interface{}{
-					"event":  "curl_output",
-					"output": string(r),
+					"event": "upload_skipped",
+					"volid": existing.Volid,
+					"size":  info.Size(),
 				})
+			return &ProxmoxUploadResult{Storage: ur.Storage, Volid: existing.Volid, Skipped: true}, nil
+		default:
+			return nil, fmt.Errorf("%s already exists with a different size (%d bytes, local file %d bytes)",
+				existing.Volid, int64(existing.Size), info.Size())
 		}
-		if err != nil {
-			return err
+	}
+
+	upid, err := ur.doUpload(ctx, pve, info.Size(), checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	if ur.Wait && len(upid) > 0 {
+		if _, err = task.WaitWith(ctx, pve, upid, ur.Options()); err != nil {
+			return nil, err
 		}
 	}
 
+	return &ProxmoxUploadResult{
+		Storage: ur.Storage,
+		Volid:   fmt.Sprintf("%s:%s/%s", ur.Storage, ur.Format, filename),
+		Upid:    upid,
+	}, nil
+}
+
+// Deletes the volume and waits for the delete task, so that it can not remove a file stored after it.
+func DeleteVolume(ctx context.Context, pve *client.Client, node, storage, volid string) error {
+	upid, err := pve.DeleteVolume(ctx, node, storage, volid)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %s", volid, err.Error())
+	}
+	if len(upid) > 0 {
+		if _, err = task.WaitWith(ctx, pve, upid, &task.WaitOptions{}); err != nil {
+			return fmt.Errorf("failed to delete %s: %s", volid, err.Error())
+		}
+	}
 	return nil
 }
 
-// Query the Proxmox API to match first storage device that accepts content specified by ProxmoxUploadRequest#Format
-func (ur *ProxmoxUploadRequest) matchFirstStorageDevice() (string, error) {
+// Returns the content of the storage of the format and name, e.g. iso and ubuntu.iso, or nil if none.
+func FindContent(ctx context.Context, pve *client.Client, node, storage, format, filename string) (*client.StorageContent, error) {
+	contents, err := pve.StorageContent(ctx, node, storage, format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list content of storage %s: %s", storage, err.Error())
+	}
+
+	for _, content := range contents {
+		if content.Filename() == filename {
+			return &content, nil
+		}
+	}
+	return nil, nil
+}
+
+// Actually perform the upload operation, streaming the file to the Proxmox API. The checksum, if any,
+// is only passed to servers of Proxmox VE 7 or later, as older servers reject the parameter.
+func (ur *ProxmoxUploadRequest) doUpload(ctx context.Context, pve *client.Client, size int64, checksum *Checksum) (string, error) {
 	var (
-		err     error
-		subject *common.ProxmoxSubject
-		req     *http.Request
-		resp    *http.Response
-		client  = common.HttpClient()
+		err    error
+		file   *os.File
+		output = shared.Printer(ctx)
+		req    = &client.UploadRequest{
+			Node:     ur.Node,
+			Storage:  ur.Storage,
+			Content:  ur.Format,
+			Filename: filepath.Base(ur.File),
+			Size:     size,
+			Progress: reportProgress(output, ur.File),
+		}
 	)
 
-	if subject, err = common.ReadSubjectFromCache(); err != nil {
-		return "", fmt.Errorf("unable to read ticket cache: %s", err.Error())
+	if checksum != nil {
+		if version, err := pve.Version(ctx); err == nil && version.Major() >= 7 {
+			req.Checksum, req.ChecksumAlgorithm = checksum.Digest, checksum.Algorithm
+		}
 	}
 
-	if req, err = http.NewRequest(http.MethodGet, getStorageUrl(subject.ApiServer, ur.Node), nil); err != nil {
-		return "", err
-	} else if req, err = common.WithHttpCredentials(req); err != nil {
+	if file, err = os.Open(ur.File); err != nil {
 		return "", err
 	}
+	defer file.Close()
+	req.File = file
 
-	if resp, err = client.Do(req); err != nil {
+	upid, err := pve.Upload(ctx, req)
+	if err != nil {
+		if client.IsUnauthorized(err) {
+			return "", login.ErrAuth
+		}
 		return "", err
 	}
-	defer resp.Body.Close()
 
-	output.Debug("get storage request http code: {{index .code}}",
+	output.Debug("upload task {{index .upid}} submitted.",
 		map[string]interface{}{
-			"event":  "http_response",
-			"code":   resp.StatusCode,
-			"status": resp.Status,
+			"event": "task_submitted",
+			"upid":  upid,
 		})
 
-	if resp.StatusCode == http.StatusUnauthorized {
-		return "", login.ErrAuth
-	} else if resp.StatusCode != http.StatusOK {
-		return "", errors.New("get storage failed")
+	return upid, nil
+}
+
+// Returns a progress function reporting every ten percent of the upload.
+func reportProgress(output shared.MessagePrinter, file string) client.ProgressFunc {
+	var reported int64 = -1
+	return func(sent, total int64) {
+		if total <= 0 {
+			return
+		}
+		if percent := sent * 100 / total; percent/10 > reported {
+			reported = percent / 10
+			output.Info("Uploaded {{index .percent}}% of {{index .file}}.",
+				map[string]interface{}{
+					"event":   "upload_progress",
+					"file":    file,
+					"percent": percent,
+					"sent":    sent,
+					"total":   total,
+				})
+		}
 	}
+}
 
-	respData := make(map[string]interface{})
-	if err = json.NewDecoder(resp.Body).Decode(&respData); err != nil {
-		return "", shared.ErrParse
+// Query the Proxmox API to match first storage device of the node that accepts the format.
+func MatchFirstStorageDevice(ctx context.Context, pve *client.Client, node, format string) (string, error) {
+	storages, err := pve.Storages(ctx, node)
+	if err != nil {
+		if client.IsUnauthorized(err) {
+			return "", login.ErrAuth
+		}
+		return "", fmt.Errorf("get storage failed: %s", err.Error())
 	}
 
-	for _, each := range respData["data"].([]interface{}) {
-		acceptContents := strings.Split(each.(map[string]interface{})["content"].(string), ",")
-		for _, c := range acceptContents {
-			if c == ur.Format {
-				return each.(map[string]interface{})["storage"].(string), nil
-			}
+	for _, storage := range storages {
+		if storage.Accepts(format) {
+			return storage.Storage, nil
 		}
 	}
 
 	return "", errors.New("no storage device match")
 }
-
-func uploadUrl(base, node, storage string) string {
-	return fmt.Sprintf("%s/api2/json/nodes/%s/storage/%s/upload", base, node, storage)
-}
-
-func getStorageUrl(base, node string) string {
-	return fmt.Sprintf("%s/api2/json/nodes/%s/storage", base, node)
-}
@@ -1,6 +1,7 @@
 package vm
 
 import (
+	"context"
 	"github.com/spf13/cobra"
 	"sync"
 )
@@ -28,7 +29,7 @@ type Archetype interface {
 	// Bind flags to its internal payload
 	BindFlags(cmd *cobra.Command)
 	// Create VM
-	CreateVM() error
+	CreateVM(ctx context.Context) error
 }
 
 var (
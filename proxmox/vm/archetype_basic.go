@@ -1,28 +1,37 @@
 package vm
 
 import (
+	"context"
 	"fmt"
 	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
 	"github.com/xeha-gmbh/homelab/shared"
 	"github.com/lithammer/dedent"
 	"github.com/spf13/cobra"
-	"io/ioutil"
-	"net/http"
 	"net/url"
-	"strings"
 )
 
 const (
 	basicArchFlagNode             = "node"
 	basicArchFlagVmId             = "id"
+	basicArchFlagIdRange          = "id-range"
 	basicArchFlagName             = "name"
 	basicArchFlagIsoStorage       = "iso-storage"
 	basicArchFlagIsoImage         = "iso-image"
+	basicArchFlagSeedImage        = "seed-image"
 	basicArchFlagDriveStorage     = "drive-storage"
 	basicArchFlagDriveSize        = "drive-size"
 	basicArchFlagCore             = "core"
 	basicArchFlagMemory           = "memory"
 	basicArchFlagNetworkInterface = "iface"
+	basicArchFlagDisk             = "disk"
+	basicArchFlagNet              = "net"
+	basicArchFlagSockets          = "sockets"
+	basicArchFlagCpuType          = "cpu-type"
+	basicArchFlagMachine          = "machine"
+	basicArchFlagBios             = "bios"
+	basicArchFlagEfiDiskStorage   = "efidisk-storage"
+	basicArchFlagOsType           = "ostype"
 	basicArchFlagStart            = "start"
 
 	basicArchDefaultNode         = "pve"
@@ -31,6 +40,9 @@ const (
 	basicArchDefaultCore         = 2
 	basicArchDefaultMemory       = 2048
 	basicArchDefaultNetworkIFace = "vmbr0"
+	basicArchDefaultSockets      = 1
+	basicArchDefaultBios         = BiosSeaBios
+	basicArchDefaultOsType       = "l26"
 	basicArchDefaultStart        = false
 
 	noDefault = ""
@@ -40,20 +52,49 @@ func init() {
 	ArchetypeRepository().SubmitArchetype(&basicArchetype{})
 }
 
+// Parameters of a VM created by the basic archetype.
+type BasicVM struct {
+	Node string
+	// Id of the VM, or AutoVmId to allocate one from IdRange.
+	VmId       string
+	IdRange    string
+	Name       string
+	IsoStorage string
+	IsoImage   string
+	// File name of a second ISO image in IsoStorage, attached as second CD drive, e.g. the seed medium
+	// carrying the settings of the VM for an installation media shared by several VMs.
+	SeedImage string
+	// The single hard drive, unless Disks is set.
+	DriveStorage string
+	DriveSize    int
+	// All hard drives, attached as scsi0, scsi1, ... The first one is the system drive.
+	Disks   []Disk
+	Sockets int
+	Cores   int
+	Memory  int
+	// CPU type, e.g. host. Empty uses the default of Proxmox.
+	CpuType string
+	// Machine type, e.g. q35. Empty uses the default of Proxmox.
+	Machine string
+	// Either seabios or ovmf. OVMF gets an EFI disk on EfiDiskStorage, defaulting to the system drive storage.
+	Bios           string
+	EfiDiskStorage string
+	// Guest OS type, defaults to l26.
+	OsType string
+	// The host interface of the single network device, unless Nics is set.
+	NetworkIFace string
+	// All network devices, attached as net0, net1, ...
+	Nics []Nic
+}
+
 type basicArchetype struct {
 	shared.ExtraArgs
-	_output      shared.MessagePrinter
-	node         string
-	vmId         string
-	vmName       string
-	isoStorage   string
-	isoImage     string
-	driveStorage string
-	driveSize    int
-	cpuCores     int
-	memory       int
-	networkIFace string
-	start        bool
+	task.WaitArgs
+	_output shared.MessagePrinter
+	vm      BasicVM
+	disks   []string
+	nics    []string
+	start   bool
 }
 
 func (b *basicArchetype) Name() string {
@@ -72,9 +113,9 @@ func (b *basicArchetype) Long() string {
 	return dedent.Dedent(`
 		This archetype describes a VM with basic configuration. It has the following features:
 			* Creates Linux VM with 2.6/3.X or later Kernal.
-			* Creates VM with one CPU socket and configurable number of cores.
-			* Creates one hard drive with SCSI format with VirtIO PCI driver.
-			* Creates bridged network with VirtIO driver on the configurable interface.
+			* Creates VM with configurable number of CPU sockets and cores, CPU type, machine type and BIOS.
+			* Creates one or more hard drives with SCSI format with VirtIO SCSI driver.
+			* Creates one or more bridged networks, optionally VLAN tagged, with VirtIO driver by default.
 			* Installs OS using ISO image mounted as CD-ROM.
 			* NUMA support is turned on.
 		
@@ -86,14 +127,24 @@ func (b *basicArchetype) AllFlags() []string {
 	return []string{
 		basicArchFlagNode,
 		basicArchFlagVmId,
+		basicArchFlagIdRange,
 		basicArchFlagName,
 		basicArchFlagIsoStorage,
 		basicArchFlagIsoImage,
+		basicArchFlagSeedImage,
 		basicArchFlagDriveStorage,
 		basicArchFlagDriveSize,
 		basicArchFlagCore,
 		basicArchFlagMemory,
 		basicArchFlagNetworkInterface,
+		basicArchFlagDisk,
+		basicArchFlagNet,
+		basicArchFlagSockets,
+		basicArchFlagCpuType,
+		basicArchFlagMachine,
+		basicArchFlagBios,
+		basicArchFlagEfiDiskStorage,
+		basicArchFlagOsType,
 		basicArchFlagStart,
 	}
 }
@@ -103,197 +154,291 @@ func (b *basicArchetype) RequiredFlags() []string {
 		basicArchFlagVmId,
 		basicArchFlagName,
 		basicArchFlagIsoImage,
-		basicArchFlagDriveStorage,
 	}
 }
 
 func (b *basicArchetype) BindFlags(cmd *cobra.Command) {
 	b.InjectExtraArgs(cmd)
+	b.InjectWaitArgs(cmd)
 	b._output = shared.WithConfig(cmd, &b.ExtraArgs)
 
 	cmd.Flags().StringVar(
-		&b.node, basicArchFlagNode, basicArchDefaultNode,
+		&b.vm.Node, basicArchFlagNode, basicArchDefaultNode,
 		"The node which VM will be created on.",
 	)
 	cmd.Flags().StringVar(
-		&b.vmId, basicArchFlagVmId, noDefault,
-		"The ID number of the new VM. Must be unique. Required.",
+		&b.vm.VmId, basicArchFlagVmId, noDefault,
+		"The ID number of the new VM, or auto to allocate a free one. Must be unique. Required.",
+	)
+	cmd.Flags().StringVar(
+		&b.vm.IdRange, basicArchFlagIdRange, noDefault,
+		"Range of ids, e.g. 100-199, to allocate an auto id from. Defaults to the range of the context.",
 	)
 	cmd.Flags().StringVar(
-		&b.vmName, basicArchFlagName, noDefault,
+		&b.vm.Name, basicArchFlagName, noDefault,
 		"The name of the new VM. Required.",
 	)
 	cmd.Flags().StringVar(
-		&b.isoStorage, basicArchFlagIsoStorage, basicArchDefaultIsoStorage,
+		&b.vm.IsoStorage, basicArchFlagIsoStorage, basicArchDefaultIsoStorage,
 		"The storage device name for the ISO installation media.",
 	)
 	cmd.Flags().StringVar(
-		&b.isoImage, basicArchFlagIsoImage, noDefault,
+		&b.vm.IsoImage, basicArchFlagIsoImage, noDefault,
 		"File name for the ISO installation media. Required.",
 	)
 	cmd.Flags().StringVar(
-		&b.driveStorage, basicArchFlagDriveStorage, noDefault,
-		"The storage device name for the hard drive. Required.",
+		&b.vm.SeedImage, basicArchFlagSeedImage, noDefault,
+		"File name for an ISO image on the same storage device, attached as second CD drive.",
+	)
+	cmd.Flags().StringVar(
+		&b.vm.DriveStorage, basicArchFlagDriveStorage, noDefault,
+		"The storage device name for the hard drive. Required unless --disk is given.",
 	)
 	cmd.Flags().IntVar(
-		&b.driveSize, basicArchFlagDriveSize, basicArchDefaultDriveSize,
+		&b.vm.DriveSize, basicArchFlagDriveSize, basicArchDefaultDriveSize,
 		"The size in GB of the hard drive.",
 	)
 	cmd.Flags().IntVar(
-		&b.cpuCores, basicArchFlagCore, basicArchDefaultCore,
+		&b.vm.Cores, basicArchFlagCore, basicArchDefaultCore,
 		"Number of of virtual CPU cores.",
 	)
 	cmd.Flags().IntVar(
-		&b.memory, basicArchFlagMemory, basicArchDefaultMemory,
+		&b.vm.Memory, basicArchFlagMemory, basicArchDefaultMemory,
 		"Amount of virtual memory in MB",
 	)
 	cmd.Flags().StringVar(
-		&b.networkIFace, basicArchFlagNetworkInterface, basicArchDefaultNetworkIFace,
-		"Host interface to bridge the network to.",
+		&b.vm.NetworkIFace, basicArchFlagNetworkInterface, noDefault,
+		"Host interface to bridge the network to, unless --net is given. Defaults to "+basicArchDefaultNetworkIFace+".",
+	)
+	cmd.Flags().StringArrayVar(
+		&b.disks, basicArchFlagDisk, nil,
+		"Hard drive as storage:size[,ssd=1][,discard=on][,iothread=1] with size in GB. Repeat for more drives, "+
+			"the first one is the system drive. Replaces --drive-storage and --drive-size.",
+	)
+	cmd.Flags().StringArrayVar(
+		&b.nics, basicArchFlagNet, nil,
+		"Network device as bridge=..[,model=virtio][,tag=..][,macaddr=..][,firewall=1]. Repeat for more devices. "+
+			"Replaces --iface.",
+	)
+	cmd.Flags().IntVar(
+		&b.vm.Sockets, basicArchFlagSockets, basicArchDefaultSockets,
+		"Number of CPU sockets.",
+	)
+	cmd.Flags().StringVar(
+		&b.vm.CpuType, basicArchFlagCpuType, noDefault,
+		"CPU type, e.g. host. Defaults to the default of Proxmox.",
+	)
+	cmd.Flags().StringVar(
+		&b.vm.Machine, basicArchFlagMachine, noDefault,
+		"Machine type, e.g. q35. Defaults to the default of Proxmox.",
+	)
+	cmd.Flags().StringVar(
+		&b.vm.Bios, basicArchFlagBios, basicArchDefaultBios,
+		"BIOS, either seabios or ovmf. OVMF creates an EFI disk.",
+	)
+	cmd.Flags().StringVar(
+		&b.vm.EfiDiskStorage, basicArchFlagEfiDiskStorage, noDefault,
+		"The storage device name for the EFI disk. Defaults to the storage device of the system drive.",
+	)
+	cmd.Flags().StringVar(
+		&b.vm.OsType, basicArchFlagOsType, basicArchDefaultOsType,
+		"Guest OS type, e.g. l26 or win11.",
 	)
 	cmd.Flags().BoolVar(
 		&b.start, basicArchFlagStart, basicArchDefaultStart,
 		"Starts VM after successful creation.")
 }
 
-// Post to Proxmox API to create a VM. If '--start' is requested, it will attempt to start the VM.
-func (b *basicArchetype) CreateVM() error {
-	if err := b.doCreateVM(); err != nil {
+// Post to Proxmox API to create a VM. If '--start' is requested, it will wait for the creation and
+// then attempt to start the VM. If '--wait' is requested, it waits for each submitted task.
+func (b *basicArchetype) CreateVM(ctx context.Context) error {
+	ctx = shared.WithPrinter(ctx, b._output)
+
+	err := b.parseDevices()
+	var upid string
+	if err == nil {
+		upid, err = CreateBasicVM(ctx, &b.vm)
+	}
+	if err != nil {
 		b._output.Fatal(shared.ErrOp.ExitCode,
 			"failed to create vm {{index .id}} on proxmox. Cause: {{index .cause}}",
 			map[string]interface{}{
 				"event": "vm_creation_failed",
-				"id":    b.vmId,
+				"id":    b.vm.VmId,
 				"cause": err.Error(),
 			})
 		return shared.ErrOp
 	}
 
+	// the vm is locked until created, so it has to be waited for before starting.
+	if b.Wait || b.start {
+		if _, err := task.Wait(ctx, upid, b.waitOptions()); err != nil {
+			return task.ReportWaitError(b._output, upid, err)
+		}
+	}
+
 	if b.start {
-		if err := b.startVM(); err != nil {
+		if upid, err = StartVM(ctx, b.vm.Node, b.vm.VmId); err != nil {
 			b._output.Fatal(shared.ErrOp.ExitCode,
 				"failed to start vm {{index .id}} on proxmox. Cause: {{index .cause}}",
 				map[string]interface{}{
 					"event": "vm_start_failed",
-					"id":    b.vmId,
+					"id":    b.vm.VmId,
 					"cause": err.Error(),
 				})
 			return err
 		}
+		if b.Wait {
+			if _, err := task.Wait(ctx, upid, b.waitOptions()); err != nil {
+				return task.ReportWaitError(b._output, upid, err)
+			}
+		}
 	}
 
 	b._output.Info("vm {{index .id}} is created on proxmox.",
 		map[string]interface{}{
 			"event": "vm_creation_success",
-			"id":    b.vmId,
+			"id":    b.vm.VmId,
+			"upid":  upid,
 		})
 	return nil
 }
 
-func (b *basicArchetype) doCreateVM() error {
-	var (
-		err     error
-		subject *common.ProxmoxSubject
-		req     *http.Request
-		resp    *http.Response
-	)
+// Parses the --disk and --net flags into the devices of the VM.
+func (b *basicArchetype) parseDevices() error {
+	for _, spec := range b.disks {
+		disk, err := ParseDisk(spec)
+		if err != nil {
+			return err
+		}
+		b.vm.Disks = append(b.vm.Disks, disk)
+	}
+	for _, spec := range b.nics {
+		nic, err := ParseNic(spec)
+		if err != nil {
+			return err
+		}
+		b.vm.Nics = append(b.vm.Nics, nic)
+	}
+	return nil
+}
 
-	if subject, err = common.ReadSubjectFromCache(); err != nil {
-		return fmt.Errorf("unable to read ticket: %s", err.Error())
+// Returns the options to wait for tasks with. The task log is only followed if '--wait' is requested.
+func (b *basicArchetype) waitOptions() *task.WaitOptions {
+	if b.Wait {
+		return b.Options()
 	}
+	return &task.WaitOptions{Timeout: b.Timeout}
+}
 
-	form := url.Values{}
-	form.Set("vmid", b.vmId)
-	form.Set("name", b.vmName)
-	form.Set("ide2", fmt.Sprintf("%s:iso/%s,media=cdrom", b.isoStorage, b.isoImage))
-	form.Set("ostype", "l26")
-	form.Set("scsihw", "virtio-scsi-pci")
-	form.Set("scsi0", fmt.Sprintf("%s:%d", b.driveStorage, b.driveSize))
-	form.Set("sockets", "1")
-	form.Set("cores", fmt.Sprintf("%d", b.cpuCores))
-	form.Set("numa", "1")
-	form.Set("memory", fmt.Sprintf("%d", b.memory))
-	form.Set("net0", fmt.Sprintf("virtio,bridge=vmbr0"))
+// Creates a VM of the basic archetype using the ticket cache. Returns the UPID of the creation task.
+func CreateBasicVM(ctx context.Context, vm *BasicVM) (string, error) {
+	output := shared.Printer(ctx)
 
-	if req, err = http.NewRequest(http.MethodPost, qemuUrl(subject.ApiServer, b.node), strings.NewReader(form.Encode())); err != nil {
-		return err
-	} else if req, err = common.WithHttpCredentials(req); err != nil {
-		return err
+	pve, err := common.NewClientFromCache(ctx, output)
+	if err != nil {
+		return "", fmt.Errorf("unable to read ticket: %s", err.Error())
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	client := common.HttpClient()
-	if resp, err = client.Do(req); err != nil {
-		return err
+	if vm.VmId, err = ResolveVmId(ctx, vm.VmId, vm.IdRange); err != nil {
+		return "", err
 	}
-	defer resp.Body.Close()
 
-	b._output.Debug("create vm request status: {{index .code}}.",
-		map[string]interface{}{
-			"event":  "http_response",
-			"code":   resp.StatusCode,
-			"status": resp.Status,
-		})
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("create vm request non-200 code: %d", resp.StatusCode)
+	form, err := vm.form()
+	if err != nil {
+		return "", err
 	}
 
-	if body, err := ioutil.ReadAll(resp.Body); err != nil {
-		return shared.ErrParse
-	} else {
-		b._output.Debug("http response body:\n\n{{index .content}}\n",
-			map[string]interface{}{
-				"event":   "http_response",
-				"content": string(body),
-			})
+	upid, err := pve.CreateQemu(ctx, vm.Node, form)
+	if err != nil {
+		return "", err
 	}
 
-	return nil
-}
+	output.Debug("create vm task {{index .upid}} submitted.",
+		map[string]interface{}{
+			"event": "task_submitted",
+			"upid":  upid,
+		})
 
-func (b *basicArchetype) startVM() error {
-	var (
-		err     error
-		subject *common.ProxmoxSubject
-		req     *http.Request
-		resp    *http.Response
-	)
+	return upid, nil
+}
 
-	if subject, err = common.ReadSubjectFromCache(); err != nil {
-		return fmt.Errorf("unable to read ticket: %s", err.Error())
+// Returns the parameters to create the VM with. The single drive and network options are turned into
+// a device each, unless devices are given explicitly.
+func (vm *BasicVM) form() (url.Values, error) {
+	disks, nics := vm.Disks, vm.Nics
+	switch {
+	case len(disks) > 0 && len(vm.DriveStorage) > 0:
+		return nil, fmt.Errorf("either disks or a drive storage can be given, not both")
+	case len(disks) == 0 && len(vm.DriveStorage) == 0:
+		return nil, fmt.Errorf("no hard drive given")
+	case len(disks) == 0:
+		disks = []Disk{{Storage: vm.DriveStorage, Size: vm.DriveSize}}
+	}
+	switch {
+	case len(nics) > 0 && len(vm.NetworkIFace) > 0:
+		return nil, fmt.Errorf("either network devices or an interface can be given, not both")
+	case len(nics) == 0 && len(vm.NetworkIFace) > 0:
+		nics = []Nic{{Bridge: vm.NetworkIFace}}
+	case len(nics) == 0:
+		nics = []Nic{{Bridge: basicArchDefaultNetworkIFace}}
 	}
 
-	if req, err = http.NewRequest(http.MethodPost, qemuStartUrl(subject.ApiServer, b.node, b.vmId), nil); err != nil {
-		return err
-	} else if req, err = common.WithHttpCredentials(req); err != nil {
-		return err
+	form := url.Values{}
+	form.Set("vmid", vm.VmId)
+	form.Set("name", vm.Name)
+	form.Set("ide2", fmt.Sprintf("%s:iso/%s,media=cdrom", vm.IsoStorage, vm.IsoImage))
+	if len(vm.SeedImage) > 0 {
+		form.Set("ide3", fmt.Sprintf("%s:iso/%s,media=cdrom", vm.IsoStorage, vm.SeedImage))
+	}
+	form.Set("ostype", withDefault(vm.OsType, basicArchDefaultOsType))
+	form.Set("sockets", fmt.Sprintf("%d", withDefaultInt(vm.Sockets, basicArchDefaultSockets)))
+	form.Set("cores", fmt.Sprintf("%d", vm.Cores))
+	form.Set("numa", "1")
+	form.Set("memory", fmt.Sprintf("%d", vm.Memory))
+	if len(vm.CpuType) > 0 {
+		form.Set("cpu", vm.CpuType)
+	}
+	if len(vm.Machine) > 0 {
+		form.Set("machine", vm.Machine)
 	}
 
-	client := common.HttpClient()
-	if resp, err = client.Do(req); err != nil {
-		return err
+	switch bios := withDefault(vm.Bios, BiosSeaBios); bios {
+	case BiosSeaBios:
+	case BiosOvmf:
+		form.Set("bios", bios)
+		form.Set("efidisk0", fmt.Sprintf("%s:1,efitype=4m", withDefault(vm.EfiDiskStorage, disks[0].Storage)))
+	default:
+		return nil, fmt.Errorf("unsupported bios %s, expecting %s or %s", bios, BiosSeaBios, BiosOvmf)
 	}
-	defer resp.Body.Close()
 
-	b._output.Debug("start vm request status: {{index .code}}.",
-		map[string]interface{}{
-			"event":  "http_response",
-			"code":   resp.StatusCode,
-			"status": resp.Status,
-		})
+	// IO threads per drive need a controller per drive.
+	scsihw := "virtio-scsi-pci"
+	for i, disk := range disks {
+		if disk.IOThread {
+			scsihw = "virtio-scsi-single"
+		}
+		form.Set(fmt.Sprintf("scsi%d", i), disk.String())
+	}
+	form.Set("scsihw", scsihw)
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("start vm request non-200 code: %d", resp.StatusCode)
+	for i, nic := range nics {
+		form.Set(fmt.Sprintf("net%d", i), nic.String())
 	}
 
-	return nil
+	return form, nil
 }
 
-func qemuUrl(base, node string) string {
-	return fmt.Sprintf("%s/api2/json/nodes/%s/qemu", base, node)
+func withDefault(value, defaultValue string) string {
+	if len(value) == 0 {
+		return defaultValue
+	}
+	return value
 }
 
-func qemuStartUrl(base, node, vmId string) string {
-	return fmt.Sprintf("%s/api2/json/nodes/%s/qemu/%s/status/start", base, node, vmId)
+func withDefaultInt(value, defaultValue int) int {
+	if value == 0 {
+		return defaultValue
+	}
+	return value
 }
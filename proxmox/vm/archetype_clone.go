@@ -0,0 +1,312 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+const (
+	cloneArchFlagNode             = "node"
+	cloneArchFlagTemplate         = "template"
+	cloneArchFlagVmId             = "id"
+	cloneArchFlagIdRange          = "id-range"
+	cloneArchFlagName             = "name"
+	cloneArchFlagFull             = "full"
+	cloneArchFlagStorage          = "storage"
+	cloneArchFlagCore             = "core"
+	cloneArchFlagMemory           = "memory"
+	cloneArchFlagDrive            = "drive"
+	cloneArchFlagDriveSize        = "drive-size"
+	cloneArchFlagNetworkInterface = "iface"
+	cloneArchFlagStart            = "start"
+
+	cloneArchDefaultFull  = false
+	cloneArchDefaultStart = false
+)
+
+func init() {
+	ArchetypeRepository().SubmitArchetype(&cloneArchetype{})
+}
+
+// Parameters of a VM created by the clone archetype. Zero values of the overrides keep the value
+// of the template.
+type CloneVM struct {
+	// Target node. Defaults to the node of the template.
+	Node string
+	// Id or name of the template.
+	Template string
+	// Id of the VM, or AutoVmId to allocate one from IdRange.
+	VmId    string
+	IdRange string
+	Name    string
+	// Full clones copy all disks, linked clones share the disks of the template and are only
+	// possible from templates.
+	Full bool
+	// Target storage of a full clone. Defaults to the storage of the template disks.
+	Storage      string
+	Cores        int
+	Memory       int
+	Drive        string
+	DriveSize    int
+	NetworkIFace string
+}
+
+type cloneArchetype struct {
+	shared.ExtraArgs
+	task.WaitArgs
+	_output shared.MessagePrinter
+	vm      CloneVM
+	start   bool
+}
+
+func (c *cloneArchetype) Name() string {
+	return "clone archetype"
+}
+
+func (c *cloneArchetype) Use() string {
+	return "clone"
+}
+
+func (c *cloneArchetype) Short() string {
+	return "clone archetype to create a vm from a template."
+}
+
+func (c *cloneArchetype) Long() string {
+	return dedent.Dedent(`
+		This archetype creates a VM by cloning a template, which takes seconds instead of an OS installation.
+			* Performs a linked clone by default, or a full clone with --full.
+			* Clones to another node with --node and, for full clones, to another storage with --storage.
+			* Waits for the clone to finish, then applies the cores, memory, drive size and network overrides.
+		
+		Use 'proxmox vm template' to convert a prepared VM into a template.
+	`)
+}
+
+func (c *cloneArchetype) AllFlags() []string {
+	return []string{
+		cloneArchFlagNode,
+		cloneArchFlagTemplate,
+		cloneArchFlagVmId,
+		cloneArchFlagIdRange,
+		cloneArchFlagName,
+		cloneArchFlagFull,
+		cloneArchFlagStorage,
+		cloneArchFlagCore,
+		cloneArchFlagMemory,
+		cloneArchFlagDrive,
+		cloneArchFlagDriveSize,
+		cloneArchFlagNetworkInterface,
+		cloneArchFlagStart,
+	}
+}
+
+func (c *cloneArchetype) RequiredFlags() []string {
+	return []string{
+		cloneArchFlagTemplate,
+		cloneArchFlagVmId,
+		cloneArchFlagName,
+	}
+}
+
+func (c *cloneArchetype) BindFlags(cmd *cobra.Command) {
+	c.InjectExtraArgs(cmd)
+	c.InjectWaitArgs(cmd)
+	c._output = shared.WithConfig(cmd, &c.ExtraArgs)
+
+	cmd.Flags().StringVar(
+		&c.vm.Node, cloneArchFlagNode, noDefault,
+		"The node which VM will be created on. Defaults to the node of the template.",
+	)
+	cmd.Flags().StringVar(
+		&c.vm.Template, cloneArchFlagTemplate, noDefault,
+		"The id or name of the template to clone. Required.",
+	)
+	cmd.Flags().StringVar(
+		&c.vm.VmId, cloneArchFlagVmId, noDefault,
+		"The ID number of the new VM, or auto to allocate a free one. Must be unique. Required.",
+	)
+	cmd.Flags().StringVar(
+		&c.vm.IdRange, cloneArchFlagIdRange, noDefault,
+		"Range of ids, e.g. 100-199, to allocate an auto id from. Defaults to the range of the context.",
+	)
+	cmd.Flags().StringVar(
+		&c.vm.Name, cloneArchFlagName, noDefault,
+		"The name of the new VM. Required.",
+	)
+	cmd.Flags().BoolVar(
+		&c.vm.Full, cloneArchFlagFull, cloneArchDefaultFull,
+		"Whether to copy all disks instead of creating a linked clone.",
+	)
+	cmd.Flags().StringVar(
+		&c.vm.Storage, cloneArchFlagStorage, noDefault,
+		"The storage device for the disks of a full clone. Defaults to the storage of the template.",
+	)
+	cmd.Flags().IntVar(
+		&c.vm.Cores, cloneArchFlagCore, 0,
+		"Number of virtual CPU cores. Defaults to that of the template.",
+	)
+	cmd.Flags().IntVar(
+		&c.vm.Memory, cloneArchFlagMemory, 0,
+		"Amount of virtual memory in MB. Defaults to that of the template.",
+	)
+	cmd.Flags().StringVar(
+		&c.vm.Drive, cloneArchFlagDrive, setDefaultDrive,
+		"The drive to grow with --drive-size.",
+	)
+	cmd.Flags().IntVar(
+		&c.vm.DriveSize, cloneArchFlagDriveSize, 0,
+		"The size in GB of the drive --drive. Defaults to that of the template.",
+	)
+	cmd.Flags().StringVar(
+		&c.vm.NetworkIFace, cloneArchFlagNetworkInterface, noDefault,
+		"Host interface to bridge the network to. Defaults to that of the template.",
+	)
+	cmd.Flags().BoolVar(
+		&c.start, cloneArchFlagStart, cloneArchDefaultStart,
+		"Starts VM after successful creation.")
+}
+
+// Clones the template and applies the overrides. If '--start' is requested, it will attempt to start the VM.
+func (c *cloneArchetype) CreateVM(ctx context.Context) error {
+	ctx = shared.WithPrinter(ctx, c._output)
+
+	node, err := CreateCloneVM(ctx, &c.vm)
+	if err != nil {
+		switch e := err.(type) {
+		case *task.TaskError:
+			return task.ReportWaitError(c._output, e.UPID, err)
+		case *task.TimeoutError:
+			return task.ReportWaitError(c._output, e.UPID, err)
+		}
+		c._output.Fatal(shared.ErrOp.ExitCode,
+			"failed to clone vm {{index .id}} on proxmox. Cause: {{index .cause}}",
+			map[string]interface{}{
+				"event": "vm_creation_failed",
+				"id":    c.vm.VmId,
+				"cause": err.Error(),
+			})
+		return shared.ErrOp
+	}
+
+	if c.start {
+		upid, err := StartVM(ctx, node, c.vm.VmId)
+		if err != nil {
+			c._output.Fatal(shared.ErrOp.ExitCode,
+				"failed to start vm {{index .id}} on proxmox. Cause: {{index .cause}}",
+				map[string]interface{}{
+					"event": "vm_start_failed",
+					"id":    c.vm.VmId,
+					"cause": err.Error(),
+				})
+			return err
+		}
+		if c.Wait {
+			if _, err := task.Wait(ctx, upid, c.Options()); err != nil {
+				return task.ReportWaitError(c._output, upid, err)
+			}
+		}
+	}
+
+	c._output.Info("vm {{index .id}} is created on proxmox.",
+		map[string]interface{}{
+			"event": "vm_creation_success",
+			"id":    c.vm.VmId,
+			"node":  node,
+		})
+	return nil
+}
+
+// Clones the template using the ticket cache, waits for the clone task and applies the overrides.
+// Returns the node the new VM is on.
+func CreateCloneVM(ctx context.Context, vm *CloneVM) (string, error) {
+	output := shared.Printer(ctx)
+
+	pve, err := common.NewClientFromCache(ctx, output)
+	if err != nil {
+		return "", fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	template, err := SelectVM(ctx, pve, vm.Template, "")
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case !vm.Full && template.Template == 0:
+		return "", fmt.Errorf("vm %s is not a template, only full clones are possible", vm.Template)
+	case !vm.Full && len(vm.Storage) > 0:
+		return "", fmt.Errorf("linked clones stay on the storage of the template, use a full clone to change storage")
+	}
+
+	if vm.VmId, err = ResolveVmId(ctx, vm.VmId, vm.IdRange); err != nil {
+		return "", err
+	}
+
+	node := template.Node
+	form := url.Values{}
+	form.Set("newid", vm.VmId)
+	form.Set("name", vm.Name)
+	if vm.Full {
+		form.Set("full", "1")
+	} else {
+		form.Set("full", "0")
+	}
+	if len(vm.Storage) > 0 {
+		form.Set("storage", vm.Storage)
+	}
+	if len(vm.Node) > 0 && vm.Node != template.Node {
+		form.Set("target", vm.Node)
+		node = vm.Node
+	}
+
+	upid, err := pve.CloneQemu(ctx, template.Node, template.VmId.String(), form)
+	if err != nil {
+		return "", err
+	}
+	output.Debug("clone vm task {{index .upid}} submitted.",
+		map[string]interface{}{
+			"event": "task_submitted",
+			"upid":  upid,
+		})
+
+	// the clone is locked until the task finishes, so overrides can only be applied afterwards.
+	if _, err = task.WaitWith(ctx, pve, upid, nil); err != nil {
+		return "", err
+	}
+
+	drive := vm.Drive
+	if len(drive) == 0 {
+		drive = setDefaultDrive
+	}
+	result, err := Set(ctx, &SetRequest{
+		Node:         node,
+		VM:           vm.VmId,
+		Cores:        vm.Cores,
+		Memory:       vm.Memory,
+		Drive:        drive,
+		DriveSize:    vm.DriveSize,
+		Net:          setDefaultNet,
+		NetworkIFace: vm.NetworkIFace,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to apply overrides: %s", err.Error())
+	}
+	for _, change := range result.Changes {
+		output.Debug("{{index .key}}: {{index .from}} -> {{index .to}}",
+			map[string]interface{}{
+				"event": "vm_config_change",
+				"id":    vm.VmId,
+				"key":   change.Key,
+				"from":  change.From,
+				"to":    change.To,
+			})
+	}
+
+	return node, nil
+}
@@ -0,0 +1,506 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+// Keys of the disks in a qemu configuration, e.g. scsi0 or virtio1.
+var diskKey = regexp.MustCompile(`^(ide|sata|scsi|virtio)\d+$`)
+
+const (
+	cloudInitArchFlagNode             = "node"
+	cloudInitArchFlagVmId             = "id"
+	cloudInitArchFlagIdRange          = "id-range"
+	cloudInitArchFlagName             = "name"
+	cloudInitArchFlagCloudImage       = "cloud-image"
+	cloudInitArchFlagTemplate         = "template"
+	cloudInitArchFlagFull             = "full"
+	cloudInitArchFlagDriveStorage     = "drive-storage"
+	cloudInitArchFlagDriveSize        = "drive-size"
+	cloudInitArchFlagCore             = "core"
+	cloudInitArchFlagMemory           = "memory"
+	cloudInitArchFlagNetworkInterface = "iface"
+	cloudInitArchFlagUser             = "user"
+	cloudInitArchFlagPassword         = "password"
+	cloudInitArchFlagSshKeys          = "ssh-keys"
+	cloudInitArchFlagIp               = "ip"
+	cloudInitArchFlagGateway          = "gateway"
+	cloudInitArchFlagDns              = "dns"
+	cloudInitArchFlagSearchDomain     = "search-domain"
+	cloudInitArchFlagStart            = "start"
+
+	cloudInitArchDefaultCore         = 2
+	cloudInitArchDefaultMemory       = 2048
+	cloudInitArchDefaultNetworkIFace = "vmbr0"
+	cloudInitArchDefaultIp           = "dhcp"
+
+	cloudInitDrive = "ide2"
+)
+
+func init() {
+	ArchetypeRepository().SubmitArchetype(&cloudInitArchetype{})
+}
+
+// Parameters of a VM created by the cloudinit archetype. The system disk either is imported from a
+// cloud image, or comes from cloning a template prepared from one.
+type CloudInitVM struct {
+	// Target node. Required to import a cloud image, clones default to the node of the template.
+	Node string
+	// Id of the VM, or AutoVmId to allocate one from IdRange.
+	VmId    string
+	IdRange string
+	Name    string
+	// Volume (e.g. local:iso/jammy-server-cloudimg-amd64.img) or absolute path on the node of the
+	// cloud image to import as system disk. Mutually exclusive with Template.
+	CloudImage string
+	// Id or name of the template to clone, and whether to perform a full clone.
+	Template string
+	Full     bool
+	// Storage of the system disk and the cloud-init drive. For clones, defaults to the storage of
+	// the cloned system disk.
+	DriveStorage string
+	// Size in GB the system disk is grown to. Zero keeps the size of the image.
+	DriveSize    int
+	Cores        int
+	Memory       int
+	NetworkIFace string
+	CloudInit    CloudInit
+}
+
+// Cloud-init settings of a VM. The VM name is used as the host name.
+type CloudInit struct {
+	User     string
+	Password string
+	// Public SSH keys, one per line in OpenSSH format.
+	SshKeys string
+	// Address in CIDR notation, e.g. 192.168.100.30/24, or dhcp.
+	Ip      string
+	Gateway string
+	// DNS servers and the DNS search domain. Defaults to the settings of the node.
+	Dns          []string
+	SearchDomain string
+}
+
+// Returns the cloud-init configuration parameters.
+func (ci *CloudInit) params() url.Values {
+	params := url.Values{}
+	if len(ci.User) > 0 {
+		params.Set("ciuser", ci.User)
+	}
+	if len(ci.Password) > 0 {
+		params.Set("cipassword", ci.Password)
+	}
+	if keys := strings.TrimSpace(ci.SshKeys); len(keys) > 0 {
+		// Proxmox expects the keys url encoded once more, with spaces encoded as %20.
+		params.Set("sshkeys", strings.Replace(url.QueryEscape(keys), "+", "%20", -1))
+	}
+	if len(ci.Ip) > 0 {
+		ipConfig := "ip=" + ci.Ip
+		if len(ci.Gateway) > 0 {
+			ipConfig += ",gw=" + ci.Gateway
+		}
+		params.Set("ipconfig0", ipConfig)
+	}
+	if len(ci.Dns) > 0 {
+		params.Set("nameserver", strings.Join(ci.Dns, " "))
+	}
+	if len(ci.SearchDomain) > 0 {
+		params.Set("searchdomain", ci.SearchDomain)
+	}
+	return params
+}
+
+type cloudInitArchetype struct {
+	shared.ExtraArgs
+	task.WaitArgs
+	_output     shared.MessagePrinter
+	vm          CloudInitVM
+	sshKeysFile string
+	start       bool
+}
+
+func (c *cloudInitArchetype) Name() string {
+	return "cloudinit archetype"
+}
+
+func (c *cloudInitArchetype) Use() string {
+	return "cloudinit"
+}
+
+func (c *cloudInitArchetype) Short() string {
+	return "cloudinit archetype to create a vm from a cloud image."
+}
+
+func (c *cloudInitArchetype) Long() string {
+	return dedent.Dedent(`
+		This archetype creates a VM from a cloud image, which boots in seconds and is configured by cloud-init.
+			* Imports the cloud image given by --cloud-image as system disk, or clones the template given by --template.
+			* Grows the system disk to --drive-size.
+			* Attaches a cloud-init drive and configures user, password, SSH keys, network and DNS.
+			* Uses a serial console, as most cloud images expect one.
+		
+		Importing cloud images requires Proxmox VE 7.2 or later.
+	`)
+}
+
+func (c *cloudInitArchetype) AllFlags() []string {
+	return []string{
+		cloudInitArchFlagNode,
+		cloudInitArchFlagVmId,
+		cloudInitArchFlagIdRange,
+		cloudInitArchFlagName,
+		cloudInitArchFlagCloudImage,
+		cloudInitArchFlagTemplate,
+		cloudInitArchFlagFull,
+		cloudInitArchFlagDriveStorage,
+		cloudInitArchFlagDriveSize,
+		cloudInitArchFlagCore,
+		cloudInitArchFlagMemory,
+		cloudInitArchFlagNetworkInterface,
+		cloudInitArchFlagUser,
+		cloudInitArchFlagPassword,
+		cloudInitArchFlagSshKeys,
+		cloudInitArchFlagIp,
+		cloudInitArchFlagGateway,
+		cloudInitArchFlagDns,
+		cloudInitArchFlagSearchDomain,
+		cloudInitArchFlagStart,
+	}
+}
+
+func (c *cloudInitArchetype) RequiredFlags() []string {
+	return []string{
+		cloudInitArchFlagVmId,
+		cloudInitArchFlagName,
+	}
+}
+
+func (c *cloudInitArchetype) BindFlags(cmd *cobra.Command) {
+	c.InjectExtraArgs(cmd)
+	c.InjectWaitArgs(cmd)
+	c._output = shared.WithConfig(cmd, &c.ExtraArgs)
+
+	cmd.Flags().StringVar(
+		&c.vm.Node, cloudInitArchFlagNode, noDefault,
+		"The node which VM will be created on. Required with --cloud-image. For clones, defaults to the node of the template.",
+	)
+	cmd.Flags().StringVar(
+		&c.vm.VmId, cloudInitArchFlagVmId, noDefault,
+		"The ID number of the new VM, or auto to allocate a free one. Must be unique. Required.",
+	)
+	cmd.Flags().StringVar(
+		&c.vm.IdRange, cloudInitArchFlagIdRange, noDefault,
+		"Range of ids, e.g. 100-199, to allocate an auto id from. Defaults to the range of the context.",
+	)
+	cmd.Flags().StringVar(
+		&c.vm.Name, cloudInitArchFlagName, noDefault,
+		"The name of the new VM, also used as host name. Required.",
+	)
+	cmd.Flags().StringVar(
+		&c.vm.CloudImage, cloudInitArchFlagCloudImage, noDefault,
+		"The volume (e.g. local:iso/jammy-server-cloudimg-amd64.img) or absolute path on the node of the cloud image to import. "+
+			"Either this or --template is required.",
+	)
+	cmd.Flags().StringVar(
+		&c.vm.Template, cloudInitArchFlagTemplate, noDefault,
+		"The id or name of a template prepared from a cloud image to clone. Either this or --cloud-image is required.",
+	)
+	cmd.Flags().BoolVar(
+		&c.vm.Full, cloudInitArchFlagFull, false,
+		"Whether to copy all disks of the template instead of creating a linked clone.",
+	)
+	cmd.Flags().StringVar(
+		&c.vm.DriveStorage, cloudInitArchFlagDriveStorage, noDefault,
+		"The storage device name for the system disk and the cloud-init drive. Required with --cloud-image.",
+	)
+	cmd.Flags().IntVar(
+		&c.vm.DriveSize, cloudInitArchFlagDriveSize, 0,
+		"The size in GB to grow the system disk to. Defaults to the size of the image.",
+	)
+	cmd.Flags().IntVar(
+		&c.vm.Cores, cloudInitArchFlagCore, cloudInitArchDefaultCore,
+		"Number of of virtual CPU cores.",
+	)
+	cmd.Flags().IntVar(
+		&c.vm.Memory, cloudInitArchFlagMemory, cloudInitArchDefaultMemory,
+		"Amount of virtual memory in MB",
+	)
+	cmd.Flags().StringVar(
+		&c.vm.NetworkIFace, cloudInitArchFlagNetworkInterface, cloudInitArchDefaultNetworkIFace,
+		"Host interface to bridge the network to.",
+	)
+	cmd.Flags().StringVar(
+		&c.vm.CloudInit.User, cloudInitArchFlagUser, noDefault,
+		"The user cloud-init creates. Defaults to the default user of the image.",
+	)
+	cmd.Flags().StringVar(
+		&c.vm.CloudInit.Password, cloudInitArchFlagPassword, noDefault,
+		"The password of the user.",
+	)
+	cmd.Flags().StringVar(
+		&c.sshKeysFile, cloudInitArchFlagSshKeys, noDefault,
+		"Path to a file of public SSH keys to authorize, e.g. ~/.ssh/id_rsa.pub.",
+	)
+	cmd.Flags().StringVar(
+		&c.vm.CloudInit.Ip, cloudInitArchFlagIp, cloudInitArchDefaultIp,
+		"The IPv4 address in CIDR notation, e.g. 192.168.100.30/24, or dhcp.",
+	)
+	cmd.Flags().StringVar(
+		&c.vm.CloudInit.Gateway, cloudInitArchFlagGateway, noDefault,
+		"The IPv4 gateway. Ignored with dhcp.",
+	)
+	cmd.Flags().StringSliceVar(
+		&c.vm.CloudInit.Dns, cloudInitArchFlagDns, nil,
+		"DNS servers, comma separated. Defaults to those of the node.",
+	)
+	cmd.Flags().StringVar(
+		&c.vm.CloudInit.SearchDomain, cloudInitArchFlagSearchDomain, noDefault,
+		"The DNS search domain. Defaults to that of the node.",
+	)
+	cmd.Flags().BoolVar(
+		&c.start, cloudInitArchFlagStart, false,
+		"Starts VM after successful creation.")
+}
+
+// Creates the VM from the cloud image or template. If '--start' is requested, it will attempt to start the VM.
+func (c *cloudInitArchetype) CreateVM(ctx context.Context) error {
+	ctx = shared.WithPrinter(ctx, c._output)
+
+	if len(c.sshKeysFile) > 0 {
+		keys, err := ioutil.ReadFile(c.sshKeysFile)
+		if err != nil {
+			c._output.Fatal(shared.ErrParse.ExitCode,
+				"failed to read ssh keys {{index .file}}. Cause: {{index .cause}}",
+				map[string]interface{}{
+					"event": "parse_error",
+					"file":  c.sshKeysFile,
+					"cause": err.Error(),
+				})
+			return shared.ErrParse
+		}
+		c.vm.CloudInit.SshKeys = string(keys)
+	}
+
+	node, err := CreateCloudInitVM(ctx, &c.vm)
+	if err != nil {
+		switch e := err.(type) {
+		case *task.TaskError:
+			return task.ReportWaitError(c._output, e.UPID, err)
+		case *task.TimeoutError:
+			return task.ReportWaitError(c._output, e.UPID, err)
+		}
+		c._output.Fatal(shared.ErrOp.ExitCode,
+			"failed to create vm {{index .id}} on proxmox. Cause: {{index .cause}}",
+			map[string]interface{}{
+				"event": "vm_creation_failed",
+				"id":    c.vm.VmId,
+				"cause": err.Error(),
+			})
+		return shared.ErrOp
+	}
+
+	if c.start {
+		upid, err := StartVM(ctx, node, c.vm.VmId)
+		if err != nil {
+			c._output.Fatal(shared.ErrOp.ExitCode,
+				"failed to start vm {{index .id}} on proxmox. Cause: {{index .cause}}",
+				map[string]interface{}{
+					"event": "vm_start_failed",
+					"id":    c.vm.VmId,
+					"cause": err.Error(),
+				})
+			return err
+		}
+		if c.Wait {
+			if _, err := task.Wait(ctx, upid, c.Options()); err != nil {
+				return task.ReportWaitError(c._output, upid, err)
+			}
+		}
+	}
+
+	c._output.Info("vm {{index .id}} is created on proxmox.",
+		map[string]interface{}{
+			"event": "vm_creation_success",
+			"id":    c.vm.VmId,
+			"node":  node,
+		})
+	return nil
+}
+
+// Creates a VM of the cloudinit archetype using the ticket cache and waits for its creation. Returns
+// the node the new VM is on.
+func CreateCloudInitVM(ctx context.Context, vm *CloudInitVM) (string, error) {
+	switch {
+	case len(vm.CloudImage) > 0 && len(vm.Template) > 0:
+		return "", errors.New("either a cloud image or a template is required, not both")
+	case len(vm.Template) > 0:
+		return cloneCloudInitVM(ctx, vm)
+	case len(vm.CloudImage) == 0:
+		return "", errors.New("either a cloud image or a template is required")
+	case len(vm.Node) == 0:
+		return "", errors.New("node is required to import a cloud image")
+	case len(vm.DriveStorage) == 0:
+		return "", errors.New("drive storage is required to import a cloud image")
+	}
+
+	output := shared.Printer(ctx)
+
+	pve, err := common.NewClientFromCache(ctx, output)
+	if err != nil {
+		return "", fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	if vm.VmId, err = ResolveVmId(ctx, vm.VmId, vm.IdRange); err != nil {
+		return "", err
+	}
+
+	form := vm.CloudInit.params()
+	form.Set("vmid", vm.VmId)
+	form.Set("name", vm.Name)
+	form.Set("ostype", "l26")
+	form.Set("scsihw", "virtio-scsi-pci")
+	form.Set("scsi0", fmt.Sprintf("%s:0,import-from=%s", vm.DriveStorage, vm.CloudImage))
+	form.Set(cloudInitDrive, fmt.Sprintf("%s:cloudinit", vm.DriveStorage))
+	form.Set("boot", "order=scsi0")
+	form.Set("serial0", "socket")
+	form.Set("vga", "serial0")
+	form.Set("agent", "1")
+	form.Set("sockets", "1")
+	form.Set("cores", fmt.Sprintf("%d", vm.Cores))
+	form.Set("numa", "1")
+	form.Set("memory", fmt.Sprintf("%d", vm.Memory))
+	form.Set("net0", fmt.Sprintf("virtio,bridge=%s", vm.NetworkIFace))
+
+	upid, err := pve.CreateQemu(ctx, vm.Node, form)
+	if err != nil {
+		return "", err
+	}
+	output.Debug("create vm task {{index .upid}} submitted.",
+		map[string]interface{}{
+			"event": "task_submitted",
+			"upid":  upid,
+		})
+
+	// the disk is imported by the creation task, so it can only be grown afterwards.
+	if _, err = task.WaitWith(ctx, pve, upid, nil); err != nil {
+		return "", err
+	}
+
+	if vm.DriveSize > 0 {
+		if _, err = Set(ctx, &SetRequest{
+			Node:      vm.Node,
+			VM:        vm.VmId,
+			Drive:     setDefaultDrive,
+			DriveSize: vm.DriveSize,
+		}); err != nil {
+			return "", fmt.Errorf("failed to grow system disk: %s", err.Error())
+		}
+	}
+
+	return vm.Node, nil
+}
+
+// Clones the template, then adds a cloud-init drive unless the template has one and applies the
+// cloud-init settings.
+func cloneCloudInitVM(ctx context.Context, vm *CloudInitVM) (string, error) {
+	clone := &CloneVM{
+		Node:         vm.Node,
+		Template:     vm.Template,
+		VmId:         vm.VmId,
+		IdRange:      vm.IdRange,
+		Name:         vm.Name,
+		Full:         vm.Full,
+		Storage:      vm.DriveStorage,
+		Cores:        vm.Cores,
+		Memory:       vm.Memory,
+		DriveSize:    vm.DriveSize,
+		NetworkIFace: vm.NetworkIFace,
+	}
+	node, err := CreateCloneVM(ctx, clone)
+	if err != nil {
+		return "", err
+	}
+	// the clone resolves an auto id.
+	vm.VmId = clone.VmId
+
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return "", fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	config, err := pve.QemuConfig(ctx, node, vm.VmId)
+	if err != nil {
+		return "", err
+	}
+
+	params := vm.CloudInit.params()
+	if !hasCloudInitDrive(config) {
+		storage := vm.DriveStorage
+		if len(storage) == 0 {
+			if storage, err = bootDiskStorage(config); err != nil {
+				return "", err
+			}
+		}
+		params.Set(cloudInitDrive, fmt.Sprintf("%s:cloudinit", storage))
+	}
+	if len(params) == 0 {
+		return node, nil
+	}
+
+	params.Set("digest", config.Digest())
+	if err = pve.UpdateQemuConfig(ctx, node, vm.VmId, params); err != nil {
+		return "", fmt.Errorf("failed to configure cloud-init: %s", err.Error())
+	}
+	return node, nil
+}
+
+// Returns the storage of the boot disk named in the boot order of the configuration, or else of the
+// first disk, e.g. local-lvm of scsi0=local-lvm:vm-9000-disk-0. CD drives and cloud-init drives are no disks.
+func bootDiskStorage(config client.Config) (string, error) {
+	keys := make([]string, 0)
+	if order := client.PropertyValue(config["boot"], "order"); len(order) > 0 {
+		keys = append(keys, strings.Split(order, ";")...)
+	} else if len(config["bootdisk"]) > 0 {
+		keys = append(keys, config["bootdisk"])
+	}
+	keys = append(keys, config.Keys()...)
+
+	for _, key := range keys {
+		if !diskKey.MatchString(key) {
+			continue
+		}
+		value := config[key]
+		volume := strings.SplitN(value, ",", 2)[0]
+		if client.PropertyValue(value, "media") == "cdrom" || strings.Contains(volume, "cloudinit") {
+			continue
+		}
+		if i := strings.Index(volume, ":"); i > 0 {
+			return volume[:i], nil
+		}
+	}
+	return "", errors.New("no disk to take the storage of the cloud-init drive from, set the drive storage")
+}
+
+// Returns true if the configuration has a cloud-init drive, whose volume is named like vm-9000-cloudinit.
+func hasCloudInitDrive(config client.Config) bool {
+	for _, key := range config.Keys() {
+		isDrive := strings.HasPrefix(key, "ide") || strings.HasPrefix(key, "sata") || strings.HasPrefix(key, "scsi")
+		if isDrive && strings.Contains(strings.SplitN(config[key], ",", 2)[0], "cloudinit") {
+			return true
+		}
+	}
+	return false
+}
@@ -1,13 +1,34 @@
 package vm
 
 import (
-	"github.com/xeha-gmbh/homelab/shared"
-	"github.com/spf13/cobra"
+	"context"
+	"fmt"
 	"os"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+const (
+	flagNode    = "node"
+	flagTimeout = "timeout"
+	flagForce   = "force"
+	flagPurge   = "purge"
+
+	actionDelete   = "delete"
+	actionSet      = "set"
+	actionTemplate = "template"
+
+	defaultShutdownTimeout = 3 * time.Minute
 )
 
 var (
-	output shared.MessagePrinter
+	output   shared.MessagePrinter
+	commands = &GuestCommands{Kind: "virtual machine", Noun: "vm", Prefix: "vm", Output: &output}
 )
 
 func NewProxmoxVMCommand() *cobra.Command {
@@ -17,6 +38,24 @@ func NewProxmoxVMCommand() *cobra.Command {
 	}
 
 	cmd.AddCommand(NewProxmoxVMCreateCommand())
+	cmd.AddCommand(newListCommand())
+	cmd.AddCommand(newShowCommand())
+	cmd.AddCommand(newSetCommand())
+	for _, action := range []struct{ name, short string }{
+		{client.QemuActionStart, "start a virtual machine"},
+		{client.QemuActionStop, "stop a virtual machine immediately, like pulling the power plug"},
+		{client.QemuActionReboot, "reboot a virtual machine through its guest OS"},
+		{client.QemuActionReset, "reset a virtual machine, like pressing the reset button"},
+		{client.QemuActionSuspend, "suspend a virtual machine"},
+		{client.QemuActionResume, "resume a suspended virtual machine"},
+	} {
+		cmd.AddCommand(newStateCommand(action.name, action.short))
+	}
+	cmd.AddCommand(newShutdownCommand())
+	cmd.AddCommand(newDeleteCommand())
+	cmd.AddCommand(newTemplateCommand())
+	cmd.AddCommand(newSnapshotCommand())
+	cmd.AddCommand(newMigrateCommand())
 
 	return cmd
 }
@@ -28,6 +67,7 @@ func NewProxmoxVMCreateCommand() *cobra.Command {
 	}
 
 	for _, arch := range ArchetypeRepository().AllArchetypes() {
+		arch := arch
 		subCmd := &cobra.Command{
 			Use:   arch.Use(),
 			Short: arch.Short(),
@@ -40,7 +80,7 @@ func NewProxmoxVMCreateCommand() *cobra.Command {
 				return nil
 			},
 			RunE: func(cmd *cobra.Command, args []string) error {
-				if err := arch.CreateVM(); err != nil {
+				if err := arch.CreateVM(common.CommandContext(cmd, nil)); err != nil {
 					return err
 				}
 				return nil
@@ -58,3 +98,453 @@ func NewProxmoxVMCreateCommand() *cobra.Command {
 
 	return cmd
 }
+
+func newListCommand() *cobra.Command {
+	var (
+		extraArgs = new(shared.ExtraArgs)
+		node      string
+	)
+
+	cmd := &cobra.Command{
+		Use:     "list",
+		Short:   "list virtual machines of the cluster",
+		PreRunE: commands.PreRun(extraArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			vms, err := ListVMs(common.CommandContext(cmd, output), node)
+			if err != nil {
+				output.Fatal(shared.ErrOp.ExitCode,
+					"failed to list vms. Cause: {{index .cause}}",
+					map[string]interface{}{
+						"event": "vm_list_failed",
+						"cause": err.Error(),
+					})
+				return shared.ErrOp
+			}
+
+			for _, vm := range vms {
+				output.Info("{{index .id}}\t{{index .name}}\t{{index .node}}\t{{index .status}}",
+					map[string]interface{}{
+						"event":    "vm",
+						"id":       vm.VmId.String(),
+						"name":     vm.Name,
+						"node":     vm.Node,
+						"status":   vm.Status,
+						"template": vm.Template != 0,
+						"cpus":     int64(vm.MaxCpu),
+						"maxmem":   int64(vm.MaxMem),
+						"maxdisk":  int64(vm.MaxDisk),
+						"uptime":   int64(vm.Uptime),
+					})
+			}
+			return nil
+		},
+	}
+
+	extraArgs.InjectExtraArgs(cmd)
+	cmd.Flags().StringVar(&node, flagNode, "",
+		"Only list virtual machines on this node.")
+
+	return cmd
+}
+
+func newShowCommand() *cobra.Command {
+	var (
+		extraArgs = new(shared.ExtraArgs)
+		node      string
+	)
+
+	cmd := &cobra.Command{
+		Use:     "show <vmid|name>",
+		Short:   "show status and configuration of a virtual machine",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: commands.PreRun(extraArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			details, err := ShowVM(common.CommandContext(cmd, output), args[0], node)
+			if err != nil {
+				output.Fatal(shared.ErrOp.ExitCode,
+					"failed to show vm {{index .vm}}. Cause: {{index .cause}}",
+					map[string]interface{}{
+						"event": "vm_show_failed",
+						"vm":    args[0],
+						"cause": err.Error(),
+					})
+				return shared.ErrOp
+			}
+
+			status := details.Status
+			output.Info("{{index .id}}\t{{index .name}}\t{{index .node}}\t{{index .status}}",
+				map[string]interface{}{
+					"event":     "vm",
+					"id":        status.VmId.String(),
+					"name":      status.Name,
+					"node":      details.Node,
+					"status":    status.Status,
+					"qmpstatus": status.QmpStatus,
+					"lock":      status.Lock,
+					"cpus":      int64(status.Cpus),
+					"maxmem":    int64(status.MaxMem),
+					"mem":       int64(status.Mem),
+					"maxdisk":   int64(status.MaxDisk),
+					"uptime":    int64(status.Uptime),
+				})
+			for _, key := range details.Config.Keys() {
+				output.Info("  {{index .key}}: {{index .value}}",
+					map[string]interface{}{
+						"event": "vm_config",
+						"key":   key,
+						"value": details.Config[key],
+					})
+			}
+			return nil
+		},
+	}
+
+	extraArgs.InjectExtraArgs(cmd)
+	cmd.Flags().StringVar(&node, flagNode, "",
+		"The node of the virtual machine. Discovered from the cluster if not set.")
+
+	return cmd
+}
+
+func newStateCommand(action, short string) *cobra.Command {
+	payload := &StateRequest{Action: action}
+
+	cmd := &cobra.Command{
+		Use:     action + " <vmid|name>",
+		Short:   short,
+		Args:    cobra.ExactArgs(1),
+		PreRunE: commands.PreRun(&payload.ExtraArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			payload.VM = args[0]
+
+			result, err := ChangeState(common.CommandContext(cmd, output), payload)
+			if err != nil {
+				return commands.ReportError(action, payload.VM, err)
+			}
+
+			output.Info("vm {{index .id}}: {{index .action}} submitted.",
+				map[string]interface{}{
+					"event":  fmt.Sprintf("vm_%s_success", action),
+					"action": action,
+					"id":     result.VmId,
+					"name":   result.Name,
+					"node":   result.Node,
+					"upid":   result.Upid,
+				})
+			return nil
+		},
+	}
+
+	payload.InjectExtraArgs(cmd)
+	payload.InjectWaitArgs(cmd)
+	commands.AddNodeFlag(cmd.Flags(), &payload.Node)
+
+	return cmd
+}
+
+func newShutdownCommand() *cobra.Command {
+	payload := &ShutdownRequest{}
+
+	cmd := &cobra.Command{
+		Use:     "shutdown <vmid|name>",
+		Short:   "shut down a virtual machine through its guest OS",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: commands.PreRun(&payload.ExtraArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			payload.VM = args[0]
+
+			result, err := Shutdown(common.CommandContext(cmd, output), payload)
+			if err != nil {
+				return commands.ReportError(client.QemuActionShutdown, payload.VM, err)
+			}
+
+			output.Info("vm {{index .id}} is shut down.",
+				map[string]interface{}{
+					"event":  "vm_shutdown_success",
+					"action": client.QemuActionShutdown,
+					"id":     result.VmId,
+					"name":   result.Name,
+					"node":   result.Node,
+					"upid":   result.Upid,
+					"forced": result.Forced,
+				})
+			return nil
+		},
+	}
+
+	payload.InjectExtraArgs(cmd)
+	commands.AddNodeFlag(cmd.Flags(), &payload.Node)
+	cmd.Flags().DurationVar(&payload.Timeout, flagTimeout, defaultShutdownTimeout,
+		"Time granted to the guest OS to shut down.")
+	cmd.Flags().BoolVar(&payload.Force, flagForce, false,
+		"Whether to stop the virtual machine if it did not shut down in time.")
+
+	return cmd
+}
+
+func newDeleteCommand() *cobra.Command {
+	payload := &DeleteRequest{}
+
+	cmd := &cobra.Command{
+		Use:     "delete <vmid|name>",
+		Short:   "destroy a virtual machine and its disks",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: commands.PreRun(&payload.ExtraArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			payload.VM = args[0]
+
+			result, err := Delete(common.CommandContext(cmd, output), payload)
+			if err != nil {
+				return commands.ReportError(actionDelete, payload.VM, err)
+			}
+
+			output.Info("vm {{index .id}}: delete submitted.",
+				map[string]interface{}{
+					"event":  "vm_delete_success",
+					"action": actionDelete,
+					"id":     result.VmId,
+					"name":   result.Name,
+					"node":   result.Node,
+					"upid":   result.Upid,
+				})
+			return nil
+		},
+	}
+
+	payload.InjectExtraArgs(cmd)
+	payload.InjectWaitArgs(cmd)
+	commands.AddNodeFlag(cmd.Flags(), &payload.Node)
+	cmd.Flags().BoolVar(&payload.Purge, flagPurge, false,
+		"Whether to also remove the virtual machine from backup jobs, replication jobs and HA.")
+	cmd.Flags().BoolVar(&payload.Force, flagForce, false,
+		"Whether to stop a running virtual machine first. Otherwise, deleting a running virtual machine fails.")
+
+	return cmd
+}
+
+func newTemplateCommand() *cobra.Command {
+	payload := &TemplateRequest{}
+
+	cmd := &cobra.Command{
+		Use:     "template <vmid|name>",
+		Short:   "convert a stopped virtual machine into a template",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: commands.PreRun(&payload.ExtraArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			payload.VM = args[0]
+
+			result, err := ConvertToTemplate(common.CommandContext(cmd, output), payload)
+			if err != nil {
+				return commands.ReportError(actionTemplate, payload.VM, err)
+			}
+
+			output.Info("vm {{index .id}} is converted into a template.",
+				map[string]interface{}{
+					"event":  "vm_template_success",
+					"action": actionTemplate,
+					"id":     result.VmId,
+					"name":   result.Name,
+					"node":   result.Node,
+					"upid":   result.Upid,
+				})
+			return nil
+		},
+	}
+
+	payload.InjectExtraArgs(cmd)
+	payload.InjectWaitArgs(cmd)
+	commands.AddNodeFlag(cmd.Flags(), &payload.Node)
+
+	return cmd
+}
+
+func newSetCommand() *cobra.Command {
+	payload := &SetRequest{}
+
+	cmd := &cobra.Command{
+		Use:   "set <vmid|name>",
+		Short: "change the configuration of a virtual machine",
+		Long: dedent.Dedent(`
+			Changes the configuration of a virtual machine to the requested values. Options not requested
+			are left unchanged. The changes are printed before they are applied. Drives can only grow.
+			Changes the running virtual machine cannot take are reported as pending until it is restarted.
+		`),
+		Args:    cobra.ExactArgs(1),
+		PreRunE: commands.PreRun(&payload.ExtraArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			payload.VM = args[0]
+			payload.Preview = func(result *SetResult) {
+				for _, change := range result.Changes {
+					output.Info("{{index .key}}: {{index .from}} -> {{index .to}}",
+						map[string]interface{}{
+							"event": "vm_config_change",
+							"id":    result.VmId,
+							"key":   change.Key,
+							"from":  change.From,
+							"to":    change.To,
+						})
+				}
+			}
+
+			result, err := Set(common.CommandContext(cmd, output), payload)
+			if err != nil {
+				return commands.ReportError(actionSet, payload.VM, err)
+			}
+
+			for _, option := range result.Pending {
+				output.Info("{{index .key}}: {{index .to}} is pending until the vm restarts.",
+					map[string]interface{}{
+						"event":  "vm_config_pending",
+						"id":     result.VmId,
+						"key":    option.Key,
+						"from":   option.Value,
+						"to":     option.Pending,
+						"delete": option.Delete != 0,
+					})
+			}
+
+			message := "vm {{index .id}}: {{len .changes}} change(s) applied."
+			switch {
+			case len(result.Changes) == 0:
+				message = "vm {{index .id}} is up to date."
+			case payload.DryRun:
+				message = "vm {{index .id}}: {{len .changes}} change(s) not applied, dry run."
+			}
+			output.Info(message,
+				map[string]interface{}{
+					"event":   "vm_set_success",
+					"action":  actionSet,
+					"id":      result.VmId,
+					"node":    result.Node,
+					"changes": result.Changes,
+					"pending": len(result.Pending) > 0,
+					"dry_run": payload.DryRun,
+				})
+			return nil
+		},
+	}
+
+	payload.InjectExtraArgs(cmd)
+	commands.AddNodeFlag(cmd.Flags(), &payload.Node)
+	cmd.Flags().StringVar(&payload.Name, setFlagName, "",
+		"The new name of the virtual machine.")
+	cmd.Flags().IntVar(&payload.Cores, setFlagCore, 0,
+		"Number of virtual CPU cores per socket.")
+	cmd.Flags().IntVar(&payload.Sockets, setFlagSocket, 0,
+		"Number of CPU sockets.")
+	cmd.Flags().IntVar(&payload.Memory, setFlagMemory, 0,
+		"Amount of virtual memory in MB.")
+	cmd.Flags().StringVar(&payload.Drive, setFlagDrive, setDefaultDrive,
+		"The drive to grow with --drive-size.")
+	cmd.Flags().IntVar(&payload.DriveSize, setFlagDriveSize, 0,
+		"The new size in GB of the drive --drive. Must not be smaller than the current size.")
+	cmd.Flags().StringVar(&payload.Net, setFlagNet, setDefaultNet,
+		"The network device to bridge with --iface.")
+	cmd.Flags().StringVar(&payload.NetworkIFace, setFlagIFace, "",
+		"Host interface to bridge the network device --net to.")
+	cmd.Flags().BoolVar(&payload.DryRun, setFlagDryRun, false,
+		"Whether to only print the changes without applying them.")
+
+	return cmd
+}
+
+func newSnapshotCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "snapshot",
+		Short: "manage snapshots of a virtual machine",
+	}
+
+	cmd.AddCommand(commands.NewSnapshotListCommand(func(ctx context.Context, selector, node string) (*GuestResult, []SnapshotNode, error) {
+		return ListSnapshots(ctx, selector, node)
+	}))
+	for _, c := range []struct {
+		use, short, action string
+		op                 func(context.Context, *SnapshotRequest) (*GuestResult, error)
+	}{
+		{"create <vmid|name> <snapshot>", "take a snapshot of a virtual machine", SnapshotActionCreate, CreateSnapshot},
+		{"rollback <vmid|name> <snapshot>", "roll a virtual machine back to a snapshot", SnapshotActionRollback, RollbackSnapshot},
+		{"delete <vmid|name> <snapshot>", "delete a snapshot of a virtual machine", SnapshotActionDelete, DeleteSnapshot},
+	} {
+		payload, op := &SnapshotRequest{}, c.op
+		taskCmd := commands.NewSnapshotTaskCommand(c.use, c.short, c.action, &payload.GuestSnapshotRequest,
+			func(ctx context.Context) (*GuestResult, error) {
+				return op(ctx, payload)
+			})
+		if c.action == SnapshotActionCreate {
+			taskCmd.Flags().BoolVar(&payload.VmState, snapshotFlagVmState, false,
+				"Whether to include the RAM of the running virtual machine, so that a rollback resumes it.")
+		}
+		cmd.AddCommand(taskCmd)
+	}
+
+	return cmd
+}
+
+func newMigrateCommand() *cobra.Command {
+	payload := &MigrateRequest{}
+
+	cmd := &cobra.Command{
+		Use:   "migrate <vmid|name>",
+		Short: "migrate a virtual machine to another node of the cluster",
+		Long: dedent.Dedent(`
+			Migrates a virtual machine to the node --target. Before the migration is submitted, its
+			preconditions are checked, and reasons it would fail, such as local resources or storage
+			devices missing on the target, are reported. Running virtual machines are only migrated
+			with --online.
+		`),
+		Args:    cobra.ExactArgs(1),
+		PreRunE: commands.PreRun(&payload.ExtraArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			payload.VM = args[0]
+
+			result, err := Migrate(common.CommandContext(cmd, output), payload)
+			if e, ok := err.(*MigrationBlockedError); ok {
+				for _, blocker := range e.Blockers {
+					output.Info("{{index .blocker}}",
+						map[string]interface{}{
+							"event":   "vm_migrate_blocker",
+							"id":      e.VmId,
+							"target":  e.Target,
+							"blocker": blocker,
+						})
+				}
+			}
+			if err != nil {
+				return commands.ReportError(actionMigrate, payload.VM, err)
+			}
+
+			message := "vm {{index .id}}: migrate to {{index .target}} submitted."
+			if payload.DryRun {
+				message = "vm {{index .id}} can be migrated to {{index .target}}, dry run."
+			}
+			output.Info(message,
+				map[string]interface{}{
+					"event":   "vm_migrate_success",
+					"action":  actionMigrate,
+					"id":      result.VmId,
+					"name":    result.Name,
+					"target":  payload.Target,
+					"upid":    result.Upid,
+					"dry_run": payload.DryRun,
+				})
+			return nil
+		},
+	}
+
+	payload.InjectExtraArgs(cmd)
+	payload.InjectWaitArgs(cmd)
+	commands.AddNodeFlag(cmd.Flags(), &payload.Node)
+	cmd.Flags().StringVar(&payload.Target, migrateFlagTarget, "",
+		"The node to migrate the virtual machine to. Required.")
+	cmd.Flags().BoolVar(&payload.Online, migrateFlagOnline, false,
+		"Whether to migrate a running virtual machine without stopping it.")
+	cmd.Flags().BoolVar(&payload.WithLocalDisks, migrateFlagWithLocalDisks, false,
+		"Whether to copy disks on local storage while the virtual machine runs. Offline migration always copies them.")
+	cmd.Flags().StringSliceVar(&payload.TargetStorage, migrateFlagTargetStorage, nil,
+		"Storage device on the target to place local disks on, or source:target pairs mapping storage devices.")
+	cmd.Flags().BoolVar(&payload.DryRun, migrateFlagDryRun, false,
+		"Whether to only check the preconditions of the migration.")
+	cmd.MarkFlagRequired(migrateFlagTarget)
+
+	return cmd
+}
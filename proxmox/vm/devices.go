@@ -0,0 +1,176 @@
+package vm
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	NicModelVirtio = "virtio"
+
+	BiosSeaBios = "seabios"
+	BiosOvmf    = "ovmf"
+)
+
+// A hard drive attached to the VM as scsi device.
+type Disk struct {
+	Storage string
+	// Size in GB.
+	Size int
+	// Presents the drive as SSD to the guest.
+	SSD bool
+	// Passes discards of the guest on to the storage device, so that thin volumes shrink.
+	Discard bool
+	// Gives the drive its own IO thread. Requires the virtio-scsi-single controller.
+	IOThread bool
+}
+
+// Parses a disk of the form storage:size[,ssd=1][,discard=on][,iothread=1], with size in GB.
+func ParseDisk(spec string) (Disk, error) {
+	var d Disk
+
+	parts := strings.Split(spec, ",")
+	volume := strings.SplitN(parts[0], ":", 2)
+	if len(volume) != 2 || len(volume[0]) == 0 {
+		return d, fmt.Errorf("malformed disk %s, expecting storage:size", spec)
+	}
+	size, err := strconv.Atoi(strings.TrimSuffix(strings.ToUpper(volume[1]), "G"))
+	if err != nil || size <= 0 {
+		return d, fmt.Errorf("malformed size %s of disk %s", volume[1], spec)
+	}
+	d.Storage, d.Size = volume[0], size
+
+	for _, option := range parts[1:] {
+		key, value, err := keyValue(option)
+		if err != nil {
+			return d, fmt.Errorf("malformed disk %s: %s", spec, err.Error())
+		}
+		switch key {
+		case "ssd":
+			d.SSD, err = switchValue(value)
+		case "discard":
+			d.Discard, err = switchValue(value)
+		case "iothread":
+			d.IOThread, err = switchValue(value)
+		default:
+			err = fmt.Errorf("unsupported option %s", key)
+		}
+		if err != nil {
+			return d, fmt.Errorf("malformed disk %s: %s", spec, err.Error())
+		}
+	}
+
+	return d, nil
+}
+
+// Returns the value of the scsi option of the disk when creating a VM.
+func (d Disk) String() string {
+	value := fmt.Sprintf("%s:%d", d.Storage, d.Size)
+	if d.SSD {
+		value += ",ssd=1"
+	}
+	if d.Discard {
+		value += ",discard=on"
+	}
+	if d.IOThread {
+		value += ",iothread=1"
+	}
+	return value
+}
+
+// A network device of the VM, bridged to a host interface.
+type Nic struct {
+	// One of virtio, e1000, rtl8139 and vmxnet3. Defaults to virtio.
+	Model  string
+	Bridge string
+	// VLAN tag, zero for untagged.
+	Tag int
+	// MAC address. Generated by Proxmox if empty.
+	MacAddr  string
+	Firewall bool
+}
+
+// Parses a network device of the form bridge=vmbr0[,model=virtio][,tag=20][,macaddr=..][,firewall=1].
+func ParseNic(spec string) (Nic, error) {
+	n := Nic{Model: NicModelVirtio}
+
+	for _, option := range strings.Split(spec, ",") {
+		key, value, err := keyValue(option)
+		if err != nil {
+			return n, fmt.Errorf("malformed network device %s: %s", spec, err.Error())
+		}
+		switch key {
+		case "model":
+			switch value {
+			case NicModelVirtio, "e1000", "rtl8139", "vmxnet3":
+				n.Model = value
+			default:
+				err = fmt.Errorf("unsupported model %s", value)
+			}
+		case "bridge":
+			n.Bridge = value
+		case "tag":
+			if n.Tag, err = strconv.Atoi(value); err == nil && (n.Tag < 1 || n.Tag > 4094) {
+				err = fmt.Errorf("tag %s out of range 1-4094", value)
+			}
+		case "macaddr":
+			var mac net.HardwareAddr
+			if mac, err = net.ParseMAC(value); err == nil {
+				n.MacAddr = strings.ToUpper(mac.String())
+			}
+		case "firewall":
+			n.Firewall, err = switchValue(value)
+		default:
+			err = fmt.Errorf("unsupported option %s", key)
+		}
+		if err != nil {
+			return n, fmt.Errorf("malformed network device %s: %s", spec, err.Error())
+		}
+	}
+
+	if len(n.Bridge) == 0 {
+		return n, fmt.Errorf("network device %s has no bridge", spec)
+	}
+	return n, nil
+}
+
+// Returns the value of the net option of the network device when creating a VM.
+func (n Nic) String() string {
+	model := n.Model
+	if len(model) == 0 {
+		model = NicModelVirtio
+	}
+	value := "model=" + model + ",bridge=" + n.Bridge
+	if n.Tag > 0 {
+		value += ",tag=" + strconv.Itoa(n.Tag)
+	}
+	if len(n.MacAddr) > 0 {
+		value += ",macaddr=" + n.MacAddr
+	}
+	if n.Firewall {
+		value += ",firewall=1"
+	}
+	return value
+}
+
+func keyValue(option string) (string, string, error) {
+	kv := strings.SplitN(option, "=", 2)
+	if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+		return "", "", fmt.Errorf("expecting key=value, got %s", option)
+	}
+	return kv[0], kv[1], nil
+}
+
+// Reads on/off options, which Proxmox expresses as 1/0 or on/ignore.
+func switchValue(value string) (bool, error) {
+	switch value {
+	case "1", "on", "true":
+		return true, nil
+	case "0", "off", "ignore", "false":
+		return false, nil
+	default:
+		return false, fmt.Errorf("expecting 1 or 0, got %s", value)
+	}
+}
@@ -0,0 +1,213 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	flag "github.com/spf13/pflag"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+const (
+	snapshotFlagDescription = "description"
+
+	// Actions of the snapshot commands, named after the qm and pct commands, e.g. the failure event of
+	// delete is vm_delsnapshot_failed.
+	SnapshotActionCreate   = "snapshot"
+	SnapshotActionRollback = "rollback"
+	SnapshotActionDelete   = "delsnapshot"
+)
+
+// Outcome of an operation on a guest, i.e. a VM or container.
+type GuestResult struct {
+	Node string
+	VmId string
+	Name string
+	Upid string
+}
+
+// Arguments for the 'snapshot create|rollback|delete' commands of a guest.
+type GuestSnapshotRequest struct {
+	shared.ExtraArgs
+	Node string
+	// Id or name of the guest.
+	Guest string
+	// Name of the snapshot.
+	Snapshot string
+	// Only used on create.
+	Description string
+	// If set on delete, the snapshot is removed from the configuration even if removing its disk
+	// snapshots fails.
+	Force bool
+	// Maximum time to wait for the snapshot task. Zero waits indefinitely.
+	Timeout time.Duration
+}
+
+// Scaffolding of the commands managing one type of guest, i.e. 'proxmox vm' and 'proxmox ct'.
+type GuestCommands struct {
+	// Name of the guest type in help texts, e.g. virtual machine or container.
+	Kind string
+	// Name of the guest type in messages, e.g. vm or container.
+	Noun string
+	// Prefix of the event names and key of the guest in failure events, e.g. vm or ct.
+	Prefix string
+	// The printer of the running command, set by PreRun.
+	Output *shared.MessagePrinter
+}
+
+// Returns the PreRunE function of the commands, which sets up the printer.
+func (g *GuestCommands) PreRun(extraArgs *shared.ExtraArgs) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		cmd.SetOutput(os.Stdout)
+		if err := cmd.ParseFlags(args); err != nil {
+			return err
+		}
+		*g.Output = shared.WithConfig(cmd, extraArgs)
+		return nil
+	}
+}
+
+func (g *GuestCommands) AddNodeFlag(flagSet *flag.FlagSet, node *string) {
+	flagSet.StringVar(node, flagNode, "",
+		fmt.Sprintf("The node of the %s. Discovered from the cluster if not set.", g.Kind))
+}
+
+// Reports the error of an operation on the guest and returns the matching LabError.
+func (g *GuestCommands) ReportError(action, guest string, err error) error {
+	output := *g.Output
+	switch e := err.(type) {
+	case *task.TaskError:
+		return task.ReportWaitError(output, e.UPID, err)
+	case *task.TimeoutError:
+		return task.ReportWaitError(output, e.UPID, err)
+	}
+
+	output.Fatal(shared.ErrOp.ExitCode,
+		fmt.Sprintf("failed to {{index .action}} %s {{index .%s}}. Cause: {{index .cause}}", g.Noun, g.Prefix),
+		map[string]interface{}{
+			"event":  fmt.Sprintf("%s_%s_failed", g.Prefix, action),
+			"action": action,
+			g.Prefix: guest,
+			"cause":  err.Error(),
+		})
+	return shared.ErrOp
+}
+
+// Returns the 'snapshot list' command, listing the snapshots returned by list.
+func (g *GuestCommands) NewSnapshotListCommand(list func(ctx context.Context, selector, node string) (*GuestResult, []SnapshotNode, error)) *cobra.Command {
+	var (
+		extraArgs = new(shared.ExtraArgs)
+		node      string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "list <vmid|name>",
+		Short: fmt.Sprintf("list the snapshots of a %s", g.Kind),
+		Long: dedent.Dedent(fmt.Sprintf(`
+			Lists the snapshots of a %[1]s. Text output shows the hierarchy of snapshots as a tree, with
+			'current' being the current state of the %[1]s. JSON output is a flat list of snapshots
+			referring to their parent.
+		`, g.Kind)),
+		Args:    cobra.ExactArgs(1),
+		PreRunE: g.PreRun(extraArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output := *g.Output
+			guest, snapshots, err := list(common.CommandContext(cmd, output), args[0], node)
+			if err != nil {
+				output.Fatal(shared.ErrOp.ExitCode,
+					fmt.Sprintf("failed to list snapshots of %s {{index .%s}}. Cause: {{index .cause}}", g.Noun, g.Prefix),
+					map[string]interface{}{
+						"event":  fmt.Sprintf("%s_snapshot_list_failed", g.Prefix),
+						g.Prefix: args[0],
+						"cause":  err.Error(),
+					})
+				return shared.ErrOp
+			}
+
+			for _, snapshot := range snapshots {
+				prefix := ""
+				if extraArgs.OutputFormat != shared.OutputFormatJson {
+					prefix = snapshot.Prefix()
+				}
+				args := map[string]interface{}{
+					"event":       fmt.Sprintf("%s_snapshot", g.Prefix),
+					"id":          guest.VmId,
+					"prefix":      prefix,
+					"name":        snapshot.Name,
+					"parent":      snapshot.Parent,
+					"depth":       snapshot.Depth,
+					"description": snapshot.Description,
+					"vmstate":     snapshot.VmState != 0,
+					"time":        "",
+				}
+				message := "{{index .prefix}}{{index .name}}\t{{index .time}}\t{{index .description}}"
+				if snapshot.SnapTime != 0 {
+					args["time"] = time.Unix(int64(snapshot.SnapTime), 0).Format(time.RFC3339)
+				}
+				if snapshot.VmState != 0 {
+					message = "{{index .prefix}}{{index .name}} (ram)\t{{index .time}}\t{{index .description}}"
+				}
+				output.Info(message, args)
+			}
+			return nil
+		},
+	}
+
+	extraArgs.InjectExtraArgs(cmd)
+	g.AddNodeFlag(cmd.Flags(), &node)
+
+	return cmd
+}
+
+// Returns the 'snapshot create|rollback|delete' command of the action, which binds its arguments and
+// flags to the payload and runs op. Flags specific to the guest type can be added to the command.
+func (g *GuestCommands) NewSnapshotTaskCommand(use, short, action string, payload *GuestSnapshotRequest, op func(ctx context.Context) (*GuestResult, error)) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     use,
+		Short:   short,
+		Args:    cobra.ExactArgs(2),
+		PreRunE: g.PreRun(&payload.ExtraArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output := *g.Output
+			payload.Guest, payload.Snapshot = args[0], args[1]
+
+			result, err := op(common.CommandContext(cmd, output))
+			if err != nil {
+				return g.ReportError(action, payload.Guest, err)
+			}
+
+			output.Info(fmt.Sprintf("%s {{index .id}}: {{index .action}} {{index .snapshot}} done.", g.Noun),
+				map[string]interface{}{
+					"event":    fmt.Sprintf("%s_%s_success", g.Prefix, action),
+					"action":   action,
+					"id":       result.VmId,
+					"name":     result.Name,
+					"node":     result.Node,
+					"snapshot": payload.Snapshot,
+					"upid":     result.Upid,
+				})
+			return nil
+		},
+	}
+
+	payload.InjectExtraArgs(cmd)
+	g.AddNodeFlag(cmd.Flags(), &payload.Node)
+	cmd.Flags().DurationVar(&payload.Timeout, flagTimeout, 0,
+		"Maximum time to wait for the task, e.g. 10m. Zero waits indefinitely.")
+	switch action {
+	case SnapshotActionCreate:
+		cmd.Flags().StringVar(&payload.Description, snapshotFlagDescription, "",
+			"Description of the snapshot.")
+	case SnapshotActionDelete:
+		cmd.Flags().BoolVar(&payload.Force, flagForce, false,
+			"Whether to remove the snapshot from the configuration even if removing its disk snapshots fails.")
+	}
+
+	return cmd
+}
@@ -0,0 +1,178 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+const (
+	migrateFlagTarget         = "target"
+	migrateFlagOnline         = "online"
+	migrateFlagWithLocalDisks = "with-local-disks"
+	migrateFlagTargetStorage  = "target-storage"
+	migrateFlagDryRun         = "dry-run"
+
+	actionMigrate = "migrate"
+
+	nodeStatusOnline = "online"
+)
+
+// Arguments for the 'proxmox vm migrate' command.
+type MigrateRequest struct {
+	shared.ExtraArgs
+	task.WaitArgs
+	Node string
+	// Id or name of the VM.
+	VM string
+	// The node to migrate to.
+	Target string
+	// If set, a running VM is migrated without stopping it.
+	Online bool
+	// If set, disks on storage local to the node are copied to the target while the VM runs. Offline
+	// migration always copies them.
+	WithLocalDisks bool
+	// Storage devices on the target to place local disks on, either a single storage for all
+	// disks or source:target pairs.
+	TargetStorage []string
+	// If set, only the preflight checks are run.
+	DryRun bool
+}
+
+// Returned when the preflight checks found reasons the migration would fail.
+type MigrationBlockedError struct {
+	VmId     string
+	Target   string
+	Blockers []string
+}
+
+func (e *MigrationBlockedError) Error() string {
+	return fmt.Sprintf("vm %s cannot be migrated to %s: %s", e.VmId, e.Target, strings.Join(e.Blockers, "; "))
+}
+
+// Migrates the VM selected by MigrateRequest#VM to the node MigrateRequest#Target. Before the
+// migration is submitted, its preconditions are checked and any blockers, such as local resources
+// or storage devices missing on the target, are returned as *MigrationBlockedError. If
+// MigrateRequest#Wait is set, it waits for the migration task to finish.
+func Migrate(ctx context.Context, mr *MigrateRequest) (*StateResult, error) {
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	vm, err := SelectVM(ctx, pve, mr.VM, mr.Node)
+	if err != nil {
+		return nil, err
+	}
+
+	result := resultOf(vm)
+	if vm.Node == mr.Target {
+		return nil, fmt.Errorf("vm %s already is on node %s", result.VmId, mr.Target)
+	}
+	if err = checkTargetNode(ctx, pve, mr.Target); err != nil {
+		return nil, err
+	}
+
+	precondition, err := pve.QemuMigratePrecondition(ctx, vm.Node, result.VmId, mr.Target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check migration of vm %s: %s", result.VmId, err.Error())
+	}
+	if blockers := mr.blockers(precondition); len(blockers) > 0 {
+		return nil, &MigrationBlockedError{VmId: result.VmId, Target: mr.Target, Blockers: blockers}
+	}
+	if mr.DryRun {
+		return result, nil
+	}
+
+	params := url.Values{}
+	if mr.Online {
+		params.Set("online", "1")
+	}
+	if mr.WithLocalDisks {
+		params.Set("with-local-disks", "1")
+	}
+	if len(mr.TargetStorage) > 0 {
+		params.Set("targetstorage", strings.Join(mr.TargetStorage, ","))
+	}
+	if result.Upid, err = pve.MigrateQemu(ctx, vm.Node, result.VmId, mr.Target, params); err != nil {
+		return nil, err
+	}
+	result.Node = mr.Target
+	if mr.Wait {
+		if _, err = task.WaitWith(ctx, pve, result.Upid, mr.Options()); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Returns the reasons the migration would fail given the preconditions.
+func (mr *MigrateRequest) blockers(precondition *client.MigratePrecondition) []string {
+	blockers := make([]string, 0)
+
+	if precondition.Running != 0 && !mr.Online {
+		blockers = append(blockers, fmt.Sprintf("vm is running, migrate it with --%s or stop it first", migrateFlagOnline))
+	}
+	if len(precondition.LocalResources) > 0 {
+		blockers = append(blockers, fmt.Sprintf("local resources %s are bound to the node",
+			strings.Join(precondition.LocalResources, ", ")))
+	}
+	for _, disk := range precondition.LocalDisks {
+		switch {
+		case disk.Cdrom != 0:
+			blockers = append(blockers, fmt.Sprintf("cd-rom %s uses local image %s, remove it first", disk.DriveName, disk.Volid))
+		case precondition.Running != 0 && !mr.WithLocalDisks:
+			// offline migration copies local disks by itself.
+			blockers = append(blockers, fmt.Sprintf("disk %s is on local storage, migrate it with --%s",
+				disk.Volid, migrateFlagWithLocalDisks))
+		}
+	}
+	if blocker, ok := precondition.NotAllowedNodes[mr.Target]; ok {
+		for _, storage := range blocker.UnavailableStorages {
+			if !mr.mapsStorage(storage) {
+				blockers = append(blockers, fmt.Sprintf("storage %s is not available on %s, map it with --%s",
+					storage, mr.Target, migrateFlagTargetStorage))
+			}
+		}
+		for _, resource := range blocker.UnavailableResources {
+			blockers = append(blockers, fmt.Sprintf("mapped resource %s is not available on %s", resource, mr.Target))
+		}
+	}
+	return blockers
+}
+
+// Returns true if disks on the storage are placed on another storage on the target.
+func (mr *MigrateRequest) mapsStorage(storage string) bool {
+	for _, mapping := range mr.TargetStorage {
+		pair := strings.SplitN(mapping, ":", 2)
+		if len(pair) == 1 || pair[0] == storage {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifies the node is an online member of the cluster.
+func checkTargetNode(ctx context.Context, pve *client.Client, target string) error {
+	nodes, err := pve.ClusterResources(ctx, client.ResourceTypeNode)
+	if err != nil {
+		return fmt.Errorf("failed to list cluster resources: %s", err.Error())
+	}
+
+	for _, node := range nodes {
+		if node.Node != target {
+			continue
+		}
+		if node.Status != nodeStatusOnline {
+			return fmt.Errorf("node %s is %s", target, node.Status)
+		}
+		return nil
+	}
+	return fmt.Errorf("no node %s in the cluster", target)
+}
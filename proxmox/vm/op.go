@@ -0,0 +1,301 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+// Starts the VM on the node using the ticket cache. Returns the UPID of the start task.
+func StartVM(ctx context.Context, node, vmId string) (string, error) {
+	output := shared.Printer(ctx)
+
+	pve, err := common.NewClientFromCache(ctx, output)
+	if err != nil {
+		return "", fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	upid, err := pve.StartQemu(ctx, node, vmId)
+	if err != nil {
+		return "", err
+	}
+
+	output.Debug("start vm task {{index .upid}} submitted.",
+		map[string]interface{}{
+			"event": "task_submitted",
+			"upid":  upid,
+		})
+
+	return upid, nil
+}
+
+// Returns all VMs of the cluster ordered by id, or only those on the node if node is not empty.
+func ListVMs(ctx context.Context, node string) ([]client.ClusterResource, error) {
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	resources, err := pve.ClusterResources(ctx, client.ResourceTypeVM)
+	if err != nil {
+		return nil, err
+	}
+
+	vms := make([]client.ClusterResource, 0, len(resources))
+	for _, r := range resources {
+		if r.Type == client.GuestTypeQemu && (len(node) == 0 || r.Node == node) {
+			vms = append(vms, r)
+		}
+	}
+	sort.Slice(vms, func(i, j int) bool {
+		return vms[i].VmId < vms[j].VmId
+	})
+	return vms, nil
+}
+
+// Details of a single VM.
+type VMDetails struct {
+	Node   string
+	Status *client.Qemu
+	Config client.Config
+}
+
+// Returns the current status and configuration of the VM selected by id or name.
+func ShowVM(ctx context.Context, selector, node string) (*VMDetails, error) {
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	vm, err := SelectVM(ctx, pve, selector, node)
+	if err != nil {
+		return nil, err
+	}
+
+	details := &VMDetails{Node: vm.Node}
+	if details.Status, err = pve.QemuStatus(ctx, vm.Node, vm.VmId.String()); err != nil {
+		return nil, err
+	}
+	if details.Config, err = pve.QemuConfig(ctx, vm.Node, vm.VmId.String()); err != nil {
+		return nil, err
+	}
+	return details, nil
+}
+
+// Arguments for the 'proxmox vm start|stop|reboot|reset|suspend|resume' commands.
+type StateRequest struct {
+	shared.ExtraArgs
+	task.WaitArgs
+	Node string
+	// Id or name of the VM.
+	VM string
+	// One of the client.QemuAction constants.
+	Action string
+}
+
+// Outcome of a state change.
+type StateResult struct {
+	GuestResult
+	// Set when a graceful shutdown timed out and the VM was stopped instead.
+	Forced bool
+}
+
+// Changes the state of the VM selected by StateRequest#VM. If StateRequest#Wait is set, it waits for
+// the task to finish.
+func ChangeState(ctx context.Context, sr *StateRequest) (*StateResult, error) {
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	vm, err := SelectVM(ctx, pve, sr.VM, sr.Node)
+	if err != nil {
+		return nil, err
+	}
+
+	result := resultOf(vm)
+	if result.Upid, err = pve.QemuAction(ctx, vm.Node, result.VmId, sr.Action, nil); err != nil {
+		return nil, err
+	}
+	if sr.Wait {
+		if _, err = task.WaitWith(ctx, pve, result.Upid, sr.Options()); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Arguments for the 'proxmox vm shutdown' command.
+type ShutdownRequest struct {
+	shared.ExtraArgs
+	Node string
+	// Id or name of the VM.
+	VM string
+	// Time granted to the guest OS to shut down.
+	Timeout time.Duration
+	// If set, the VM is stopped if it did not shut down in time.
+	Force bool
+}
+
+// Asks the guest OS of the VM selected by ShutdownRequest#VM to shut down and waits until it did. If
+// the shutdown does not finish within ShutdownRequest#Timeout and ShutdownRequest#Force is set, the
+// VM is stopped instead.
+func Shutdown(ctx context.Context, sr *ShutdownRequest) (*StateResult, error) {
+	output := shared.Printer(ctx)
+
+	pve, err := common.NewClientFromCache(ctx, output)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	vm, err := SelectVM(ctx, pve, sr.VM, sr.Node)
+	if err != nil {
+		return nil, err
+	}
+
+	result := resultOf(vm)
+	params := url.Values{}
+	params.Set("timeout", fmt.Sprintf("%d", int(sr.Timeout.Seconds())))
+	if result.Upid, err = pve.QemuAction(ctx, vm.Node, result.VmId, client.QemuActionShutdown, params); err != nil {
+		return nil, err
+	}
+
+	// the shutdown task fails by itself once the timeout passed, the margin covers polling delays.
+	_, err = task.WaitWith(ctx, pve, result.Upid, &task.WaitOptions{Timeout: sr.Timeout + time.Minute})
+	switch err.(type) {
+	case nil:
+		return result, nil
+	case *task.TaskError, *task.TimeoutError:
+		if !sr.Force {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	output.Info("vm {{index .id}} did not shut down within {{index .timeout}}, stopping it.",
+		map[string]interface{}{
+			"event":   "vm_shutdown_forced",
+			"id":      result.VmId,
+			"timeout": sr.Timeout.String(),
+			"cause":   err.Error(),
+		})
+	if result.Upid, err = pve.QemuAction(ctx, vm.Node, result.VmId, client.QemuActionStop, nil); err != nil {
+		return nil, err
+	}
+	if _, err = task.WaitWith(ctx, pve, result.Upid, nil); err != nil {
+		return nil, err
+	}
+	result.Forced = true
+	return result, nil
+}
+
+// Arguments for the 'proxmox vm delete' command.
+type DeleteRequest struct {
+	shared.ExtraArgs
+	task.WaitArgs
+	Node string
+	// Id or name of the VM.
+	VM string
+	// If set, the VM is also removed from backup jobs, replication jobs and HA.
+	Purge bool
+	// If set, a running VM is stopped first. Otherwise, deleting a running VM fails.
+	Force bool
+}
+
+// Destroys the VM selected by DeleteRequest#VM together with its disks.
+func Delete(ctx context.Context, dr *DeleteRequest) (*StateResult, error) {
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	vm, err := SelectVM(ctx, pve, dr.VM, dr.Node)
+	if err != nil {
+		return nil, err
+	}
+
+	result := resultOf(vm)
+	if vm.Status != qemuStatusStopped {
+		if !dr.Force {
+			return nil, fmt.Errorf("vm %s is %s, stop it first", result.VmId, vm.Status)
+		}
+		if result.Upid, err = pve.QemuAction(ctx, vm.Node, result.VmId, client.QemuActionStop, nil); err != nil {
+			return nil, err
+		}
+		if _, err = task.WaitWith(ctx, pve, result.Upid, &task.WaitOptions{Timeout: dr.Timeout}); err != nil {
+			return nil, err
+		}
+	}
+
+	params := url.Values{}
+	if dr.Purge {
+		params.Set("purge", "1")
+	}
+	if result.Upid, err = pve.DeleteQemu(ctx, vm.Node, result.VmId, params); err != nil {
+		return nil, err
+	}
+	if dr.Wait {
+		if _, err = task.WaitWith(ctx, pve, result.Upid, dr.Options()); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Arguments for the 'proxmox vm template' command.
+type TemplateRequest struct {
+	shared.ExtraArgs
+	task.WaitArgs
+	Node string
+	// Id or name of the VM.
+	VM string
+}
+
+// Converts the VM selected by TemplateRequest#VM into a template. The VM must be stopped.
+func ConvertToTemplate(ctx context.Context, tr *TemplateRequest) (*StateResult, error) {
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	vm, err := SelectVM(ctx, pve, tr.VM, tr.Node)
+	if err != nil {
+		return nil, err
+	}
+
+	result := resultOf(vm)
+	switch {
+	case vm.Template != 0:
+		return nil, fmt.Errorf("vm %s is already a template", result.VmId)
+	case vm.Status != qemuStatusStopped:
+		return nil, fmt.Errorf("vm %s is %s, stop it first", result.VmId, vm.Status)
+	}
+
+	if result.Upid, err = pve.ConvertQemuToTemplate(ctx, vm.Node, result.VmId); err != nil {
+		return nil, err
+	}
+	if tr.Wait && len(result.Upid) > 0 {
+		if _, err = task.WaitWith(ctx, pve, result.Upid, tr.Options()); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func resultOf(vm *client.ClusterResource) *StateResult {
+	return &StateResult{
+		GuestResult: GuestResult{
+			Node: vm.Node,
+			VmId: vm.VmId.String(),
+			Name: vm.Name,
+		},
+	}
+}
@@ -0,0 +1,58 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+)
+
+const (
+	qemuStatusStopped = "stopped"
+)
+
+// Names of the guest types in messages.
+var guestNouns = map[string]string{
+	client.GuestTypeQemu: "vm",
+	client.GuestTypeLxc:  "container",
+}
+
+// Finds the VM by its id or name through /cluster/resources, so the node it runs on need not be
+// known. If node is not empty, the VM must be on that node. Names must be unique in the cluster
+// to select a VM by name.
+func SelectVM(ctx context.Context, pve *client.Client, selector, node string) (*client.ClusterResource, error) {
+	return SelectGuest(ctx, pve, selector, node, client.GuestTypeQemu)
+}
+
+// Same as SelectVM, but finds a guest of the type, one of the client.GuestType constants.
+func SelectGuest(ctx context.Context, pve *client.Client, selector, node, guestType string) (*client.ClusterResource, error) {
+	resources, err := pve.ClusterResources(ctx, client.ResourceTypeVM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cluster resources: %s", err.Error())
+	}
+
+	matches := make([]client.ClusterResource, 0, 1)
+	_, byIdErr := strconv.Atoi(selector)
+	for _, r := range resources {
+		if r.Type != guestType || (len(node) > 0 && r.Node != node) {
+			continue
+		}
+		if (byIdErr == nil && r.VmId.String() == selector) || (byIdErr != nil && r.Name == selector) {
+			matches = append(matches, r)
+		}
+	}
+
+	noun := guestNouns[guestType]
+	switch len(matches) {
+	case 0:
+		if len(node) > 0 {
+			return nil, fmt.Errorf("no %s %s on node %s", noun, selector, node)
+		}
+		return nil, fmt.Errorf("no %s %s in the cluster", noun, selector)
+	case 1:
+		return &matches[0], nil
+	default:
+		return nil, fmt.Errorf("%d %ss are named %s, select by id instead", len(matches), noun, selector)
+	}
+}
@@ -0,0 +1,195 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+const (
+	setFlagName      = "name"
+	setFlagCore      = "core"
+	setFlagSocket    = "socket"
+	setFlagMemory    = "memory"
+	setFlagDrive     = "drive"
+	setFlagDriveSize = "drive-size"
+	setFlagIFace     = "iface"
+	setFlagNet       = "net"
+	setFlagDryRun    = "dry-run"
+
+	setDefaultDrive = "scsi0"
+	setDefaultNet   = "net0"
+)
+
+// Arguments for the 'proxmox vm set' command. Zero values leave the option unchanged.
+type SetRequest struct {
+	shared.ExtraArgs
+	Node string
+	// Id or name of the VM.
+	VM      string
+	Name    string
+	Cores   int
+	Sockets int
+	// Memory in MB.
+	Memory int
+	// The disk to grow, e.g. scsi0, and its new size in GB. Disks cannot shrink.
+	Drive     string
+	DriveSize int
+	// The network device, e.g. net0, and the host interface to bridge it to.
+	Net          string
+	NetworkIFace string
+	// If set, changes are computed and reported, but not applied.
+	DryRun bool
+	// If set, called with the result once the changes are computed, before any is applied, e.g. to print them.
+	Preview func(result *SetResult)
+}
+
+// A change of a configuration option.
+type Change struct {
+	Key  string
+	From string
+	To   string
+	// Set for disks, which are grown through the resize endpoint instead of the configuration.
+	Resize bool
+}
+
+// Outcome of 'proxmox vm set'.
+type SetResult struct {
+	Node    string
+	VmId    string
+	Changes []Change
+	// Options whose changes only take effect after the VM is restarted.
+	Pending []client.PendingOption
+}
+
+// Computes the changes between the current configuration of the VM selected by SetRequest#VM and the
+// requested values, and applies them unless SetRequest#DryRun is set. Configuration changes are applied
+// in one update guarded by the digest of the configuration read, so concurrent modifications fail the
+// update instead of being overwritten. Disks are grown afterwards, waiting for each resize task.
+func Set(ctx context.Context, sr *SetRequest) (*SetResult, error) {
+	output := shared.Printer(ctx)
+
+	pve, err := common.NewClientFromCache(ctx, output)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	vm, err := SelectVM(ctx, pve, sr.VM, sr.Node)
+	if err != nil {
+		return nil, err
+	}
+	result := &SetResult{Node: vm.Node, VmId: vm.VmId.String()}
+
+	config, err := pve.QemuConfig(ctx, result.Node, result.VmId)
+	if err != nil {
+		return nil, err
+	}
+	if result.Changes, err = sr.diff(config); err != nil {
+		return nil, err
+	}
+	if sr.Preview != nil {
+		sr.Preview(result)
+	}
+	if sr.DryRun || len(result.Changes) == 0 {
+		return result, nil
+	}
+
+	params := url.Values{}
+	for _, change := range result.Changes {
+		if !change.Resize {
+			params.Set(change.Key, change.To)
+		}
+	}
+	if len(params) > 0 {
+		params.Set("digest", config.Digest())
+		if err = pve.UpdateQemuConfig(ctx, result.Node, result.VmId, params); err != nil {
+			return nil, fmt.Errorf("failed to update config: %s", err.Error())
+		}
+	}
+
+	for _, change := range result.Changes {
+		if !change.Resize {
+			continue
+		}
+		upid, err := pve.ResizeQemuDisk(ctx, result.Node, result.VmId, change.Key, change.To)
+		if err == nil && len(upid) > 0 {
+			_, err = task.WaitWith(ctx, pve, upid, nil)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to resize %s: %s", change.Key, err.Error())
+		}
+	}
+
+	pending, err := pve.QemuPending(ctx, result.Node, result.VmId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pending changes: %s", err.Error())
+	}
+	for _, option := range pending {
+		if option.IsPending() {
+			result.Pending = append(result.Pending, option)
+		}
+	}
+
+	return result, nil
+}
+
+// Returns the changes to the configuration necessary to reach the requested values.
+func (sr *SetRequest) diff(config client.Config) ([]Change, error) {
+	changes := make([]Change, 0)
+	add := func(key, to string) {
+		if from := config[key]; from != to {
+			changes = append(changes, Change{Key: key, From: from, To: to})
+		}
+	}
+
+	if len(sr.Name) > 0 {
+		add("name", sr.Name)
+	}
+	if sr.Cores > 0 {
+		add("cores", strconv.Itoa(sr.Cores))
+	}
+	if sr.Sockets > 0 {
+		add("sockets", strconv.Itoa(sr.Sockets))
+	}
+	if sr.Memory > 0 {
+		add("memory", strconv.Itoa(sr.Memory))
+	}
+
+	if len(sr.NetworkIFace) > 0 {
+		net, ok := config[sr.Net]
+		if !ok {
+			return nil, fmt.Errorf("vm has no network device %s", sr.Net)
+		}
+		add(sr.Net, client.WithProperty(net, "bridge", sr.NetworkIFace))
+	}
+
+	if sr.DriveSize > 0 {
+		drive, ok := config[sr.Drive]
+		if !ok {
+			return nil, fmt.Errorf("vm has no drive %s", sr.Drive)
+		}
+		current, err := client.ParseSize(client.PropertyValue(drive, "size"))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read size of drive %s: %s", sr.Drive, err.Error())
+		}
+		switch requested := int64(sr.DriveSize) << 30; {
+		case requested < current:
+			return nil, fmt.Errorf("drive %s cannot shrink from %s to %dG", sr.Drive, client.PropertyValue(drive, "size"), sr.DriveSize)
+		case requested > current:
+			changes = append(changes, Change{
+				Key:    sr.Drive,
+				From:   client.PropertyValue(drive, "size"),
+				To:     fmt.Sprintf("%dG", sr.DriveSize),
+				Resize: true,
+			})
+		}
+	}
+
+	return changes, nil
+}
@@ -0,0 +1,173 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/proxmox/task"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+const (
+	snapshotFlagVmState = "vmstate"
+)
+
+// Arguments for the 'proxmox vm snapshot create|rollback|delete' commands. GuestSnapshotRequest#Guest
+// is the id or name of the VM.
+type SnapshotRequest struct {
+	GuestSnapshotRequest
+	// If set on create, the RAM of the running VM is saved as well.
+	VmState bool
+}
+
+// Takes the snapshot SnapshotRequest#Snapshot of the VM selected by SnapshotRequest#Guest and waits for
+// the task to finish.
+func CreateSnapshot(ctx context.Context, sr *SnapshotRequest) (*GuestResult, error) {
+	return snapshotTask(ctx, sr, func(pve *client.Client, vm *client.ClusterResource) (string, error) {
+		if sr.VmState && vm.Status == qemuStatusStopped {
+			return "", fmt.Errorf("vm %s is stopped, there is no RAM state to save", vm.VmId)
+		}
+		return pve.CreateSnapshot(ctx, vm.Node, vm.VmId.String(), sr.Snapshot, sr.Description, sr.VmState)
+	})
+}
+
+// Rolls the VM selected by SnapshotRequest#Guest back to the snapshot SnapshotRequest#Snapshot and waits
+// for the task to finish. Unless the snapshot includes the RAM state, the VM is stopped afterwards.
+func RollbackSnapshot(ctx context.Context, sr *SnapshotRequest) (*GuestResult, error) {
+	return snapshotTask(ctx, sr, func(pve *client.Client, vm *client.ClusterResource) (string, error) {
+		return pve.RollbackSnapshot(ctx, vm.Node, vm.VmId.String(), sr.Snapshot)
+	})
+}
+
+// Deletes the snapshot SnapshotRequest#Snapshot of the VM selected by SnapshotRequest#Guest and waits for
+// the task to finish.
+func DeleteSnapshot(ctx context.Context, sr *SnapshotRequest) (*GuestResult, error) {
+	return snapshotTask(ctx, sr, func(pve *client.Client, vm *client.ClusterResource) (string, error) {
+		return pve.DeleteSnapshot(ctx, vm.Node, vm.VmId.String(), sr.Snapshot, sr.Force)
+	})
+}
+
+func snapshotTask(ctx context.Context, sr *SnapshotRequest, submit func(pve *client.Client, vm *client.ClusterResource) (string, error)) (*GuestResult, error) {
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	vm, err := SelectVM(ctx, pve, sr.Guest, sr.Node)
+	if err != nil {
+		return nil, err
+	}
+	if sr.Snapshot == client.CurrentSnapshot {
+		return nil, fmt.Errorf("%s is reserved for the current state of the vm", client.CurrentSnapshot)
+	}
+
+	result := &resultOf(vm).GuestResult
+	if result.Upid, err = submit(pve, vm); err != nil {
+		return nil, err
+	}
+	if _, err = task.WaitWith(ctx, pve, result.Upid, &task.WaitOptions{Timeout: sr.Timeout}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// A snapshot placed in the snapshot hierarchy of a VM.
+type SnapshotNode struct {
+	client.Snapshot
+	// Number of ancestors of the snapshot.
+	Depth int
+	// Set if the snapshot is the last child of its parent.
+	Last bool
+	// For each ancestor below the roots, whether it is the last child of its parent. Used to draw the tree.
+	lastAncestors []bool
+}
+
+// Returns the tree prefix of the snapshot for text output, e.g. "│  └─ ".
+func (n *SnapshotNode) Prefix() string {
+	prefix := ""
+	for _, last := range n.lastAncestors {
+		if last {
+			prefix += "   "
+		} else {
+			prefix += "│  "
+		}
+	}
+	if n.Last {
+		return prefix + "└─ "
+	}
+	return prefix + "├─ "
+}
+
+// Returns the snapshots of the VM selected by selector in depth first order of their hierarchy,
+// siblings ordered by time. The current state of the VM is included as client.CurrentSnapshot.
+func ListSnapshots(ctx context.Context, selector, node string) (*GuestResult, []SnapshotNode, error) {
+	pve, err := common.NewClientFromCache(ctx, shared.Printer(ctx))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	vm, err := SelectVM(ctx, pve, selector, node)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	snapshots, err := pve.Snapshots(ctx, vm.Node, vm.VmId.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	return &resultOf(vm).GuestResult, SnapshotTree(snapshots), nil
+}
+
+// Orders the snapshots depth first, siblings ordered by time. Snapshots whose parent is unknown are
+// treated as roots.
+func SnapshotTree(snapshots []client.Snapshot) []SnapshotNode {
+	known := make(map[string]bool, len(snapshots))
+	for _, s := range snapshots {
+		known[s.Name] = true
+	}
+
+	children := make(map[string][]client.Snapshot)
+	for _, s := range snapshots {
+		parent := s.Parent
+		if !known[parent] {
+			parent = ""
+		}
+		children[parent] = append(children[parent], s)
+	}
+	for _, siblings := range children {
+		sort.SliceStable(siblings, func(i, j int) bool {
+			// the current state has no snapshot time and always comes last.
+			switch {
+			case siblings[i].Name == client.CurrentSnapshot:
+				return false
+			case siblings[j].Name == client.CurrentSnapshot:
+				return true
+			}
+			return siblings[i].SnapTime < siblings[j].SnapTime
+		})
+	}
+
+	nodes := make([]SnapshotNode, 0, len(snapshots))
+	var walk func(parent string, depth int, lastAncestors []bool)
+	walk = func(parent string, depth int, lastAncestors []bool) {
+		siblings := children[parent]
+		for i, s := range siblings {
+			n := SnapshotNode{
+				Snapshot:      s,
+				Depth:         depth,
+				Last:          i == len(siblings)-1,
+				lastAncestors: lastAncestors,
+			}
+			nodes = append(nodes, n)
+
+			descendants := make([]bool, len(lastAncestors), len(lastAncestors)+1)
+			copy(descendants, lastAncestors)
+			walk(s.Name, depth+1, append(descendants, n.Last))
+		}
+	}
+	walk("", 0, nil)
+	return nodes
+}
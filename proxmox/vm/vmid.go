@@ -0,0 +1,155 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/xeha-gmbh/homelab/proxmox/client"
+	"github.com/xeha-gmbh/homelab/proxmox/common"
+	"github.com/xeha-gmbh/homelab/shared"
+)
+
+const (
+	// VM id resolved to a free id on creation.
+	AutoVmId = "auto"
+
+	maxVmId = 999999999
+)
+
+// An inclusive range of VM ids.
+type IdRange struct {
+	From int
+	To   int
+}
+
+// Parses a range of the form from-to, e.g. 100-199.
+func ParseIdRange(value string) (*IdRange, error) {
+	bounds := strings.SplitN(value, "-", 2)
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("malformed id range %s, expecting from-to", value)
+	}
+	from, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return nil, fmt.Errorf("malformed id range %s, expecting from-to", value)
+	}
+	to, err := strconv.Atoi(strings.TrimSpace(bounds[1]))
+	if err != nil {
+		return nil, fmt.Errorf("malformed id range %s, expecting from-to", value)
+	}
+	if from < 100 || to < from {
+		return nil, fmt.Errorf("invalid id range %s, ids start at 100", value)
+	}
+	return &IdRange{From: from, To: to}, nil
+}
+
+func (r *IdRange) String() string {
+	return fmt.Sprintf("%d-%d", r.From, r.To)
+}
+
+// Returns the id to create a guest with. AutoVmId or an empty id is resolved to the lowest free id
+// within idRange, or within the id range of the selected context if idRange is empty, or to the next
+// free id of the cluster if neither is set. Other ids are checked to be free, so that collisions
+// surface before the guest is created. Reserved ids, e.g. of guests about to be created concurrently,
+// are never resolved to.
+func ResolveVmId(ctx context.Context, vmId, idRange string, reserved ...string) (string, error) {
+	output := shared.Printer(ctx)
+
+	pve, err := common.NewClientFromCache(ctx, output)
+	if err != nil {
+		return "", fmt.Errorf("unable to read ticket: %s", err.Error())
+	}
+
+	taken := make(map[string]bool, len(reserved))
+	for _, id := range reserved {
+		taken[id] = true
+	}
+
+	if len(vmId) > 0 && vmId != AutoVmId {
+		if taken[vmId] {
+			return "", fmt.Errorf("vm id %s is not available: reserved for another guest", vmId)
+		}
+		if _, err := pve.NextId(ctx, vmId); err != nil {
+			return "", fmt.Errorf("vm id %s is not available: %s", vmId, err.Error())
+		}
+		return vmId, nil
+	}
+
+	if len(idRange) == 0 {
+		if subject, err := common.ReadSubjectFromCache(common.SelectedContext(ctx)); err == nil {
+			idRange = subject.VmIdRange
+		}
+	}
+
+	if len(idRange) == 0 {
+		vmId, err = nextId(ctx, pve, taken)
+	} else {
+		vmId, err = nextIdInRange(ctx, pve, idRange, taken)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	output.Info("Allocated vm id {{index .id}}.",
+		map[string]interface{}{
+			"event": "vmid_allocated",
+			"id":    vmId,
+			"range": idRange,
+		})
+	return vmId, nil
+}
+
+// Returns the next free id of the cluster that is not taken.
+func nextId(ctx context.Context, pve *client.Client, taken map[string]bool) (string, error) {
+	vmId, err := pve.NextId(ctx, "")
+	if err != nil || !taken[vmId] {
+		return vmId, err
+	}
+
+	id, _ := strconv.Atoi(vmId)
+	for id++; id <= maxVmId; id++ {
+		if taken[strconv.Itoa(id)] {
+			continue
+		}
+		switch _, err := pve.NextId(ctx, strconv.Itoa(id)); {
+		case err == nil:
+			return strconv.Itoa(id), nil
+		case !client.IsBadRequest(err):
+			return "", err
+		}
+	}
+	return "", errors.New("no free vm id")
+}
+
+// Returns the lowest id of the range that is neither in use nor taken.
+func nextIdInRange(ctx context.Context, pve *client.Client, value string, taken map[string]bool) (string, error) {
+	idRange, err := ParseIdRange(value)
+	if err != nil {
+		return "", err
+	}
+
+	resources, err := pve.ClusterResources(ctx, client.ResourceTypeVM)
+	if err != nil {
+		return "", err
+	}
+	used := make(map[int]bool, len(resources))
+	for _, r := range resources {
+		used[int(r.VmId)] = true
+	}
+
+	for id := idRange.From; id <= idRange.To; id++ {
+		if used[id] || taken[strconv.Itoa(id)] {
+			continue
+		}
+		// the cluster also knows of ids not yet listed as resources, e.g. of guests being created.
+		switch _, err := pve.NextId(ctx, strconv.Itoa(id)); {
+		case err == nil:
+			return strconv.Itoa(id), nil
+		case !client.IsBadRequest(err):
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no free vm id in range %s", idRange)
+}
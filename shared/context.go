@@ -0,0 +1,33 @@
+package shared
+
+import (
+	"context"
+	"os"
+)
+
+type printerKey struct{}
+
+// Returns a copy of ctx carrying the printer. Operations invoked in-process (i.e. by bootstrap)
+// report their progress through the printer found in their context.
+func WithPrinter(ctx context.Context, printer MessagePrinter) context.Context {
+	return context.WithValue(ctx, printerKey{}, printer)
+}
+
+// Returns the printer carried by ctx. If ctx carries no printer, a printer discarding
+// all non-fatal messages is returned.
+func Printer(ctx context.Context) MessagePrinter {
+	if p, ok := ctx.Value(printerKey{}).(MessagePrinter); ok && p != nil {
+		return p
+	}
+	return silentPrinter{}
+}
+
+type silentPrinter struct{}
+
+func (silentPrinter) Info(templateText string, args map[string]interface{}) {}
+
+func (silentPrinter) Debug(templateText string, args map[string]interface{}) {}
+
+func (silentPrinter) Fatal(exitCode int, templateText string, args map[string]interface{}) {
+	os.Exit(exitCode)
+}